@@ -1,32 +1,360 @@
 package auth
 
 import (
+	"bytes"
+	"context"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/confs"
+	"llmmask/src/privacypass"
 	"llmmask/src/secrets"
+	"slices"
+	"sync"
+	"time"
 )
 
+// AuthManager blind signs and verifies the tokens for a model.
+// It holds every key of the model that is still valid: the newest one that started is used for signing, while older
+// ones keep verifying the tokens signed under them until they expire or get revoked.
+// New tokens are only issued under the model's scheme, tokens of any scheme are verified so that switching it
+// doesn't strand the tokens clients hold. The keys include the shared partially blind issuer keys, which only sign
+// and verify partially blind tokens, bound to the model by their metadata.
 type AuthManager struct {
-	rsaKeys *secrets.RSAKeys
+	sync.RWMutex
+	modelName string
+	// scheme is one of confs.TokenScheme*.
+	scheme            string
+	delayedRedemption bool
+	keys              map[string]*secrets.RSAKeys
+	// tokenKeyIDs are the Privacy Pass token key IDs of keys, see privacypass.TokenKeyID.
+	tokenKeyIDs map[string][]byte
+	// revoked is kept around so a reload racing with a revocation can't bring the key back.
+	revoked map[string]bool
 }
 
-func NewAuthManager(rsaKeys *secrets.RSAKeys) *AuthManager {
-	return &AuthManager{
-		rsaKeys: rsaKeys,
+func NewAuthManager(modelSpec *confs.ModelSpec, rsaKeys ...*secrets.RSAKeys) *AuthManager {
+	a := &AuthManager{
+		modelName:         modelSpec.Name,
+		scheme:            modelSpec.TokenScheme,
+		delayedRedemption: modelSpec.DelayedRedemption,
+		revoked:           map[string]bool{},
 	}
+	a.SetKeys(rsaKeys...)
+	return a
 }
 
-func (a *AuthManager) SignBlindedToken(blindedToken []byte) ([]byte, error) {
-	signedBlindedToken, err := secrets.RSASignBlinded(a.rsaKeys.PrivateKey, blindedToken)
+// SetKeys replaces the key set, used when keys are reloaded after a rotation.
+func (a *AuthManager) SetKeys(rsaKeys ...*secrets.RSAKeys) {
+	keys := make(map[string]*secrets.RSAKeys, len(rsaKeys))
+	tokenKeyIDs := make(map[string][]byte, len(rsaKeys))
+	for _, rsaKey := range rsaKeys {
+		keys[rsaKey.KeyID] = rsaKey
+		if rsaKey.IsPartiallyBlind() {
+			continue
+		}
+		tokenKeyID, err := privacypass.TokenKeyID(rsaKey.PublicKey)
+		if err == nil {
+			tokenKeyIDs[rsaKey.KeyID] = tokenKeyID
+		}
+	}
+	a.Lock()
+	defer a.Unlock()
+	for keyID := range a.revoked {
+		delete(keys, keyID)
+	}
+	a.keys = keys
+	a.tokenKeyIDs = tokenKeyIDs
+}
+
+// Revoke immediately stops signing and accepting tokens under keyID.
+func (a *AuthManager) Revoke(keyID string) {
+	a.Lock()
+	defer a.Unlock()
+	a.revoked[keyID] = true
+	delete(a.keys, keyID)
+}
+
+func isKeyValid(rsaKeys *secrets.RSAKeys, now time.Time) bool {
+	return rsaKeys.NotAfter.IsZero() || now.Before(rsaKeys.NotAfter)
+}
+
+// currentKey is the valid key of the denomination with the latest NotBefore that is not in the future.
+func (a *AuthManager) currentKey(now time.Time, denomination int) (*secrets.RSAKeys, error) {
+	current := a.latestKey(now, func(rsaKeys *secrets.RSAKeys) bool {
+		return !rsaKeys.IsPartiallyBlind() && rsaKeys.Denomination == denomination
+	})
+	if current == nil {
+		return nil, errors.Newf("no signing key available for denomination %d", denomination)
+	}
+	return current, nil
+}
+
+// currentPartiallyBlindKey is the partially blind issuer key with the latest NotBefore that is not in the future.
+func (a *AuthManager) currentPartiallyBlindKey(now time.Time) (*secrets.RSAKeys, error) {
+	current := a.latestKey(now, (*secrets.RSAKeys).IsPartiallyBlind)
+	if current == nil {
+		return nil, errors.New("no partially blind signing key available")
+	}
+	return current, nil
+}
+
+func (a *AuthManager) latestKey(now time.Time, matches func(rsaKeys *secrets.RSAKeys) bool) *secrets.RSAKeys {
+	a.RLock()
+	defer a.RUnlock()
+	var current *secrets.RSAKeys
+	for _, rsaKeys := range a.keys {
+		if !matches(rsaKeys) || !isKeyValid(rsaKeys, now) || rsaKeys.NotBefore.After(now) {
+			continue
+		}
+		if current == nil || rsaKeys.NotBefore.After(current.NotBefore) {
+			current = rsaKeys
+		}
+	}
+	return current
+}
+
+// Scheme new tokens are issued under.
+func (a *AuthManager) Scheme() string {
+	return a.scheme
+}
+
+func (a *AuthManager) checkScheme(scheme string) error {
+	if a.scheme != scheme {
+		return errors.Newf("model issues %s tokens, not %s", a.scheme, scheme)
+	}
+	return nil
+}
+
+// KeyID of the key new single credit tokens are signed with, the issuer key for partially blind tokens.
+func (a *AuthManager) KeyID() string {
+	var current *secrets.RSAKeys
+	var err error
+	if a.scheme == confs.TokenSchemePartiallyBlindRSA {
+		current, err = a.currentPartiallyBlindKey(time.Now().UTC())
+	} else {
+		current, err = a.currentKey(time.Now().UTC(), 1)
+	}
+	if err != nil {
+		return ""
+	}
+	return current.KeyID
+}
+
+// PublicKeys lists the keys clients may see tokens signed under, private keys redacted.
+func (a *AuthManager) PublicKeys() []secrets.RSAKeys {
+	now := time.Now().UTC()
+	a.RLock()
+	defer a.RUnlock()
+	var res []secrets.RSAKeys
+	for _, rsaKeys := range a.keys {
+		if isKeyValid(rsaKeys, now) {
+			res = append(res, rsaKeys.ToRedacted().(secrets.RSAKeys))
+		}
+	}
+	return res
+}
+
+// Denomination of the key with keyID, 0 if there is no such key.
+func (a *AuthManager) Denomination(keyID string) int {
+	a.RLock()
+	defer a.RUnlock()
+	rsaKeys, ok := a.keys[keyID]
+	if !ok {
+		return 0
+	}
+	return rsaKeys.Denomination
+}
+
+// SignBlindedToken signs with the current key of the denomination, and returns its key ID along with the signature.
+func (a *AuthManager) SignBlindedToken(denomination int, blindedToken []byte) ([]byte, string, error) {
+	err := a.checkScheme(confs.TokenSchemeBlindRSA)
+	if err != nil {
+		return nil, "", err
+	}
+	current, err := a.currentKey(time.Now().UTC(), denomination)
+	if err != nil {
+		return nil, "", err
+	}
+	signedBlindedToken, err := secrets.RSASignBlinded(current.PrivateKey, blindedToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return signedBlindedToken, current.KeyID, nil
+}
+
+// VerifyUnBlindedToken checks the token against the key with keyID, and returns the ID of the key it verified under.
+// Tokens from older clients carry no key ID, they are checked against every valid key.
+func (a *AuthManager) VerifyUnBlindedToken(keyID string, unblindedToken, signedUnblindedToken []byte) (string, error) {
+	return a.verify(keyID, false, func(rsaKeys *secrets.RSAKeys) error {
+		return secrets.RSABlindVerify(rsaKeys.PublicKey, unblindedToken, signedUnblindedToken)
+	})
+}
+
+// verify runs verifyWith against the key with keyID, or against every valid key when keyID is empty, and returns the
+// ID of the first key it passes for. Only partially blind issuer keys are tried for partiallyBlind tokens, and only
+// the others for the rest.
+func (a *AuthManager) verify(keyID string, partiallyBlind bool,
+	verifyWith func(rsaKeys *secrets.RSAKeys) error) (string, error) {
+	now := time.Now().UTC()
+	a.RLock()
+	var candidates []*secrets.RSAKeys
+	if keyID != "" {
+		rsaKeys, ok := a.keys[keyID]
+		if ok && rsaKeys.IsPartiallyBlind() == partiallyBlind {
+			candidates = append(candidates, rsaKeys)
+		}
+	} else {
+		for _, rsaKeys := range a.keys {
+			if rsaKeys.IsPartiallyBlind() == partiallyBlind {
+				candidates = append(candidates, rsaKeys)
+			}
+		}
+	}
+	a.RUnlock()
+
+	if keyID != "" && len(candidates) == 0 {
+		return "", errors.Newf("unknown or revoked key id %s", keyID)
+	}
+	var err error
+	for _, rsaKeys := range candidates {
+		if !isKeyValid(rsaKeys, now) {
+			err = errors.Newf("key %s expired", rsaKeys.KeyID)
+			continue
+		}
+		err = verifyWith(rsaKeys)
+		if err == nil {
+			return rsaKeys.KeyID, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no key to verify token against")
+	}
+	return "", err
+}
+
+// EvaluateVOPRF evaluates a batch of blinded VOPRF elements with the current key of the denomination. Returns the
+// evaluated elements, one DLEQ proof covering all of them, and the key ID.
+func (a *AuthManager) EvaluateVOPRF(denomination int, blindedElements [][]byte) ([][]byte, []byte, string, error) {
+	err := a.checkScheme(confs.TokenSchemeVOPRF)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	current, err := a.currentKey(time.Now().UTC(), denomination)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	evaluatedElements, proof, err := secrets.VOPRFEvaluate(current.VOPRFKey, blindedElements)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return evaluatedElements, proof, current.KeyID, nil
+}
+
+// VerifyVOPRFToken checks a VOPRF token, see VerifyUnBlindedToken.
+func (a *AuthManager) VerifyVOPRFToken(keyID string, input, output []byte) (string, error) {
+	return a.verify(keyID, false, func(rsaKeys *secrets.RSAKeys) error {
+		return secrets.VOPRFVerify(rsaKeys.VOPRFKey, input, output)
+	})
+}
+
+// SignPartiallyBlindToken signs a blinded token for the model, denomination and expiry epoch with the current issuer
+// key, and returns its key ID along with the signature. The expiry must be the one of tokens issued now, or of the
+// next epoch for clients that blinded right before it changes, so the tokens of an epoch all look alike. Never an
+// earlier one, the expiry tells when the token was issued, see TokenMetadata.IssuanceEpoch.
+func (a *AuthManager) SignPartiallyBlindToken(ctx context.Context, denomination int, expiryEpoch int64,
+	blindedToken []byte) ([]byte, string, error) {
+	err := a.checkScheme(confs.TokenSchemePartiallyBlindRSA)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now().UTC()
+	expected := IssuanceExpiryEpoch(ctx, now)
+	if expiryEpoch != expected && expiryEpoch != expected+1 {
+		return nil, "", errors.Newf("tokens issued now expire in epoch %d, not %d", expected, expiryEpoch)
+	}
+	current, err := a.currentPartiallyBlindKey(now)
+	if err != nil {
+		return nil, "", err
+	}
+	metadata := TokenMetadata{ModelName: a.modelName, Denomination: denomination, ExpiryEpoch: expiryEpoch}
+	signedBlindedToken, err := secrets.PBRSASignBlinded(current.PartiallyBlindSigner, blindedToken, metadata.Marshal())
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+	return signedBlindedToken, current.KeyID, nil
+}
 
-	return signedBlindedToken, nil
+// VerifyPartiallyBlindToken checks a partially blind token signed for metadata, see VerifyUnBlindedToken. Tokens of
+// other models, of denominations that aren't issued, and past their expiry epoch are rejected. So are tokens still in
+// their issuance epoch when the model delays redemption.
+func (a *AuthManager) VerifyPartiallyBlindToken(ctx context.Context, keyID string, metadata TokenMetadata, token,
+	signedToken []byte) (string, error) {
+	if metadata.ModelName != a.modelName {
+		return "", errors.Newf("token is for model %s", metadata.ModelName)
+	}
+	if !slices.Contains(confs.TokenDenominations(ctx), metadata.Denomination) {
+		return "", errors.Newf("invalid denomination %d", metadata.Denomination)
+	}
+	epoch := Epoch(ctx, time.Now().UTC())
+	if epoch > metadata.ExpiryEpoch {
+		return "", errors.Newf("token expired at the end of epoch %d", metadata.ExpiryEpoch)
+	}
+	if a.delayedRedemption && epoch <= metadata.IssuanceEpoch(ctx) {
+		return "", errors.Newf("token is redeemable from %v, once the epoch it was issued in is over",
+			EpochEnd(ctx, metadata.IssuanceEpoch(ctx)))
+	}
+	return a.verify(keyID, true, func(rsaKeys *secrets.RSAKeys) error {
+		return secrets.PBRSAVerify(rsaKeys.PublicKey, token, metadata.Marshal(), signedToken)
+	})
 }
 
-func (a *AuthManager) VerifyUnBlindedToken(unblindedToken, signedUnblindedToken []byte) (bool, error) {
-	err := secrets.RSABlindVerify(a.rsaKeys.PublicKey, unblindedToken, signedUnblindedToken)
+// SignPrivacyPassRequest answers a Privacy Pass token request with the current single credit key, and returns its key
+// ID along with the response. Requests blinded for any other key are rejected, clients only know the current one from
+// the issuer directory.
+func (a *AuthManager) SignPrivacyPassRequest(req *privacypass.TokenRequest) (*privacypass.TokenResponse, string, error) {
+	err := a.checkScheme(confs.TokenSchemeBlindRSA)
+	if err != nil {
+		return nil, "", err
+	}
+	current, err := a.currentKey(time.Now().UTC(), 1)
+	if err != nil {
+		return nil, "", err
+	}
+	a.RLock()
+	tokenKeyID := a.tokenKeyIDs[current.KeyID]
+	a.RUnlock()
+	if len(tokenKeyID) != privacypass.Nid || tokenKeyID[privacypass.Nid-1] != req.TruncatedTokenKeyID {
+		return nil, "", errors.New("token request is for a key that isn't signing, refetch the issuer directory")
+	}
+	resp, err := privacypass.Sign(current.PrivateKey, req)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp, current.KeyID, nil
+}
+
+// VerifyPrivacyPassToken checks the token against the valid key with its token key ID, and returns that key's ID.
+// The challenge digest is up to the caller.
+func (a *AuthManager) VerifyPrivacyPassToken(token *privacypass.Token) (string, error) {
+	now := time.Now().UTC()
+	a.RLock()
+	var rsaKeys *secrets.RSAKeys
+	for keyID, tokenKeyID := range a.tokenKeyIDs {
+		if bytes.Equal(tokenKeyID, token.TokenKeyID) {
+			rsaKeys = a.keys[keyID]
+		}
+	}
+	a.RUnlock()
+
+	if rsaKeys == nil {
+		return "", errors.New("unknown or revoked token key")
+	}
+	if !isKeyValid(rsaKeys, now) {
+		return "", errors.Newf("key %s expired", rsaKeys.KeyID)
+	}
+	err := privacypass.Verify(rsaKeys.PublicKey, token)
 	if err != nil {
-		return false, err
+		return "", err
 	}
-	return true, nil
+	return rsaKeys.KeyID, nil
 }
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"context"
+	"encoding/binary"
+	"llmmask/src/confs"
+	"time"
+)
+
+// TokenMetadata is the public metadata partially blind tokens are signed for. Clients pick all of it, and everyone
+// issuing in an epoch picks the same, so it says nothing about who holds the token.
+type TokenMetadata struct {
+	ModelName    string
+	Denomination int
+	// ExpiryEpoch is the last epoch the token is redeemable in, see Epoch.
+	ExpiryEpoch int64
+}
+
+// Marshal is the metadata as signed, clients have to encode it the same way:
+// "llmmask-pbrsa-v1" || uint16 len(ModelName) || ModelName || uint32 Denomination || uint64 ExpiryEpoch, big endian.
+func (m TokenMetadata) Marshal() []byte {
+	res := []byte("llmmask-pbrsa-v1")
+	res = binary.BigEndian.AppendUint16(res, uint16(len(m.ModelName)))
+	res = append(res, m.ModelName...)
+	res = binary.BigEndian.AppendUint32(res, uint32(m.Denomination))
+	return binary.BigEndian.AppendUint64(res, uint64(m.ExpiryEpoch))
+}
+
+// Epoch is the number of confs.TokenEpochLength periods since the unix epoch at t.
+func Epoch(ctx context.Context, t time.Time) int64 {
+	return t.Unix() / int64(confs.TokenEpochLength(ctx)/time.Second)
+}
+
+// EpochEnd is when epoch is over.
+func EpochEnd(ctx context.Context, epoch int64) time.Time {
+	return time.Unix((epoch+1)*int64(confs.TokenEpochLength(ctx)/time.Second), 0).UTC()
+}
+
+// IssuanceExpiryEpoch is the ExpiryEpoch of tokens issued at t.
+func IssuanceExpiryEpoch(ctx context.Context, t time.Time) int64 {
+	return Epoch(ctx, t) + confs.TokenLifetimeEpochs(ctx)
+}
+
+// IssuanceEpoch is the epoch the token was issued in, or a later one for tokens blinded ahead.
+func (m TokenMetadata) IssuanceEpoch(ctx context.Context) int64 {
+	return m.ExpiryEpoch - confs.TokenLifetimeEpochs(ctx)
+}
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/confs"
+	"testing"
+	"time"
+)
+
+func TestEpochs(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	epoch := Epoch(ctx, now)
+	assert.True(t, now.Before(EpochEnd(ctx, epoch)))
+	assert.False(t, now.Before(EpochEnd(ctx, epoch-1)))
+	assert.Equal(t, epoch+1, Epoch(ctx, EpochEnd(ctx, epoch)))
+	assert.Equal(t, confs.TokenEpochLength(ctx), EpochEnd(ctx, epoch).Sub(EpochEnd(ctx, epoch-1)))
+
+	metadata := TokenMetadata{ModelName: "m", Denomination: 5, ExpiryEpoch: IssuanceExpiryEpoch(ctx, now)}
+	assert.Equal(t, epoch, metadata.IssuanceEpoch(ctx))
+}
+
+func TestTokenMetadataMarshal(t *testing.T) {
+	metadata := TokenMetadata{ModelName: "m", Denomination: 5, ExpiryEpoch: 100}
+	assert.Equal(t, metadata.Marshal(), metadata.Marshal())
+	for _, other := range []TokenMetadata{
+		{ModelName: "n", Denomination: 5, ExpiryEpoch: 100},
+		{ModelName: "m", Denomination: 25, ExpiryEpoch: 100},
+		{ModelName: "m", Denomination: 5, ExpiryEpoch: 101},
+	} {
+		assert.NotEqual(t, metadata.Marshal(), other.Marshal())
+	}
+}
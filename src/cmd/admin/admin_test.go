@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	"llmmask/src/locks"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"llmmask/src/secrets"
+	"testing"
+)
+
+func newTestEnv() *env {
+	return &env{
+		dbHandler: models.NewMemDBHandler(),
+		locker:    locks.NewMemLocker(),
+	}
+}
+
+func TestAdjustCredits(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	env := newTestEnv()
+	user := &models.User{DocID: "user"}
+	user.SubscriptionInfo.ActiveAuthTokens = models.AuthTokenInfo{confs.ModelGemini25Flash: 5}
+	assert.Nil(t, env.dbHandler.Upsert(ctx, user))
+
+	entry, err := adjustCredits(ctx, env, user.DocID, confs.ModelGemini25Flash, 10, "ref-1", "support")
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+	// Same reference again is a no-op.
+	entry, err = adjustCredits(ctx, env, user.DocID, confs.ModelGemini25Flash, 10, "ref-1", "support")
+	assert.Nil(t, err)
+	assert.Nil(t, entry)
+	_, err = adjustCredits(ctx, env, user.DocID, confs.ModelGemini25Flash, -20, "ref-2", "abuse")
+	assert.NotNil(t, err)
+	_, err = adjustCredits(ctx, env, user.DocID, "unknown-model", 1, "ref-3", "typo")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, env.dbHandler.Fetch(ctx, user))
+	assert.Equal(t, 15, user.SubscriptionInfo.ActiveAuthTokens[confs.ModelGemini25Flash])
+	entries, err := models.FetchLedgerEntries(ctx, env.dbHandler, user.DocID)
+	assert.Nil(t, err)
+	// The opening balance and the grant.
+	assert.Len(t, entries, 2)
+	assert.Empty(t, models.FindLedgerDrift(user, entries))
+}
+
+func TestReencryptUserCreds(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	env := newTestEnv()
+	oldKey, newKey := common.RandomString(32), common.RandomString(32)
+	tokenSerialized, err := secrets.EncryptAES("creds", oldKey)
+	assert.Nil(t, err)
+	assert.Nil(t, env.dbHandler.Upsert(ctx, &models.User{DocID: "user", TokenSerialized: tokenSerialized}))
+	assert.Nil(t, env.dbHandler.Upsert(ctx, &models.User{DocID: "no-creds"}))
+
+	assert.Nil(t, reencryptUserCreds(ctx, env, newKey, oldKey))
+	// Running it again leaves everything as is.
+	assert.Nil(t, reencryptUserCreds(ctx, env, newKey, oldKey))
+	user := &models.User{DocID: "user"}
+	assert.Nil(t, env.dbHandler.Fetch(ctx, user))
+	creds, err := secrets.DecryptAES(user.TokenSerialized, newKey)
+	assert.Nil(t, err)
+	assert.Equal(t, "creds", creds)
+}
+
+func TestValidateModelPackages(t *testing.T) {
+	problems := validateModelPackages([]common.ModelTokenPackage{
+		{ID: "ok", ModelID: confs.ModelGemini25Flash, Tokens: 10, PaddlePriceID: "pri_1"},
+		{ID: "unknown-model", ModelID: "unknown", Tokens: 10},
+		{ID: "empty", ModelID: confs.ModelGemini25Flash, Tokens: 0, PaddlePriceID: "pri_1"},
+	})
+	assert.Len(t, problems, 3)
+}
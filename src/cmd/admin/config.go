@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	llm_proxy "llmmask/src/llm-proxy"
+	"llmmask/src/locks"
+	"llmmask/src/models"
+	"llmmask/src/secrets"
+	"os"
+)
+
+func validateConfigCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	file := fs.String("file", "", "Config file to check, the platform config when not set")
+	offline := fs.Bool("offline", false, "Only check the config itself, not the keys and DEKs it points to")
+	err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch {
+	case *file != "":
+		data, err = os.ReadFile(*file)
+	case common.IsProd():
+		data = []byte(os.Getenv("PROD_CREDENTIALS_CONFIG"))
+	default:
+		data, err = os.ReadFile(common.PlatformCredsConfigFile())
+	}
+	if err != nil {
+		return err
+	}
+
+	problems := validateConfig(ctx, data, !*offline)
+	for _, problem := range problems {
+		fmt.Printf("- %v\n", problem)
+	}
+	if len(problems) > 0 {
+		return errors.Newf("%d problems found", len(problems))
+	}
+	fmt.Println("Config is valid")
+	return nil
+}
+
+// validateConfig runs the config through what the server does with it at startup, collecting every problem instead
+// of stopping at the first. With online it also checks that every model has usable keys and the user-creds-dek
+// unwraps.
+func validateConfig(ctx context.Context, data []byte, online bool) []error {
+	var problems []error
+	conf := &common.CredsConfig{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(conf)
+	if err != nil {
+		return append(problems, errors.Wrapf(err, "failed to parse config"))
+	}
+
+	err = confs.InitModelRegistry(conf.Models, conf.LLMAPIKeys)
+	if err != nil {
+		problems = append(problems, errors.Wrapf(err, "models"))
+	} else if _, err = llm_proxy.NewAPIKeyManagerFromRegistry(); err != nil {
+		problems = append(problems, errors.Wrapf(err, "api keys"))
+	}
+	err = confs.InitRetention(conf.Retention)
+	if err != nil {
+		problems = append(problems, errors.Wrapf(err, "retention"))
+	}
+
+	if conf.ContentModeratorConfig == nil {
+		problems = append(problems, errors.New("content_moderator_config is missing"))
+	} else if _, err = llm_proxy.NewModeratorFromConfig(conf.ContentModeratorConfig); err != nil {
+		problems = append(problems, errors.Wrapf(err, "content moderator"))
+	}
+	if conf.UserOAuthCreds == nil || conf.UserOAuthCreds.ClientID == "" {
+		problems = append(problems, errors.New("user_oauth_creds is missing"))
+	}
+	if conf.PaddleCreds == nil || conf.PaddleCreds.SecretKey == "" {
+		problems = append(problems, errors.New("paddle_creds.secret_key is missing, webhooks can't be verified"))
+	}
+	problems = append(problems, validateModelPackages(conf.ModelPackages)...)
+
+	dbHandler, err := models.NewDBHandler(conf)
+	if err != nil {
+		return append(problems, errors.Wrapf(err, "storage"))
+	}
+	_, err = locks.NewLocker(conf.Storage, dbHandler)
+	if err != nil {
+		problems = append(problems, errors.Wrapf(err, "locks"))
+	}
+	kms, err := secrets.NewKMS(conf)
+	if err != nil {
+		return append(problems, errors.Wrapf(err, "kms"))
+	}
+	if !online {
+		return problems
+	}
+
+	for _, modelName := range keyNamesToGenerate() {
+		rsaKeys, err := secrets.LoadRSAKeysForModel(ctx, dbHandler, kms, modelName)
+		if err != nil {
+			problems = append(problems, errors.Wrapf(err, "rsa keys of %s", modelName))
+		} else if len(rsaKeys) == 0 {
+			problems = append(problems, errors.Newf("no usable rsa keys for %s, see generate-rsa-keys", modelName))
+		}
+	}
+	_, _, err = secrets.FetchUserCredsDEK(ctx, dbHandler, kms)
+	if err != nil {
+		problems = append(problems, errors.Wrapf(err, "user-creds-dek, see create-user-creds-dek"))
+	}
+	return problems
+}
+
+func validateModelPackages(packages []common.ModelTokenPackage) []error {
+	var problems []error
+	priceIDs := map[string]bool{}
+	for _, pkg := range packages {
+		if _, err := confs.ModelSpecFor(pkg.ModelID); err != nil {
+			problems = append(problems, errors.Wrapf(err, "package %s", pkg.ID))
+		}
+		if pkg.Tokens <= 0 {
+			problems = append(problems, errors.Newf("package %s grants no tokens", pkg.ID))
+		}
+		if pkg.PaddlePriceID == "" {
+			continue
+		}
+		if priceIDs[pkg.PaddlePriceID] {
+			problems = append(problems, errors.Newf("paddle price id %s is used by more than one package", pkg.PaddlePriceID))
+		}
+		priceIDs[pkg.PaddlePriceID] = true
+	}
+	return problems
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"github.com/google/uuid"
+	"llmmask/src/confs"
+	"llmmask/src/locks"
+	"llmmask/src/models"
+	"time"
+)
+
+func grantCreditsCmd(ctx context.Context, args []string) error {
+	return adjustCreditsCmd(ctx, "grant-credits", 1, args)
+}
+
+func revokeCreditsCmd(ctx context.Context, args []string) error {
+	return adjustCreditsCmd(ctx, "revoke-credits", -1, args)
+}
+
+func adjustCreditsCmd(ctx context.Context, name string, sign int, args []string) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	userDocID := fs.String("user", "", "Doc ID of the user")
+	model := fs.String("model", "", "Model the credits are for")
+	credits := fs.Int("credits", 0, "How many credits")
+	reference := fs.String("reference", "", "Identifies the adjustment, running it again with the same one is a no-op. Random when not set")
+	note := fs.String("note", "", "Why, kept in the ledger")
+	err := parseFlags(fs, args, "user", "model", "credits", "note")
+	if err != nil {
+		return err
+	}
+	if *credits <= 0 {
+		return errors.New("-credits must be positive")
+	}
+	if *reference == "" {
+		*reference = uuid.New().String()
+	}
+	env, err := newEnv(ctx)
+	if err != nil {
+		return err
+	}
+	entry, err := adjustCredits(ctx, env, *userDocID, *model, sign**credits, *reference, *note)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		fmt.Printf("Adjustment %s was already applied\n", *reference)
+		return nil
+	}
+	fmt.Printf("Adjusted %s of user %s by %d, reference %s\n", *model, *userDocID, entry.Credits, *reference)
+	return nil
+}
+
+// adjustCredits changes the balance of the user and records it in the ledger as an admin adjustment, once per
+// reference. It's nil if the adjustment was already applied.
+func adjustCredits(ctx context.Context, env *env, userDocID string, modelName confs.ModelName, credits int,
+	reference, note string) (*models.LedgerEntry, error) {
+	if _, err := confs.ModelSpecFor(modelName); err != nil {
+		return nil, err
+	}
+	release, err := locks.AcquireAll(ctx, env.locker, confs.LockLeaseTTL(ctx), models.UserBalanceLockKey(userDocID))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	now := time.Now().UTC()
+	entry := models.NewLedgerEntry(userDocID, models.LedgerKindAdminAdjustment, reference, modelName, credits, 0, now)
+	entry.Note = note
+	err = env.dbHandler.Fetch(ctx, &models.LedgerEntry{DocID: entry.DocID})
+	if err == nil {
+		return nil, nil
+	}
+	if !models.IsNotFoundErr(err) {
+		return nil, err
+	}
+
+	user := &models.User{DocID: userDocID}
+	err = env.dbHandler.Fetch(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	err = user.SubscriptionInfo.AdjustCredits(modelName, credits)
+	if err != nil {
+		return nil, err
+	}
+	entries := models.OpenLedger(user, []*models.LedgerEntry{entry}, now)
+	err = env.dbHandler.Upsert(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	err = models.AppendLedgerEntries(ctx, env.dbHandler, entries...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "balance adjusted, but failed to record it in the ledger, it shows up as drift")
+	}
+	return entry, nil
+}
+
+func reconcileUserBalanceCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("reconcile-user-balance", flag.ExitOnError)
+	userDocID := fs.String("user", "", "Doc ID of the user")
+	err := parseFlags(fs, args, "user")
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(ctx)
+	if err != nil {
+		return err
+	}
+	user := &models.User{DocID: *userDocID}
+	err = env.dbHandler.Fetch(ctx, user)
+	if err != nil {
+		return err
+	}
+	if user.SubscriptionInfo.LedgerOpenedAt.IsZero() {
+		fmt.Println("The user has no ledger yet")
+		return nil
+	}
+	entries, err := models.FetchLedgerEntries(ctx, env.dbHandler, *userDocID)
+	if err != nil {
+		return err
+	}
+	drifts := models.FindLedgerDrift(user, entries)
+	for _, drift := range drifts {
+		fmt.Printf("%s: active %d, ledger says %d; used %d, ledger says %d\n",
+			drift.ModelName, drift.Active, drift.LedgerActive, drift.Used, drift.LedgerUsed)
+	}
+	if len(drifts) == 0 {
+		fmt.Printf("Balance matches the %d ledger entries\n", len(entries))
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	"llmmask/src/locks"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"llmmask/src/secrets"
+	"time"
+)
+
+func generateRSAKeysCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("generate-rsa-keys", flag.ExitOnError)
+	model := fs.String("model", "", "Model to generate the keys for, every model when not set. "+
+		secrets.PartiallyBlindKeyName+" for the partially blind issuer key")
+	err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(ctx)
+	if err != nil {
+		return err
+	}
+	modelNames := keyNamesToGenerate()
+	if *model != "" {
+		modelNames = []confs.ModelName{*model}
+	}
+	for _, modelName := range modelNames {
+		denominations := confs.TokenDenominations(ctx)
+		if modelName == secrets.PartiallyBlindKeyName {
+			// The issuer key signs every denomination, it's bound by the token metadata.
+			denominations = []int{1}
+		}
+		for _, denomination := range denominations {
+			created, err := generateRSAKeys(ctx, env, modelName, denomination)
+			if err != nil {
+				return err
+			}
+			if created == nil {
+				fmt.Printf("%s (x%d): has keys already, skipped\n", modelName, denomination)
+				continue
+			}
+			fmt.Printf("%s (x%d): generated key %s\n%s\n", modelName, denomination, rsaKeyIDOf(created), created.PublicKeyPlaintext)
+		}
+	}
+	return nil
+}
+
+// keyNamesToGenerate are the models needing keys of their own, those issuing partially blind tokens only need the
+// issuer key.
+func keyNamesToGenerate() []confs.ModelName {
+	var res []confs.ModelName
+	partiallyBlind := false
+	for _, modelName := range confs.AllModels() {
+		if common.Must(confs.ModelSpecFor(modelName)).TokenScheme == confs.TokenSchemePartiallyBlindRSA {
+			partiallyBlind = true
+		} else {
+			res = append(res, modelName)
+		}
+	}
+	if partiallyBlind {
+		res = append(res, secrets.PartiallyBlindKeyName)
+	}
+	return res
+}
+
+// generateRSAKeys gives a model its first key of the denomination, it's nil if the model has keys of it already.
+// Later keys come from rotations.
+func generateRSAKeys(ctx context.Context, env *env, modelName confs.ModelName, denomination int) (*models.RSAKeys, error) {
+	if _, err := confs.ModelSpecFor(modelName); err != nil && modelName != secrets.PartiallyBlindKeyName {
+		return nil, err
+	}
+	docs, err := secrets.ListRSAKeyDocsForModel(ctx, env.dbHandler, modelName)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		if doc.GetDenomination() == denomination {
+			return nil, nil
+		}
+	}
+	rsaKeys, err := secrets.NewWrappedRSAKeys(ctx, env.kms, modelName, denomination,
+		secrets.RSAKeyDocID(modelName, denomination, time.Time{}), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	err = env.dbHandler.Create(ctx, rsaKeys)
+	if models.IsConflictErr(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Infof(ctx, "Generated rsa key for model %s (x%d)", modelName, denomination)
+	return rsaKeys, nil
+}
+
+func rotateRSAKeyCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rotate-rsa-key", flag.ExitOnError)
+	model := fs.String("model", "", "Model to rotate the key of")
+	denomination := fs.Int("denomination", 1, "Denomination of the key, in credits")
+	in := fs.Duration("in", time.Hour, "How long from now the new key starts signing, servers must reload keys before that")
+	overlap := fs.Duration("overlap", 0, "How long the current keys keep verifying after that, defaults to 7 days "+
+		"and to the token lifetime for the partially blind issuer")
+	err := parseFlags(fs, args, "model")
+	if err != nil {
+		return err
+	}
+	if *overlap == 0 {
+		*overlap = 7 * 24 * time.Hour
+		if *model == secrets.PartiallyBlindKeyName {
+			*overlap = confs.PartiallyBlindKeyMinOverlap(ctx)
+		}
+	}
+	env, err := newEnv(ctx)
+	if err != nil {
+		return err
+	}
+	notBefore := time.Now().UTC().Add(*in)
+	rsaKeys, err := secrets.RotateRSAKey(ctx, env.dbHandler, env.kms, *model, *denomination, notBefore, *overlap)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s (x%d): new key %s signs from %v\n", *model, *denomination, rsaKeyIDOf(rsaKeys), notBefore)
+	return nil
+}
+
+func revokeRSAKeyCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("revoke-rsa-key", flag.ExitOnError)
+	model := fs.String("model", "", "Model the key belongs to")
+	keyID := fs.String("key-id", "", "ID of the key, as listed by list-rsa-keys")
+	err := parseFlags(fs, args, "model", "key-id")
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(ctx)
+	if err != nil {
+		return err
+	}
+	return secrets.RevokeRSAKey(ctx, env.dbHandler, *model, *keyID)
+}
+
+func listRSAKeysCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list-rsa-keys", flag.ExitOnError)
+	model := fs.String("model", "", "Model to list the keys of")
+	err := parseFlags(fs, args, "model")
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(ctx)
+	if err != nil {
+		return err
+	}
+	docs, err := secrets.ListRSAKeyDocsForModel(ctx, env.dbHandler, *model)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		fmt.Printf("%s\tkey-id=%s\tdenomination=%d\tnot-before=%v\tnot-after=%v\trevoked=%v\n",
+			doc.DocID, rsaKeyIDOf(doc), doc.GetDenomination(), doc.NotBefore, doc.NotAfter, doc.Revoked)
+	}
+	return nil
+}
+
+func rsaKeyIDOf(doc *models.RSAKeys) string {
+	publicKey, err := secrets.RSALoadPublicKey(string(doc.PublicKeyPlaintext))
+	if err != nil {
+		return "<invalid public key>"
+	}
+	return secrets.RSAKeyID(publicKey)
+}
+
+func createUserCredsDEKCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("create-user-creds-dek", flag.ExitOnError)
+	err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(ctx)
+	if err != nil {
+		return err
+	}
+	return secrets.CreateUserCredsDEK(ctx, env.dbHandler, env.kms)
+}
+
+func rotateUserCredsDEKCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rotate-user-creds-dek", flag.ExitOnError)
+	err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(ctx)
+	if err != nil {
+		return err
+	}
+	// Everything must be under the current DEK first, as the one before it is dropped by the rotation.
+	key, previousKey, err := secrets.FetchUserCredsDEK(ctx, env.dbHandler, env.kms)
+	if err != nil {
+		return err
+	}
+	err = reencryptUserCreds(ctx, env, key, previousKey)
+	if err != nil {
+		return errors.Wrapf(err, "not rotating, failed to re-encrypt under the current dek")
+	}
+	_, err = secrets.RotateUserCredsDEK(ctx, env.dbHandler, env.kms)
+	if err != nil {
+		return err
+	}
+	key, previousKey, err = secrets.FetchUserCredsDEK(ctx, env.dbHandler, env.kms)
+	if err != nil {
+		return err
+	}
+	err = reencryptUserCreds(ctx, env, key, previousKey)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Rotated. Restart the servers, then run reencrypt-user-creds for sign ins that happened meanwhile.")
+	return nil
+}
+
+func reencryptUserCredsCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("reencrypt-user-creds", flag.ExitOnError)
+	err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(ctx)
+	if err != nil {
+		return err
+	}
+	key, previousKey, err := secrets.FetchUserCredsDEK(ctx, env.dbHandler, env.kms)
+	if err != nil {
+		return err
+	}
+	return reencryptUserCreds(ctx, env, key, previousKey)
+}
+
+// reencryptUserCreds moves the credentials of every user under key. Users are saved under their balance lock, as
+// that's what every other writer of the user holds.
+func reencryptUserCreds(ctx context.Context, env *env, key, previousKey string) error {
+	items, err := env.dbHandler.Query(ctx, &models.User{}, 0)
+	if err != nil {
+		return err
+	}
+	reencrypted := 0
+	for _, item := range items {
+		user := &models.User{}
+		err = models.Deserialize(item, user)
+		if err != nil {
+			return err
+		}
+		changed, err := reencryptUserCredsOf(ctx, env, user.DocID, key, previousKey)
+		if err != nil {
+			return errors.Wrapf(err, "failed to re-encrypt the creds of user %s", user.DocID)
+		}
+		if changed {
+			reencrypted++
+		}
+	}
+	fmt.Printf("Re-encrypted the creds of %d of %d users\n", reencrypted, len(items))
+	return nil
+}
+
+func reencryptUserCredsOf(ctx context.Context, env *env, userDocID, key, previousKey string) (bool, error) {
+	release, err := locks.AcquireAll(ctx, env.locker, confs.LockLeaseTTL(ctx), models.UserBalanceLockKey(userDocID))
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	user := &models.User{DocID: userDocID}
+	err = env.dbHandler.Fetch(ctx, user)
+	if err != nil || user.TokenSerialized == "" {
+		return false, err
+	}
+	tokenSerialized, changed, err := secrets.ReencryptAES(user.TokenSerialized, key, previousKey)
+	if err != nil || !changed {
+		return false, err
+	}
+	user.TokenSerialized = tokenSerialized
+	return true, env.dbHandler.Upsert(ctx, user)
+}
@@ -0,0 +1,126 @@
+// Command admin runs one-off operations against the platform storage and KMS: provisioning signing keys, managing
+// the user-creds-dek, adjusting credits, inspecting auth tokens and validating the platform config.
+//
+//	go run ./src/cmd/admin <command> [flags]
+//
+// It reads the same platform config as the server, see common.PlatformCredsConfig.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	"llmmask/src/locks"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"llmmask/src/secrets"
+	"os"
+	"sort"
+)
+
+// env is what the commands work against, built from the platform config.
+type env struct {
+	dbHandler models.DBHandler
+	kms       secrets.KMS
+	locker    locks.Locker
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"validate-config":        {"Check the platform config, and the keys it points to", validateConfigCmd},
+	"generate-rsa-keys":      {"Generate the first signing key of every denomination a model lacks", generateRSAKeysCmd},
+	"rotate-rsa-key":         {"Add a new signing key for a model, retiring the current ones", rotateRSAKeyCmd},
+	"revoke-rsa-key":         {"Revoke a signing key of a model", revokeRSAKeyCmd},
+	"list-rsa-keys":          {"List the signing keys of a model", listRSAKeysCmd},
+	"create-user-creds-dek":  {"Create the DEK encrypting user credentials", createUserCredsDEKCmd},
+	"rotate-user-creds-dek":  {"Replace the DEK encrypting user credentials and re-encrypt them", rotateUserCredsDEKCmd},
+	"reencrypt-user-creds":   {"Re-encrypt user credentials still under the previous DEK", reencryptUserCredsCmd},
+	"grant-credits":          {"Give credits to a user", grantCreditsCmd},
+	"revoke-credits":         {"Take credits away from a user", revokeCreditsCmd},
+	"inspect-token":          {"Show the redemption state of an auth token", inspectTokenCmd},
+	"reconcile-user-balance": {"Check the balance of a user against their ledger", reconcileUserBalanceCmd},
+}
+
+func main() {
+	log.Init()
+	ctx := context.Background()
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	err := cmd.run(ctx, os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %+v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: admin <command> [flags]\n\ncommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-24s %s\n", name, commands[name].usage)
+	}
+}
+
+// newEnv connects to what the platform config points to. Unlike the server it doesn't load keys or DEKs, so it
+// works on a fresh deployment.
+func newEnv(ctx context.Context) (*env, error) {
+	conf := common.PlatformCredsConfig()
+	err := confs.InitModelRegistry(conf.Models, conf.LLMAPIKeys)
+	if err != nil {
+		return nil, err
+	}
+	dbHandler, err := models.NewDBHandler(conf)
+	if err != nil {
+		return nil, err
+	}
+	kms, err := secrets.NewKMS(conf)
+	if err != nil {
+		return nil, err
+	}
+	locker, err := locks.NewLocker(conf.Storage, dbHandler)
+	if err != nil {
+		return nil, err
+	}
+	return &env{
+		dbHandler: dbHandler,
+		kms:       kms,
+		locker:    locker,
+	}, nil
+}
+
+func parseFlags(fs *flag.FlagSet, args []string, required ...string) error {
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for _, name := range required {
+		if !set[name] {
+			fs.Usage()
+			return errors.Newf("-%s is required", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/models"
+	"os"
+	"time"
+)
+
+// tokenInspection is an auth token record without the cached response itself.
+type tokenInspection struct {
+	DocID              string
+	ModelName          string
+	KeyID              string
+	State              string
+	StateAt            time.Time
+	CreatedAt          time.Time
+	ExpiresAt          time.Time
+	HasRequestHash     bool
+	CachedResponseSize int
+	Stripped           bool
+	StrippedAt         time.Time
+}
+
+func inspectTokenCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("inspect-token", flag.ExitOnError)
+	hash := fs.String("hash", "", "Doc ID of the token record, base64 of the sha256 of the token")
+	token := fs.String("token", "", "The token itself, base64")
+	credit := fs.Int("credit", 0, "Credit of the token to inspect, for tokens worth more than one")
+	err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	docID := *hash
+	if *token != "" {
+		tokenBytes, err := base64.StdEncoding.DecodeString(*token)
+		if err != nil {
+			return errors.Wrapf(err, "token isn't base64")
+		}
+		docID = models.DocIDForAuthTokenCredit(tokenBytes, *credit)
+	}
+	if docID == "" {
+		return errors.New("either -hash or -token is required")
+	}
+	env, err := newEnv(ctx)
+	if err != nil {
+		return err
+	}
+
+	authToken := &models.AuthToken{DocID: docID}
+	err = env.dbHandler.Fetch(ctx, authToken)
+	if models.IsNotFoundErr(err) {
+		fmt.Printf("No record of %s, it was never issued or redeemed, or got cleaned up\n", docID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := authToken.State
+	if state == "" {
+		state = models.AuthTokenStateCompleted
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(&tokenInspection{
+		DocID:              authToken.DocID,
+		ModelName:          authToken.ModelName,
+		KeyID:              authToken.KeyID,
+		State:              state,
+		StateAt:            authToken.StateAt,
+		CreatedAt:          authToken.CreatedAt,
+		ExpiresAt:          authToken.ExpiresAt,
+		HasRequestHash:     len(authToken.RequestHash) > 0,
+		CachedResponseSize: len(authToken.CachedResponse),
+		Stripped:           authToken.Stripped,
+		StrippedAt:         authToken.StrippedAt,
+	})
+}
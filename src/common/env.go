@@ -49,13 +49,81 @@ func PlatformCredsConfig() *CredsConfig {
 
 type CredsConfig struct {
 	Cosmos                 *CosmosDBCredsConfig    `json:"cosmos"`
+	Storage                *StorageConfig          `json:"storage"`
 	LLMAPIKeys             map[string][]string     `json:"llm_api_keys"`
 	KeyVaultCreds          *KeyVaultCredsConfig    `json:"key_vault_creds"`
+	KMS                    *KMSConfig              `json:"kms"`
 	ModelToKeyNames        map[string]string       `json:"model_to_key_names"`
 	ContentModeratorConfig *ContentModeratorConfig `json:"content_moderator_config"`
 	UserOAuthCreds         *UserOAuthCreds         `json:"user_oauth_creds"`
 	PaddleCreds            *PaddleCreds            `json:"paddle_creds"`
 	ModelPackages          []ModelTokenPackage     `json:"model_packages"`
+	// AdminEmails are the signed in users allowed on the admin apis.
+	AdminEmails []string `json:"admin_emails"`
+	// Models is the model registry, the built-in models are served when empty. See confs.InitModelRegistry.
+	Models []ModelConfig `json:"models"`
+	// Retention of spent auth token records, defaults when unset.
+	Retention *RetentionConfig `json:"retention"`
+}
+
+// RetentionConfig are the windows after which spent auth token records are cleaned up.
+type RetentionConfig struct {
+	// CachedResponseRetentionHours is how long after ExpiresAt the cached response and its DEK are kept.
+	CachedResponseRetentionHours int `json:"cached_response_retention_hours"`
+	// SpentMarkerRetentionHours is how long spent markers are kept after their signing key expired or got revoked.
+	// Tokens of such keys no longer verify, so the markers aren't needed to reject replays.
+	SpentMarkerRetentionHours int `json:"spent_marker_retention_hours"`
+}
+
+// ModelConfig declares a model served by the proxy, and how to reach its provider.
+type ModelConfig struct {
+	Name      string                `json:"name"`
+	Provider  string                `json:"provider"` // openai, gemini or anthropic
+	Endpoints []ModelEndpointConfig `json:"endpoints"`
+	// AuthHeader is bearer, x-api-key, x-goog-api-key or api-key, defaults per provider.
+	AuthHeader string `json:"auth_header"`
+	// APIKeys falls back to llm_api_keys[name] when empty.
+	APIKeys []string `json:"api_keys"`
+	// APIKeyBudgets caps how many tokens keys of the pool may consume, keys without one are unbounded.
+	APIKeyBudgets []APIKeyBudgetConfig `json:"api_key_budgets"`
+	// RequestTransformer is openai (sent as is) or anthropic, defaults per provider.
+	RequestTransformer string `json:"request_transformer"`
+	// MaxCreditsPerRequest can only lower the global limit, 0 means the global limit.
+	MaxCreditsPerRequest int               `json:"max_credits_per_request"`
+	Capabilities         ModelCapabilities `json:"capabilities"`
+	// AllowedParams are the OpenAI chat parameters passed on besides model and messages, defaults per provider.
+	AllowedParams []string `json:"allowed_params"`
+	// ParamRenames maps OpenAI parameter names to what the provider calls them, e.g. max_tokens to
+	// max_completion_tokens for reasoning models.
+	ParamRenames map[string]string `json:"param_renames"`
+	// TokenScheme is blind-rsa (the default), voprf or partially-blind-rsa, the scheme new tokens of the model are
+	// issued under.
+	TokenScheme string `json:"token_scheme"`
+	// DelayedRedemption only lets tokens be redeemed once the epoch they were issued in is over, so issuance and
+	// redemption can't be linked by timing. Needs the partially-blind-rsa token scheme.
+	DelayedRedemption bool `json:"delayed_redemption"`
+	// PrivacyPassIssuer is the host name Privacy Pass clients fetch the model's issuer directory from, at
+	// /.well-known/private-token-issuer-directory. Defaults to the api server's, shared with the other models.
+	PrivacyPassIssuer string `json:"privacy_pass_issuer"`
+}
+
+// ModelEndpointConfig is one region of a model, requests are spread over the endpoints by weight.
+type ModelEndpointConfig struct {
+	URL    string `json:"url"`
+	Region string `json:"region"`
+	Weight int    `json:"weight"` // defaults to 1
+}
+
+// APIKeyBudgetConfig is in prompt plus completion tokens. A key used by several models shares its budget.
+type APIKeyBudgetConfig struct {
+	Key                string `json:"key"`
+	DailyTokenBudget   int64  `json:"daily_token_budget"`   // 0 means no daily cap
+	MonthlyTokenBudget int64  `json:"monthly_token_budget"` // 0 means no monthly cap
+}
+
+type ModelCapabilities struct {
+	Streaming bool `json:"streaming"`
+	Vision    bool `json:"vision"`
 }
 
 type PaddleCreds struct {
@@ -73,14 +141,48 @@ type KeyVaultCredsConfig struct {
 	PlatformKey  string `json:"platform_key"`
 }
 
+// KMSConfig picks the KMS wrapping DEKs, azure key vault is used when not set.
+type KMSConfig struct {
+	Backend        string `json:"backend"`          // azure or local
+	MasterKeysFile string `json:"master_keys_file"` // local only, takes precedence over the env var
+	MasterKeysEnv  string `json:"master_keys_env"`  // local only, defaults to LLMMASK_KMS_MASTER_KEYS
+}
+
 type CosmosDBCredsConfig struct {
 	DatabaseName     string `json:"database_name"`
 	ConnectionString string `json:"connection_string"`
 }
 
+// StorageConfig picks the document store, cosmos is used when not set.
+type StorageConfig struct {
+	Backend string `json:"backend"` // cosmos, memory or bolt
+	Path    string `json:"path"`    // DB file path for bolt
+	// Locks is memory or storage, see locks.NewLocker. Defaults to storage for cosmos, as it's shared by instances.
+	Locks string `json:"locks"`
+}
+
 type ContentModeratorConfig struct {
 	Endpoint string `json:"endpoint"`
 	APIKey   string `json:"api_key"`
+	// Providers are chained when set, otherwise only Azure Content Safety at Endpoint is used.
+	Providers []ModerationProviderConfig `json:"providers"`
+}
+
+type ModerationProviderConfig struct {
+	Type     string               `json:"type"` // azure, openai or rules
+	Endpoint string               `json:"endpoint"`
+	APIKey   string               `json:"api_key"`
+	Model    string               `json:"model"` // openai only
+	Rules    []ModerationRuleConf `json:"rules"` // rules only
+}
+
+// ModerationRuleConf flags content matching any of the keywords (case-insensitive) or regexes under a category.
+type ModerationRuleConf struct {
+	Name     string   `json:"name"`
+	Category string   `json:"category"`
+	Severity int      `json:"severity"`
+	Keywords []string `json:"keywords"`
+	Regexes  []string `json:"regexes"`
 }
 
 type UserOAuthCreds struct {
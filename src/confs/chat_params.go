@@ -0,0 +1,64 @@
+package confs
+
+// OpenAI chat parameters that can be allowed for a model, besides model, messages, stream and stream_options which
+// are always passed on. Values are validated by the proxy before any token is spent.
+const (
+	ParamTemperature         = "temperature"
+	ParamTopP                = "top_p"
+	ParamPresencePenalty     = "presence_penalty"
+	ParamFrequencyPenalty    = "frequency_penalty"
+	ParamMaxTokens           = "max_tokens"
+	ParamMaxCompletionTokens = "max_completion_tokens"
+	ParamStop                = "stop"
+	ParamSeed                = "seed"
+	ParamResponseFormat      = "response_format"
+	ParamTools               = "tools"
+	ParamToolChoice          = "tool_choice"
+	ParamParallelToolCalls   = "parallel_tool_calls"
+	ParamReasoningEffort     = "reasoning_effort"
+)
+
+func AllChatParams() []string {
+	return []string{
+		ParamTemperature,
+		ParamTopP,
+		ParamPresencePenalty,
+		ParamFrequencyPenalty,
+		ParamMaxTokens,
+		ParamMaxCompletionTokens,
+		ParamStop,
+		ParamSeed,
+		ParamResponseFormat,
+		ParamTools,
+		ParamToolChoice,
+		ParamParallelToolCalls,
+		ParamReasoningEffort,
+	}
+}
+
+// anthropicChatParams are the ones the anthropic request transformer knows how to translate.
+func anthropicChatParams() []string {
+	return []string{
+		ParamTemperature,
+		ParamTopP,
+		ParamMaxTokens,
+		ParamMaxCompletionTokens,
+		ParamStop,
+		ParamTools,
+		ParamToolChoice,
+	}
+}
+
+// reasoningChatParams are the ones OpenAI reasoning models (o1 and later) accept, they don't take sampling parameters
+// and call max_tokens max_completion_tokens.
+func reasoningChatParams() []string {
+	return []string{
+		ParamMaxTokens,
+		ParamMaxCompletionTokens,
+		ParamSeed,
+		ParamResponseFormat,
+		ParamTools,
+		ParamToolChoice,
+		ParamReasoningEffort,
+	}
+}
@@ -1,6 +1,9 @@
 package confs
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 func MaxRPSPerUser(ctx context.Context) int {
 	return 100
@@ -10,6 +13,180 @@ func MaxRPSPerIp(ctx context.Context) int {
 	return 10000
 }
 
+// MaxOffensiveContentSeverity is the highest severity let through, on the Azure Content Safety scale (0-7). OpenAI
+// scores (0-1) are mapped onto it as int(score*8), so 2 blocks scores of 0.375 and up.
 func MaxOffensiveContentSeverity(ctx context.Context) int {
 	return 2
 }
+
+// RequestBytesPerCredit is how much of a proxied request body a single credit pays for.
+func RequestBytesPerCredit(ctx context.Context) int {
+	return 30000 // 30KB
+}
+
+// MaxCreditsPerRequest caps how many tokens can be spent on a single request, and so the request size.
+func MaxCreditsPerRequest(ctx context.Context) int {
+	return 10
+}
+
+// MaxTokensPerIssuanceBatch caps how many blinded tokens are signed in a single batch call.
+func MaxTokensPerIssuanceBatch(ctx context.Context) int {
+	return 100
+}
+
+// TokenDenominations are the credit values tokens are issued in, each has its own keys per model.
+func TokenDenominations(ctx context.Context) []int {
+	return []int{1, 5, 25}
+}
+
+// TokenEpochLength is how long a token epoch lasts, partially blind tokens expire at the end of one.
+func TokenEpochLength(ctx context.Context) time.Duration {
+	return time.Hour * 24
+}
+
+// TokenLifetimeEpochs is how many epochs after the current one partially blind tokens issued now stay redeemable.
+// Their issuance epoch is told from the expiry, changing it moves when delayed tokens become redeemable.
+func TokenLifetimeEpochs(ctx context.Context) int64 {
+	return 30
+}
+
+// PartiallyBlindKeyMinOverlap is how long a rotated out partially blind issuer key must keep verifying, so that the
+// tokens it signed last stay redeemable till their expiry. Those expire at the end of the epoch TokenLifetimeEpochs
+// after the next one, at the latest.
+func PartiallyBlindKeyMinOverlap(ctx context.Context) time.Duration {
+	return time.Duration(TokenLifetimeEpochs(ctx)+2) * TokenEpochLength(ctx)
+}
+
+// MaxCreditsPerRequestForModel is MaxCreditsPerRequest, lowered by the model's own limit if it has one.
+func MaxCreditsPerRequestForModel(ctx context.Context, modelName ModelName) int {
+	maxCredits := MaxCreditsPerRequest(ctx)
+	spec, err := ModelSpecFor(modelName)
+	if err == nil && spec.MaxCreditsPerRequest > 0 {
+		maxCredits = min(maxCredits, spec.MaxCreditsPerRequest)
+	}
+	return maxCredits
+}
+
+// UpstreamMaxAttempts is how many times a request is sent upstream, across keys and endpoints, before giving up.
+func UpstreamMaxAttempts(ctx context.Context) int {
+	return 3
+}
+
+// UpstreamRetryBackoff is the wait before the first retry, doubled for every further one.
+func UpstreamRetryBackoff(ctx context.Context) time.Duration {
+	return 200 * time.Millisecond
+}
+
+// UpstreamRequestTimeout bounds a request upstream, answer included. It isn't tied to the client, whose tokens pay
+// for the answer even if it goes away. Below AuthTokenRecoveryAfter, so recovery never races a live request.
+func UpstreamRequestTimeout(ctx context.Context) time.Duration {
+	return 10 * time.Minute
+}
+
+// APIKeyRateLimitCooldown is how long a key rests after a 429 without a Retry-After.
+func APIKeyRateLimitCooldown(ctx context.Context) time.Duration {
+	return 30 * time.Second
+}
+
+// APIKeyCircuitBreakerThreshold is how many failures in a row open the circuit of a key.
+func APIKeyCircuitBreakerThreshold(ctx context.Context) int {
+	return 5
+}
+
+func APIKeyCircuitOpen(ctx context.Context) time.Duration {
+	return 30 * time.Second
+}
+
+func APIKeyMaxCircuitOpen(ctx context.Context) time.Duration {
+	return 10 * time.Minute
+}
+
+// APIKeyUsageFlushInterval is how often api key usage is stored and reloaded, budgets can overshoot by about the
+// usage of all instances in this interval.
+func APIKeyUsageFlushInterval(ctx context.Context) time.Duration {
+	return time.Minute
+}
+
+// RSAKeyRevocationPollInterval is how often instances check for revoked signing keys, a revoked key can keep verifying
+// tokens elsewhere for about this long.
+func RSAKeyRevocationPollInterval(ctx context.Context) time.Duration {
+	return 15 * time.Second
+}
+
+// APIKeyUsageFlushAttempts is how many times adding to a usage doc is tried when other instances keep changing it,
+// what isn't added stays pending for the next flush.
+func APIKeyUsageFlushAttempts(ctx context.Context) int {
+	return 5
+}
+
+// AuthTokenGCBatchSize is how many auth token records are cleaned up per query.
+func AuthTokenGCBatchSize(ctx context.Context) int {
+	return 100
+}
+
+// AuthTokenGCMaxBatches caps the work of a single run, what's left is picked up by the next one.
+func AuthTokenGCMaxBatches(ctx context.Context) int {
+	return 50
+}
+
+// AuthTokenRecoveryAfter is how long a redemption may sit reserved or in flight before it's considered crashed and
+// its tokens refunded. Well above the longest request.
+func AuthTokenRecoveryAfter(ctx context.Context) time.Duration {
+	return 15 * time.Minute
+}
+
+// AuthTokenCompleteAttempts is how many times storing a paid for response is tried before leaving it to recovery.
+func AuthTokenCompleteAttempts(ctx context.Context) int {
+	return 3
+}
+
+// LockLeaseTTL is how long a lock outlives a crashed holder. Live holders renew it every third of that.
+func LockLeaseTTL(ctx context.Context) time.Duration {
+	return 30 * time.Second
+}
+
+// LockPollInterval is how often a storage lock held elsewhere is checked again.
+func LockPollInterval(ctx context.Context) time.Duration {
+	return 100 * time.Millisecond
+}
+
+// IdleLockEvictionInterval is how often in memory locks whose lease lapsed are dropped.
+func IdleLockEvictionInterval(ctx context.Context) time.Duration {
+	return time.Minute
+}
+
+// PaddleEventMaxAttempts is how many times a webhook event is processed before it's left for a human.
+func PaddleEventMaxAttempts(ctx context.Context) int {
+	return 10
+}
+
+// PaddleEventRetryBackoff is the wait before the first retry of a failed webhook event, doubled for every further one
+// up to PaddleEventMaxRetryBackoff.
+func PaddleEventRetryBackoff(ctx context.Context) time.Duration {
+	return 5 * time.Minute
+}
+
+func PaddleEventMaxRetryBackoff(ctx context.Context) time.Duration {
+	return 6 * time.Hour
+}
+
+// PaddleEventRetryBatchSize is how many failed webhook events are retried per background run, the rest wait for the
+// next one.
+func PaddleEventRetryBatchSize(ctx context.Context) int {
+	return 50
+}
+
+// LedgerReconcileInterval is how often the balance of every user is checked against their ledger.
+func LedgerReconcileInterval(ctx context.Context) time.Duration {
+	return 24 * time.Hour
+}
+
+// LedgerReconcileBatchSize caps the users checked in a single run, what's left is picked up by the next one.
+func LedgerReconcileBatchSize(ctx context.Context) int {
+	return 200
+}
+
+// LedgerMaxEntriesShown is how many of their latest ledger entries users get to see.
+func LedgerMaxEntriesShown(ctx context.Context) int {
+	return 500
+}
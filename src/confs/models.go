@@ -2,6 +2,7 @@ package confs
 
 type ModelName = string
 
+// Built-in models, served when the config doesn't declare any. See defaultModelSpecs.
 const (
 	// Google
 	ModelGemini25FlashLite = "gemini-2.5-flash-lite"
@@ -15,20 +16,18 @@ const (
 	ModelChatGPT41Mini = "gpt-4.1-mini"
 	ModelChatGPT4o     = "gpt-4o"
 	ModelChatGPTo1     = "o1"
+
+	// Anthropic
+	ModelClaudeSonnet45 = "claude-sonnet-4-5"
+	ModelClaudeHaiku45  = "claude-haiku-4-5"
+	ModelClaudeOpus41   = "claude-opus-4-1"
 )
 
+// AllModels lists the models in the registry, in config order.
 func AllModels() []ModelName {
-	return []ModelName{
-		// Google
-		ModelGemini25FlashLite,
-		ModelGemini25Flash,
-		ModelGemini25Pro,
-		ModelGemini3Flash,
-		ModelGemini3Pro,
-		// OpenAI
-		ModelChatGPT41,
-		ModelChatGPT41Mini,
-		ModelChatGPT4o,
-		ModelChatGPTo1,
+	res := make([]ModelName, 0, len(modelRegistry))
+	for _, spec := range modelRegistry {
+		res = append(res, spec.Name)
 	}
+	return res
 }
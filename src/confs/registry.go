@@ -0,0 +1,283 @@
+package confs
+
+import (
+	"context"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/common"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const (
+	ProviderOpenAI    = "openai" // Also Azure OpenAI and any other OpenAI compatible endpoint.
+	ProviderGemini    = "gemini"
+	ProviderAnthropic = "anthropic"
+)
+
+const (
+	AuthHeaderBearer     = "bearer"
+	AuthHeaderXAPIKey    = "x-api-key"
+	AuthHeaderGoogAPIKey = "x-goog-api-key"
+	AuthHeaderAzureKey   = "api-key"
+)
+
+const (
+	RequestTransformerOpenAI    = "openai"
+	RequestTransformerAnthropic = "anthropic"
+)
+
+const (
+	TokenSchemeBlindRSA = "blind-rsa"
+	TokenSchemeVOPRF    = "voprf"
+	// TokenSchemePartiallyBlindRSA tokens are signed by the shared issuer key, bound to the model, denomination and
+	// expiry epoch.
+	TokenSchemePartiallyBlindRSA = "partially-blind-rsa"
+)
+
+// ModelSpec is everything the proxy needs to know about a model. Loaded from common.ModelConfig.
+type ModelSpec struct {
+	Name                 ModelName
+	Provider             string
+	Endpoints            []ModelEndpoint
+	AuthHeader           string
+	APIKeys              []string
+	RequestTransformer   string
+	MaxCreditsPerRequest int
+	Streaming            bool
+	Vision               bool
+	AllowedParams        []string
+	ParamRenames         map[string]string
+	// TokenScheme is what new tokens are issued under, tokens of either scheme are redeemed.
+	TokenScheme string
+	// DelayedRedemption rejects tokens redeemed in the epoch they were issued in, only partially blind tokens carry it.
+	DelayedRedemption bool
+	// PrivacyPassIssuer is the issuer name of the model's Privacy Pass challenges, empty for the api server's.
+	PrivacyPassIssuer string
+	// APIKeyBudgets is keyed by the api key.
+	APIKeyBudgets map[string]APIKeyBudget
+}
+
+type APIKeyBudget struct {
+	DailyTokens   int64
+	MonthlyTokens int64
+}
+
+type ModelEndpoint struct {
+	URL    string
+	Region string
+	Weight int
+}
+
+// modelRegistry is set once at startup by Init, before anything reads it.
+var modelRegistry = defaultModelSpecs(nil)
+
+func Init(ctx context.Context) {
+	conf := common.PlatformCredsConfig()
+	common.Must2(InitModelRegistry(conf.Models, conf.LLMAPIKeys))
+	common.Must2(InitRetention(conf.Retention))
+}
+
+// InitModelRegistry validates the model configs and makes them the registry. Without any configs the built-in models
+// are used. legacyAPIKeys (llm_api_keys) fills in the api keys of models that don't list their own.
+func InitModelRegistry(modelConfs []common.ModelConfig, legacyAPIKeys map[string][]string) error {
+	if len(modelConfs) == 0 {
+		modelRegistry = defaultModelSpecs(legacyAPIKeys)
+		return nil
+	}
+
+	var specs []*ModelSpec
+	seen := map[ModelName]bool{}
+	for _, modelConf := range modelConfs {
+		spec, err := newModelSpec(modelConf, legacyAPIKeys)
+		if err != nil {
+			return errors.Wrapf(err, "invalid config for model %q", modelConf.Name)
+		}
+		if seen[spec.Name] {
+			return errors.Newf("model %s declared more than once", spec.Name)
+		}
+		seen[spec.Name] = true
+		specs = append(specs, spec)
+	}
+	modelRegistry = specs
+	return nil
+}
+
+func newModelSpec(modelConf common.ModelConfig, legacyAPIKeys map[string][]string) (*ModelSpec, error) {
+	if modelConf.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	spec := &ModelSpec{
+		Name:                 modelConf.Name,
+		Provider:             modelConf.Provider,
+		AuthHeader:           modelConf.AuthHeader,
+		APIKeys:              modelConf.APIKeys,
+		RequestTransformer:   modelConf.RequestTransformer,
+		MaxCreditsPerRequest: modelConf.MaxCreditsPerRequest,
+		Streaming:            modelConf.Capabilities.Streaming,
+		Vision:               modelConf.Capabilities.Vision,
+		AllowedParams:        modelConf.AllowedParams,
+		ParamRenames:         modelConf.ParamRenames,
+		TokenScheme:          common.ValueOR(modelConf.TokenScheme, TokenSchemeBlindRSA),
+		DelayedRedemption:    modelConf.DelayedRedemption,
+		PrivacyPassIssuer:    modelConf.PrivacyPassIssuer,
+	}
+	switch spec.Provider {
+	case ProviderOpenAI, ProviderGemini:
+		spec.AuthHeader = common.ValueOR(spec.AuthHeader, AuthHeaderBearer)
+		spec.RequestTransformer = common.ValueOR(spec.RequestTransformer, RequestTransformerOpenAI)
+	case ProviderAnthropic:
+		spec.AuthHeader = common.ValueOR(spec.AuthHeader, AuthHeaderXAPIKey)
+		spec.RequestTransformer = common.ValueOR(spec.RequestTransformer, RequestTransformerAnthropic)
+	default:
+		return nil, errors.Newf("unknown provider %q", spec.Provider)
+	}
+	supportedParams := AllChatParams()
+	if spec.RequestTransformer == RequestTransformerAnthropic {
+		supportedParams = anthropicChatParams()
+	}
+	if spec.AllowedParams == nil {
+		spec.AllowedParams = supportedParams
+	}
+	for _, param := range spec.AllowedParams {
+		if !slices.Contains(supportedParams, param) {
+			return nil, errors.Newf("parameter %q not supported", param)
+		}
+	}
+	for from, to := range spec.ParamRenames {
+		if !slices.Contains(spec.AllowedParams, from) || to == "" {
+			return nil, errors.Newf("invalid rename of parameter %q", from)
+		}
+	}
+	if !slices.Contains([]string{AuthHeaderBearer, AuthHeaderXAPIKey, AuthHeaderGoogAPIKey, AuthHeaderAzureKey}, spec.AuthHeader) {
+		return nil, errors.Newf("unknown auth header %q", spec.AuthHeader)
+	}
+	if !slices.Contains([]string{RequestTransformerOpenAI, RequestTransformerAnthropic}, spec.RequestTransformer) {
+		return nil, errors.Newf("unknown request transformer %q", spec.RequestTransformer)
+	}
+	if !slices.Contains([]string{TokenSchemeBlindRSA, TokenSchemeVOPRF, TokenSchemePartiallyBlindRSA}, spec.TokenScheme) {
+		return nil, errors.Newf("unknown token scheme %q", spec.TokenScheme)
+	}
+	if spec.DelayedRedemption && spec.TokenScheme != TokenSchemePartiallyBlindRSA {
+		return nil, errors.Newf("delayed redemption needs the %s token scheme", TokenSchemePartiallyBlindRSA)
+	}
+	if strings.ContainsAny(spec.PrivacyPassIssuer, "/:@ ") {
+		return nil, errors.Newf("privacy pass issuer %q must be a bare host name", spec.PrivacyPassIssuer)
+	}
+	if spec.MaxCreditsPerRequest < 0 {
+		return nil, errors.New("max_credits_per_request can't be negative")
+	}
+	if len(spec.APIKeys) == 0 {
+		spec.APIKeys = legacyAPIKeys[spec.Name]
+	}
+	if len(spec.APIKeys) == 0 {
+		return nil, errors.New("no api keys")
+	}
+	for i, budgetConf := range modelConf.APIKeyBudgets {
+		if !slices.Contains(spec.APIKeys, budgetConf.Key) {
+			return nil, errors.Newf("budget %d is for a key not in the pool", i)
+		}
+		if budgetConf.DailyTokenBudget < 0 || budgetConf.MonthlyTokenBudget < 0 {
+			return nil, errors.Newf("budget %d can't be negative", i)
+		}
+		if spec.APIKeyBudgets == nil {
+			spec.APIKeyBudgets = map[string]APIKeyBudget{}
+		}
+		spec.APIKeyBudgets[budgetConf.Key] = APIKeyBudget{
+			DailyTokens:   budgetConf.DailyTokenBudget,
+			MonthlyTokens: budgetConf.MonthlyTokenBudget,
+		}
+	}
+
+	if len(modelConf.Endpoints) == 0 {
+		return nil, errors.New("no endpoints")
+	}
+	for _, endpointConf := range modelConf.Endpoints {
+		endpointURL, err := url.Parse(endpointConf.URL)
+		if err != nil || endpointURL.Scheme != "https" && endpointURL.Scheme != "http" {
+			return nil, errors.Newf("invalid endpoint url %q", endpointConf.URL)
+		}
+		weight := endpointConf.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		if weight < 0 {
+			return nil, errors.Newf("negative weight for endpoint %s", endpointConf.URL)
+		}
+		spec.Endpoints = append(spec.Endpoints, ModelEndpoint{
+			URL:    endpointConf.URL,
+			Region: endpointConf.Region,
+			Weight: weight,
+		})
+	}
+	return spec, nil
+}
+
+// ModelSpecFor looks up a model in the registry.
+func ModelSpecFor(modelName ModelName) (*ModelSpec, error) {
+	for _, spec := range modelRegistry {
+		if spec.Name == modelName {
+			return spec, nil
+		}
+	}
+	return nil, errors.Newf("unknown model %s", modelName)
+}
+
+// PickEndpoint chooses one of the endpoints at random, by weight. Endpoints in tried are only picked once every
+// endpoint was tried.
+func (m *ModelSpec) PickEndpoint(tried ...string) ModelEndpoint {
+	candidates := slices.DeleteFunc(slices.Clone(m.Endpoints), func(endpoint ModelEndpoint) bool {
+		return slices.Contains(tried, endpoint.URL)
+	})
+	if len(candidates) == 0 {
+		candidates = m.Endpoints
+	}
+	total := 0
+	for _, endpoint := range candidates {
+		total += endpoint.Weight
+	}
+	n := common.RandomInt(total)
+	for _, endpoint := range candidates {
+		if n < endpoint.Weight {
+			return endpoint
+		}
+		n -= endpoint.Weight
+	}
+	panic("unreachable")
+}
+
+// defaultModelSpecs are the models served before the registry was configurable.
+func defaultModelSpecs(legacyAPIKeys map[string][]string) []*ModelSpec {
+	var specs []*ModelSpec
+	add := func(provider, endpointURL, authHeader, transformer string, allowedParams []string,
+		paramRenames map[string]string, modelNames ...ModelName) {
+		for _, modelName := range modelNames {
+			specs = append(specs, &ModelSpec{
+				Name:               modelName,
+				Provider:           provider,
+				Endpoints:          []ModelEndpoint{{URL: endpointURL, Weight: 1}},
+				AuthHeader:         authHeader,
+				APIKeys:            legacyAPIKeys[modelName],
+				RequestTransformer: transformer,
+				Streaming:          true,
+				Vision:             true,
+				AllowedParams:      allowedParams,
+				ParamRenames:       paramRenames,
+				TokenScheme:        TokenSchemeBlindRSA,
+			})
+		}
+	}
+	add(ProviderGemini, "https://generativelanguage.googleapis.com/v1beta/openai/chat/completions",
+		AuthHeaderBearer, RequestTransformerOpenAI, AllChatParams(), nil,
+		ModelGemini25FlashLite, ModelGemini25Flash, ModelGemini25Pro, ModelGemini3Flash, ModelGemini3Pro)
+	add(ProviderOpenAI, "https://llmtoropenai.openai.azure.com/openai/v1/chat/completions",
+		AuthHeaderBearer, RequestTransformerOpenAI, AllChatParams(), nil,
+		ModelChatGPT41, ModelChatGPT41Mini, ModelChatGPT4o)
+	add(ProviderOpenAI, "https://llmtoropenai.openai.azure.com/openai/v1/chat/completions",
+		AuthHeaderBearer, RequestTransformerOpenAI, reasoningChatParams(),
+		map[string]string{ParamMaxTokens: ParamMaxCompletionTokens}, ModelChatGPTo1)
+	add(ProviderAnthropic, "https://api.anthropic.com/v1/messages",
+		AuthHeaderXAPIKey, RequestTransformerAnthropic, anthropicChatParams(), nil,
+		ModelClaudeSonnet45, ModelClaudeHaiku45, ModelClaudeOpus41)
+	return specs
+}
@@ -0,0 +1,65 @@
+package confs
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/common"
+	"testing"
+)
+
+func TestInitModelRegistry(t *testing.T) {
+	t.Cleanup(func() { modelRegistry = defaultModelSpecs(nil) })
+
+	assert.Nil(t, InitModelRegistry(nil, map[string][]string{ModelClaudeHaiku45: {"legacy"}}))
+	assert.Contains(t, AllModels(), ModelGemini25Pro)
+	spec, err := ModelSpecFor(ModelClaudeHaiku45)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"legacy"}, spec.APIKeys)
+	assert.Equal(t, RequestTransformerAnthropic, spec.RequestTransformer)
+
+	err = InitModelRegistry([]common.ModelConfig{
+		{
+			Name:     "llama",
+			Provider: ProviderOpenAI,
+			Endpoints: []common.ModelEndpointConfig{
+				{URL: "https://eu.example.com/v1/chat/completions", Region: "eu", Weight: 3},
+				{URL: "https://us.example.com/v1/chat/completions", Region: "us"},
+			},
+			APIKeys:              []string{"key"},
+			MaxCreditsPerRequest: 2,
+		},
+		{
+			Name:      "claude",
+			Provider:  ProviderAnthropic,
+			Endpoints: []common.ModelEndpointConfig{{URL: "https://api.anthropic.com/v1/messages"}},
+		},
+	}, map[string][]string{"claude": {"legacy"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []ModelName{"llama", "claude"}, AllModels())
+	_, err = ModelSpecFor(ModelGemini25Pro)
+	assert.NotNil(t, err)
+
+	spec, err = ModelSpecFor("llama")
+	assert.Nil(t, err)
+	assert.Equal(t, AuthHeaderBearer, spec.AuthHeader)
+	assert.Equal(t, 1, spec.Endpoints[1].Weight)
+	assert.Equal(t, TokenSchemeBlindRSA, spec.TokenScheme)
+	assert.Equal(t, 2, MaxCreditsPerRequestForModel(context.Background(), "llama"))
+	assert.Equal(t, MaxCreditsPerRequest(context.Background()), MaxCreditsPerRequestForModel(context.Background(), "claude"))
+	regions := map[string]bool{}
+	for range 100 {
+		regions[spec.PickEndpoint().Region] = true
+	}
+	assert.Equal(t, map[string]bool{"eu": true, "us": true}, regions)
+
+	for _, bad := range []common.ModelConfig{
+		{Name: "x", Provider: "unknown", Endpoints: []common.ModelEndpointConfig{{URL: "https://a"}}, APIKeys: []string{"k"}},
+		{Name: "x", Provider: ProviderOpenAI, APIKeys: []string{"k"}},
+		{Name: "x", Provider: ProviderOpenAI, Endpoints: []common.ModelEndpointConfig{{URL: "https://a"}}},
+		{Name: "x", Provider: ProviderOpenAI, Endpoints: []common.ModelEndpointConfig{{URL: "ftp://a"}}, APIKeys: []string{"k"}},
+		{Name: "x", Provider: ProviderOpenAI, Endpoints: []common.ModelEndpointConfig{{URL: "https://a"}}, APIKeys: []string{"k"}, TokenScheme: "hmac"},
+		{Name: "x", Provider: ProviderOpenAI, Endpoints: []common.ModelEndpointConfig{{URL: "https://a"}}, APIKeys: []string{"k"}, DelayedRedemption: true},
+	} {
+		assert.NotNil(t, InitModelRegistry([]common.ModelConfig{bad}, nil))
+	}
+}
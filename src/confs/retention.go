@@ -0,0 +1,38 @@
+package confs
+
+import (
+	"context"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/common"
+	"time"
+)
+
+const defaultSpentMarkerRetention = 30 * 24 * time.Hour
+
+// retentionConfig is set once at startup by Init, nil means the defaults.
+var retentionConfig *common.RetentionConfig
+
+func InitRetention(conf *common.RetentionConfig) error {
+	if conf != nil && (conf.CachedResponseRetentionHours < 0 || conf.SpentMarkerRetentionHours < 0) {
+		return errors.New("retention can't be negative")
+	}
+	retentionConfig = conf
+	return nil
+}
+
+// CachedResponseRetention is how long after a spent token's ExpiresAt its cached response is kept. By default it's
+// stripped right away, ExpiresAt already leaves clients time to retry.
+func CachedResponseRetention(ctx context.Context) time.Duration {
+	if retentionConfig == nil {
+		return 0
+	}
+	return time.Duration(retentionConfig.CachedResponseRetentionHours) * time.Hour
+}
+
+// SpentMarkerRetention is how long spent markers are kept after their signing key expired or got revoked.
+func SpentMarkerRetention(ctx context.Context) time.Duration {
+	if retentionConfig == nil || retentionConfig.SpentMarkerRetentionHours == 0 {
+		return defaultSpentMarkerRetention
+	}
+	return time.Duration(retentionConfig.SpentMarkerRetentionHours) * time.Hour
+}
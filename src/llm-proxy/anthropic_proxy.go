@@ -0,0 +1,608 @@
+package llm_proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Anthropic doesn't speak the OpenAI chat completions API, so requests are translated into the Messages API, and
+// responses (plain and SSE) back into ChatCompletion JSON. Clients keep sending and reading the OpenAI format.
+
+const (
+	anthropicAPIVersion = "2023-06-01"
+	// max_tokens is mandatory for Anthropic, used when the client didn't ask for a limit.
+	defaultAnthropicMaxTokens = 8192
+)
+
+type openAIChatRequest struct {
+	Model               string              `json:"model"`
+	Messages            []openAIChatMessage `json:"messages"`
+	Stream              bool                `json:"stream"`
+	MaxTokens           *int                `json:"max_tokens"`
+	MaxCompletionTokens *int                `json:"max_completion_tokens"`
+	Temperature         *float64            `json:"temperature"`
+	TopP                *float64            `json:"top_p"`
+	Stop                json.RawMessage     `json:"stop"`
+	Tools               []openAITool        `json:"tools"`
+	ToolChoice          json.RawMessage     `json:"tool_choice"`
+}
+
+type openAIChatMessage struct {
+	Role       string           `json:"role"`
+	Content    json.RawMessage  `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls"`   // assistant only
+	ToolCallID string           `json:"tool_call_id"` // tool only
+}
+
+type openAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters"`
+	} `json:"function"`
+}
+
+// openAIToolCall is a function call of the model, its arguments JSON encoded in a string. Index is only set in
+// stream chunks, which send the arguments in pieces.
+type openAIToolCall struct {
+	Index    *int                   `json:"index,omitempty"`
+	ID       string                 `json:"id,omitempty"`
+	Type     string                 `json:"type,omitempty"`
+	Function openAIToolCallFunction `json:"function"`
+}
+
+type openAIToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+type openAIContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url"`
+}
+
+type anthropicRequest struct {
+	Model         string               `json:"model"`
+	System        string               `json:"system,omitempty"`
+	Messages      []anthropicMessage   `json:"messages"`
+	MaxTokens     int                  `json:"max_tokens"`
+	Stream        bool                 `json:"stream,omitempty"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	TopP          *float64             `json:"top_p,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Tools         []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *anthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type string `json:"type"` // auto, any, tool or none
+	Name string `json:"name,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []anthropicContentBlock `json:"content"`
+}
+
+type anthropicContentBlock struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *anthropicImageSource `json:"source,omitempty"`
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// tool_result
+	ToolUseID string                  `json:"tool_use_id,omitempty"`
+	Content   []anthropicContentBlock `json:"content,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"` // base64 or url
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type anthropicResponse struct {
+	ID         string `json:"id"`
+	Model      string `json:"model"`
+	StopReason string `json:"stop_reason"`
+	Content    []struct {
+		Type  string          `json:"type"`
+		Text  string          `json:"text"`
+		ID    string          `json:"id"`
+		Name  string          `json:"name"`
+		Input json.RawMessage `json:"input"`
+	} `json:"content"`
+	Usage anthropicUsage `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type anthropicStreamEvent struct {
+	Type         string             `json:"type"`
+	Message      *anthropicResponse `json:"message"`
+	Index        int                `json:"index"`
+	ContentBlock *struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"content_block"`
+	Delta struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage"`
+	Error *anthropicError `json:"error"`
+}
+
+type openAIChatCompletion struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []openAIChatChoice `json:"choices"`
+	Usage   *openAIUsage       `json:"usage,omitempty"`
+}
+
+type openAIChatChoice struct {
+	Index        int            `json:"index"`
+	Message      *openAIRespMsg `json:"message,omitempty"`
+	Delta        map[string]any `json:"delta,omitempty"`
+	FinishReason *string        `json:"finish_reason"`
+}
+
+type openAIRespMsg struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// openAIToAnthropicRequest translates an OpenAI chat completions body into an Anthropic Messages one.
+// System and developer messages become the top level system prompt. Tool calls become tool_use blocks of the assistant
+// message, and tool messages tool_result blocks of a user message, those answering the same turn share one.
+func openAIToAnthropicRequest(proxyReqBody []byte) ([]byte, error) {
+	openAIReq := &openAIChatRequest{}
+	err := json.Unmarshal(proxyReqBody, openAIReq)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse chat request")
+	}
+
+	anthropicReq := &anthropicRequest{
+		Model:       openAIReq.Model,
+		MaxTokens:   defaultAnthropicMaxTokens,
+		Stream:      openAIReq.Stream,
+		Temperature: openAIReq.Temperature,
+		TopP:        openAIReq.TopP,
+	}
+	if openAIReq.MaxCompletionTokens != nil {
+		anthropicReq.MaxTokens = *openAIReq.MaxCompletionTokens
+	} else if openAIReq.MaxTokens != nil {
+		anthropicReq.MaxTokens = *openAIReq.MaxTokens
+	}
+	if len(openAIReq.Stop) > 0 {
+		var stop string
+		if json.Unmarshal(openAIReq.Stop, &stop) == nil {
+			anthropicReq.StopSequences = []string{stop}
+		} else if err := json.Unmarshal(openAIReq.Stop, &anthropicReq.StopSequences); err != nil {
+			return nil, errors.Wrapf(err, "invalid stop")
+		}
+	}
+	for _, tool := range openAIReq.Tools {
+		inputSchema := tool.Function.Parameters
+		if len(inputSchema) == 0 {
+			// Anthropic requires a schema, OpenAI takes none for functions without parameters.
+			inputSchema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		anthropicReq.Tools = append(anthropicReq.Tools, anthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: inputSchema,
+		})
+	}
+	if len(openAIReq.ToolChoice) > 0 {
+		anthropicReq.ToolChoice, err = openAIToolChoiceToAnthropic(openAIReq.ToolChoice)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var systemPrompts []string
+	for _, msg := range openAIReq.Messages {
+		blocks, err := openAIContentToAnthropic(msg.Content)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Role {
+		case "system", "developer":
+			for _, block := range blocks {
+				if block.Type != "text" {
+					return nil, errors.New("only text is supported in system messages")
+				}
+				systemPrompts = append(systemPrompts, block.Text)
+			}
+		case "user":
+			anthropicReq.Messages = append(anthropicReq.Messages, anthropicMessage{
+				Role:    msg.Role,
+				Content: blocks,
+			})
+		case "assistant":
+			for _, toolCall := range msg.ToolCalls {
+				input := json.RawMessage(toolCall.Function.Arguments)
+				if len(input) == 0 {
+					input = json.RawMessage(`{}`)
+				}
+				if !json.Valid(input) {
+					return nil, errors.Newf("invalid arguments of tool call %s", toolCall.ID)
+				}
+				blocks = append(blocks, anthropicContentBlock{
+					Type:  "tool_use",
+					ID:    toolCall.ID,
+					Name:  toolCall.Function.Name,
+					Input: input,
+				})
+			}
+			anthropicReq.Messages = append(anthropicReq.Messages, anthropicMessage{
+				Role:    msg.Role,
+				Content: blocks,
+			})
+		case "tool":
+			if msg.ToolCallID == "" {
+				return nil, errors.New("tool message without tool_call_id")
+			}
+			toolResult := anthropicContentBlock{
+				Type:      "tool_result",
+				ToolUseID: msg.ToolCallID,
+				Content:   blocks,
+			}
+			if last := len(anthropicReq.Messages) - 1; last >= 0 && isAnthropicToolResults(anthropicReq.Messages[last]) {
+				anthropicReq.Messages[last].Content = append(anthropicReq.Messages[last].Content, toolResult)
+				continue
+			}
+			anthropicReq.Messages = append(anthropicReq.Messages, anthropicMessage{
+				Role:    "user",
+				Content: []anthropicContentBlock{toolResult},
+			})
+		default:
+			return nil, errors.Newf("unsupported message role %s", msg.Role)
+		}
+	}
+	if len(anthropicReq.Messages) == 0 {
+		return nil, errors.New("no user or assistant messages")
+	}
+	anthropicReq.System = strings.Join(systemPrompts, "\n\n")
+
+	return json.Marshal(anthropicReq)
+}
+
+// isAnthropicToolResults tells if the message only carries tool results, further ones for the same turn go with them.
+func isAnthropicToolResults(msg anthropicMessage) bool {
+	if msg.Role != "user" || len(msg.Content) == 0 {
+		return false
+	}
+	for _, block := range msg.Content {
+		if block.Type != "tool_result" {
+			return false
+		}
+	}
+	return true
+}
+
+// openAIToolChoiceToAnthropic maps none, auto, required and {"type": "function", "function": {"name": ...}}.
+func openAIToolChoiceToAnthropic(toolChoice json.RawMessage) (*anthropicToolChoice, error) {
+	var choice string
+	if json.Unmarshal(toolChoice, &choice) == nil {
+		switch choice {
+		case "none", "auto":
+			return &anthropicToolChoice{Type: choice}, nil
+		case "required":
+			return &anthropicToolChoice{Type: "any"}, nil
+		default:
+			return nil, errors.Newf("unsupported tool_choice %s", choice)
+		}
+	}
+	functionRef := &struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}{}
+	err := json.Unmarshal(toolChoice, functionRef)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid tool_choice")
+	}
+	return &anthropicToolChoice{Type: "tool", Name: functionRef.Function.Name}, nil
+}
+
+// openAIContentToAnthropic handles both the plain string and the array of parts forms of message content. Missing or
+// empty content, as in assistant messages with only tool calls, has no blocks, Anthropic rejects empty text blocks.
+func openAIContentToAnthropic(content json.RawMessage) ([]anthropicContentBlock, error) {
+	if len(content) == 0 || string(content) == "null" {
+		return nil, nil
+	}
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		if text == "" {
+			return nil, nil
+		}
+		return []anthropicContentBlock{{Type: "text", Text: text}}, nil
+	}
+
+	var parts []openAIContentPart
+	err := json.Unmarshal(content, &parts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid message content")
+	}
+	var blocks []anthropicContentBlock
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			blocks = append(blocks, anthropicContentBlock{Type: "text", Text: part.Text})
+		case "image_url":
+			if part.ImageURL == nil {
+				return nil, errors.New("image_url part without url")
+			}
+			source, err := anthropicImageSourceFromURL(part.ImageURL.URL)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, anthropicContentBlock{Type: "image", Source: source})
+		default:
+			return nil, errors.Newf("unsupported content part type %s", part.Type)
+		}
+	}
+	return blocks, nil
+}
+
+// anthropicImageSourceFromURL maps `data:<media type>;base64,<data>` urls to inline images, the rest are fetched by
+// Anthropic.
+func anthropicImageSourceFromURL(imageURL string) (*anthropicImageSource, error) {
+	dataURL, ok := strings.CutPrefix(imageURL, "data:")
+	if !ok {
+		return &anthropicImageSource{Type: "url", URL: imageURL}, nil
+	}
+	mediaType, data, ok := strings.Cut(dataURL, ";base64,")
+	if !ok {
+		return nil, errors.New("only base64 data urls are supported for images")
+	}
+	return &anthropicImageSource{Type: "base64", MediaType: mediaType, Data: data}, nil
+}
+
+func anthropicStopReasonToOpenAI(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// anthropicToOpenAIResponse translates a Messages API response body, or error body, into the OpenAI format.
+func anthropicToOpenAIResponse(statusCode int, body []byte) ([]byte, error) {
+	if statusCode != http.StatusOK {
+		errResp := &struct {
+			Error *anthropicError `json:"error"`
+		}{}
+		if json.Unmarshal(body, errResp) != nil || errResp.Error == nil {
+			return body, nil
+		}
+		return json.Marshal(map[string]any{
+			"error": map[string]any{
+				"message": errResp.Error.Message,
+				"type":    errResp.Error.Type,
+				"code":    nil,
+			},
+		})
+	}
+
+	anthropicResp := &anthropicResponse{}
+	err := json.Unmarshal(body, anthropicResp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse anthropic response")
+	}
+	text := &strings.Builder{}
+	var toolCalls []openAIToolCall
+	for _, block := range anthropicResp.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			arguments := &bytes.Buffer{}
+			err = json.Compact(arguments, block.Input)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid input of tool use %s", block.ID)
+			}
+			toolCalls = append(toolCalls, openAIToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: openAIToolCallFunction{Name: block.Name, Arguments: arguments.String()},
+			})
+		}
+	}
+	finishReason := anthropicStopReasonToOpenAI(anthropicResp.StopReason)
+	return json.Marshal(&openAIChatCompletion{
+		ID:      anthropicResp.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   anthropicResp.Model,
+		Choices: []openAIChatChoice{{
+			Message:      &openAIRespMsg{Role: "assistant", Content: text.String(), ToolCalls: toolCalls},
+			FinishReason: &finishReason,
+		}},
+		Usage: &openAIUsage{
+			PromptTokens:     anthropicResp.Usage.InputTokens,
+			CompletionTokens: anthropicResp.Usage.OutputTokens,
+			TotalTokens:      anthropicResp.Usage.InputTokens + anthropicResp.Usage.OutputTokens,
+		},
+	})
+}
+
+// anthropicSSEReader turns an Anthropic Messages event stream into OpenAI chat.completion.chunk events.
+type anthropicSSEReader struct {
+	*io.PipeReader
+	upstream io.Closer
+}
+
+func newAnthropicSSEReader(upstream io.ReadCloser) *anthropicSSEReader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(translateAnthropicSSE(upstream, pw))
+	}()
+	return &anthropicSSEReader{PipeReader: pr, upstream: upstream}
+}
+
+func (r *anthropicSSEReader) Close() error {
+	_ = r.PipeReader.Close()
+	return r.upstream.Close()
+}
+
+func translateAnthropicSSE(upstream io.Reader, w io.Writer) error {
+	chunk := &openAIChatCompletion{Object: "chat.completion.chunk", Created: time.Now().Unix()}
+	inputTokens := 0
+	// OpenAI numbers tool calls, Anthropic content blocks, text ones included.
+	toolCallIndexes := map[int]int{}
+	writeChunk := func(choice openAIChatChoice, usage *openAIUsage) error {
+		chunk.Choices = []openAIChatChoice{choice}
+		chunk.Usage = usage
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		return err
+	}
+
+	reader := bufio.NewReader(upstream)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		data, isData := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+		if isData {
+			event := &anthropicStreamEvent{}
+			err := json.Unmarshal(bytes.TrimSpace(data), event)
+			if err != nil {
+				return errors.Wrapf(err, "failed to parse anthropic stream event")
+			}
+			switch event.Type {
+			case "message_start":
+				if event.Message != nil {
+					chunk.ID = event.Message.ID
+					chunk.Model = event.Message.Model
+					inputTokens = event.Message.Usage.InputTokens
+				}
+				err = writeChunk(openAIChatChoice{Delta: map[string]any{"role": "assistant", "content": ""}}, nil)
+			case "content_block_start":
+				if event.ContentBlock != nil && event.ContentBlock.Type == "tool_use" {
+					toolCallIndex := len(toolCallIndexes)
+					toolCallIndexes[event.Index] = toolCallIndex
+					err = writeChunk(openAIChatChoice{Delta: map[string]any{"tool_calls": []openAIToolCall{{
+						Index:    &toolCallIndex,
+						ID:       event.ContentBlock.ID,
+						Type:     "function",
+						Function: openAIToolCallFunction{Name: event.ContentBlock.Name},
+					}}}}, nil)
+				}
+			case "content_block_delta":
+				switch event.Delta.Type {
+				case "text_delta":
+					err = writeChunk(openAIChatChoice{Delta: map[string]any{"content": event.Delta.Text}}, nil)
+				case "input_json_delta":
+					toolCallIndex, ok := toolCallIndexes[event.Index]
+					if !ok {
+						return errors.Newf("input_json_delta for content block %d that isn't a tool call", event.Index)
+					}
+					err = writeChunk(openAIChatChoice{Delta: map[string]any{"tool_calls": []openAIToolCall{{
+						Index:    &toolCallIndex,
+						Function: openAIToolCallFunction{Arguments: event.Delta.PartialJSON},
+					}}}}, nil)
+				}
+			case "message_delta":
+				finishReason := anthropicStopReasonToOpenAI(event.Delta.StopReason)
+				var usage *openAIUsage
+				if event.Usage != nil {
+					usage = &openAIUsage{
+						PromptTokens:     inputTokens,
+						CompletionTokens: event.Usage.OutputTokens,
+						TotalTokens:      inputTokens + event.Usage.OutputTokens,
+					}
+				}
+				err = writeChunk(openAIChatChoice{Delta: map[string]any{}, FinishReason: &finishReason}, usage)
+			case "message_stop":
+				_, err = io.WriteString(w, "data: [DONE]\n\n")
+			case "error":
+				var errData []byte
+				errData, err = json.Marshal(map[string]any{"error": event.Error})
+				if err == nil {
+					_, err = fmt.Fprintf(w, "data: %s\n\n", errData)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// transformAnthropicResp swaps the upstream body for its OpenAI format translation.
+func transformAnthropicResp(proxyResp *http.Response, isStream bool) (*http.Response, error) {
+	if isStream && proxyResp.StatusCode == http.StatusOK {
+		proxyResp.Body = newAnthropicSSEReader(proxyResp.Body)
+		return proxyResp, nil
+	}
+	body, err := io.ReadAll(proxyResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = proxyResp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body, err = anthropicToOpenAIResponse(proxyResp.StatusCode, body)
+	if err != nil {
+		return nil, err
+	}
+	proxyResp.Body = io.NopCloser(bytes.NewReader(body))
+	return proxyResp, nil
+}
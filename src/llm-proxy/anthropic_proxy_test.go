@@ -0,0 +1,206 @@
+package llm_proxy
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIToAnthropicRequest(t *testing.T) {
+	body, err := openAIToAnthropicRequest([]byte(`{
+		"model": "claude-sonnet-4-5",
+		"stream": true,
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": [
+				{"type": "text", "text": "What is this?"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,aGk="}}
+			]},
+			{"role": "assistant", "content": "A cat."}
+		]
+	}`))
+	assert.Nil(t, err)
+
+	anthropicReq := &anthropicRequest{}
+	assert.Nil(t, json.Unmarshal(body, anthropicReq))
+	assert.Equal(t, "claude-sonnet-4-5", anthropicReq.Model)
+	assert.Equal(t, "Be brief.", anthropicReq.System)
+	assert.Equal(t, defaultAnthropicMaxTokens, anthropicReq.MaxTokens)
+	assert.True(t, anthropicReq.Stream)
+	assert.Len(t, anthropicReq.Messages, 2)
+	assert.Equal(t, "image", anthropicReq.Messages[0].Content[1].Type)
+	assert.Equal(t, &anthropicImageSource{Type: "base64", MediaType: "image/png", Data: "aGk="}, anthropicReq.Messages[0].Content[1].Source)
+	assert.Equal(t, "A cat.", anthropicReq.Messages[1].Content[0].Text)
+
+	_, err = openAIToAnthropicRequest([]byte(`{"model": "claude-sonnet-4-5", "messages": [{"role": "system", "content": "hi"}]}`))
+	assert.NotNil(t, err)
+}
+
+func TestOpenAIToAnthropicRequestWithTools(t *testing.T) {
+	body, err := openAIToAnthropicRequest([]byte(`{
+		"model": "claude-sonnet-4-5",
+		"tools": [
+			{"type": "function", "function": {"name": "weather", "description": "Weather of a city",
+				"parameters": {"type": "object", "properties": {"city": {"type": "string"}}}}},
+			{"type": "function", "function": {"name": "time"}}
+		],
+		"tool_choice": "required",
+		"messages": [
+			{"role": "user", "content": "Weather and time in Paris?"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "weather", "arguments": "{\"city\":\"Paris\"}"}},
+				{"id": "call_2", "type": "function", "function": {"name": "time", "arguments": ""}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "Sunny"},
+			{"role": "tool", "tool_call_id": "call_2", "content": [{"type": "text", "text": "Noon"}]},
+			{"role": "assistant", "content": "Sunny, at noon."}
+		]
+	}`))
+	assert.Nil(t, err)
+
+	anthropicReq := &anthropicRequest{}
+	assert.Nil(t, json.Unmarshal(body, anthropicReq))
+	assert.Equal(t, &anthropicToolChoice{Type: "any"}, anthropicReq.ToolChoice)
+	assert.Len(t, anthropicReq.Tools, 2)
+	assert.Equal(t, "Weather of a city", anthropicReq.Tools[0].Description)
+	assert.JSONEq(t, `{"type":"object","properties":{}}`, string(anthropicReq.Tools[1].InputSchema))
+
+	assert.Len(t, anthropicReq.Messages, 4)
+	toolUses := anthropicReq.Messages[1].Content
+	assert.Equal(t, "assistant", anthropicReq.Messages[1].Role)
+	assert.Len(t, toolUses, 2)
+	assert.Equal(t, "tool_use", toolUses[0].Type)
+	assert.Equal(t, "call_1", toolUses[0].ID)
+	assert.Equal(t, "weather", toolUses[0].Name)
+	assert.JSONEq(t, `{"city":"Paris"}`, string(toolUses[0].Input))
+	assert.JSONEq(t, `{}`, string(toolUses[1].Input))
+	// Results of the same turn share a user message.
+	assert.Equal(t, anthropicMessage{Role: "user", Content: []anthropicContentBlock{
+		{Type: "tool_result", ToolUseID: "call_1", Content: []anthropicContentBlock{{Type: "text", Text: "Sunny"}}},
+		{Type: "tool_result", ToolUseID: "call_2", Content: []anthropicContentBlock{{Type: "text", Text: "Noon"}}},
+	}}, anthropicReq.Messages[2])
+	assert.Equal(t, "assistant", anthropicReq.Messages[3].Role)
+
+	body, err = openAIToAnthropicRequest([]byte(`{"model": "claude-sonnet-4-5",
+		"tool_choice": {"type": "function", "function": {"name": "weather"}},
+		"messages": [{"role": "user", "content": "hi"}]}`))
+	assert.Nil(t, err)
+	anthropicReq = &anthropicRequest{}
+	assert.Nil(t, json.Unmarshal(body, anthropicReq))
+	assert.Equal(t, &anthropicToolChoice{Type: "tool", Name: "weather"}, anthropicReq.ToolChoice)
+
+	_, err = openAIToAnthropicRequest([]byte(`{"model": "claude-sonnet-4-5", "messages": [{"role": "tool", "content": "hi"}]}`))
+	assert.ErrorContains(t, err, "without tool_call_id")
+}
+
+func TestAnthropicToOpenAIResponse(t *testing.T) {
+	body, err := anthropicToOpenAIResponse(http.StatusOK, []byte(`{
+		"id": "msg_1", "model": "claude-sonnet-4-5", "stop_reason": "max_tokens",
+		"content": [{"type": "text", "text": "Hello"}, {"type": "text", "text": " there"}],
+		"usage": {"input_tokens": 3, "output_tokens": 2}
+	}`))
+	assert.Nil(t, err)
+	resp := &openAIChatCompletion{}
+	assert.Nil(t, json.Unmarshal(body, resp))
+	assert.Equal(t, "chat.completion", resp.Object)
+	assert.Equal(t, "Hello there", resp.Choices[0].Message.Content)
+	assert.Equal(t, "length", *resp.Choices[0].FinishReason)
+	assert.Equal(t, 5, resp.Usage.TotalTokens)
+
+	body, err = anthropicToOpenAIResponse(http.StatusTooManyRequests, []byte(`{"type": "error", "error": {"type": "rate_limit_error", "message": "slow down"}}`))
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"error": {"type": "rate_limit_error", "message": "slow down", "code": null}}`, string(body))
+
+	body, err = anthropicToOpenAIResponse(http.StatusOK, []byte(`{
+		"id": "msg_2", "model": "claude-sonnet-4-5", "stop_reason": "tool_use",
+		"content": [{"type": "tool_use", "id": "toolu_1", "name": "weather", "input": {"city": "Paris"}}],
+		"usage": {"input_tokens": 3, "output_tokens": 2}
+	}`))
+	assert.Nil(t, err)
+	resp = &openAIChatCompletion{}
+	assert.Nil(t, json.Unmarshal(body, resp))
+	assert.Equal(t, "tool_calls", *resp.Choices[0].FinishReason)
+	assert.Equal(t, []openAIToolCall{{
+		ID:       "toolu_1",
+		Type:     "function",
+		Function: openAIToolCallFunction{Name: "weather", Arguments: `{"city":"Paris"}`},
+	}}, resp.Choices[0].Message.ToolCalls)
+}
+
+func TestAnthropicSSETranslation(t *testing.T) {
+	upstream := strings.Join([]string{
+		`event: message_start`,
+		`data: {"type":"message_start","message":{"id":"msg_1","model":"claude-haiku-4-5","usage":{"input_tokens":4}}}`,
+		``,
+		`event: ping`,
+		`data: {"type":"ping"}`,
+		``,
+		`event: content_block_delta`,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}`,
+		``,
+		`event: message_delta`,
+		`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":1}}`,
+		``,
+		`event: message_stop`,
+		`data: {"type":"message_stop"}`,
+		``,
+	}, "\n")
+	reader := newAnthropicSSEReader(io.NopCloser(strings.NewReader(upstream)))
+	out, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Close())
+
+	events := strings.Split(strings.TrimSpace(string(out)), "\n\n")
+	assert.Len(t, events, 4)
+	assert.Equal(t, "data: [DONE]", events[3])
+
+	chunk := &openAIChatCompletion{}
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(events[1], "data: ")), chunk))
+	assert.Equal(t, "msg_1", chunk.ID)
+	assert.Equal(t, "chat.completion.chunk", chunk.Object)
+	assert.Equal(t, "Hi", chunk.Choices[0].Delta["content"])
+
+	chunk = &openAIChatCompletion{}
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(events[2], "data: ")), chunk))
+	assert.Equal(t, "stop", *chunk.Choices[0].FinishReason)
+	assert.Equal(t, 5, chunk.Usage.TotalTokens)
+}
+
+func TestAnthropicSSETranslationWithToolCalls(t *testing.T) {
+	upstream := strings.Join([]string{
+		`data: {"type":"message_start","message":{"id":"msg_1","model":"claude-haiku-4-5","usage":{"input_tokens":4}}}`,
+		`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Checking."}}`,
+		`data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"weather","input":{}}}`,
+		`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+		`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}`,
+		`data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":7}}`,
+		`data: {"type":"message_stop"}`,
+	}, "\n\n")
+	out, err := io.ReadAll(newAnthropicSSEReader(io.NopCloser(strings.NewReader(upstream))))
+	assert.Nil(t, err)
+
+	events := strings.Split(strings.TrimSpace(string(out)), "\n\n")
+	assert.Len(t, events, 7)
+	toolCallDeltas := []string{}
+	for _, event := range events[2:5] {
+		chunk := &struct {
+			Choices []struct {
+				Delta struct {
+					ToolCalls json.RawMessage `json:"tool_calls"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}{}
+		assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), chunk))
+		toolCallDeltas = append(toolCallDeltas, string(chunk.Choices[0].Delta.ToolCalls))
+	}
+	// Tool calls are numbered on their own, the text block before doesn't count.
+	assert.JSONEq(t, `[{"index":0,"id":"toolu_1","type":"function","function":{"name":"weather","arguments":""}}]`,
+		toolCallDeltas[0])
+	assert.JSONEq(t, `[{"index":0,"function":{"arguments":"{\"city\":"}}]`, toolCallDeltas[1])
+	assert.JSONEq(t, `[{"index":0,"function":{"arguments":"\"Paris\"}"}}]`, toolCallDeltas[2])
+	assert.Contains(t, events[5], `"finish_reason":"tool_calls"`)
+}
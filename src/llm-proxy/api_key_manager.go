@@ -2,25 +2,403 @@ package llm_proxy
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/cockroachdb/errors"
 	"llmmask/src/common"
 	"llmmask/src/confs"
+	"llmmask/src/models"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// APIKeyManager hands out provider API keys, steering clear of keys that are rate limited, failing or over budget.
+// A key that gets a 429 cools down for the Retry-After the provider asked for. A key failing
+// confs.APIKeyCircuitBreakerThreshold times in a row has its circuit opened, and gets a single trial request once the
+// open period is over, other requests steer clear of it until the trial is reported. Every further failure doubles the
+// open period, up to confs.APIKeyMaxCircuitOpen.
+// Token usage is kept per key and period (see models.APIKeyUsage), a key over its daily or monthly budget is out of
+// rotation until the period ends. Keys shared by models are tracked once.
 type APIKeyManager struct {
-	pool map[confs.ModelName][]common.SecretString
+	sync.Mutex
+	pool map[confs.ModelName][]*APIKey
+	byID map[string]*APIKey
+}
+
+// APIKey is a key from the pool along with its health, report how calls with it went with APIKeyManager.Report.
+type APIKey struct {
+	Secret common.SecretString
+	// ID identifies the key in logs and stats without revealing it.
+	ID string
+
+	cooldownUntil       time.Time
+	consecutiveFailures int
+	circuitOpenFor      time.Duration
+	requests            int
+	failures            int
+	// trialUntil is set while the trial request of a key whose circuit was open is in flight, in case it's never
+	// reported.
+	trialUntil time.Time
+
+	budget confs.APIKeyBudget
+	// pending is the usage of this instance not yet flushed, by models.APIKeyUsage doc ID.
+	pending map[string]*models.APIKeyUsage
+	// flushed is the usage of all instances as of the last flush, by period type.
+	flushed map[string]*models.APIKeyUsage
+}
+
+// APIKeyHealth is a snapshot of a key's health for admin views.
+type APIKeyHealth struct {
+	ModelName           confs.ModelName
+	KeyID               string
+	Available           bool
+	CooldownUntil       time.Time `json:",omitempty"`
+	ConsecutiveFailures int
+	Requests            int
+	Failures            int
+	OverBudget          bool
+	DailyTokens         int64
+	DailyTokenBudget    int64 `json:",omitempty"`
+	MonthlyTokens       int64
+	MonthlyTokenBudget  int64 `json:",omitempty"`
 }
 
 func NewAPIKeyManager(pool map[confs.ModelName][]common.SecretString) *APIKeyManager {
-	return &APIKeyManager{
-		pool: pool,
+	res := &APIKeyManager{
+		pool: map[confs.ModelName][]*APIKey{},
+		byID: map[string]*APIKey{},
+	}
+	for modelName, secrets := range pool {
+		for _, secret := range secrets {
+			keyID := apiKeyID(secret)
+			key, ok := res.byID[keyID]
+			if !ok {
+				key = &APIKey{
+					Secret:  secret,
+					ID:      keyID,
+					pending: map[string]*models.APIKeyUsage{},
+					flushed: map[string]*models.APIKeyUsage{},
+				}
+				res.byID[keyID] = key
+			}
+			res.pool[modelName] = append(res.pool[modelName], key)
+		}
+	}
+	return res
+}
+
+func apiKeyID(secret common.SecretString) string {
+	hash := sha256.Sum256([]byte(secret.UnsafeString()))
+	return hex.EncodeToString(hash[:6])
+}
+
+// NewAPIKeyManagerFromRegistry uses the api key pool of every model in the registry.
+func NewAPIKeyManagerFromRegistry() (*APIKeyManager, error) {
+	pool := map[confs.ModelName][]common.SecretString{}
+	for _, modelName := range confs.AllModels() {
+		spec, err := confs.ModelSpecFor(modelName)
+		if err != nil {
+			return nil, err
+		}
+		pool[modelName] = common.Map(spec.APIKeys, common.NewSecretString)
 	}
+	res := NewAPIKeyManager(pool)
+	for _, modelName := range confs.AllModels() {
+		spec := common.Must(confs.ModelSpecFor(modelName))
+		for key, budget := range spec.APIKeyBudgets {
+			res.byID[apiKeyID(common.NewSecretString(key))].budget = budget
+		}
+	}
+	return res, nil
 }
 
-func (a *APIKeyManager) GetAPIKeyForModel(ctx context.Context, modelName confs.ModelName) (common.SecretString, error) {
+// GetAPIKeyForModel picks a random available key, preferring ones not in tried. When every key is cooling down, the
+// one available soonest is used rather than failing the request outright.
+func (a *APIKeyManager) GetAPIKeyForModel(ctx context.Context, modelName confs.ModelName, tried ...*APIKey) (*APIKey, error) {
+	a.Lock()
+	defer a.Unlock()
 	keys, ok := a.pool[modelName]
-	if !ok {
+	if !ok || len(keys) == 0 {
 		return nil, errors.Newf("no api keys for model %s", modelName)
 	}
-	return common.RandomChoose(keys...), nil
+
+	now := time.Now()
+	var available, untried []*APIKey
+	var soonest *APIKey
+	for _, key := range keys {
+		if key.overBudget(now) || key.trialUntil.After(now) {
+			continue
+		}
+		if soonest == nil || key.cooldownUntil.Before(soonest.cooldownUntil) {
+			soonest = key
+		}
+		if key.cooldownUntil.After(now) {
+			continue
+		}
+		available = append(available, key)
+		if !containsKey(tried, key) {
+			untried = append(untried, key)
+		}
+	}
+	var key *APIKey
+	switch {
+	case len(untried) > 0:
+		key = common.RandomChoose(untried...)
+	case len(available) > 0:
+		key = common.RandomChoose(available...)
+	case soonest != nil:
+		key = soonest
+	default:
+		return nil, errors.Newf("all api keys for model %s are over budget or on trial", modelName)
+	}
+	if key.circuitOpenFor > 0 && !key.cooldownUntil.After(now) {
+		key.trialUntil = now.Add(confs.UpstreamRequestTimeout(ctx))
+	}
+	return key, nil
+}
+
+// usedTokens is the usage of all instances in the current period, as far as this instance knows.
+func (k *APIKey) usedTokens(periodType string, now time.Time) int64 {
+	period := models.APIKeyUsagePeriod(periodType, now)
+	var res int64
+	if flushed := k.flushed[periodType]; flushed != nil && flushed.Period == period {
+		res += flushed.TotalTokens()
+	}
+	if pending := k.pending[models.DocIDForAPIKeyUsage(k.ID, period)]; pending != nil {
+		res += pending.TotalTokens()
+	}
+	return res
+}
+
+func (k *APIKey) overBudget(now time.Time) bool {
+	if k.budget.DailyTokens > 0 && k.usedTokens(models.APIKeyUsageDaily, now) >= k.budget.DailyTokens {
+		return true
+	}
+	return k.budget.MonthlyTokens > 0 && k.usedTokens(models.APIKeyUsageMonthly, now) >= k.budget.MonthlyTokens
+}
+
+// RecordUsage adds the tokens of a completed upstream call to the key's usage.
+func (a *APIKeyManager) RecordUsage(ctx context.Context, key *APIKey, promptTokens, completionTokens int64) {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now().UTC()
+	for _, periodType := range []string{models.APIKeyUsageDaily, models.APIKeyUsageMonthly} {
+		period := models.APIKeyUsagePeriod(periodType, now)
+		docID := models.DocIDForAPIKeyUsage(key.ID, period)
+		pending, ok := key.pending[docID]
+		if !ok {
+			pending = &models.APIKeyUsage{
+				DocID:      docID,
+				KeyID:      key.ID,
+				PeriodType: periodType,
+				Period:     period,
+			}
+			key.pending[docID] = pending
+		}
+		pending.PromptTokens += promptTokens
+		pending.CompletionTokens += completionTokens
+		pending.Requests++
+	}
+}
+
+// FlushUsage adds the pending usage of this instance to the stored totals, and loads the current totals of all
+// instances for the budget checks. Usage that fails to be stored stays pending for the next flush.
+func (a *APIKeyManager) FlushUsage(ctx context.Context, dbHandler models.DBHandler) error {
+	a.Lock()
+	pendingPerKey := map[*APIKey]map[string]*models.APIKeyUsage{}
+	for _, key := range a.byID {
+		pendingPerKey[key] = key.pending
+		key.pending = map[string]*models.APIKeyUsage{}
+	}
+	a.Unlock()
+
+	now := time.Now().UTC()
+	var errs error
+	for key, pending := range pendingPerKey {
+		docIDs := map[string]*models.APIKeyUsage{}
+		for _, periodType := range []string{models.APIKeyUsageDaily, models.APIKeyUsageMonthly} {
+			period := models.APIKeyUsagePeriod(periodType, now)
+			docIDs[models.DocIDForAPIKeyUsage(key.ID, period)] = &models.APIKeyUsage{
+				KeyID:      key.ID,
+				PeriodType: periodType,
+				Period:     period,
+			}
+		}
+		for docID, usage := range pending {
+			docIDs[docID] = usage
+		}
+
+		for docID, template := range docIDs {
+			usage, err := a.flushUsageDoc(ctx, dbHandler, docID, template, pending[docID])
+			if err != nil {
+				errs = errors.CombineErrors(errs, err)
+				if delta := pending[docID]; delta != nil {
+					a.Lock()
+					a.addPending(key, delta)
+					a.Unlock()
+				}
+				continue
+			}
+			if usage.Period == models.APIKeyUsagePeriod(usage.PeriodType, now) {
+				a.Lock()
+				key.flushed[usage.PeriodType] = usage
+				a.Unlock()
+			}
+		}
+	}
+	return errs
+}
+
+// flushUsageDoc adds delta to the usage doc, with a create or an ETag checked replace so that concurrent flushes of
+// other instances aren't overwritten. Losing to one of them rereads the doc and tries again.
+func (a *APIKeyManager) flushUsageDoc(ctx context.Context, dbHandler models.DBHandler, docID string,
+	template *models.APIKeyUsage, delta *models.APIKeyUsage) (*models.APIKeyUsage, error) {
+	var err error
+	for range confs.APIKeyUsageFlushAttempts(ctx) {
+		usage := &models.APIKeyUsage{DocID: docID}
+		err = dbHandler.Fetch(ctx, usage)
+		if err != nil && !models.IsNotFoundErr(err) {
+			return nil, err
+		}
+		found := err == nil
+		if !found {
+			usage = &models.APIKeyUsage{
+				DocID:      docID,
+				KeyID:      template.KeyID,
+				PeriodType: template.PeriodType,
+				Period:     template.Period,
+			}
+		}
+		if delta == nil {
+			return usage, nil
+		}
+		usage.PromptTokens += delta.PromptTokens
+		usage.CompletionTokens += delta.CompletionTokens
+		usage.Requests += delta.Requests
+		usage.UpdatedAt = time.Now().UTC()
+		if found {
+			err = dbHandler.Replace(ctx, usage)
+		} else {
+			err = dbHandler.Create(ctx, usage)
+		}
+		if err == nil {
+			return usage, nil
+		}
+		if !models.IsConflictErr(err) {
+			return nil, err
+		}
+	}
+	return nil, errors.Wrapf(err, "usage doc %s kept changing", docID)
+}
+
+func (a *APIKeyManager) addPending(key *APIKey, delta *models.APIKeyUsage) {
+	pending, ok := key.pending[delta.DocID]
+	if !ok {
+		key.pending[delta.DocID] = delta
+		return
+	}
+	pending.PromptTokens += delta.PromptTokens
+	pending.CompletionTokens += delta.CompletionTokens
+	pending.Requests += delta.Requests
+}
+
+func containsKey(keys []*APIKey, key *APIKey) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Report records the outcome of a call made with key, resp is nil when the call failed without a response.
+func (a *APIKeyManager) Report(ctx context.Context, key *APIKey, resp *http.Response) {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	key.requests++
+	key.trialUntil = time.Time{}
+	if resp != nil && !IsRetryableUpstreamStatus(resp.StatusCode) {
+		key.consecutiveFailures = 0
+		key.circuitOpenFor = 0
+		return
+	}
+
+	key.failures++
+	key.consecutiveFailures++
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		cooldown := retryAfter(resp, confs.APIKeyRateLimitCooldown(ctx))
+		key.cooldownUntil = maxTime(key.cooldownUntil, now.Add(cooldown))
+		return
+	}
+	if key.consecutiveFailures >= confs.APIKeyCircuitBreakerThreshold(ctx) {
+		key.circuitOpenFor = min(max(2*key.circuitOpenFor, confs.APIKeyCircuitOpen(ctx)), confs.APIKeyMaxCircuitOpen(ctx))
+		key.cooldownUntil = maxTime(key.cooldownUntil, now.Add(key.circuitOpenFor))
+	}
+}
+
+// Health lists the state of every key in the pool.
+func (a *APIKeyManager) Health() []APIKeyHealth {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	var res []APIKeyHealth
+	for _, modelName := range slices.Sorted(maps.Keys(a.pool)) {
+		for _, key := range a.pool[modelName] {
+			health := APIKeyHealth{
+				ModelName:           modelName,
+				KeyID:               key.ID,
+				Available:           !key.cooldownUntil.After(now) && !key.trialUntil.After(now) && !key.overBudget(now),
+				ConsecutiveFailures: key.consecutiveFailures,
+				Requests:            key.requests,
+				Failures:            key.failures,
+				OverBudget:          key.overBudget(now),
+				DailyTokens:         key.usedTokens(models.APIKeyUsageDaily, now),
+				DailyTokenBudget:    key.budget.DailyTokens,
+				MonthlyTokens:       key.usedTokens(models.APIKeyUsageMonthly, now),
+				MonthlyTokenBudget:  key.budget.MonthlyTokens,
+			}
+			if !health.Available {
+				health.CooldownUntil = key.cooldownUntil
+			}
+			res = append(res, health)
+		}
+	}
+	return res
+}
+
+// IsRetryableUpstreamStatus tells if the status points at the key or the provider rather than the request, so the
+// request is worth retrying elsewhere and mustn't be charged for.
+func IsRetryableUpstreamStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return statusCode >= 500
+}
+
+// retryAfter reads the Retry-After header, in seconds or as a date.
+func retryAfter(resp *http.Response, fallback time.Duration) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return fallback
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return fallback
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
 }
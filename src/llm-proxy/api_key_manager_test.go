@@ -0,0 +1,225 @@
+package llm_proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyManagerCooldowns(t *testing.T) {
+	ctx := context.Background()
+	manager := NewAPIKeyManager(map[confs.ModelName][]common.SecretString{
+		"m": {common.NewSecretString("a"), common.NewSecretString("b")},
+	})
+	_, err := manager.GetAPIKeyForModel(ctx, "other")
+	assert.NotNil(t, err)
+
+	keyA := manager.pool["m"][0]
+	keyB := manager.pool["m"][1]
+	rateLimited := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"60"}}}
+	manager.Report(ctx, keyA, rateLimited)
+	for range 10 {
+		key, err := manager.GetAPIKeyForModel(ctx, "m")
+		assert.Nil(t, err)
+		assert.Equal(t, keyB, key)
+	}
+
+	// B's circuit opens after enough failures in a row. It's closed again before A's rate limit is over, so with
+	// nothing available B is the one used.
+	for range confs.APIKeyCircuitBreakerThreshold(ctx) {
+		manager.Report(ctx, keyB, nil)
+	}
+	key, err := manager.GetAPIKeyForModel(ctx, "m")
+	assert.Nil(t, err)
+	assert.Equal(t, keyB, key)
+	for _, health := range manager.Health() {
+		assert.False(t, health.Available)
+	}
+}
+
+func TestAPIKeyManagerCircuitTrial(t *testing.T) {
+	ctx := context.Background()
+	manager := NewAPIKeyManager(map[confs.ModelName][]common.SecretString{"m": {common.NewSecretString("a")}})
+	key := manager.pool["m"][0]
+	for range confs.APIKeyCircuitBreakerThreshold(ctx) {
+		manager.Report(ctx, key, nil)
+	}
+	openFor := key.circuitOpenFor
+	key.cooldownUntil = time.Now().Add(-time.Second)
+
+	// Once the circuit's open period is over, a single request tries the key.
+	trial, err := manager.GetAPIKeyForModel(ctx, "m")
+	assert.Nil(t, err)
+	assert.Equal(t, key, trial)
+	_, err = manager.GetAPIKeyForModel(ctx, "m")
+	assert.NotNil(t, err)
+	assert.False(t, manager.Health()[0].Available)
+
+	// A failed trial opens the circuit for longer.
+	manager.Report(ctx, key, nil)
+	assert.Equal(t, 2*openFor, key.circuitOpenFor)
+	key.cooldownUntil = time.Now().Add(-time.Second)
+	_, err = manager.GetAPIKeyForModel(ctx, "m")
+	assert.Nil(t, err)
+
+	// A successful one closes it.
+	manager.Report(ctx, key, &http.Response{StatusCode: http.StatusOK})
+	for range 3 {
+		_, err = manager.GetAPIKeyForModel(ctx, "m")
+		assert.Nil(t, err)
+	}
+}
+
+func TestAPIKeyManagerBudgets(t *testing.T) {
+	ctx := context.Background()
+	dbHandler := models.NewMemDBHandler()
+	newManager := func() *APIKeyManager {
+		manager := NewAPIKeyManager(map[confs.ModelName][]common.SecretString{
+			"m1": {common.NewSecretString("shared")},
+			"m2": {common.NewSecretString("shared")},
+		})
+		manager.byID[apiKeyID(common.NewSecretString("shared"))].budget = confs.APIKeyBudget{DailyTokens: 100}
+		return manager
+	}
+
+	instance1 := newManager()
+	key, err := instance1.GetAPIKeyForModel(ctx, "m1")
+	assert.Nil(t, err)
+	instance1.RecordUsage(ctx, key, 60, 0)
+	assert.Nil(t, instance1.FlushUsage(ctx, dbHandler))
+
+	// Another instance sees the flushed usage, and the budget is shared across models.
+	instance2 := newManager()
+	assert.Nil(t, instance2.FlushUsage(ctx, dbHandler))
+	key, err = instance2.GetAPIKeyForModel(ctx, "m2")
+	assert.Nil(t, err)
+	instance2.RecordUsage(ctx, key, 20, 20)
+	_, err = instance2.GetAPIKeyForModel(ctx, "m1")
+	assert.NotNil(t, err)
+	assert.Nil(t, instance2.FlushUsage(ctx, dbHandler))
+
+	assert.Nil(t, instance1.FlushUsage(ctx, dbHandler))
+	health := instance1.Health()
+	assert.True(t, health[0].OverBudget)
+	assert.Equal(t, int64(100), health[0].DailyTokens)
+	assert.Equal(t, int64(100), health[0].MonthlyTokens)
+}
+
+func TestAPIKeyManagerConcurrentFlushes(t *testing.T) {
+	ctx := context.Background()
+	dbHandler := models.NewMemDBHandler()
+	var wg sync.WaitGroup
+	for range 10 {
+		manager := NewAPIKeyManager(map[confs.ModelName][]common.SecretString{"m": {common.NewSecretString("k")}})
+		key, err := manager.GetAPIKeyForModel(ctx, "m")
+		assert.Nil(t, err)
+		manager.RecordUsage(ctx, key, 3, 7)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Usage that lost too many races stays pending, and goes with the next flush.
+			for manager.FlushUsage(ctx, dbHandler) != nil {
+			}
+		}()
+	}
+	wg.Wait()
+
+	usage := &models.APIKeyUsage{DocID: models.DocIDForAPIKeyUsage(apiKeyID(common.NewSecretString("k")),
+		models.APIKeyUsagePeriod(models.APIKeyUsageDaily, time.Now()))}
+	assert.Nil(t, dbHandler.Fetch(ctx, usage))
+	assert.Equal(t, int64(100), usage.TotalTokens())
+	assert.Equal(t, int64(10), usage.Requests)
+}
+
+func TestParseUsage(t *testing.T) {
+	promptTokens, completionTokens := ParseUsage([]byte(`{"usage": {"prompt_tokens": 3, "completion_tokens": 4}}`), false)
+	assert.Equal(t, int64(3), promptTokens)
+	assert.Equal(t, int64(4), completionTokens)
+
+	promptTokens, completionTokens = ParseUsage([]byte("data: {\"choices\": []}\n\n"+
+		"data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 5, \"completion_tokens\": 6}}\n\ndata: [DONE]\n\n"), true)
+	assert.Equal(t, int64(5), promptTokens)
+	assert.Equal(t, int64(6), completionTokens)
+}
+
+func TestUsageStrippingReader(t *testing.T) {
+	body, clientWantsUsage, err := includeStreamUsage([]byte(`{"stream": true, "stream_options": {"include_usage": true}}`))
+	assert.Nil(t, err)
+	assert.True(t, clientWantsUsage)
+	assert.Equal(t, `{"stream": true, "stream_options": {"include_usage": true}}`, string(body))
+	body, clientWantsUsage, err = includeStreamUsage([]byte(`{"stream": true}`))
+	assert.Nil(t, err)
+	assert.False(t, clientWantsUsage)
+	assert.Equal(t, `{"stream":true,"stream_options":{"include_usage":true}}`, string(body))
+
+	usageChunk := "data: {\"id\": \"1\", \"choices\": [], \"usage\": {\"prompt_tokens\": 5, \"completion_tokens\": 6}}\n\n"
+	chunk := "data: {\"id\": \"1\", \"choices\": [{\"delta\": {}}], \"usage\": null}\n\n"
+	stripper := newUsageStrippingReader(strings.NewReader(chunk + usageChunk + "data: [DONE]\n\n"))
+	stripped, err := io.ReadAll(stripper)
+	assert.Nil(t, err)
+	assert.Equal(t, chunk+"data: [DONE]\n\n", string(stripped))
+	promptTokens, completionTokens := ParseUsage(stripper.Stripped, true)
+	assert.Equal(t, int64(5), promptTokens)
+	assert.Equal(t, int64(6), completionTokens)
+}
+
+func TestForwardWithRetries(t *testing.T) {
+	log.Init()
+	t.Cleanup(func() { _ = confs.InitModelRegistry(nil, nil) })
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") == "Bearer bad" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok": true}`))
+	}))
+	defer upstream.Close()
+
+	err := confs.InitModelRegistry([]common.ModelConfig{{
+		Name:      "m",
+		Provider:  confs.ProviderOpenAI,
+		Endpoints: []common.ModelEndpointConfig{{URL: upstream.URL}},
+		APIKeys:   []string{"bad", "good"},
+	}}, nil)
+	assert.Nil(t, err)
+	modelSpec, err := confs.ModelSpecFor("m")
+	assert.Nil(t, err)
+	manager := common.Must(NewAPIKeyManagerFromRegistry())
+	proxy := NewLLMProxy(nil, manager, nil, nil, nil, nil)
+
+	for range 5 {
+		r := httptest.NewRequest(http.MethodPost, "/llm-proxy", nil)
+		resp, _, err := proxy.forwardWithRetries(r.Context(), r, modelSpec, []byte(`{}`))
+		assert.Nil(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, `{"ok": true}`, string(body))
+	}
+	// The bad key fails at most once per request, and is skipped once its circuit opens.
+	assert.LessOrEqual(t, int(calls.Load()), 5+confs.APIKeyCircuitBreakerThreshold(context.Background()))
+
+	// With every key failing, the request errors out instead of returning the failure.
+	err = confs.InitModelRegistry([]common.ModelConfig{{
+		Name:      "m",
+		Provider:  confs.ProviderOpenAI,
+		Endpoints: []common.ModelEndpointConfig{{URL: upstream.URL}},
+		APIKeys:   []string{"bad"},
+	}}, nil)
+	assert.Nil(t, err)
+	proxy = NewLLMProxy(nil, common.Must(NewAPIKeyManagerFromRegistry()), nil, nil, nil, nil)
+	r := httptest.NewRequest(http.MethodPost, "/llm-proxy", nil)
+	_, _, err = proxy.forwardWithRetries(r.Context(), r, common.Must(confs.ModelSpecFor("m")), []byte(`{}`))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,104 @@
+package llm_proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"net/http"
+	"strings"
+)
+
+// AzureContentSafetyModerator is a client wrapper for the Azure AI Content Safety API.
+type AzureContentSafetyModerator struct {
+	endpoint string
+	apiKey   string
+	client   *http.Client
+}
+
+type ContentModerationImage struct {
+	Content string `json:"content"`
+}
+
+// ContentModerationRequest represents the JSON request body for the text analysis API.
+type ContentModerationRequest struct {
+	Text  *string                 `json:"text,omitempty"`
+	Image *ContentModerationImage `json:"image,omitempty"`
+}
+
+func NewAzureContentSafetyModerator(endpoint string, apiKey string) *AzureContentSafetyModerator {
+	return &AzureContentSafetyModerator{
+		endpoint: endpoint,
+		apiKey:   apiKey,
+		client:   http.DefaultClient,
+	}
+}
+
+func (cm *AzureContentSafetyModerator) Name() string {
+	return ModerationProviderAzure
+}
+
+func (cm *AzureContentSafetyModerator) CacheKey() string {
+	return cm.Name()
+}
+
+func (cm *AzureContentSafetyModerator) AnalyzeContent(ctx context.Context, content *Content) (*ContentSafetyResponse, error) {
+	var url string
+	requestBody := ContentModerationRequest{}
+	switch content.ContentType {
+	case ContentTypeText:
+		url = fmt.Sprintf("%s/contentsafety/text:analyze?api-version=2024-09-01", cm.endpoint)
+		requestBody.Text = &content.Data
+	case ContentTypeImageURL:
+		url = fmt.Sprintf("%s/contentsafety/image:analyze?api-version=2024-09-01", cm.endpoint)
+		imgData := content.Data
+		// Prefix should be of any type like: data:image/<ext>;base64,
+		if !strings.HasPrefix(imgData, "data:image/") {
+			return nil, errors.New("image data format invalid, must start with 'data:image/'")
+		}
+		_, imgData, found := strings.Cut(imgData, ";base64,")
+		if !found {
+			return nil, errors.New("image data format invalid, must be base64 like 'data:image/<ext>;base64,'")
+		}
+		requestBody.Image = &ContentModerationImage{
+			Content: strings.TrimPrefix(imgData, "data:image/png;base64,"),
+		}
+	default:
+		return nil, errors.New("unknown content type")
+	}
+	jsonBody, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal request")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create request")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Ocp-Apim-Subscription-Key", cm.apiKey)
+
+	resp, err := cm.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "API request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&errResp)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to unmarshal response")
+		}
+		return nil, errors.Newf("API call failed with status %s: %+v", resp.Status, errResp)
+	}
+
+	var contentSafetyResp ContentSafetyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&contentSafetyResp); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode response")
+	}
+
+	return &contentSafetyResp, nil
+}
@@ -0,0 +1,218 @@
+package llm_proxy
+
+import (
+	"github.com/cockroachdb/errors"
+	"llmmask/src/confs"
+	"maps"
+	"math"
+	"slices"
+)
+
+const (
+	maxStopSequences = 4
+	maxTools         = 128
+	maxOutputTokens  = 1_000_000
+)
+
+// chatParamValidators type and range check the values of confs.AllChatParams, as decoded from JSON.
+var chatParamValidators = map[string]func(value any) error{
+	confs.ParamTemperature:         numberInRange(0, 2),
+	confs.ParamTopP:                numberInRange(0, 1),
+	confs.ParamPresencePenalty:     numberInRange(-2, 2),
+	confs.ParamFrequencyPenalty:    numberInRange(-2, 2),
+	confs.ParamMaxTokens:           integerInRange(1, maxOutputTokens),
+	confs.ParamMaxCompletionTokens: integerInRange(1, maxOutputTokens),
+	confs.ParamSeed:                integerInRange(math.MinInt64, math.MaxInt64),
+	confs.ParamStop:                validateStop,
+	confs.ParamResponseFormat:      validateResponseFormat,
+	confs.ParamTools:               validateTools,
+	confs.ParamToolChoice:          validateToolChoice,
+	confs.ParamParallelToolCalls:   validateBool,
+	confs.ParamReasoningEffort:     oneOf("minimal", "low", "medium", "high"),
+}
+
+// CleanProxyRequest drops everything but the parameters allowed for the model, and rejects invalid values, so that
+// bad requests fail before any token is spent. Parameters are then renamed to what the provider calls them, and text
+// parts without text dropped from the messages, before they get moderated.
+func CleanProxyRequest(req map[string]any, modelSpec *confs.ModelSpec) error {
+	for key, value := range req {
+		switch key {
+		case "model", "messages", "stream", "stream_options":
+			continue
+		}
+		if !slices.Contains(modelSpec.AllowedParams, key) {
+			delete(req, key)
+			continue
+		}
+		validate, ok := chatParamValidators[key]
+		if !ok {
+			delete(req, key)
+			continue
+		}
+		err := validate(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", key)
+		}
+	}
+
+	// Sorted, so renames chaining into one another always end up the same.
+	for _, from := range slices.Sorted(maps.Keys(modelSpec.ParamRenames)) {
+		to := modelSpec.ParamRenames[from]
+		value, ok := req[from]
+		if !ok {
+			continue
+		}
+		delete(req, from)
+		// The provider's own name wins if the client sent both.
+		if _, ok := req[to]; !ok {
+			req[to] = value
+		}
+	}
+
+	dropEmptyTextParts(req)
+	return nil
+}
+
+// dropEmptyTextParts removes text parts with no text from the content of the messages, providers like Anthropic
+// reject them and there is nothing to moderate. Malformed messages are left for the moderation to reject.
+func dropEmptyTextParts(req map[string]any) {
+	messages, _ := req["messages"].([]any)
+	for _, message := range messages {
+		message, ok := message.(map[string]any)
+		if !ok {
+			continue
+		}
+		parts, ok := message["content"].([]any)
+		if !ok {
+			continue
+		}
+		message["content"] = slices.DeleteFunc(parts, func(part any) bool {
+			textPart, ok := part.(map[string]any)
+			return ok && textPart["type"] == string(ContentTypeText) && textPart["text"] == ""
+		})
+	}
+}
+
+func numberInRange(lo, hi float64) func(value any) error {
+	return func(value any) error {
+		num, ok := value.(float64)
+		if !ok {
+			return errors.New("must be a number")
+		}
+		if num < lo || num > hi {
+			return errors.Newf("must be between %v and %v", lo, hi)
+		}
+		return nil
+	}
+}
+
+func integerInRange(lo, hi float64) func(value any) error {
+	inRange := numberInRange(lo, hi)
+	return func(value any) error {
+		err := inRange(value)
+		if err != nil {
+			return err
+		}
+		if num := value.(float64); num != math.Trunc(num) {
+			return errors.New("must be an integer")
+		}
+		return nil
+	}
+}
+
+func oneOf(allowed ...string) func(value any) error {
+	return func(value any) error {
+		str, ok := value.(string)
+		if !ok || !slices.Contains(allowed, str) {
+			return errors.Newf("must be one of %v", allowed)
+		}
+		return nil
+	}
+}
+
+func validateBool(value any) error {
+	if _, ok := value.(bool); !ok {
+		return errors.New("must be a boolean")
+	}
+	return nil
+}
+
+func validateStop(value any) error {
+	if _, ok := value.(string); ok {
+		return nil
+	}
+	stops, ok := value.([]any)
+	if !ok || len(stops) > maxStopSequences {
+		return errors.Newf("must be a string or at most %d strings", maxStopSequences)
+	}
+	for _, stop := range stops {
+		if _, ok := stop.(string); !ok {
+			return errors.New("must only have strings")
+		}
+	}
+	return nil
+}
+
+func validateResponseFormat(value any) error {
+	format, ok := value.(map[string]any)
+	if !ok {
+		return errors.New("must be an object")
+	}
+	switch format["type"] {
+	case "text", "json_object":
+		return nil
+	case "json_schema":
+		schema, ok := format["json_schema"].(map[string]any)
+		if !ok {
+			return errors.New("json_schema must be an object")
+		}
+		if name, ok := schema["name"].(string); !ok || name == "" {
+			return errors.New("json_schema needs a name")
+		}
+		return nil
+	default:
+		return errors.New("type must be text, json_object or json_schema")
+	}
+}
+
+// validateFunctionRef checks for {"type": "function", "function": {"name": ...}}, used by tools and tool_choice.
+func validateFunctionRef(value any) error {
+	ref, ok := value.(map[string]any)
+	if !ok || ref["type"] != "function" {
+		return errors.New("must be a function object")
+	}
+	function, ok := ref["function"].(map[string]any)
+	if !ok {
+		return errors.New("function must be an object")
+	}
+	if name, ok := function["name"].(string); !ok || name == "" {
+		return errors.New("function needs a name")
+	}
+	return nil
+}
+
+func validateTools(value any) error {
+	tools, ok := value.([]any)
+	if !ok || len(tools) > maxTools {
+		return errors.Newf("must be an array of at most %d tools", maxTools)
+	}
+	for _, tool := range tools {
+		err := validateFunctionRef(tool)
+		if err != nil {
+			return err
+		}
+		if params, ok := tool.(map[string]any)["function"].(map[string]any)["parameters"]; ok {
+			if _, ok := params.(map[string]any); !ok {
+				return errors.New("function parameters must be an object")
+			}
+		}
+	}
+	return nil
+}
+
+func validateToolChoice(value any) error {
+	if _, ok := value.(string); ok {
+		return oneOf("none", "auto", "required")(value)
+	}
+	return validateFunctionRef(value)
+}
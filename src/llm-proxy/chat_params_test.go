@@ -0,0 +1,87 @@
+package llm_proxy
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/confs"
+	"testing"
+)
+
+func TestCleanProxyRequest(t *testing.T) {
+	parse := func(body string) map[string]any {
+		req := map[string]any{}
+		assert.Nil(t, json.Unmarshal([]byte(body), &req))
+		return req
+	}
+	gpt, err := confs.ModelSpecFor(confs.ModelChatGPT41)
+	assert.Nil(t, err)
+	o1, err := confs.ModelSpecFor(confs.ModelChatGPTo1)
+	assert.Nil(t, err)
+
+	req := parse(`{
+		"model": "gpt-4.1", "messages": [], "stream": true, "extra_body": {}, "n": 3, "user": "me",
+		"temperature": 0.2, "max_tokens": 100, "seed": 7, "stop": ["a", "b"],
+		"response_format": {"type": "json_schema", "json_schema": {"name": "answer", "schema": {}}},
+		"tools": [{"type": "function", "function": {"name": "lookup", "parameters": {"type": "object"}}}],
+		"tool_choice": {"type": "function", "function": {"name": "lookup"}}
+	}`)
+	assert.Nil(t, CleanProxyRequest(req, gpt))
+	for _, dropped := range []string{"extra_body", "n", "user"} {
+		assert.NotContains(t, req, dropped)
+	}
+	for _, kept := range []string{"model", "messages", "stream", "temperature", "max_tokens", "seed", "stop",
+		"response_format", "tools", "tool_choice"} {
+		assert.Contains(t, req, kept)
+	}
+
+	// o1 drops sampling parameters and calls max_tokens max_completion_tokens.
+	req = parse(`{"model": "o1", "messages": [], "temperature": 1, "max_tokens": 100, "reasoning_effort": "high"}`)
+	assert.Nil(t, CleanProxyRequest(req, o1))
+	assert.NotContains(t, req, "temperature")
+	assert.NotContains(t, req, "max_tokens")
+	assert.Equal(t, float64(100), req["max_completion_tokens"])
+	assert.Equal(t, "high", req["reasoning_effort"])
+
+	// Renames chaining into one another are applied in a fixed order.
+	chained := &confs.ModelSpec{
+		AllowedParams: []string{confs.ParamMaxTokens, confs.ParamMaxCompletionTokens},
+		ParamRenames: map[string]string{
+			confs.ParamMaxCompletionTokens: confs.ParamMaxTokens,
+			confs.ParamMaxTokens:           "max_output_tokens",
+		},
+	}
+	for range 10 {
+		req = parse(`{"model": "m", "messages": [], "max_completion_tokens": 50}`)
+		assert.Nil(t, CleanProxyRequest(req, chained))
+		assert.Equal(t, map[string]any{"model": "m", "messages": []any{}, "max_output_tokens": float64(50)}, req)
+	}
+
+	// Text parts without text are dropped, other content is left alone.
+	req = parse(`{"model": "gpt-4.1", "messages": [
+		{"role": "user", "content": [{"type": "text", "text": ""}, {"type": "text", "text": "hi"},
+			{"type": "image_url", "image_url": {"url": "https://example.com/cat.png"}}]},
+		{"role": "assistant", "content": ""}
+	]}`)
+	assert.Nil(t, CleanProxyRequest(req, gpt))
+	assert.Equal(t, parse(`{"model": "gpt-4.1", "messages": [
+		{"role": "user", "content": [{"type": "text", "text": "hi"},
+			{"type": "image_url", "image_url": {"url": "https://example.com/cat.png"}}]},
+		{"role": "assistant", "content": ""}
+	]}`), req)
+
+	for _, bad := range []string{
+		`{"temperature": 3}`,
+		`{"temperature": "hot"}`,
+		`{"max_tokens": 1.5}`,
+		`{"max_tokens": 0}`,
+		`{"stop": ["a", "b", "c", "d", "e"]}`,
+		`{"response_format": {"type": "xml"}}`,
+		`{"response_format": {"type": "json_schema"}}`,
+		`{"tools": [{"type": "function", "function": {}}]}`,
+		`{"tool_choice": "sometimes"}`,
+		`{"parallel_tool_calls": "yes"}`,
+		`{"reasoning_effort": "extreme"}`,
+	} {
+		assert.NotNil(t, CleanProxyRequest(parse(bad), gpt), bad)
+	}
+}
@@ -61,6 +61,13 @@ func (t *ChatGPTContentChunker) HasNext(ctx context.Context) bool {
 func (t *ChatGPTContentChunker) Next(ctx context.Context) (*Content, error) {
 	m := t.msgs[t.idx]
 
+	// Assistant messages with only tool calls have no content.
+	if m.Content == nil {
+		t.idx++
+		return &Content{
+			ContentType: ContentTypeText,
+		}, nil
+	}
 	if strContent, ok := m.Content.(string); ok {
 		t.idx++
 		return &Content{
@@ -75,6 +82,12 @@ func (t *ChatGPTContentChunker) Next(ctx context.Context) (*Content, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to convert content to []ContentPart")
 	}
+	if len(parts) == 0 {
+		t.idx++
+		return &Content{
+			ContentType: ContentTypeText,
+		}, nil
+	}
 
 	c := parts[t.partIdx]
 	t.partIdx++
@@ -97,3 +110,21 @@ func (t *ChatGPTContentChunker) Next(ctx context.Context) (*Content, error) {
 		return nil, errors.Newf("unsupported content part: %s", c.ContentType)
 	}
 }
+
+// RequestHasImages tells if any message of an OpenAI chat request has an image part.
+func RequestHasImages(ctx context.Context, src []byte) (bool, error) {
+	contentChunker, err := NewChatGPTContentChunker(src)
+	if err != nil {
+		return false, err
+	}
+	for contentChunker.HasNext(ctx) {
+		content, err := contentChunker.Next(ctx)
+		if err != nil {
+			return false, err
+		}
+		if content.ContentType == ContentTypeImageURL {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -1,17 +1,14 @@
 package llm_proxy
 
 import (
-	"bytes"
 	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"github.com/cockroachdb/errors"
 	"llmmask/src/common"
 	"llmmask/src/log"
 	"llmmask/src/models"
-	"net/http"
 	"slices"
 	"strings"
 )
@@ -22,22 +19,35 @@ const (
 	textChunkingSizeForAnalysis = 9000
 )
 
-// ContentModerator is a client wrapper for the Azure AI Content Safety API.
-type ContentModerator struct {
-	endpoint  string
-	apiKey    string
-	client    *http.Client
-	dbHandler *models.DBHandler
-}
+const (
+	ModerationProviderAzure  = "azure"
+	ModerationProviderOpenAI = "openai"
+	ModerationProviderRules  = "rules"
+)
+
+// Harm categories as named by Azure Content Safety, other providers map their verdicts onto these.
+const (
+	ModerationCategoryHate     = "Hate"
+	ModerationCategorySelfHarm = "SelfHarm"
+	ModerationCategorySexual   = "Sexual"
+	ModerationCategoryViolence = "Violence"
+)
 
-type ContentModerationImage struct {
-	Content string `json:"content"`
+// Moderator analyzes a single content chunk, text or image, and reports harm categories with severities on the
+// Azure Content Safety scale (0-7).
+type Moderator interface {
+	// Name identifies the provider.
+	Name() string
+	// CacheKey identifies the provider and the configuration its verdicts depend on, the analysis cache is kept per
+	// cache key so changing that configuration doesn't serve verdicts of the old one.
+	CacheKey() string
+	AnalyzeContent(ctx context.Context, content *Content) (*ContentSafetyResponse, error)
 }
 
-// ContentModerationRequest represents the JSON request body for the text analysis API.
-type ContentModerationRequest struct {
-	Text  *string                 `json:"text,omitempty"`
-	Image *ContentModerationImage `json:"image,omitempty"`
+// ContentModerator splits GPT requests into content chunks, and runs them through a Moderator with caching.
+type ContentModerator struct {
+	moderator Moderator
+	dbHandler models.DBHandler
 }
 
 // ContentSafetyResponse represents the top-level JSON response from the text analysis API.
@@ -59,18 +69,47 @@ type BlocklistMatch struct {
 }
 
 // NewContentModerator creates a new instance of ContentModerator.
-func NewContentModerator(endpoint string, apiKey string, dbHandler *models.DBHandler) *ContentModerator {
+func NewContentModerator(moderator Moderator, dbHandler models.DBHandler) *ContentModerator {
 	return &ContentModerator{
-		endpoint:  endpoint,
-		apiKey:    apiKey,
-		client:    http.DefaultClient,
+		moderator: moderator,
 		dbHandler: dbHandler,
 	}
 }
 
+// NewModeratorFromConfig builds the configured moderation providers. With no providers listed only the Azure
+// Content Safety endpoint is used, multiple providers are chained.
+func NewModeratorFromConfig(conf *common.ContentModeratorConfig) (Moderator, error) {
+	if len(conf.Providers) == 0 {
+		return NewAzureContentSafetyModerator(conf.Endpoint, conf.APIKey), nil
+	}
+
+	var moderators []Moderator
+	for _, providerConf := range conf.Providers {
+		var moderator Moderator
+		var err error
+		switch providerConf.Type {
+		case ModerationProviderAzure:
+			moderator = NewAzureContentSafetyModerator(providerConf.Endpoint, providerConf.APIKey)
+		case ModerationProviderOpenAI:
+			moderator = NewOpenAIModerator(providerConf.Endpoint, providerConf.APIKey, providerConf.Model)
+		case ModerationProviderRules:
+			moderator, err = NewRuleModerator(providerConf.Rules)
+		default:
+			err = errors.Newf("unknown moderation provider: %s", providerConf.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		moderators = append(moderators, moderator)
+	}
+	if len(moderators) == 1 {
+		return moderators[0], nil
+	}
+	return NewChainModerator(moderators...), nil
+}
+
 func (cm *ContentModerator) AnalyzeGPTReq(ctx context.Context, req []byte) (*ContentSafetyResponse, error) {
-	categoriesAnalysis := map[string]CategoryAnalysis{}
-	blocklistsMatch := []BlocklistMatch{}
+	var responses []*ContentSafetyResponse
 
 	contentChunker, err := NewChatGPTContentChunker(req)
 	if err != nil {
@@ -100,33 +139,50 @@ func (cm *ContentModerator) AnalyzeGPTReq(ctx context.Context, req []byte) (*Con
 			if err != nil {
 				return nil, err
 			}
-			blocklistsMatch = append(blocklistsMatch, currResp.BlocklistsMatch...)
-			for _, categoryAnalysis := range currResp.CategoriesAnalysis {
-				prevAnalysis, ok := categoriesAnalysis[categoryAnalysis.Category]
-				if !ok {
-					prevAnalysis = CategoryAnalysis{Severity: 0, Category: categoryAnalysis.Category}
-				}
-				if categoryAnalysis.Severity > prevAnalysis.Severity {
-					prevAnalysis.Severity = categoryAnalysis.Severity
-				}
-				categoriesAnalysis[categoryAnalysis.Category] = prevAnalysis
+			responses = append(responses, currResp)
+		}
+	}
+
+	return mergeContentSafetyResponses(responses...), nil
+}
+
+// mergeContentSafetyResponses keeps the highest severity seen per category, and all blocklist matches.
+func mergeContentSafetyResponses(responses ...*ContentSafetyResponse) *ContentSafetyResponse {
+	categoriesAnalysis := map[string]CategoryAnalysis{}
+	categoriesOrder := []string{}
+	blocklistsMatch := []BlocklistMatch{}
+	for _, resp := range responses {
+		blocklistsMatch = append(blocklistsMatch, resp.BlocklistsMatch...)
+		for _, categoryAnalysis := range resp.CategoriesAnalysis {
+			prevAnalysis, ok := categoriesAnalysis[categoryAnalysis.Category]
+			if !ok {
+				prevAnalysis = CategoryAnalysis{Severity: 0, Category: categoryAnalysis.Category}
+				categoriesOrder = append(categoriesOrder, categoryAnalysis.Category)
 			}
+			if categoryAnalysis.Severity > prevAnalysis.Severity {
+				prevAnalysis.Severity = categoryAnalysis.Severity
+			}
+			categoriesAnalysis[categoryAnalysis.Category] = prevAnalysis
 		}
 	}
 
 	categoriesAnalysisArr := []CategoryAnalysis{}
-	for _, categoryAnalysis := range categoriesAnalysis {
-		categoriesAnalysisArr = append(categoriesAnalysisArr, categoryAnalysis)
+	for _, category := range categoriesOrder {
+		categoriesAnalysisArr = append(categoriesAnalysisArr, categoriesAnalysis[category])
 	}
 
 	return &ContentSafetyResponse{
 		CategoriesAnalysis: categoriesAnalysisArr,
 		BlocklistsMatch:    blocklistsMatch,
-	}, nil
+	}
 }
 
 func (cm *ContentModerator) analyzeContentWithCaching(ctx context.Context, content *Content) (*ContentSafetyResponse, error) {
 	md5Hash := md5.Sum([]byte(content.Data))
+	if cacheKey := cm.moderator.CacheKey(); cacheKey != ModerationProviderAzure {
+		// Azure keeps the plain content hash so analysis cached before providers were pluggable stays valid.
+		md5Hash = md5.Sum([]byte(cacheKey + "\x00" + content.Data))
+	}
 	textAnalysisID := base64.URLEncoding.EncodeToString(md5Hash[:])
 
 	textAnalysis := &models.TextAnalysis{
@@ -144,7 +200,7 @@ func (cm *ContentModerator) analyzeContentWithCaching(ctx context.Context, conte
 		return resp, err
 	}
 
-	resp, err := cm.analyzeContent(ctx, content)
+	resp, err := cm.moderator.AnalyzeContent(ctx, content)
 	if err != nil {
 		return nil, err
 	}
@@ -152,62 +208,36 @@ func (cm *ContentModerator) analyzeContentWithCaching(ctx context.Context, conte
 	return resp, cm.dbHandler.Upsert(ctx, textAnalysis)
 }
 
-func (cm *ContentModerator) analyzeContent(ctx context.Context, content *Content) (*ContentSafetyResponse, error) {
-	var url string
-	requestBody := ContentModerationRequest{}
-	switch content.ContentType {
-	case ContentTypeText:
-		url = fmt.Sprintf("%s/contentsafety/text:analyze?api-version=2024-09-01", cm.endpoint)
-		requestBody.Text = &content.Data
-	case ContentTypeImageURL:
-		url = fmt.Sprintf("%s/contentsafety/image:analyze?api-version=2024-09-01", cm.endpoint)
-		imgData := content.Data
-		// Prefix should be of any type like: data:image/<ext>;base64,
-		if !strings.HasPrefix(imgData, "data:image/") {
-			return nil, errors.New("image data format invalid, must start with 'data:image/'")
-		}
-		_, imgData, found := strings.Cut(imgData, ";base64,")
-		if !found {
-			return nil, errors.New("image data format invalid, must be base64 like 'data:image/<ext>;base64,'")
-		}
-		requestBody.Image = &ContentModerationImage{
-			Content: strings.TrimPrefix(imgData, "data:image/png;base64,"),
-		}
-	default:
-		return nil, errors.New("unknown content type")
-	}
-	jsonBody, err := json.Marshal(requestBody)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to marshal request")
-	}
+// ChainModerator runs every moderator on the content and combines the verdicts, so the strictest one wins.
+// Any provider failing fails the whole analysis, we don't want to let content through unchecked.
+type ChainModerator struct {
+	moderators []Moderator
+}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create request")
+func NewChainModerator(moderators ...Moderator) *ChainModerator {
+	return &ChainModerator{
+		moderators: moderators,
 	}
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Ocp-Apim-Subscription-Key", cm.apiKey)
+func (c *ChainModerator) Name() string {
+	names := common.Map(c.moderators, Moderator.Name)
+	return "chain(" + strings.Join(names, ",") + ")"
+}
 
-	resp, err := cm.client.Do(req)
-	if err != nil {
-		return nil, errors.Wrapf(err, "API request failed")
-	}
-	defer resp.Body.Close()
+func (c *ChainModerator) CacheKey() string {
+	cacheKeys := common.Map(c.moderators, Moderator.CacheKey)
+	return "chain(" + strings.Join(cacheKeys, ",") + ")"
+}
 
-	if resp.StatusCode != http.StatusOK {
-		var errResp map[string]interface{}
-		err = json.NewDecoder(resp.Body).Decode(&errResp)
+func (c *ChainModerator) AnalyzeContent(ctx context.Context, content *Content) (*ContentSafetyResponse, error) {
+	var responses []*ContentSafetyResponse
+	for _, moderator := range c.moderators {
+		resp, err := moderator.AnalyzeContent(ctx, content)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to unmarshal response")
+			return nil, errors.Wrapf(err, "moderation provider %s failed", moderator.Name())
 		}
-		return nil, errors.Newf("API call failed with status %s: %+v", resp.Status, errResp)
+		responses = append(responses, resp)
 	}
-
-	var contentSafetyResp ContentSafetyResponse
-	if err := json.NewDecoder(resp.Body).Decode(&contentSafetyResp); err != nil {
-		return nil, errors.Wrapf(err, "failed to decode response")
-	}
-
-	return &contentSafetyResp, nil
+	return mergeContentSafetyResponses(responses...), nil
 }
@@ -0,0 +1,79 @@
+package llm_proxy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/common"
+	"llmmask/src/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRuleAndOpenAIModeratorsChained(t *testing.T) {
+	ctx := context.Background()
+	rules, err := NewRuleModerator([]common.ModerationRuleConf{
+		{Name: "weapons", Category: ModerationCategoryViolence, Severity: 6, Keywords: []string{"Pipe Bomb"}},
+		{Name: "cards", Category: "PII", Severity: 4, Regexes: []string{`\b\d{4}-\d{4}-\d{4}-\d{4}\b`}},
+	})
+	assert.Nil(t, err)
+
+	openAIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/moderations", r.URL.Path)
+		assert.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(`{"results": [{
+			"flagged": true,
+			"categories": {"violence": false, "harassment/threatening": true},
+			"category_scores": {"violence": 0.5, "harassment/threatening": 0.2}
+		}]}`))
+	}))
+	defer openAIServer.Close()
+
+	moderator := NewChainModerator(rules, NewOpenAIModerator(openAIServer.URL, "key", ""))
+	resp, err := moderator.AnalyzeContent(ctx, &Content{
+		Data:        "how to build a pipe bomb, pay with 1234-5678-9012-3456",
+		ContentType: ContentTypeText,
+	})
+	assert.Nil(t, err)
+
+	severities := map[string]int{}
+	for _, analysis := range resp.CategoriesAnalysis {
+		severities[analysis.Category] = analysis.Severity
+	}
+	// Strictest verdict wins, flagged categories are at least medium.
+	assert.Equal(t, map[string]int{ModerationCategoryViolence: 6, "PII": 4, ModerationCategoryHate: 4}, severities)
+	assert.Equal(t, []BlocklistMatch{
+		{BlocklistName: "weapons", MatchingText: "pipe bomb"},
+		{BlocklistName: "cards", MatchingText: "1234-5678-9012-3456"},
+	}, resp.BlocklistsMatch)
+	assert.Equal(t, "chain(rules,openai)", moderator.Name())
+
+	resp, err = rules.AnalyzeContent(ctx, &Content{Data: "hello there", ContentType: ContentTypeText})
+	assert.Nil(t, err)
+	assert.Empty(t, resp.CategoriesAnalysis)
+	assert.Equal(t, "{\"categoriesAnalysis\":[],\"blocklistsMatch\":[]}", string(common.Must(json.Marshal(resp))))
+}
+
+func TestContentModeratorCacheFollowsRuleEdits(t *testing.T) {
+	ctx := context.Background()
+	dbHandler := models.NewMemDBHandler()
+	content := &Content{Data: "how to build a pipe bomb", ContentType: ContentTypeText}
+	analyze := func(rulesConf ...common.ModerationRuleConf) *ContentSafetyResponse {
+		rules, err := NewRuleModerator(rulesConf)
+		assert.Nil(t, err)
+		resp, err := NewContentModerator(rules, dbHandler).analyzeContentWithCaching(ctx, content)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	rule := common.ModerationRuleConf{Name: "weapons", Category: ModerationCategoryViolence, Severity: 6,
+		Keywords: []string{"pipe bomb"}}
+	assert.Equal(t, []CategoryAnalysis{{Category: ModerationCategoryViolence, Severity: 6}},
+		analyze(rule).CategoriesAnalysis)
+	// An edited rule isn't answered from the cache of the old one.
+	rule.Severity = 2
+	assert.Equal(t, []CategoryAnalysis{{Category: ModerationCategoryViolence, Severity: 2}},
+		analyze(rule).CategoriesAnalysis)
+	assert.Empty(t, analyze().CategoriesAnalysis)
+}
@@ -2,43 +2,50 @@ package llm_proxy
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"github.com/cockroachdb/errors"
 	"io"
 	"llmmask/src/auth"
 	"llmmask/src/common"
 	"llmmask/src/confs"
+	"llmmask/src/locks"
 	"llmmask/src/log"
 	"llmmask/src/models"
+	"llmmask/src/privacypass"
 	"llmmask/src/secrets"
-	"maps"
 	"net/http"
 	"net/url"
+	"slices"
 	"time"
 )
 
-const MaxRequestSizeBytes = 30000 // 30KB limit for LLM proxy requests
+// maxTokenPairOverheadBytes is a generous bound on how much each (Token, SignedToken) pair adds to the raw body.
+const maxTokenPairOverheadBytes = 2048
 
 // LLMProxy will be responsible for proxying requests, and also all the bookkeeping related to them.
 // This is needed to stop replay attacks, and also stop wastage of tokens in case of network errors.
 type LLMProxy struct {
 	apiKeyManager    *APIKeyManager
 	authManagers     map[confs.ModelName]*auth.AuthManager
-	dbHandler        *models.DBHandler
+	dbHandler        models.DBHandler
 	contentModerator *ContentModerator
-	kms              *secrets.AzureKMS
+	kms              secrets.KMS
+	locker           locks.Locker
 }
 
-func NewLLMProxy(authManagers map[confs.ModelName]*auth.AuthManager, apiKeyManager *APIKeyManager, dbHandler *models.DBHandler,
-	contentModerator *ContentModerator, kms *secrets.AzureKMS) *LLMProxy {
+func NewLLMProxy(authManagers map[confs.ModelName]*auth.AuthManager, apiKeyManager *APIKeyManager, dbHandler models.DBHandler,
+	contentModerator *ContentModerator, kms secrets.KMS, locker locks.Locker) *LLMProxy {
 	return &LLMProxy{
 		authManagers:     authManagers,
 		apiKeyManager:    apiKeyManager,
 		dbHandler:        dbHandler,
 		contentModerator: contentModerator,
 		kms:              kms,
+		locker:           locker,
 	}
 }
 
@@ -47,19 +54,22 @@ func NewLLMProxy(authManagers map[confs.ModelName]*auth.AuthManager, apiKeyManag
 // OpenAI API calls are made. Since most of the vendors support this,
 // this way clients only need to send data in 1 format.
 // In extra_body.llmmask we have the required token info.
-func (l *LLMProxy) ServeRequest(r *http.Request) (*LLMProxyResponse, error) {
+// STREAMING:
+// With `stream: true` the upstream SSE chunks are relayed to w as they arrive, and the assembled stream is cached
+// like any other response. Check LLMProxyResponse.Streamed before writing anything else to w.
+func (l *LLMProxy) ServeRequest(w http.ResponseWriter, r *http.Request) (*LLMProxyResponse, error) {
 	ctx := r.Context()
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check request size limit
-	// TODO: Large requests with multiple credits
-	if len(bodyBytes) > MaxRequestSizeBytes {
+	// Check request size limit before parsing, even the largest multi credit request can't be bigger than this.
+	maxCredits := confs.MaxCreditsPerRequest(ctx)
+	if len(bodyBytes) > maxCredits*(confs.RequestBytesPerCredit(ctx)+maxTokenPairOverheadBytes) {
 		return &LLMProxyResponse{
 			SizeLimitExceeded: true,
-			SizeLimitReason:   "",
+			SizeLimitReason:   fmt.Sprintf("request too large, at most %d credits can be spent on one request", maxCredits),
 		}, nil
 	}
 
@@ -69,12 +79,26 @@ func (l *LLMProxy) ServeRequest(r *http.Request) (*LLMProxyResponse, error) {
 		return nil, err
 	}
 
-	extraBody_ := bodyMap["extra_body"]
-	extraBody := extraBody_.(map[string]any)
-	llmmaskData := extraBody["llmmask"]
-	delete(extraBody, "llmmask") // Drop this from going to any vendor.
-	bodyMap["extra_body"] = extraBody
-	CleanProxyRequest(bodyMap)
+	// Privacy Pass clients send plain requests, with the tokens in the Authorization header.
+	var llmmaskData any
+	if extraBody, ok := bodyMap["extra_body"].(map[string]any); ok {
+		llmmaskData = extraBody["llmmask"]
+		delete(extraBody, "llmmask") // Drop this from going to any vendor.
+		bodyMap["extra_body"] = extraBody
+	}
+	isStream := IsStreamingRequest(bodyMap)
+	if _, ok := w.(http.Flusher); isStream && !ok {
+		return nil, errors.New("streaming not supported by the response writer")
+	}
+	modelName, _ := bodyMap["model"].(string)
+	modelSpec, err := confs.ModelSpecFor(modelName)
+	if err != nil {
+		return nil, err
+	}
+	err = CleanProxyRequest(bodyMap, modelSpec)
+	if err != nil {
+		return nil, err
+	}
 
 	proxyReqBody, err := json.Marshal(bodyMap)
 	if err != nil {
@@ -90,6 +114,17 @@ func (l *LLMProxy) ServeRequest(r *http.Request) (*LLMProxyResponse, error) {
 	if err != nil {
 		return nil, err
 	}
+	privacyPassTokens, err := privacyPassTokenPairs(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid PrivateToken authorization")
+	}
+	if len(privacyPassTokens) > 0 {
+		if len(req.AllTokens()) > 0 {
+			return nil, errors.New("tokens sent both in the body and the Authorization header")
+		}
+		req.Tokens = privacyPassTokens
+		req.ModelName = common.ValueOR(req.ModelName, modelName)
+	}
 
 	// NOTE: We wanna prefer doing as much parsing as possible before putting load on our auth state.
 	err = req.Sanitize()
@@ -97,6 +132,25 @@ func (l *LLMProxy) ServeRequest(r *http.Request) (*LLMProxyResponse, error) {
 		return nil, errors.Wrapf(err, "failed to sanitize proxy request")
 	}
 
+	// Large requests cost multiple credits, figure out the cost before touching any auth state.
+	maxCredits = confs.MaxCreditsPerRequestForModel(ctx, req.ModelName)
+	creditsRequired := CreditsRequiredForRequest(ctx, proxyReqBody)
+	if creditsRequired > maxCredits {
+		return &LLMProxyResponse{
+			SizeLimitExceeded: true,
+			SizeLimitReason:   fmt.Sprintf("request needs %d credits, at most %d can be spent on one request", creditsRequired, maxCredits),
+			CreditsRequired:   creditsRequired,
+		}, nil
+	}
+	tokens := req.AllTokens()
+	if len(tokens) == 0 {
+		return nil, &NoTokensError{ModelName: common.ValueOR(req.ModelName, modelName)}
+	}
+	if len(tokens) > creditsRequired {
+		// Don't silently burn the extra tokens, every token is worth a credit at least.
+		return nil, errors.Newf("request needs %d credits, got %d tokens", creditsRequired, len(tokens))
+	}
+
 	intendedModel := req.ModelName
 	ok, err := DoesRequestHasIntendedModel(intendedModel, bodyMap)
 	if err != nil {
@@ -105,73 +159,91 @@ func (l *LLMProxy) ServeRequest(r *http.Request) (*LLMProxyResponse, error) {
 	if !ok {
 		return nil, errors.Newf("model in request body mismatch, expected %s", intendedModel)
 	}
+	if isStream && !modelSpec.Streaming {
+		return nil, errors.Newf("model %s doesn't support streaming", intendedModel)
+	}
+	if !modelSpec.Vision {
+		hasImages, err := RequestHasImages(ctx, proxyReqBody)
+		if err != nil {
+			return nil, err
+		}
+		if hasImages {
+			return nil, errors.Newf("model %s doesn't support images", intendedModel)
+		}
+	}
 
 	authManager, ok := l.authManagers[intendedModel]
 	if !ok {
 		return nil, errors.New("no auth manager for intended model")
 	}
-	apiKey, err := l.apiKeyManager.GetAPIKeyForModel(ctx, intendedModel)
-	if err != nil {
-		return nil, err
+	// Key each token verified under, kept on the spent record so it can be pruned once that key's epoch is over.
+	var verifiedTokens []verifiedToken
+	tokensValue := 0
+	for _, tokenPair := range tokens {
+		var verifiedKeyID string
+		switch tokenPair.TokenType {
+		case privacypass.TokenTypeBlindRSA:
+			verifiedKeyID, err = verifyPrivacyPassTokenPair(authManager, intendedModel, tokenPair)
+		case TokenTypeVOPRF:
+			verifiedKeyID, err = authManager.VerifyVOPRFToken(tokenPair.KeyID, tokenPair.Token, tokenPair.SignedToken)
+		case TokenTypePartiallyBlindRSA:
+			metadata := auth.TokenMetadata{
+				ModelName:    intendedModel,
+				Denomination: tokenPair.Denomination,
+				ExpiryEpoch:  tokenPair.ExpiryEpoch,
+			}
+			verifiedKeyID, err = authManager.VerifyPartiallyBlindToken(ctx, tokenPair.KeyID, metadata, tokenPair.Token,
+				tokenPair.SignedToken)
+		case 0:
+			verifiedKeyID, err = authManager.VerifyUnBlindedToken(tokenPair.KeyID, tokenPair.Token, tokenPair.SignedToken)
+		default:
+			err = errors.Newf("unknown token type %d", tokenPair.TokenType)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid token for model %s", intendedModel)
+		}
+		denomination := authManager.Denomination(verifiedKeyID)
+		if denomination == 0 {
+			return nil, errors.Newf("key %s got revoked", verifiedKeyID)
+		}
+		verified := verifiedToken{
+			LLMProxyTokenPair: tokenPair,
+			KeyID:             verifiedKeyID,
+			Denomination:      denomination,
+		}
+		if tokenPair.TokenType == TokenTypePartiallyBlindRSA {
+			// The issuer key signs every denomination, the metadata says what the token is worth.
+			verified.Denomination = tokenPair.Denomination
+			verified.ExpiresAt = common.ToPtr(auth.EpochEnd(ctx, tokenPair.ExpiryEpoch))
+		}
+		verifiedTokens = append(verifiedTokens, verified)
+		tokensValue += verified.Denomination
 	}
-
-	destURLStr := DestURLForModel(intendedModel)
-	destURL, err := url.Parse(destURLStr)
-	if err != nil {
-		return nil, err
+	if tokensValue < creditsRequired {
+		return &LLMProxyResponse{
+			SizeLimitExceeded: true,
+			SizeLimitReason:   fmt.Sprintf("request needs %d credits, got tokens worth %d", creditsRequired, tokensValue),
+			CreditsRequired:   creditsRequired,
+		}, nil
 	}
 
-	isTokenValid, err := authManager.VerifyUnBlindedToken(req.Token, req.SignedToken)
+	// Storage already lets only one request claim a token, the locks keep the others from even trying.
+	release, err := locks.AcquireAll(ctx, l.locker, confs.LockLeaseTTL(ctx), common.Map(tokens, func(t LLMProxyTokenPair) string {
+		return "auth-token-" + hex.EncodeToString(t.Token)
+	})...)
 	if err != nil {
 		return nil, err
 	}
-	if !isTokenValid {
-		return nil, errors.Newf("invalid token for model %s", intendedModel)
-	}
+	defer release()
 
-	semConf := &common.SemaphoreConf{
-		Handle:  "auth-token-" + hex.EncodeToString(req.Token),
-		Request: 1,
-		Limit:   1,
-	}
-	err = common.AcquireSemaphore(ctx, semConf)
+	// The body is part of the request hash, since tokens with credits left pay for the next turns too.
+	authTokens, creditsLeft, err := l.fetchAuthTokens(ctx, verifiedTokens, creditsRequired, intendedModel,
+		slices.Concat(req.Bytes(), proxyReqBody))
 	if err != nil {
 		return nil, err
 	}
-	defer common.ReleaseSemaphore(semConf)
-
-	tokenDocID := models.DocIDForAuthToken(req.Token)
-	authToken := &models.AuthToken{
-		DocID: tokenDocID,
-	}
-	isFirstReq := false
-	err = l.dbHandler.Fetch(ctx, authToken)
-	if err != nil {
-		if !models.IsNotFoundErr(err) {
-			return nil, err
-		}
-		isFirstReq = true
-		reqHash := sha256.Sum256(req.Bytes())
-		authToken = &models.AuthToken{
-			DocID:          tokenDocID,
-			ModelName:      intendedModel,
-			CreatedAt:      time.Now().UTC(),
-			ExpiresAt:      time.Now().UTC().Add(time.Hour * 24 * 5),
-			RequestHash:    reqHash[:],
-			CachedResponse: nil,
-		}
-	}
-
-	if authToken.ExpiresAt.Before(time.Now().UTC()) {
-		return nil, errors.New("token expired, this token was already used, and any cached response  is not available.")
-	}
-	if !isFirstReq { // Avoid recomputing
-		reqHash := sha256.Sum256(req.Bytes())
-		// TODO: constant time comparision needed? probably not.
-		if !bytes.Equal(authToken.RequestHash, reqHash[:]) {
-			return nil, errors.New("cannot reuse token for different request.")
-		}
-	}
+	// The first token holds the cached response, the rest only mark themselves spent for the same request.
+	authToken := authTokens[0]
 	if authToken.CachedResponse != nil {
 		cachedRespWrapped := authToken.CachedResponse
 		dekWrapped := authToken.DEKWrapped
@@ -187,10 +259,32 @@ func (l *LLMProxy) ServeRequest(r *http.Request) (*LLMProxyResponse, error) {
 		}
 		resp := &LLMProxyResponse{}
 		err = json.Unmarshal([]byte(respPT), resp)
+		if err != nil {
+			return nil, err
+		}
 		log.Infof(ctx, "cache hit for llm proxy")
-		return resp, err
+		if isStream {
+			return l.writeStreamResponse(w, resp)
+		}
+		return resp, nil
 	}
 
+	// Claim the tokens before doing anything on their behalf, see claimAuthTokens.
+	err = l.claimAuthTokens(ctx, authTokens)
+	if err != nil {
+		return nil, err
+	}
+	// From here on the work is on the tokens' behalf, it carries on if the client goes away so the answer gets cached.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), confs.UpstreamRequestTimeout(ctx))
+	defer cancel()
+	// Failures refund the tokens, so the client can retry. Once upstream answered only for the same request.
+	settled, calledUpstream := false, false
+	defer func() {
+		if !settled {
+			l.refundAuthTokens(ctx, authTokens, calledUpstream)
+		}
+	}()
+
 	// Content Moderation:
 	analyzeResp, err := l.contentModerator.AnalyzeGPTReq(ctx, proxyReqBody)
 	if err != nil {
@@ -211,49 +305,83 @@ func (l *LLMProxy) ServeRequest(r *http.Request) (*LLMProxyResponse, error) {
 		}
 		log.Infof(ctx, "Blocked due to offensive")
 	} else {
-		proxyReqBody, err = TransformProxyReqBody(intendedModel, proxyReqBody)
-		reqFwd := &http.Request{
-			Method: "POST",
-			URL:    destURL,
-			Header: r.Header,
-			Body:   io.NopCloser(bytes.NewReader(proxyReqBody)),
-		}
-		reqFwd = reqFwd.WithContext(ctx)
-
-		switch intendedModel {
-		case confs.ModelGemini25Flash, confs.ModelGemini25Pro, confs.ModelGemini25FlashLite, confs.ModelGemini3Flash, confs.ModelGemini3Pro:
-			reqFwd.Header.Set("x-goog-api-key", apiKey.UnsafeString())
-			reqFwd.Header.Set("Authorization", "Bearer "+apiKey.UnsafeString())
-			reqFwd.Header.Set("content-type", "application/json")
-			// TODO: Removing gzip for now, use it later.
-			reqFwd.Header.Set("Accept-Encoding", "identity")
-		case confs.ModelChatGPT41Mini, confs.ModelChatGPT41, confs.ModelChatGPT4o, confs.ModelChatGPTo1:
-			//reqFwd.Header.Set("x-goog-api-key", apiKey.UnsafeString())
-			reqFwd.Header.Set("Authorization", "Bearer "+apiKey.UnsafeString())
-			reqFwd.Header.Set("content-type", "application/json")
-			// TODO: Removing gzip for now, use it later.
-			reqFwd.Header.Set("Accept-Encoding", "identity")
-		}
-
-		proxyResp, err := http.DefaultClient.Do(reqFwd)
+		proxyReqBody, err = TransformProxyReqBody(modelSpec, proxyReqBody)
 		if err != nil {
 			return nil, err
 		}
-
-		proxyRespBytes, err := io.ReadAll(proxyResp.Body)
+		clientWantsUsage := true
+		if isStream && modelSpec.RequestTransformer == confs.RequestTransformerOpenAI {
+			proxyReqBody, clientWantsUsage, err = includeStreamUsage(proxyReqBody)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = l.setAuthTokensState(ctx, authTokens, models.AuthTokenStateInFlight)
 		if err != nil {
 			return nil, err
 		}
-		err = proxyResp.Body.Close()
+		proxyResp, apiKey, err := l.forwardWithRetries(ctx, r, modelSpec, proxyReqBody)
 		if err != nil {
 			return nil, err
 		}
-		resp = &LLMProxyResponse{
-			Metadata:      []byte("lgtm"),
-			ProxyResponse: proxyRespBytes,
+		calledUpstream = true
+		proxyResp, err = TransformProxyResp(modelSpec, proxyResp, isStream)
+		if err != nil {
+			return nil, err
+		}
+
+		if isStream && proxyResp.StatusCode == http.StatusOK {
+			var upstream io.Reader = proxyResp.Body
+			var usageStripper *usageStrippingReader
+			if !clientWantsUsage {
+				usageStripper = newUsageStrippingReader(proxyResp.Body)
+				upstream = usageStripper
+			}
+			envelope := &LLMProxyResponse{Metadata: []byte("lgtm"), IsStream: true, CreditsLeft: creditsLeft}
+			streamBytes, relayed, streamErr := relaySSE(ctx, w, upstream, envelope)
+			_ = proxyResp.Body.Close()
+			usageBytes := streamBytes
+			if usageStripper != nil {
+				usageBytes = slices.Concat(streamBytes, usageStripper.Stripped)
+			}
+			promptTokens, completionTokens := ParseUsage(usageBytes, true)
+			l.apiKeyManager.RecordUsage(ctx, apiKey, promptTokens, completionTokens)
+			resp = &LLMProxyResponse{
+				Metadata:      []byte("lgtm"),
+				ProxyResponse: streamBytes,
+				IsStream:      true,
+				streamed:      relayed,
+			}
+			if streamErr != nil && !relayed {
+				// Nothing of the answer reached the client, the tokens are refunded so it can retry, and the error
+				// goes out as a normal response.
+				return resp, streamErr
+			}
+			if streamErr != nil {
+				// Part of the answer is already with the client, so the tokens pay for it and the partial stream is
+				// what gets cached.
+				log.Errorf(ctx, "upstream stream failed after relaying, caching what was relayed: %v", streamErr)
+			}
+		} else {
+			proxyRespBytes, err := io.ReadAll(proxyResp.Body)
+			if err != nil {
+				return nil, err
+			}
+			err = proxyResp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			promptTokens, completionTokens := ParseUsage(proxyRespBytes, false)
+			l.apiKeyManager.RecordUsage(ctx, apiKey, promptTokens, completionTokens)
+			resp = &LLMProxyResponse{
+				Metadata:      []byte("lgtm"),
+				ProxyResponse: proxyRespBytes,
+			}
 		}
 	}
 
+	resp.CreditsLeft = creditsLeft
+
 	// Save the Cached Response with encryption.
 	{
 		dekPT, err := secrets.NewRandomAESKey()
@@ -275,28 +403,290 @@ func (l *LLMProxy) ServeRequest(r *http.Request) (*LLMProxyResponse, error) {
 		authToken.DEKWrapped = []byte(dekWrapped)
 		authToken.DEKKMSKeyID = kmsKeyID
 	}
-	err = l.dbHandler.Upsert(ctx, authToken)
+	// All tokens are spent together, or none of them are.
+	err = l.completeAuthTokens(ctx, authTokens)
+	settled = true
 	if err != nil {
-		return nil, err
+		// The response is paid for, so the client gets it anyway. Recovery refunds the tokens for this request only.
+		log.Errorf(ctx, "[ALERT]: Failed to complete auth token %s, left for recovery: %+v", authToken.DocID, err)
 	}
 
+	if isStream && !resp.Streamed() {
+		return l.writeStreamResponse(w, resp)
+	}
 	return resp, nil
 }
 
+// verifyPrivacyPassTokenPair checks a token sent in the Authorization header, which must be for the model's
+// PrivacyPassChallenge.
+func verifyPrivacyPassTokenPair(authManager *auth.AuthManager, modelName confs.ModelName,
+	tokenPair LLMProxyTokenPair) (string, error) {
+	token, err := privacypass.UnmarshalToken(append(slices.Clone(tokenPair.Token), tokenPair.SignedToken...))
+	if err != nil {
+		return "", err
+	}
+	challengeDigest, err := PrivacyPassChallenge(modelName).Digest()
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(token.ChallengeDigest, challengeDigest) {
+		return "", errors.New("privacy pass token is for another challenge")
+	}
+	return authManager.VerifyPrivacyPassToken(token)
+}
+
+// CreditsRequiredForRequest is the number of credits a proxied request body costs, one per started
+// confs.RequestBytesPerCredit.
+func CreditsRequiredForRequest(ctx context.Context, proxyReqBody []byte) int {
+	bytesPerCredit := confs.RequestBytesPerCredit(ctx)
+	return max(1, (len(proxyReqBody)+bytesPerCredit-1)/bytesPerCredit)
+}
+
+// verifiedToken is a token of the request that passed verification, worth Denomination credits.
+type verifiedToken struct {
+	LLMProxyTokenPair
+	KeyID        string
+	Denomination int
+	// ExpiresAt is when the token stops verifying, only partially blind tokens have one.
+	ExpiresAt *time.Time
+}
+
+// fetchAuthTokens picks the records of the credits the request spends, see models.DocIDForAuthTokenCredit. Tokens pay
+// in order, lowest unspent credits first, and whatever they have left pays for later requests (the turns of a
+// conversation, say), that count is returned too. A request already redeemed (a retry) gets back exactly the credits
+// it spent. Anything else is rejected without spending.
+func (l *LLMProxy) fetchAuthTokens(ctx context.Context, tokens []verifiedToken, creditsRequired int,
+	modelName confs.ModelName, reqBytes []byte) ([]*models.AuthToken, int, error) {
+	reqHash := sha256.Sum256(reqBytes)
+	now := time.Now().UTC()
+	var spentOnReq []*models.AuthToken
+	unspent := make([][]*models.AuthToken, len(tokens))
+	numUnspent, numSpentElsewhere, numHeldForRetry := 0, 0, 0
+	for i, token := range tokens {
+		credits, err := l.fetchCreditRecords(ctx, token)
+		if err != nil {
+			return nil, 0, err
+		}
+		for credit := range token.Denomination {
+			creditDocID := models.DocIDForAuthTokenCredit(token.Token, credit)
+			authToken, ok := credits[creditDocID]
+			if !ok {
+				authToken = &models.AuthToken{
+					DocID:      creditDocID,
+					TokenDocID: models.DocIDForAuthToken(token.Token),
+					CreatedAt:  now,
+				}
+			} else if authToken.State == models.AuthTokenStateFailedRefundable {
+				if authToken.RequestHash != nil && !bytes.Equal(authToken.RequestHash, reqHash[:]) {
+					numHeldForRetry++
+					continue
+				}
+			} else {
+				// TODO: constant time comparision needed? probably not.
+				if bytes.Equal(authToken.RequestHash, reqHash[:]) {
+					spentOnReq = append(spentOnReq, authToken)
+				} else {
+					numSpentElsewhere++
+				}
+				continue
+			}
+			authToken.ModelName = modelName
+			authToken.KeyID = token.KeyID
+			authToken.TokenExpiresAt = token.ExpiresAt
+			authToken.ExpiresAt = now.Add(time.Hour * 24 * 5)
+			authToken.RequestHash = reqHash[:]
+			unspent[i] = append(unspent[i], authToken)
+			numUnspent++
+		}
+	}
+
+	if len(spentOnReq) != 0 {
+		if len(spentOnReq) != creditsRequired {
+			return nil, 0, errors.New("some of the tokens were already used, cannot reuse token for different request.")
+		}
+		if !spentOnReq[0].IsCompleted() {
+			return nil, 0, errors.New("token is being redeemed by another request, retry later")
+		}
+		if spentOnReq[0].ExpiresAt.Before(now) {
+			return nil, 0, errors.New("token expired, this token was already used, and any cached response  is not available.")
+		}
+		return spentOnReq, numUnspent, nil
+	}
+	if numUnspent < creditsRequired {
+		if numHeldForRetry != 0 {
+			return nil, 0, errors.New("refunded token can only be retried with the request it failed on.")
+		}
+		if numSpentElsewhere != 0 {
+			return nil, 0, errors.Newf("tokens were already used for a different request, %d credits left and the request needs %d",
+				numUnspent, creditsRequired)
+		}
+		return nil, 0, errors.Newf("tokens have %d credits left, request needs %d", numUnspent, creditsRequired)
+	}
+
+	var authTokens []*models.AuthToken
+	for i := range tokens {
+		needed := creditsRequired - len(authTokens)
+		if needed == 0 {
+			// Don't silently burn the extra tokens.
+			return nil, 0, errors.Newf("request needs %d credits, token %d isn't needed to pay for it", creditsRequired, i)
+		}
+		if len(unspent[i]) == 0 {
+			return nil, 0, errors.Newf("token %d has no credits left", i)
+		}
+		authTokens = append(authTokens, unspent[i][:min(needed, len(unspent[i]))]...)
+	}
+	return authTokens, numUnspent - creditsRequired, nil
+}
+
+// fetchCreditRecords reads the records of the credits of the token spent so far, by DocID. Single credit tokens have
+// their one record read directly, it might be from before TokenDocID, the rest are queried all at once.
+func (l *LLMProxy) fetchCreditRecords(ctx context.Context, token verifiedToken) (map[string]*models.AuthToken, error) {
+	res := map[string]*models.AuthToken{}
+	if token.Denomination == 1 {
+		authToken := &models.AuthToken{DocID: models.DocIDForAuthToken(token.Token)}
+		err := l.dbHandler.Fetch(ctx, authToken)
+		if models.IsNotFoundErr(err) {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		res[authToken.DocID] = authToken
+		return res, nil
+	}
+
+	items, err := l.dbHandler.QueryEq(ctx, &models.AuthToken{}, "TokenDocID", models.DocIDForAuthToken(token.Token))
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		authToken := &models.AuthToken{}
+		err = models.Deserialize(item, authToken)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to deserialize auth token")
+		}
+		res[authToken.DocID] = authToken
+	}
+	return res, nil
+}
+
+// writeStreamResponse sends blocked, cached or failed upstream responses as SSE for streaming clients.
+func (l *LLMProxy) writeStreamResponse(w http.ResponseWriter, resp *LLMProxyResponse) (*LLMProxyResponse, error) {
+	err := WriteStreamResponse(w, resp)
+	resp.streamed = true
+	return resp, err
+}
+
+// forwardWithRetries sends the request upstream, moving to another key and endpoint with backoff when the provider
+// rate limits or fails. Only responses that are about the request itself are returned, an upstream failure after all
+// attempts is returned as an error so it never gets stored against the tokens.
+// The key that served the response is returned for usage accounting.
+// The upstream calls run under ctx rather than the request's, see UpstreamRequestTimeout.
+func (l *LLMProxy) forwardWithRetries(ctx context.Context, r *http.Request, modelSpec *confs.ModelSpec,
+	proxyReqBody []byte) (*http.Response, *APIKey, error) {
+	maxAttempts := confs.UpstreamMaxAttempts(ctx)
+	backoff := confs.UpstreamRetryBackoff(ctx)
+	var triedKeys []*APIKey
+	var triedURLs []string
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			// Jittered, so that retries from many requests don't hit the provider together.
+			wait := backoff<<(attempt-1) + time.Duration(common.RandomInt(int(backoff)))
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		apiKey, err := l.apiKeyManager.GetAPIKeyForModel(ctx, modelSpec.Name, triedKeys...)
+		if err != nil {
+			return nil, nil, err
+		}
+		destURLStr, err := DestURLForModel(modelSpec.Name, triedURLs...)
+		if err != nil {
+			return nil, nil, err
+		}
+		destURL, err := url.Parse(destURLStr)
+		if err != nil {
+			return nil, nil, err
+		}
+		triedKeys = append(triedKeys, apiKey)
+		triedURLs = append(triedURLs, destURLStr)
+
+		proxyResp, err := l.forwardRequest(ctx, r, modelSpec, apiKey.Secret, destURL, proxyReqBody)
+		l.apiKeyManager.Report(ctx, apiKey, proxyResp)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, err
+			}
+			lastErr = err
+			log.Infof(ctx, "upstream call for %s with key %s failed (attempt %d): %v", modelSpec.Name, apiKey.ID, attempt+1, err)
+			continue
+		}
+		if !IsRetryableUpstreamStatus(proxyResp.StatusCode) {
+			return proxyResp, apiKey, nil
+		}
+		_ = proxyResp.Body.Close()
+		lastErr = errors.Newf("upstream responded with %s", proxyResp.Status)
+		log.Infof(ctx, "upstream call for %s with key %s got %s (attempt %d)", modelSpec.Name, apiKey.ID, proxyResp.Status, attempt+1)
+	}
+	return nil, nil, errors.Wrapf(lastErr, "upstream failed after %d attempts", maxAttempts)
+}
+
+// forwardRequest sends the cleaned up request body to the vendor with the right auth headers.
+func (l *LLMProxy) forwardRequest(ctx context.Context, r *http.Request, modelSpec *confs.ModelSpec,
+	apiKey common.SecretString, destURL *url.URL, proxyReqBody []byte) (*http.Response, error) {
+	reqFwd := &http.Request{
+		Method: "POST",
+		URL:    destURL,
+		Header: r.Header,
+		Body:   io.NopCloser(bytes.NewReader(proxyReqBody)),
+	}
+	reqFwd = reqFwd.WithContext(ctx)
+
+	// Never pass on the client's own auth.
+	reqFwd.Header.Del("Authorization")
+	switch modelSpec.AuthHeader {
+	case confs.AuthHeaderBearer:
+		reqFwd.Header.Set("Authorization", "Bearer "+apiKey.UnsafeString())
+	case confs.AuthHeaderXAPIKey:
+		reqFwd.Header.Set("x-api-key", apiKey.UnsafeString())
+	case confs.AuthHeaderGoogAPIKey:
+		reqFwd.Header.Set("x-goog-api-key", apiKey.UnsafeString())
+	case confs.AuthHeaderAzureKey:
+		reqFwd.Header.Set("api-key", apiKey.UnsafeString())
+	}
+	if modelSpec.Provider == confs.ProviderAnthropic {
+		reqFwd.Header.Set("anthropic-version", anthropicAPIVersion)
+	}
+	reqFwd.Header.Set("content-type", "application/json")
+	// TODO: Removing gzip for now, use it later.
+	reqFwd.Header.Set("Accept-Encoding", "identity")
+
+	return http.DefaultClient.Do(reqFwd)
+}
+
 func DoesRequestHasIntendedModel(intendedModel confs.ModelName, req map[string]any) (bool, error) {
 	modelName := req["model"].(string)
 	return modelName == intendedModel, nil
 }
 
-func CleanProxyRequest(req map[string]any) {
-	keys := maps.Keys(req)
-	for key := range keys {
-		if key != "model" && key != "messages" {
-			delete(req, key)
-		}
+// TransformProxyReqBody converts the OpenAI format body for vendors that don't have an OpenAI compatible endpoint.
+func TransformProxyReqBody(modelSpec *confs.ModelSpec, proxyReqBody []byte) ([]byte, error) {
+	switch modelSpec.RequestTransformer {
+	case confs.RequestTransformerAnthropic:
+		return openAIToAnthropicRequest(proxyReqBody)
 	}
+	return proxyReqBody, nil
 }
 
-func TransformProxyReqBody(modelName string, proxyReqBody []byte) ([]byte, error) {
-	return proxyReqBody, nil
+// TransformProxyResp converts the vendor response back to the OpenAI format, see TransformProxyReqBody.
+func TransformProxyResp(modelSpec *confs.ModelSpec, proxyResp *http.Response, isStream bool) (*http.Response, error) {
+	switch modelSpec.RequestTransformer {
+	case confs.RequestTransformerAnthropic:
+		return transformAnthropicResp(proxyResp, isStream)
+	}
+	return proxyResp, nil
 }
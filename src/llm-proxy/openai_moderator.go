@@ -0,0 +1,153 @@
+package llm_proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/common"
+	"net/http"
+	"strings"
+)
+
+const defaultOpenAIModerationModel = "omni-moderation-latest"
+
+// OpenAIModerator talks to an OpenAI moderation compatible `/v1/moderations` endpoint.
+// Category scores are mapped onto the Azure categories and severity scale so verdicts can be combined.
+type OpenAIModerator struct {
+	endpoint string
+	apiKey   string
+	model    string
+	client   *http.Client
+}
+
+type openAIModerationRequest struct {
+	Model string                 `json:"model"`
+	Input []openAIModerationPart `json:"input"`
+}
+
+type openAIModerationPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+type openAIModerationResponse struct {
+	Results []struct {
+		Flagged        bool               `json:"flagged"`
+		Categories     map[string]bool    `json:"categories"`
+		CategoryScores map[string]float64 `json:"category_scores"`
+	} `json:"results"`
+}
+
+func NewOpenAIModerator(endpoint string, apiKey string, model string) *OpenAIModerator {
+	return &OpenAIModerator{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		apiKey:   apiKey,
+		model:    common.ValueOR(model, defaultOpenAIModerationModel),
+		client:   http.DefaultClient,
+	}
+}
+
+func (m *OpenAIModerator) Name() string {
+	return ModerationProviderOpenAI
+}
+
+func (m *OpenAIModerator) CacheKey() string {
+	return m.Name()
+}
+
+func (m *OpenAIModerator) AnalyzeContent(ctx context.Context, content *Content) (*ContentSafetyResponse, error) {
+	part := openAIModerationPart{}
+	switch content.ContentType {
+	case ContentTypeText:
+		part.Type = "text"
+		part.Text = content.Data
+	case ContentTypeImageURL:
+		part.Type = "image_url"
+		part.ImageURL = &struct {
+			URL string `json:"url"`
+		}{URL: content.Data}
+	default:
+		return nil, errors.New("unknown content type")
+	}
+
+	jsonBody, err := json.Marshal(&openAIModerationRequest{
+		Model: m.model,
+		Input: []openAIModerationPart{part},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal request")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", m.endpoint+"/v1/moderations", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.apiKey)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "API request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&errResp)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to unmarshal response")
+		}
+		return nil, errors.Newf("API call failed with status %s: %+v", resp.Status, errResp)
+	}
+
+	moderationResp := &openAIModerationResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(moderationResp); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode response")
+	}
+
+	var responses []*ContentSafetyResponse
+	for _, result := range moderationResp.Results {
+		var categoriesAnalysis []CategoryAnalysis
+		for category, score := range result.CategoryScores {
+			categoriesAnalysis = append(categoriesAnalysis, CategoryAnalysis{
+				Category: openAICategoryToAzure(category),
+				Severity: openAIScoreToSeverity(score, result.Categories[category]),
+			})
+		}
+		responses = append(responses, &ContentSafetyResponse{CategoriesAnalysis: categoriesAnalysis})
+	}
+	return mergeContentSafetyResponses(responses...), nil
+}
+
+// openAICategoryToAzure maps categories like "hate/threatening" or "self-harm/intent" to the Azure names.
+func openAICategoryToAzure(category string) string {
+	base, _, _ := strings.Cut(category, "/")
+	switch base {
+	case "hate", "harassment":
+		return ModerationCategoryHate
+	case "self-harm":
+		return ModerationCategorySelfHarm
+	case "sexual":
+		return ModerationCategorySexual
+	case "violence", "illicit":
+		return ModerationCategoryViolence
+	default:
+		return category
+	}
+}
+
+// openAIScoreToSeverity scales a [0, 1] score onto [0, 7] in steps of 1/8, so severity n covers scores in
+// [n/8, (n+1)/8). Anything the provider flagged is at least medium severity (4), so it's above the default blocking
+// threshold, see confs.MaxOffensiveContentSeverity.
+func openAIScoreToSeverity(score float64, flagged bool) int {
+	severity := int(score * 8)
+	severity = min(max(severity, 0), 7)
+	if flagged {
+		severity = max(severity, 4)
+	}
+	return severity
+}
@@ -0,0 +1,91 @@
+package llm_proxy
+
+import (
+	"context"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"time"
+)
+
+// Redemption moves the tokens of a request through models.AuthTokenState*, persisting every state before the step
+// it guards. A crash at any point leaves them reserved or in flight, never unspent, and models.GCAuthTokens refunds
+// them once they're stuck for confs.AuthTokenRecoveryAfter.
+
+// claimAuthTokens reserves the tokens of a request. New records are created and refunded ones replaced, both
+// conditional in storage, so of concurrent requests spending the same token, on this instance or any other, exactly
+// one succeeds.
+func (l *LLMProxy) claimAuthTokens(ctx context.Context, authTokens []*models.AuthToken) error {
+	var toCreate, toReplace []*models.AuthToken
+	for _, authToken := range authTokens {
+		authToken.SetState(models.AuthTokenStateReserved)
+		// Only records read from storage have an ETag.
+		if authToken.ETag == "" {
+			toCreate = append(toCreate, authToken)
+		} else {
+			toReplace = append(toReplace, authToken)
+		}
+	}
+	err := l.dbHandler.Create(ctx, authTokenModels(toCreate)...)
+	if err == nil {
+		err = l.dbHandler.Replace(ctx, authTokenModels(toReplace)...)
+		if err != nil {
+			l.refundAuthTokens(ctx, toCreate, false)
+		}
+	}
+	if models.IsConflictErr(err) {
+		return errors.New("token is being redeemed by another request, retry later")
+	}
+	return err
+}
+
+// setAuthTokensState moves claimed tokens on, failing if anything else touched them since.
+func (l *LLMProxy) setAuthTokensState(ctx context.Context, authTokens []*models.AuthToken, state string) error {
+	for _, authToken := range authTokens {
+		authToken.SetState(state)
+	}
+	return l.dbHandler.Replace(ctx, authTokenModels(authTokens)...)
+}
+
+// refundAuthTokens makes the tokens of a failed request redeemable again, see models.AuthToken.Refund.
+func (l *LLMProxy) refundAuthTokens(ctx context.Context, authTokens []*models.AuthToken, keepRequestHash bool) {
+	if len(authTokens) == 0 {
+		return
+	}
+	// The request context is likely what got cancelled.
+	ctx = context.WithoutCancel(ctx)
+	for _, authToken := range authTokens {
+		authToken.Refund(keepRequestHash)
+	}
+	err := l.dbHandler.Replace(ctx, authTokenModels(authTokens)...)
+	if err != nil {
+		log.Errorf(ctx, "[ALERT]: Failed to refund auth token %s, left for recovery: %+v", authTokens[0].DocID, err)
+	}
+}
+
+// completeAuthTokens stores the response the tokens paid for, which must be set on the first one already.
+// Upstream is paid by now, so storage hiccups are retried.
+func (l *LLMProxy) completeAuthTokens(ctx context.Context, authTokens []*models.AuthToken) error {
+	ctx = context.WithoutCancel(ctx)
+	for _, authToken := range authTokens {
+		authToken.SetState(models.AuthTokenStateCompleted)
+	}
+	backoff := confs.UpstreamRetryBackoff(ctx)
+	var err error
+	for attempt := range confs.AuthTokenCompleteAttempts(ctx) {
+		if attempt > 0 {
+			time.Sleep(backoff << (attempt - 1))
+		}
+		err = l.dbHandler.Replace(ctx, authTokenModels(authTokens)...)
+		if err == nil || models.IsConflictErr(err) {
+			break
+		}
+	}
+	return err
+}
+
+func authTokenModels(authTokens []*models.AuthToken) []models.Model {
+	return common.Map(authTokens, func(t *models.AuthToken) models.Model { return t })
+}
@@ -0,0 +1,148 @@
+package llm_proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/confs"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"testing"
+)
+
+func TestRedemptionStates(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	dbHandler := models.NewMemDBHandler()
+	l := &LLMProxy{dbHandler: dbHandler}
+	tokens := []verifiedToken{singleCreditToken("t1"), singleCreditToken("t2")}
+	fetch := func(reqBytes []byte) ([]*models.AuthToken, error) {
+		authTokens, _, err := l.fetchAuthTokens(ctx, tokens, 2, confs.ModelChatGPT41, reqBytes)
+		return authTokens, err
+	}
+
+	authTokens, err := fetch([]byte("req"))
+	assert.Nil(t, err)
+	assert.Nil(t, l.claimAuthTokens(ctx, authTokens))
+	// A second instance racing for the same tokens.
+	racing, err := fetch([]byte("req"))
+	assert.ErrorContains(t, err, "being redeemed")
+	assert.Nil(t, racing)
+
+	assert.Nil(t, l.setAuthTokensState(ctx, authTokens, models.AuthTokenStateInFlight))
+	l.refundAuthTokens(ctx, authTokens, true)
+	// Upstream was called, so only the same request can take the refund.
+	_, err = fetch([]byte("other req"))
+	assert.ErrorContains(t, err, "only be retried")
+
+	authTokens, err = fetch([]byte("req"))
+	assert.Nil(t, err)
+	stale, err := fetch([]byte("req"))
+	assert.Nil(t, err)
+	assert.Nil(t, l.claimAuthTokens(ctx, authTokens))
+	assert.ErrorContains(t, l.claimAuthTokens(ctx, stale), "being redeemed")
+
+	authTokens[0].CachedResponse = []byte("resp")
+	assert.Nil(t, l.completeAuthTokens(ctx, authTokens))
+	spent, err := fetch([]byte("req"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("resp"), spent[0].CachedResponse)
+	assert.True(t, spent[1].IsCompleted())
+	_, err = fetch([]byte("other req"))
+	assert.ErrorContains(t, err, "different request")
+}
+
+func TestClaimAuthTokensMixed(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	dbHandler := models.NewMemDBHandler()
+	l := &LLMProxy{dbHandler: dbHandler}
+	refunded := &models.AuthToken{DocID: models.DocIDForAuthToken([]byte("t1"))}
+	refunded.Refund(false)
+	assert.Nil(t, dbHandler.Upsert(ctx, refunded))
+
+	tokens := []verifiedToken{singleCreditToken("t1"), singleCreditToken("t3")}
+	authTokens, _, err := l.fetchAuthTokens(ctx, tokens, 2, confs.ModelChatGPT41, []byte("req"))
+	assert.Nil(t, err)
+	// Changes the ETag of t1 like a concurrent claim would, so the new t3 must not stay claimed either.
+	assert.Nil(t, dbHandler.Upsert(ctx, refunded))
+	assert.ErrorContains(t, l.claimAuthTokens(ctx, authTokens), "being redeemed")
+
+	t3 := &models.AuthToken{DocID: models.DocIDForAuthToken([]byte("t3"))}
+	assert.Nil(t, dbHandler.Fetch(ctx, t3))
+	assert.Equal(t, models.AuthTokenStateFailedRefundable, t3.State)
+}
+
+func TestRedemptionOfDenominations(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	dbHandler := models.NewMemDBHandler()
+	l := &LLMProxy{dbHandler: dbHandler}
+	five := verifiedToken{LLMProxyTokenPair: LLMProxyTokenPair{Token: []byte("t5")}, KeyID: "k5", Denomination: 5}
+	redeem := func(tokens []verifiedToken, creditsRequired int, reqBytes []byte) ([]*models.AuthToken, int, error) {
+		authTokens, creditsLeft, err := l.fetchAuthTokens(ctx, tokens, creditsRequired, confs.ModelChatGPT41, reqBytes)
+		if err != nil {
+			return nil, 0, err
+		}
+		assert.Nil(t, l.claimAuthTokens(ctx, authTokens))
+		authTokens[0].CachedResponse = reqBytes
+		assert.Nil(t, l.completeAuthTokens(ctx, authTokens))
+		return authTokens, creditsLeft, nil
+	}
+
+	authTokens, creditsLeft, err := redeem([]verifiedToken{five}, 2, []byte("turn 1"))
+	assert.Nil(t, err)
+	assert.Len(t, authTokens, 2)
+	assert.Equal(t, 3, creditsLeft)
+
+	// The rest of the token pays for the next turns.
+	_, creditsLeft, err = redeem([]verifiedToken{five}, 1, []byte("turn 2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, creditsLeft)
+	retried, _, err := l.fetchAuthTokens(ctx, []verifiedToken{five}, 2, confs.ModelChatGPT41, []byte("turn 1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("turn 1"), retried[0].CachedResponse)
+
+	_, _, err = l.fetchAuthTokens(ctx, []verifiedToken{five}, 3, confs.ModelChatGPT41, []byte("turn 3"))
+	assert.ErrorContains(t, err, "different request")
+	// Topped up with another token, the last turn takes what's left of the first one.
+	one := singleCreditToken("t1")
+	authTokens, creditsLeft, err = redeem([]verifiedToken{five, one}, 3, []byte("turn 3"))
+	assert.Nil(t, err)
+	assert.Len(t, authTokens, 3)
+	assert.Equal(t, 0, creditsLeft)
+	assert.Equal(t, models.DocIDForAuthToken([]byte("t1")), authTokens[2].DocID)
+
+	// Tokens not needed for the request aren't burnt.
+	_, _, err = l.fetchAuthTokens(ctx, []verifiedToken{singleCreditToken("t2"), singleCreditToken("t3")}, 1,
+		confs.ModelChatGPT41, []byte("turn 4"))
+	assert.ErrorContains(t, err, "isn't needed")
+
+	// The credits of a token are read in one query, not one by one.
+	counting := &countingDBHandler{DBHandler: dbHandler}
+	l.dbHandler = counting
+	retried, _, err = l.fetchAuthTokens(ctx, []verifiedToken{five}, 2, confs.ModelChatGPT41, []byte("turn 1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("turn 1"), retried[0].CachedResponse)
+	assert.Equal(t, 0, counting.fetches)
+	assert.Equal(t, 1, counting.queries)
+}
+
+// countingDBHandler counts the reads going to storage.
+type countingDBHandler struct {
+	models.DBHandler
+	fetches, queries int
+}
+
+func (d *countingDBHandler) Fetch(ctx context.Context, m models.Model) error {
+	d.fetches++
+	return d.DBHandler.Fetch(ctx, m)
+}
+
+func (d *countingDBHandler) QueryEq(ctx context.Context, m models.Model, field string, value any) ([][]byte, error) {
+	d.queries++
+	return d.DBHandler.QueryEq(ctx, m, field, value)
+}
+
+func singleCreditToken(token string) verifiedToken {
+	return verifiedToken{LLMProxyTokenPair: LLMProxyTokenPair{Token: []byte(token)}, KeyID: "k", Denomination: 1}
+}
@@ -2,35 +2,141 @@ package llm_proxy
 
 import (
 	"encoding/json"
+	"github.com/cockroachdb/errors"
 	"llmmask/src/common"
 	"llmmask/src/confs"
-	"log"
+	"llmmask/src/privacypass"
 	"net/http"
+	"net/url"
 )
 
+// TokenTypeVOPRF marks VOPRF tokens, Token is then the OPRF input and SignedToken its output. Not a Privacy Pass token
+// type, these are only redeemed here.
+const TokenTypeVOPRF uint16 = 0xF001
+
+// TokenTypePartiallyBlindRSA marks partially blind RSA tokens, signed by the shared issuer key for the metadata in
+// Denomination and ExpiryEpoch, see auth.TokenMetadata. Not a Privacy Pass token type either.
+const TokenTypePartiallyBlindRSA uint16 = 0xF002
+
 type LLMProxyExtraBodyReq struct {
 	Token       []byte
 	SignedToken []byte
+	KeyID       string `json:",omitempty"` // Key the token was signed under, see GET /api/v1/public-keys.
+	TokenType   uint16 `json:",omitempty"`
 	ModelName   string
+	// Tokens carries the extra credits for requests costing more than one, see CreditsRequiredForRequest. Tokens are
+	// worth their key's denomination, what a request doesn't use of them is spent by sending them again with later
+	// requests, see LLMProxyResponse.CreditsLeft.
+	Tokens []LLMProxyTokenPair `json:",omitempty"`
+	// Denomination and ExpiryEpoch of Token, only for partially blind tokens, see LLMProxyTokenPair.
+	Denomination int   `json:",omitempty"`
+	ExpiryEpoch  int64 `json:",omitempty"`
 }
 
-func DestURLForModel(modelName confs.ModelName) string {
-	switch modelName {
-	case confs.ModelGemini25Flash, confs.ModelGemini25Pro, confs.ModelGemini25FlashLite, confs.ModelGemini3Flash, confs.ModelGemini3Pro:
-		return "https://generativelanguage.googleapis.com/v1beta/openai/chat/completions"
-	case confs.ModelChatGPT41Mini, confs.ModelChatGPT41, confs.ModelChatGPT4o, confs.ModelChatGPTo1:
-		return "https://llmtoropenai.openai.azure.com/openai/v1/chat/completions"
-	default:
-		log.Panicf("unknown model name: %s", modelName)
-		panic("unreachable")
+type LLMProxyTokenPair struct {
+	Token       []byte
+	SignedToken []byte
+	KeyID       string `json:",omitempty"`
+	// TokenType is privacypass.TokenTypeBlindRSA for Privacy Pass tokens, Token is then the authenticator input and
+	// SignedToken the authenticator. TokenTypeVOPRF for VOPRF tokens, TokenTypePartiallyBlindRSA for partially blind
+	// ones, zero for our own blind RSA tokens.
+	TokenType uint16 `json:",omitempty"`
+	// Denomination and ExpiryEpoch are the metadata partially blind tokens were signed for, the model is the one of
+	// the request.
+	Denomination int   `json:",omitempty"`
+	ExpiryEpoch  int64 `json:",omitempty"`
+}
+
+// NoTokensError is for requests carrying no tokens at all, Privacy Pass clients get a challenge for them.
+type NoTokensError struct {
+	ModelName string
+}
+
+func (e *NoTokensError) Error() string {
+	return "no tokens sent for model " + e.ModelName
+}
+
+// PrivacyPassIssuerName is the issuer name of the model's challenges: its configured issuer, or the api server's
+// host shared by the models without one. Clients fetch the issuer directory from
+// https://<issuer name>/.well-known/private-token-issuer-directory.
+func PrivacyPassIssuerName(modelName confs.ModelName) string {
+	spec, err := confs.ModelSpecFor(modelName)
+	if err == nil && spec.PrivacyPassIssuer != "" {
+		return spec.PrivacyPassIssuer
 	}
+	issuerName := common.APIServerBaseURL()
+	if u, err := url.Parse(issuerName); err == nil && u.Host != "" {
+		issuerName = u.Host
+	}
+	return issuerName
+}
+
+// PrivacyPassChallenge is the challenge every Privacy Pass token of the model redeemed here must be for. It has no
+// redemption context, so tokens can be fetched ahead of time like our own ones, and the model is bound by the key.
+func PrivacyPassChallenge(modelName confs.ModelName) *privacypass.TokenChallenge {
+	return &privacypass.TokenChallenge{
+		TokenType:  privacypass.TokenTypeBlindRSA,
+		IssuerName: PrivacyPassIssuerName(modelName),
+	}
+}
+
+// privacyPassTokenPairs turns the PrivateToken credentials of the request into token pairs.
+func privacyPassTokenPairs(r *http.Request) ([]LLMProxyTokenPair, error) {
+	tokens, err := privacypass.AuthorizationTokens(r)
+	if err != nil {
+		return nil, err
+	}
+	var res []LLMProxyTokenPair
+	for _, token := range tokens {
+		res = append(res, LLMProxyTokenPair{
+			Token:       token.AuthenticatorInput(),
+			SignedToken: token.Authenticator,
+			TokenType:   token.TokenType,
+		})
+	}
+	return res, nil
+}
+
+// DestURLForModel picks one of the model's endpoints by weight, avoiding the tried ones if possible.
+func DestURLForModel(modelName confs.ModelName, tried ...string) (string, error) {
+	spec, err := confs.ModelSpecFor(modelName)
+	if err != nil {
+		return "", err
+	}
+	return spec.PickEndpoint(tried...).URL, nil
 }
 
 func (b *LLMProxyExtraBodyReq) Sanitize() error {
 	// TODO: Sanitize Errors.
+	seen := map[string]bool{}
+	for _, tokenPair := range b.AllTokens() {
+		if len(tokenPair.Token) == 0 || len(tokenPair.SignedToken) == 0 {
+			return errors.New("empty token")
+		}
+		if seen[string(tokenPair.Token)] {
+			return errors.New("same token sent more than once")
+		}
+		seen[string(tokenPair.Token)] = true
+	}
 	return nil
 }
 
+// AllTokens returns the primary Token/SignedToken pair followed by the extra Tokens.
+func (b *LLMProxyExtraBodyReq) AllTokens() []LLMProxyTokenPair {
+	var res []LLMProxyTokenPair
+	if len(b.Token) != 0 || len(b.SignedToken) != 0 {
+		res = append(res, LLMProxyTokenPair{
+			Token:        b.Token,
+			SignedToken:  b.SignedToken,
+			KeyID:        b.KeyID,
+			TokenType:    b.TokenType,
+			Denomination: b.Denomination,
+			ExpiryEpoch:  b.ExpiryEpoch,
+		})
+	}
+	return append(res, b.Tokens...)
+}
+
 func (b *LLMProxyExtraBodyReq) Bytes() []byte {
 	if b == nil {
 		return []byte{}
@@ -10,8 +10,21 @@ type LLMProxyResponse struct {
 	BlockedReason     string `json:"blocked_reason"`
 	SizeLimitExceeded bool   `json:"size_limit_exceeded"`
 	SizeLimitReason   string `json:"size_limit_reason"`
-	Metadata          []byte `json:"metadata"`
-	ProxyResponse     []byte `json:"proxy_response"`
+	CreditsRequired   int    `json:"credits_required,omitempty"`
+	// CreditsLeft is what the tokens of the request are still worth, they can be sent again to pay for other requests.
+	CreditsLeft   int    `json:"credits_left,omitempty"`
+	Metadata      []byte `json:"metadata"`
+	ProxyResponse []byte `json:"proxy_response"`
+	// IsStream is set when ProxyResponse holds the raw upstream SSE stream instead of a single JSON body.
+	IsStream bool `json:"is_stream"`
+
+	// streamed is set once the response was already written to the client while serving, transient.
+	streamed bool
+}
+
+// Streamed tells if the response was already relayed to the client, so nothing else should be written.
+func (b *LLMProxyResponse) Streamed() bool {
+	return b != nil && b.streamed
 }
 
 func (b *LLMProxyResponse) Bytes() []byte {
@@ -0,0 +1,102 @@
+package llm_proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/common"
+	"regexp"
+	"strings"
+)
+
+// RuleModerator is a local rule engine over keyword and regex blocklists, no network calls involved.
+// Every matching rule reports its category at its severity, and a blocklist match with the matched text.
+type RuleModerator struct {
+	rules []*moderationRule
+	// version is a hash of the rules, so cached verdicts don't outlive a rule edit.
+	version string
+}
+
+type moderationRule struct {
+	name     string
+	category string
+	severity int
+	keywords []string
+	regexes  []*regexp.Regexp
+}
+
+func NewRuleModerator(rulesConf []common.ModerationRuleConf) (*RuleModerator, error) {
+	var rules []*moderationRule
+	for _, ruleConf := range rulesConf {
+		if ruleConf.Name == "" || ruleConf.Category == "" {
+			return nil, errors.Newf("moderation rule needs a name and category: %+v", ruleConf)
+		}
+		if ruleConf.Severity < 0 || ruleConf.Severity > 7 {
+			return nil, errors.Newf("moderation rule %s severity must be in [0, 7]", ruleConf.Name)
+		}
+		rule := &moderationRule{
+			name:     ruleConf.Name,
+			category: ruleConf.Category,
+			severity: ruleConf.Severity,
+			keywords: common.Map(ruleConf.Keywords, strings.ToLower),
+		}
+		for _, expr := range ruleConf.Regexes {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid regex in moderation rule %s", ruleConf.Name)
+			}
+			rule.regexes = append(rule.regexes, re)
+		}
+		rules = append(rules, rule)
+	}
+	rulesHash := sha256.Sum256(common.Must(json.Marshal(rulesConf)))
+	return &RuleModerator{
+		rules:   rules,
+		version: hex.EncodeToString(rulesHash[:8]),
+	}, nil
+}
+
+func (m *RuleModerator) Name() string {
+	return ModerationProviderRules
+}
+
+func (m *RuleModerator) CacheKey() string {
+	return m.Name() + "@" + m.version
+}
+
+func (m *RuleModerator) AnalyzeContent(ctx context.Context, content *Content) (*ContentSafetyResponse, error) {
+	var responses []*ContentSafetyResponse
+	if content.ContentType != ContentTypeText {
+		// Rules only understand text.
+		return mergeContentSafetyResponses(), nil
+	}
+
+	lowered := strings.ToLower(content.Data)
+	for _, rule := range m.rules {
+		matchingText, ok := rule.match(content.Data, lowered)
+		if !ok {
+			continue
+		}
+		responses = append(responses, &ContentSafetyResponse{
+			CategoriesAnalysis: []CategoryAnalysis{{Category: rule.category, Severity: rule.severity}},
+			BlocklistsMatch:    []BlocklistMatch{{BlocklistName: rule.name, MatchingText: matchingText}},
+		})
+	}
+	return mergeContentSafetyResponses(responses...), nil
+}
+
+func (r *moderationRule) match(text, lowered string) (string, bool) {
+	for _, keyword := range r.keywords {
+		if keyword != "" && strings.Contains(lowered, keyword) {
+			return keyword, true
+		}
+	}
+	for _, re := range r.regexes {
+		if matched := re.FindString(text); matched != "" {
+			return matched, true
+		}
+	}
+	return "", false
+}
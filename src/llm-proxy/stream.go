@@ -0,0 +1,115 @@
+package llm_proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/cockroachdb/errors"
+	"io"
+	"llmmask/src/common"
+	"llmmask/src/log"
+	"net/http"
+)
+
+const (
+	sseContentType  = "text/event-stream"
+	sseReadBufBytes = 4096
+	// sseLLMMaskEvent carries the LLMProxyResponse envelope (without the proxy response) in stream mode, so clients
+	// can still learn about blocked or size limited requests.
+	sseLLMMaskEvent = "llmmask"
+)
+
+// IsStreamingRequest tells if the client asked for an OpenAI style `stream: true` chat completion.
+func IsStreamingRequest(req map[string]any) bool {
+	stream, ok := req["stream"].(bool)
+	return ok && stream
+}
+
+// relaySSE copies the upstream SSE body to the client as chunks arrive, flushing after every write. The response is
+// only started with the first chunk, headers and the envelope event first, see writeSSEEnvelope. Until then a failure
+// can still be reported with a normal error response.
+// The full stream is assembled and returned so that it can be cached against the auth token, along with whether the
+// response to the client was started.
+// NOTE: Once the first chunk is written, errors can't be reported to the client via a normal error response anymore.
+func relaySSE(ctx context.Context, w http.ResponseWriter, upstream io.Reader, envelope *LLMProxyResponse) ([]byte, bool,
+	error) {
+	flusher, ok := w.(http.Flusher)
+	common.Assert(ok, "relaySSE called with a response writer that can't flush")
+
+	assembled := &bytes.Buffer{}
+	buf := make([]byte, sseReadBufBytes)
+	relayed, clientGone := false, false
+	for {
+		n, readErr := upstream.Read(buf)
+		if n > 0 {
+			assembled.Write(buf[:n])
+			// Keep draining upstream even if the client went away, the answer is paid for and gets cached. The
+			// upstream call doesn't run under the client's context, see UpstreamRequestTimeout.
+			if !clientGone {
+				var err error
+				if !relayed {
+					w.Header().Set("Connection", "keep-alive")
+					err = writeSSEEnvelope(w, envelope)
+					relayed = true
+				}
+				if err == nil {
+					_, err = w.Write(buf[:n])
+				}
+				if err != nil {
+					log.Infof(ctx, "client went away mid stream, continuing to drain upstream: %v", err)
+					clientGone = true
+				} else {
+					flusher.Flush()
+				}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return assembled.Bytes(), relayed, errors.Wrapf(readErr, "failed to read upstream stream")
+		}
+	}
+	return assembled.Bytes(), relayed, nil
+}
+
+// writeSSEEnvelope starts a stream response with the LLMProxyResponse envelope (without the proxy response) as its
+// first event, so live and replayed streams look the same to clients.
+func writeSSEEnvelope(w http.ResponseWriter, resp *LLMProxyResponse) error {
+	w.Header().Set("Content-Type", sseContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	envelope := *resp
+	envelope.ProxyResponse = nil
+	_, err := w.Write([]byte("event: " + sseLLMMaskEvent + "\ndata: " + string(envelope.Bytes()) + "\n\n"))
+	return err
+}
+
+// WriteStreamResponse writes an already computed LLMProxyResponse to the client in stream mode.
+// Used for cache replays, blocked requests and non 2xx upstream responses.
+func WriteStreamResponse(w http.ResponseWriter, resp *LLMProxyResponse) error {
+	err := writeSSEEnvelope(w, resp)
+	if err != nil {
+		return err
+	}
+	if resp.IsStream {
+		// Cached stream is the raw upstream SSE, replay as is.
+		_, err = w.Write(resp.ProxyResponse)
+	} else if len(resp.ProxyResponse) > 0 {
+		// SSE data can't span lines, so compact the JSON body first.
+		data := &bytes.Buffer{}
+		if json.Compact(data, resp.ProxyResponse) != nil {
+			data.Reset()
+			data.Write(bytes.ReplaceAll(resp.ProxyResponse, []byte("\n"), []byte(" ")))
+		}
+		_, err = w.Write([]byte("data: " + data.String() + "\n\n"))
+	}
+	if err != nil {
+		return err
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package llm_proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"llmmask/src/auth"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	"llmmask/src/locks"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"llmmask/src/privacypass"
+	"llmmask/src/secrets"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testStreamChunk1 = "data: {\"choices\": [{\"delta\": {\"content\": \"Hel\"}}]}\n\n"
+	testStreamChunk2 = "data: {\"choices\": [{\"delta\": {\"content\": \"lo\"}}]}\n\ndata: [DONE]\n\n"
+)
+
+// streamTestProxy proxies model "m" to upstream, paid for with Privacy Pass tokens of a fresh key.
+type streamTestProxy struct {
+	proxy      *LLMProxy
+	dbHandler  models.DBHandler
+	privateKey *rsa.PrivateKey
+}
+
+func newStreamTestProxy(t *testing.T, upstream http.Handler) *streamTestProxy {
+	log.Init()
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { _ = confs.InitModelRegistry(nil, nil) })
+	err := confs.InitModelRegistry([]common.ModelConfig{{
+		Name:         "m",
+		Provider:     confs.ProviderOpenAI,
+		Endpoints:    []common.ModelEndpointConfig{{URL: server.URL}},
+		APIKeys:      []string{"key"},
+		Capabilities: common.ModelCapabilities{Streaming: true},
+	}}, nil)
+	assert.Nil(t, err)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	authManager := auth.NewAuthManager(common.Must(confs.ModelSpecFor("m")), &secrets.RSAKeys{
+		PrivateKey:   privateKey,
+		PublicKey:    &privateKey.PublicKey,
+		KeyID:        "k1",
+		ModelName:    "m",
+		Denomination: 1,
+	})
+	kms, err := secrets.NewLocalKMS(common.Must(secrets.NewLocalMasterKeys("test")))
+	assert.Nil(t, err)
+	rules, err := NewRuleModerator(nil)
+	assert.Nil(t, err)
+	dbHandler := models.NewMemDBHandler()
+	proxy := NewLLMProxy(map[confs.ModelName]*auth.AuthManager{"m": authManager},
+		common.Must(NewAPIKeyManagerFromRegistry()), dbHandler, NewContentModerator(rules, dbHandler), kms,
+		locks.NewMemLocker())
+	return &streamTestProxy{proxy: proxy, dbHandler: dbHandler, privateKey: privateKey}
+}
+
+// newRequest is a streamed request for model "m", paying with a fresh token. The token's record is returned too.
+func (p *streamTestProxy) newRequest(t *testing.T, ctx context.Context) (*http.Request, *models.AuthToken) {
+	challenge := PrivacyPassChallenge("m")
+	tokenReq, state, err := privacypass.NewTokenRequest(&p.privateKey.PublicKey, challenge)
+	assert.Nil(t, err)
+	tokenResp, err := privacypass.Sign(p.privateKey, tokenReq)
+	assert.Nil(t, err)
+	token, err := state.Finalize(tokenResp)
+	assert.Nil(t, err)
+
+	body := `{"model": "m", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`
+	r := httptest.NewRequest(http.MethodPost, "/llm-proxy", strings.NewReader(body)).WithContext(ctx)
+	r.Header.Set("Authorization", privacypass.AuthorizationHeader(token))
+	return r, &models.AuthToken{DocID: models.DocIDForAuthTokenCredit(token.AuthenticatorInput(), 0)}
+}
+
+// streamEnvelope is the llmmask event a stream response starts with.
+func streamEnvelope(resp *LLMProxyResponse) string {
+	envelope := &LLMProxyResponse{Metadata: []byte("lgtm"), IsStream: true, CreditsLeft: resp.CreditsLeft}
+	return "event: " + sseLLMMaskEvent + "\ndata: " + string(envelope.Bytes()) + "\n\n"
+}
+
+// goneWriter is a client that goes away once the envelope and the first chunk of the answer reached it.
+type goneWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+	gone   chan struct{}
+	writes int
+	once   sync.Once
+}
+
+func (w *goneWriter) Write(data []byte) (int, error) {
+	select {
+	case <-w.gone:
+		return 0, context.Canceled
+	default:
+	}
+	n, err := w.ResponseRecorder.Write(data)
+	w.writes++
+	if w.writes == 2 {
+		w.once.Do(func() {
+			w.cancel()
+			close(w.gone)
+		})
+	}
+	return n, err
+}
+
+func TestStreamClientDisconnect(t *testing.T) {
+	gone := make(chan struct{})
+	upstreamCtxErr := make(chan error, 1)
+	p := newStreamTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", sseContentType)
+		_, _ = w.Write([]byte(testStreamChunk1))
+		w.(http.Flusher).Flush()
+		<-gone
+		_, _ = w.Write([]byte(testStreamChunk2))
+		upstreamCtxErr <- r.Context().Err()
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, authToken := p.newRequest(t, ctx)
+	w := &goneWriter{ResponseRecorder: httptest.NewRecorder(), cancel: cancel, gone: gone}
+
+	resp, err := p.proxy.ServeRequest(w, r)
+	assert.Nil(t, err)
+	assert.True(t, resp.Streamed())
+	// The client only got the first chunk, upstream kept going and the whole answer is paid for and cached.
+	assert.Equal(t, streamEnvelope(resp)+testStreamChunk1, w.Body.String())
+	assert.Nil(t, <-upstreamCtxErr)
+	assert.Equal(t, testStreamChunk1+testStreamChunk2, string(resp.ProxyResponse))
+	assert.Nil(t, p.dbHandler.Fetch(context.Background(), authToken))
+	assert.Equal(t, models.AuthTokenStateCompleted, authToken.State)
+	assert.NotEmpty(t, authToken.CachedResponse)
+}
+
+// breakConnection drops the connection mid answer, the proxy sees a read error.
+func breakConnection(t *testing.T, w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	assert.Nil(t, err)
+	_ = conn.Close()
+}
+
+func TestStreamUpstreamErrorAfterRelaying(t *testing.T) {
+	p := newStreamTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", sseContentType)
+		_, _ = w.Write([]byte(testStreamChunk1))
+		w.(http.Flusher).Flush()
+		breakConnection(t, w)
+	}))
+	r, authToken := p.newRequest(t, context.Background())
+	w := httptest.NewRecorder()
+
+	resp, err := p.proxy.ServeRequest(w, r)
+	assert.Nil(t, err)
+	assert.True(t, resp.Streamed())
+	// The client has part of the answer, so the token paid for it.
+	assert.Equal(t, streamEnvelope(resp)+testStreamChunk1, w.Body.String())
+	assert.Nil(t, p.dbHandler.Fetch(context.Background(), authToken))
+	assert.Equal(t, models.AuthTokenStateCompleted, authToken.State)
+}
+
+func TestStreamUpstreamErrorBeforeRelaying(t *testing.T) {
+	p := newStreamTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", sseContentType)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		breakConnection(t, w)
+	}))
+	r, authToken := p.newRequest(t, context.Background())
+	w := httptest.NewRecorder()
+
+	resp, err := p.proxy.ServeRequest(w, r)
+	assert.NotNil(t, err)
+	// Nothing reached the client, the error can still go out as a normal response and the token is refunded for a
+	// retry of the request.
+	assert.False(t, resp.Streamed())
+	assert.False(t, w.Flushed)
+	assert.Empty(t, w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Body.String())
+	assert.Nil(t, p.dbHandler.Fetch(context.Background(), authToken))
+	assert.Equal(t, models.AuthTokenStateFailedRefundable, authToken.State)
+	assert.NotEmpty(t, authToken.RequestHash)
+}
+
+func TestStreamUsageIncludedUpstream(t *testing.T) {
+	const usageChunk = "data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 3, \"completion_tokens\": 4}}\n\n"
+	p := newStreamTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := map[string]any{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, map[string]any{"include_usage": true}, req["stream_options"])
+		w.Header().Set("Content-Type", sseContentType)
+		_, _ = w.Write([]byte(testStreamChunk1 + usageChunk + "data: [DONE]\n\n"))
+	}))
+	r, _ := p.newRequest(t, context.Background())
+	body, err := io.ReadAll(r.Body)
+	assert.Nil(t, err)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	header := r.Header.Clone()
+	w := httptest.NewRecorder()
+
+	resp, err := p.proxy.ServeRequest(w, r)
+	assert.Nil(t, err)
+	// The client didn't ask for usage, so it doesn't get the chunk, but the key is charged for it.
+	assert.Equal(t, streamEnvelope(resp)+testStreamChunk1+"data: [DONE]\n\n", w.Body.String())
+	assert.Equal(t, testStreamChunk1+"data: [DONE]\n\n", string(resp.ProxyResponse))
+	assert.Equal(t, int64(7), p.proxy.apiKeyManager.Health()[0].DailyTokens)
+
+	// A retry is replayed from the cache, and looks the same to the client.
+	retry := httptest.NewRequest(http.MethodPost, "/llm-proxy", bytes.NewReader(body))
+	retry.Header = header
+	replayed := httptest.NewRecorder()
+	_, err = p.proxy.ServeRequest(replayed, retry)
+	assert.Nil(t, err)
+	assert.Equal(t, w.Body.String(), replayed.Body.String())
+	assert.Equal(t, w.Header().Get("Content-Type"), replayed.Header().Get("Content-Type"))
+}
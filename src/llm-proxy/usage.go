@@ -0,0 +1,119 @@
+package llm_proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// ParseUsage reads the prompt and completion tokens from the `usage` of an OpenAI format response. For streams it's
+// the last chunk with usage, which OpenAI only sends with `stream_options.include_usage`, see includeStreamUsage. Zero
+// when not reported.
+func ParseUsage(body []byte, isStream bool) (int64, int64) {
+	usageResp := &struct {
+		Usage *openAIUsage `json:"usage"`
+	}{}
+	if !isStream {
+		if json.Unmarshal(body, usageResp) != nil || usageResp.Usage == nil {
+			return 0, 0
+		}
+		return int64(usageResp.Usage.PromptTokens), int64(usageResp.Usage.CompletionTokens)
+	}
+
+	var promptTokens, completionTokens int64
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+		if !ok {
+			continue
+		}
+		usageResp.Usage = nil
+		if json.Unmarshal(bytes.TrimSpace(data), usageResp) != nil || usageResp.Usage == nil {
+			continue
+		}
+		promptTokens = int64(usageResp.Usage.PromptTokens)
+		completionTokens = int64(usageResp.Usage.CompletionTokens)
+	}
+	return promptTokens, completionTokens
+}
+
+// includeStreamUsage sets `stream_options.include_usage` on an OpenAI format stream request, budgets are tracked from
+// the usage it makes upstream report. Also returns whether the client had asked for usage itself.
+func includeStreamUsage(proxyReqBody []byte) ([]byte, bool, error) {
+	req := map[string]any{}
+	err := json.Unmarshal(proxyReqBody, &req)
+	if err != nil {
+		return nil, false, err
+	}
+	streamOptions, _ := req["stream_options"].(map[string]any)
+	if streamOptions == nil {
+		streamOptions = map[string]any{}
+	}
+	clientWantsUsage, _ := streamOptions["include_usage"].(bool)
+	if clientWantsUsage {
+		return proxyReqBody, true, nil
+	}
+	streamOptions["include_usage"] = true
+	req["stream_options"] = streamOptions
+	proxyReqBody, err = json.Marshal(req)
+	return proxyReqBody, false, err
+}
+
+// usageStrippingReader drops the usage chunk includeStreamUsage makes OpenAI streams end with, for clients that
+// didn't ask for it. What's dropped is kept in Stripped, for the usage accounting.
+type usageStrippingReader struct {
+	upstream *bufio.Reader
+	// pending is the part of the current event not read yet, err what ended upstream.
+	pending  []byte
+	err      error
+	Stripped []byte
+}
+
+func newUsageStrippingReader(upstream io.Reader) *usageStrippingReader {
+	return &usageStrippingReader{upstream: bufio.NewReader(upstream)}
+}
+
+func (r *usageStrippingReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		var event []byte
+		event, r.err = r.readEvent()
+		if isUsageChunk(event) {
+			r.Stripped = append(r.Stripped, event...)
+		} else {
+			r.pending = event
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// readEvent reads up to and including the blank line ending an SSE event.
+func (r *usageStrippingReader) readEvent() ([]byte, error) {
+	var event []byte
+	for {
+		line, err := r.upstream.ReadBytes('\n')
+		event = append(event, line...)
+		if err != nil || len(bytes.TrimSpace(line)) == 0 {
+			return event, err
+		}
+	}
+}
+
+// isUsageChunk is true for the chunk with the usage of the whole stream, which has no choices.
+func isUsageChunk(event []byte) bool {
+	chunk := &struct {
+		Choices []json.RawMessage `json:"choices"`
+		Usage   *openAIUsage      `json:"usage"`
+	}{}
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+		if ok && json.Unmarshal(bytes.TrimSpace(data), chunk) == nil && chunk.Usage != nil && len(chunk.Choices) == 0 {
+			return true
+		}
+	}
+	return false
+}
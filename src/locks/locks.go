@@ -0,0 +1,148 @@
+package locks
+
+import (
+	"context"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/common"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	BackendMemory  = "memory"
+	BackendStorage = "storage"
+)
+
+// Locker hands out exclusive locks on keys. A lock is held through a lease that's renewed in the background until
+// released, so a crashed holder only blocks the key for the lease TTL.
+type Locker interface {
+	// Acquire blocks until the lock on key is held, or ctx is done.
+	Acquire(ctx context.Context, key string, ttl time.Duration) (*Lease, error)
+}
+
+// Lease is a held lock.
+type Lease struct {
+	Key     string
+	stop    chan struct{}
+	stopped sync.Once
+	release func(ctx context.Context) error
+}
+
+var defaultLocker Locker
+
+// NewLocker picks the locker for the storage config: storage locks for Cosmos, since it's shared by every instance,
+// memory locks for the single instance backends.
+func NewLocker(storageConf *common.StorageConfig, dbHandler models.DBHandler) (Locker, error) {
+	backend := ""
+	storageBackend := models.StorageBackendCosmos
+	if storageConf != nil {
+		backend = storageConf.Locks
+		storageBackend = common.ValueOR(storageConf.Backend, storageBackend)
+	}
+	if backend == "" {
+		backend = BackendMemory
+		if storageBackend == models.StorageBackendCosmos {
+			backend = BackendStorage
+		}
+	}
+	switch backend {
+	case BackendMemory:
+		return NewMemLocker(), nil
+	case BackendStorage:
+		return NewStoreLocker(dbHandler), nil
+	default:
+		return nil, errors.Newf("unknown locks backend: %s", backend)
+	}
+}
+
+func Init(ctx context.Context) {
+	defaultLocker = common.Must(NewLocker(common.PlatformCredsConfig().Storage, models.DefaultDBHandler()))
+}
+
+func DefaultLocker() Locker {
+	return defaultLocker
+}
+
+// newLease renews the lock every third of ttl until released. Failed renewals are retried until the lease lapses,
+// only a lapsed lease or one taken over, see models.ErrNotFound and models.ErrConflict, means the lock was lost. That's
+// logged, but the holder isn't interrupted.
+func newLease(key string, ttl time.Duration, renew func(ctx context.Context) error,
+	release func(ctx context.Context) error) *Lease {
+	lease := &Lease{
+		Key:     key,
+		stop:    make(chan struct{}),
+		release: release,
+	}
+	go func() {
+		expiresAt := time.Now().Add(ttl)
+		timer := time.NewTimer(ttl / 3)
+		defer timer.Stop()
+		for {
+			select {
+			case <-lease.stop:
+				return
+			case <-timer.C:
+				renewedAt := time.Now()
+				// A renewal that's still going when the lease lapses is too late anyway.
+				ctx, cancel := context.WithDeadline(context.Background(), expiresAt)
+				err := renew(ctx)
+				cancel()
+				switch {
+				case err == nil:
+					expiresAt = renewedAt.Add(ttl)
+					timer.Reset(ttl / 3)
+				case models.IsConflictErr(err) || models.IsNotFoundErr(err):
+					log.Errorf(ctx, "[ALERT]: Lost the lock on %s: %+v", key, err)
+					return
+				case !time.Now().Before(expiresAt):
+					log.Errorf(ctx, "[ALERT]: Lost the lock on %s, the lease lapsed while renewing failed: %+v", key, err)
+					return
+				default:
+					log.Infof(ctx, "Failed to renew the lock on %s, retrying: %v", key, err)
+					timer.Reset(ttl / 12)
+				}
+			}
+		}
+	}()
+	return lease
+}
+
+// Release gives up the lock, releasing more than once is a no-op.
+func (l *Lease) Release(ctx context.Context) {
+	l.stopped.Do(func() {
+		close(l.stop)
+		// Releasing must work even if the request that held the lock got cancelled.
+		ctx = context.WithoutCancel(ctx)
+		err := l.release(ctx)
+		if err != nil {
+			log.Errorf(ctx, "Failed to release the lock on %s, it's freed once the lease lapses: %+v", l.Key, err)
+		}
+	})
+}
+
+// AcquireAll locks every key, always in the same order so that holders of overlapping keys can't deadlock each
+// other. The returned func releases them all.
+func AcquireAll(ctx context.Context, locker Locker, ttl time.Duration, keys ...string) (func(), error) {
+	keys = slices.Clone(keys)
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	var leases []*Lease
+	release := func() {
+		for _, lease := range leases {
+			lease.Release(ctx)
+		}
+	}
+	for _, key := range keys {
+		lease, err := locker.Acquire(ctx, key, ttl)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		leases = append(leases, lease)
+	}
+	return release, nil
+}
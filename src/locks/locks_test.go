@@ -0,0 +1,147 @@
+package locks
+
+import (
+	"context"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testLockers() map[string]Locker {
+	return map[string]Locker{
+		BackendMemory:  NewMemLocker(),
+		BackendStorage: NewStoreLocker(models.NewMemDBHandler()),
+	}
+}
+
+func TestLockersExclusive(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	for name, locker := range testLockers() {
+		t.Run(name, func(t *testing.T) {
+			held, counter := 0, 0
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					lease, err := locker.Acquire(ctx, "key", time.Minute)
+					assert.Nil(t, err)
+					defer lease.Release(ctx)
+					held++
+					assert.Equal(t, 1, held)
+					counter++
+					time.Sleep(time.Millisecond)
+					held--
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, 10, counter)
+		})
+	}
+}
+
+func TestLockersLeases(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	for name, locker := range testLockers() {
+		t.Run(name, func(t *testing.T) {
+			// Renewed in the background, so still held well past the ttl.
+			lease, err := locker.Acquire(ctx, "renewed", 300*time.Millisecond)
+			assert.Nil(t, err)
+			timeoutCtx, cancel := context.WithTimeout(ctx, time.Second)
+			_, err = locker.Acquire(timeoutCtx, "renewed", time.Minute)
+			cancel()
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			lease.Release(ctx)
+			lease.Release(ctx)
+			lease, err = locker.Acquire(ctx, "renewed", time.Minute)
+			assert.Nil(t, err)
+			lease.Release(ctx)
+
+			// A holder that stopped renewing, like a crashed instance, loses the lock once the lease lapses.
+			crashed, err := locker.Acquire(ctx, "crashed", 200*time.Millisecond)
+			assert.Nil(t, err)
+			close(crashed.stop)
+			start := time.Now()
+			lease, err = locker.Acquire(ctx, "crashed", time.Minute)
+			assert.Nil(t, err)
+			assert.Greater(t, time.Since(start), 100*time.Millisecond)
+			// The lapsed holder's release must not free the new holder's lock.
+			crashed.release(ctx)
+			timeoutCtx, cancel = context.WithTimeout(ctx, 200*time.Millisecond)
+			_, err = locker.Acquire(timeoutCtx, "crashed", time.Minute)
+			cancel()
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			lease.Release(ctx)
+		})
+	}
+}
+
+func TestMemLockerEvictsIdleLocks(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	locker := NewMemLocker()
+	release, err := AcquireAll(ctx, locker, time.Minute, "b", "a", "b")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, locker.Len())
+	release()
+	assert.Equal(t, 0, locker.Len())
+
+	lapsed, err := locker.Acquire(ctx, "lapsed", time.Millisecond)
+	assert.Nil(t, err)
+	close(lapsed.stop)
+	time.Sleep(5 * time.Millisecond)
+	locker.lastEvict = time.Time{}
+	lease, err := locker.Acquire(ctx, "other", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, locker.Len())
+	lease.Release(ctx)
+}
+
+func TestLeaseRenewalRetries(t *testing.T) {
+	log.Init()
+	release := func(ctx context.Context) error { return nil }
+	renewals := func(renew func(n int) error) func() int {
+		var mu sync.Mutex
+		n := 0
+		lease := newLease("key", 120*time.Millisecond, func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			n++
+			return renew(n)
+		}, release)
+		t.Cleanup(func() { lease.Release(context.Background()) })
+		return func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return n
+		}
+	}
+
+	// A renewal failing for a while is retried, and the lease goes on being renewed.
+	flaky := renewals(func(n int) error {
+		if n <= 2 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	// Lost leases aren't renewed anymore.
+	conflict := renewals(func(n int) error { return errors.Wrapf(models.ErrConflict, "taken over") })
+	notFound := renewals(func(n int) error { return errors.Wrapf(models.ErrNotFound, "lapsed") })
+	// Neither are ones that lapsed while renewing failed.
+	failing := renewals(func(n int) error { return errors.New("transient") })
+
+	time.Sleep(500 * time.Millisecond)
+	assert.Greater(t, flaky(), 4)
+	assert.Equal(t, 1, conflict())
+	assert.Equal(t, 1, notFound())
+	lapsed := failing()
+	assert.Greater(t, lapsed, 1)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, lapsed, failing())
+}
@@ -0,0 +1,123 @@
+package locks
+
+import (
+	"context"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/confs"
+	"llmmask/src/models"
+	"sync"
+	"time"
+)
+
+// MemLocker locks within the process. Locks are dropped when released, and ones whose lease lapsed are evicted
+// every confs.IdleLockEvictionInterval, so the map only holds the locks in use.
+type MemLocker struct {
+	sync.Mutex
+	locks     map[string]*memLock
+	nextOwner uint64
+	lastEvict time.Time
+}
+
+type memLock struct {
+	owner     uint64
+	expiresAt time.Time
+	// released is closed once the lock is dropped, waking up the waiters.
+	released chan struct{}
+}
+
+func NewMemLocker() *MemLocker {
+	return &MemLocker{
+		locks:     make(map[string]*memLock),
+		lastEvict: time.Now(),
+	}
+}
+
+func (m *MemLocker) Acquire(ctx context.Context, key string, ttl time.Duration) (*Lease, error) {
+	for {
+		m.Lock()
+		now := time.Now()
+		m.evictLapsed(ctx, now)
+		lock, ok := m.locks[key]
+		if !ok || !now.Before(lock.expiresAt) {
+			if ok {
+				m.drop(key, lock)
+			}
+			m.nextOwner++
+			owner := m.nextOwner
+			m.locks[key] = &memLock{
+				owner:     owner,
+				expiresAt: now.Add(ttl),
+				released:  make(chan struct{}),
+			}
+			m.Unlock()
+			return newLease(key, ttl, func(ctx context.Context) error {
+				return m.renew(key, owner, ttl)
+			}, func(ctx context.Context) error {
+				return m.release(key, owner)
+			}), nil
+		}
+		released, wait := lock.released, lock.expiresAt.Sub(now)
+		m.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-released:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Len is the number of locks held, or lapsed and not evicted yet.
+func (m *MemLocker) Len() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.locks)
+}
+
+func (m *MemLocker) renew(key string, owner uint64, ttl time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	lock, ok := m.locks[key]
+	if !ok {
+		return errors.Wrapf(models.ErrNotFound, "lease lapsed")
+	}
+	if lock.owner != owner {
+		return errors.Wrapf(models.ErrConflict, "lease lapsed")
+	}
+	lock.expiresAt = time.Now().Add(ttl)
+	return nil
+}
+
+func (m *MemLocker) release(key string, owner uint64) error {
+	m.Lock()
+	defer m.Unlock()
+	lock, ok := m.locks[key]
+	if !ok || lock.owner != owner {
+		return errors.New("lease lapsed")
+	}
+	m.drop(key, lock)
+	return nil
+}
+
+// drop must be called with the mutex held.
+func (m *MemLocker) drop(key string, lock *memLock) {
+	delete(m.locks, key)
+	close(lock.released)
+}
+
+// evictLapsed must be called with the mutex held.
+func (m *MemLocker) evictLapsed(ctx context.Context, now time.Time) {
+	if now.Sub(m.lastEvict) < confs.IdleLockEvictionInterval(ctx) {
+		return
+	}
+	m.lastEvict = now
+	for key, lock := range m.locks {
+		if !now.Before(lock.expiresAt) {
+			m.drop(key, lock)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package locks
+
+import (
+	"context"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	"llmmask/src/models"
+	"sync"
+	"time"
+)
+
+// StoreLocker locks across instances through models.Lock documents. Taking a lock is a conditional create, or a
+// conditional replace of a lock whose lease lapsed, so exactly one contender wins.
+type StoreLocker struct {
+	dbHandler models.DBHandler
+}
+
+func NewStoreLocker(dbHandler models.DBHandler) *StoreLocker {
+	return &StoreLocker{dbHandler: dbHandler}
+}
+
+func (s *StoreLocker) Acquire(ctx context.Context, key string, ttl time.Duration) (*Lease, error) {
+	owner := common.RandomString(16)
+	pollInterval := confs.LockPollInterval(ctx)
+	for {
+		lock, err := s.tryAcquire(ctx, key, owner, ttl)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to lock %s", key)
+		}
+		if lock != nil {
+			// Renewals and the release both go by the ETag of the last write.
+			var mu sync.Mutex
+			return newLease(key, ttl, func(ctx context.Context) error {
+				mu.Lock()
+				defer mu.Unlock()
+				setLockExpiry(lock, ttl)
+				return s.dbHandler.Replace(ctx, lock)
+			}, func(ctx context.Context) error {
+				mu.Lock()
+				defer mu.Unlock()
+				return s.dbHandler.Delete(ctx, lock)
+			}), nil
+		}
+
+		// Jittered, so that waiters don't all come back together.
+		wait := pollInterval + time.Duration(common.RandomInt(int(pollInterval)))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// tryAcquire returns the lock document if it got the lock, nil if someone else holds it.
+func (s *StoreLocker) tryAcquire(ctx context.Context, key, owner string, ttl time.Duration) (*models.Lock, error) {
+	lock := &models.Lock{
+		DocID: models.DocIDForLock(key),
+		Owner: owner,
+	}
+	setLockExpiry(lock, ttl)
+	err := s.dbHandler.Create(ctx, lock)
+	if err == nil {
+		return lock, nil
+	}
+	if !models.IsConflictErr(err) {
+		return nil, err
+	}
+
+	held := &models.Lock{DocID: lock.DocID}
+	err = s.dbHandler.Fetch(ctx, held)
+	if models.IsNotFoundErr(err) {
+		// Released in the meantime, the next try creates it.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().UTC().Before(held.ExpiresAt) {
+		return nil, nil
+	}
+	// The holder crashed, take over its lapsed lease. Conditional on the fetched ETag, for a single winner.
+	held.Owner = owner
+	setLockExpiry(held, ttl)
+	err = s.dbHandler.Replace(ctx, held)
+	if models.IsConflictErr(err) || models.IsNotFoundErr(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return held, nil
+}
+
+func setLockExpiry(lock *models.Lock, ttl time.Duration) {
+	lock.ExpiresAt = time.Now().UTC().Add(ttl)
+	// Well past the lease, the document only goes away by itself for crashed holders.
+	lock.TTL = int(2*ttl/time.Second) + 60
+}
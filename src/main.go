@@ -6,6 +6,7 @@ import (
 	"llmmask/src/common"
 	"llmmask/src/confs"
 	llm_proxy "llmmask/src/llm-proxy"
+	"llmmask/src/locks"
 	"llmmask/src/log"
 	"llmmask/src/models"
 	"llmmask/src/secrets"
@@ -15,9 +16,10 @@ import (
 
 func Init(ctx context.Context) {
 	log.Init()
+	confs.Init(ctx)
 	models.Init(ctx)
 	secrets.Init(ctx)
-	common.InitGlobalSemaphoreManager()
+	locks.Init(ctx)
 	log.Infof(ctx, "Initialization Done!")
 }
 
@@ -25,24 +27,26 @@ func main() {
 	ctx := context.Background()
 	Init(ctx)
 
-	llmAPIKeys := common.PlatformCredsConfig().LLMAPIKeys
-	apiKeys := map[confs.ModelName][]common.SecretString{}
-	for modelName, plainAPIKeys := range llmAPIKeys {
-		apiKeys[modelName] = common.Map(plainAPIKeys, common.NewSecretString)
-	}
-	apiKeyManager := llm_proxy.NewAPIKeyManager(apiKeys)
+	apiKeyManager := common.Must(llm_proxy.NewAPIKeyManagerFromRegistry())
 	authManagers := map[confs.ModelName]*auth.AuthManager{}
 	for _, modelName := range confs.AllModels() {
-		authManagers[modelName] = auth.NewAuthManager(secrets.GetRSAKeysForModel(modelName))
+		rsaKeys := secrets.GetRSAKeysForModel(modelName)
+		if len(rsaKeys) == 0 {
+			// Not served till its keys are provisioned and the service restarted.
+			continue
+		}
+		modelSpec := common.Must(confs.ModelSpecFor(modelName))
+		authManagers[modelName] = auth.NewAuthManager(modelSpec, rsaKeys...)
 	}
 
 	dbHandler := models.DefaultDBHandler()
 
 	contentModeratorConf := common.PlatformCredsConfig().ContentModeratorConfig
-	contentModerator := llm_proxy.NewContentModerator(contentModeratorConf.Endpoint, contentModeratorConf.APIKey, dbHandler)
+	moderator := common.Must(llm_proxy.NewModeratorFromConfig(contentModeratorConf))
+	contentModerator := llm_proxy.NewContentModerator(moderator, dbHandler)
 
 	kms := secrets.DefaultKMS()
-	server := svc.NewService(8080, authManagers, apiKeyManager, dbHandler, contentModerator, kms)
+	server := svc.NewService(8080, authManagers, apiKeyManager, dbHandler, contentModerator, kms, locks.DefaultLocker())
 	server.Run()
 	os.Exit(0)
 }
@@ -0,0 +1,64 @@
+package models
+
+import "time"
+
+const (
+	APIKeyUsageContainer = "api_key_usage"
+)
+
+const (
+	APIKeyUsageDaily   = "daily"
+	APIKeyUsageMonthly = "monthly"
+)
+
+// APIKeyUsage is the tokens consumed by a provider API key in a day or a month, summed over all instances.
+// Only aggregates are kept, nothing links usage to users or their tokens.
+type APIKeyUsage struct {
+	DocID            string `json:"id"` // <KeyID>/<Period>
+	PartitionKey     string `json:"PartitionKey"`
+	KeyID            string
+	PeriodType       string // daily or monthly
+	Period           string // 2006-01-02 or 2006-01, UTC
+	PromptTokens     int64
+	CompletionTokens int64
+	Requests         int64
+	UpdatedAt        time.Time
+	ETag             string `json:"_etag,omitempty"`
+}
+
+func (u *APIKeyUsage) Container() string {
+	return APIKeyUsageContainer
+}
+
+func (u *APIKeyUsage) ItemID() string {
+	return u.DocID
+}
+
+func (u *APIKeyUsage) GetPartitionKey() string {
+	u.PartitionKey = DefaultPartitionKey
+	return u.PartitionKey
+}
+
+func (u *APIKeyUsage) GetETag() string {
+	return u.ETag
+}
+
+func (u *APIKeyUsage) SetETag(etag string) {
+	u.ETag = etag
+}
+
+func (u *APIKeyUsage) TotalTokens() int64 {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// APIKeyUsagePeriod is the period t falls in, for the period type.
+func APIKeyUsagePeriod(periodType string, t time.Time) string {
+	if periodType == APIKeyUsageMonthly {
+		return t.UTC().Format("2006-01")
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+func DocIDForAPIKeyUsage(keyID string, period string) string {
+	return keyID + "/" + period
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"fmt"
 	"time"
 )
 
@@ -12,16 +13,56 @@ const (
 	AuthTokenContainer = "auth_tokens"
 )
 
+// Redemption states of an AuthToken, each persisted before the step it guards.
+const (
+	// AuthTokenStateReserved tokens are claimed by a request that didn't call upstream yet.
+	AuthTokenStateReserved = "reserved"
+	// AuthTokenStateInFlight tokens have an upstream call going, they stay spent even if the server dies now.
+	AuthTokenStateInFlight = "in-flight"
+	// AuthTokenStateCompleted tokens are spent, CachedResponse has what they paid for.
+	AuthTokenStateCompleted = "completed"
+	// AuthTokenStateFailedRefundable tokens can be redeemed again. When RequestHash is kept upstream might have served
+	// the request already, so only that same request may redeem them.
+	AuthTokenStateFailedRefundable = "failed-refundable"
+)
+
+// AuthToken records the redemption of one credit of a token, tokens worth more have a record per credit, see
+// DocIDForAuthTokenCredit.
 type AuthToken struct {
-	DocID          string `json:"id"` // base64 of the token.
-	PartitionKey   string `json:"PartitionKey"`
+	DocID        string `json:"id"` // base64 of the token hash.
+	PartitionKey string `json:"PartitionKey"`
+	// TokenDocID is DocIDForAuthToken of the token, on the records of every credit so they're read in one query.
+	TokenDocID     string `json:",omitempty"`
 	ModelName      string
+	KeyID          string // Key the token was signed under, once that key expires the record only matters as a spent marker.
 	CreatedAt      time.Time
-	ExpiresAt      time.Time // TODO: Have a job that clears RequestHash and CachedResponse for already expired tokens. Maybe even move them to separate collection.
+	ExpiresAt      time.Time // Of the cached response, the token stays spent.
 	RequestHash    []byte
 	CachedResponse []byte // To not screw over customers over flaky network, wrapped with DEKWrapped
 	DEKWrapped     []byte
 	DEKKMSKeyID    string
+	// State of the redemption, records from before redemption states are completed.
+	State   string
+	StateAt time.Time
+	// TokenExpiresAt is when the token itself stops verifying, for tokens signed with an expiry. Past it the record
+	// isn't needed even as a spent marker.
+	TokenExpiresAt *time.Time `json:",omitempty"`
+	// Stripped records had everything but the spent marker removed by GCAuthTokens.
+	Stripped   bool
+	StrippedAt time.Time
+	// Issuance is set on the markers of blinded tokens signed one at a time, keyed by the blinded token.
+	Issuance *TokenIssuance `json:",omitempty"`
+	ETag     string         `json:"_etag,omitempty"`
+}
+
+// TokenIssuance keeps the signature of a blinded token, so that the user repeating the issuance gets it back instead
+// of being charged again. It's written before the debit, Charged once that went through.
+type TokenIssuance struct {
+	UserDocID          string
+	Denomination       int
+	ExpiryEpoch        int64 `json:",omitempty"`
+	SignedBlindedToken []byte
+	Charged            bool
 }
 
 func (u *AuthToken) Container() string {
@@ -32,6 +73,35 @@ func (u *AuthToken) ItemID() string {
 	return u.DocID
 }
 
+func (u *AuthToken) IsCompleted() bool {
+	return u.State == "" || u.State == AuthTokenStateCompleted
+}
+
+func (u *AuthToken) SetState(state string) {
+	u.State = state
+	u.StateAt = time.Now().UTC()
+}
+
+// Refund drops everything the failed redemption stored and makes the token redeemable again.
+// keepRequestHash once upstream was called, since it might have served the request.
+func (u *AuthToken) Refund(keepRequestHash bool) {
+	if !keepRequestHash {
+		u.RequestHash = nil
+	}
+	u.CachedResponse = nil
+	u.DEKWrapped = nil
+	u.DEKKMSKeyID = ""
+	u.SetState(AuthTokenStateFailedRefundable)
+}
+
+func (u *AuthToken) GetETag() string {
+	return u.ETag
+}
+
+func (u *AuthToken) SetETag(etag string) {
+	u.ETag = etag
+}
+
 func (u *AuthToken) GetPartitionKey() string {
 	// TODO: partition key might be useful here.
 	u.PartitionKey = DefaultPartitionKey
@@ -42,3 +112,12 @@ func DocIDForAuthToken(token []byte) string {
 	hash := sha256.Sum256(token)
 	return base64.StdEncoding.EncodeToString(hash[:])
 }
+
+// DocIDForAuthTokenCredit is the record of the i-th credit of a token. The first one is DocIDForAuthToken, so single
+// credit tokens are recorded like before denominations.
+func DocIDForAuthTokenCredit(token []byte, i int) string {
+	if i == 0 {
+		return DocIDForAuthToken(token)
+	}
+	return DocIDForAuthToken(fmt.Appendf(nil, "credit-%d/%s", i, token))
+}
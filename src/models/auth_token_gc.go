@@ -0,0 +1,182 @@
+package models
+
+import (
+	"context"
+	"github.com/cockroachdb/errors"
+	"time"
+)
+
+// AuthTokenGCOptions configures a GCAuthTokens run.
+type AuthTokenGCOptions struct {
+	// RecoverBefore refunds redemptions reserved or in flight since before it, zero skips recovery.
+	RecoverBefore time.Time
+	// StripBefore strips tokens whose ExpiresAt is before it.
+	StripBefore time.Time
+	// RetiredKeyIDs are keys no longer accepted for verification, the records of their tokens are deleted.
+	RetiredKeyIDs []string
+	BatchSize     int
+	// MaxBatches caps the queries of each phase.
+	MaxBatches int
+	// TokensExpiredBefore deletes the records of tokens whose TokenExpiresAt is before it, zero skips them.
+	TokensExpiredBefore time.Time
+}
+
+// AuthTokenGCReport is what a GCAuthTokens run processed.
+type AuthTokenGCReport struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	Scanned   int
+	Recovered int
+	Stripped  int
+	Deleted   int
+	// Truncated runs hit MaxBatches, and left records for the next run.
+	Truncated bool
+}
+
+// GCAuthTokens recovers crashed redemptions and cleans up spent auth tokens:
+//   - Tokens stuck reserved or in flight since RecoverBefore are refunded, see AuthToken.Refund.
+//   - Tokens past StripBefore lose their request hash, cached response and DEK. The record stays as a spent marker,
+//     so replays are still rejected.
+//   - Tokens signed under a retired key or past their own expiry are deleted outright, since they can't verify
+//     anymore.
+//
+// Tokens without a key ID predate key rotation, their markers are kept for good.
+func GCAuthTokens(ctx context.Context, dbHandler DBHandler, opts AuthTokenGCOptions) (*AuthTokenGCReport, error) {
+	report := &AuthTokenGCReport{
+		StartedAt: time.Now().UTC(),
+	}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt)
+	}()
+
+	if !opts.RecoverBefore.IsZero() {
+		for _, state := range []string{AuthTokenStateReserved, AuthTokenStateInFlight} {
+			filters := []QueryFilter{
+				{Field: "State", Op: QueryOpEq, Value: state},
+				{Field: "StateAt", Op: QueryOpLt, Value: opts.RecoverBefore},
+			}
+			done, err := gcAuthTokenBatches(ctx, dbHandler, opts, report, filters, func(authTokens []*AuthToken) error {
+				for _, authToken := range authTokens {
+					// Reserved tokens never made it upstream.
+					authToken.Refund(state == AuthTokenStateInFlight)
+					// One by one and conditional, the request might still finish in the meantime.
+					err := dbHandler.Replace(ctx, authToken)
+					if IsConflictErr(err) || IsNotFoundErr(err) {
+						continue
+					}
+					if err != nil {
+						return errors.Wrapf(err, "failed to recover auth token")
+					}
+					report.Recovered++
+				}
+				return nil
+			})
+			if err != nil {
+				return report, err
+			}
+			report.Truncated = report.Truncated || !done
+		}
+	}
+
+	filters := []QueryFilter{
+		{Field: "ExpiresAt", Op: QueryOpLt, Value: opts.StripBefore},
+		{Field: "Stripped", Op: QueryOpNe, Value: true},
+		// Refunded tokens are still worth a redemption.
+		{Field: "State", Op: QueryOpNe, Value: AuthTokenStateFailedRefundable},
+	}
+	done, err := gcAuthTokenBatches(ctx, dbHandler, opts, report, filters, func(authTokens []*AuthToken) error {
+		var stripped []Model
+		for _, authToken := range authTokens {
+			authToken.RequestHash = nil
+			authToken.CachedResponse = nil
+			authToken.DEKWrapped = nil
+			authToken.DEKKMSKeyID = ""
+			authToken.Stripped = true
+			authToken.StrippedAt = time.Now().UTC()
+			stripped = append(stripped, authToken)
+		}
+		err := dbHandler.UpsertBatch(ctx, stripped...)
+		if err != nil {
+			return errors.Wrapf(err, "failed to strip auth tokens")
+		}
+		report.Stripped += len(stripped)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Truncated = report.Truncated || !done
+
+	deleteAuthTokens := func(authTokens []*AuthToken) error {
+		for _, authToken := range authTokens {
+			err := dbHandler.Delete(ctx, authToken)
+			if IsConflictErr(err) {
+				// Changed since the query, the next run gets it.
+				continue
+			}
+			if err != nil && !IsNotFoundErr(err) {
+				return errors.Wrapf(err, "failed to delete auth token")
+			}
+			report.Deleted++
+		}
+		return nil
+	}
+	var deleteFilters [][]QueryFilter
+	for _, keyID := range opts.RetiredKeyIDs {
+		if keyID != "" {
+			deleteFilters = append(deleteFilters, []QueryFilter{{Field: "KeyID", Op: QueryOpEq, Value: keyID}})
+		}
+	}
+	if !opts.TokensExpiredBefore.IsZero() {
+		deleteFilters = append(deleteFilters, []QueryFilter{
+			{Field: "TokenExpiresAt", Op: QueryOpLt, Value: opts.TokensExpiredBefore},
+		})
+	}
+	for _, filters := range deleteFilters {
+		done, err := gcAuthTokenBatches(ctx, dbHandler, opts, report, filters, deleteAuthTokens)
+		if err != nil {
+			return report, err
+		}
+		report.Truncated = report.Truncated || !done
+	}
+	return report, nil
+}
+
+// gcAuthTokenBatches queries the tokens matching filters batch by batch and hands them to process, which must make
+// them stop matching. It returns whether it ran out of tokens before MaxBatches.
+func gcAuthTokenBatches(
+	ctx context.Context,
+	dbHandler DBHandler,
+	opts AuthTokenGCOptions,
+	report *AuthTokenGCReport,
+	filters []QueryFilter,
+	process func(authTokens []*AuthToken) error,
+) (bool, error) {
+	for range opts.MaxBatches {
+		items, err := dbHandler.Query(ctx, &AuthToken{}, opts.BatchSize, filters...)
+		if err != nil {
+			return false, err
+		}
+		if len(items) == 0 {
+			return true, nil
+		}
+		var authTokens []*AuthToken
+		for _, item := range items {
+			authToken := &AuthToken{}
+			err = Deserialize(item, authToken)
+			if err != nil {
+				return false, errors.Wrapf(err, "failed to deserialize auth token")
+			}
+			authTokens = append(authTokens, authToken)
+		}
+		report.Scanned += len(authTokens)
+		err = process(authTokens)
+		if err != nil {
+			return false, err
+		}
+		if len(items) < opts.BatchSize {
+			return true, nil
+		}
+	}
+	return false, nil
+}
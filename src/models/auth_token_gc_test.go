@@ -0,0 +1,153 @@
+package models
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/common"
+	"testing"
+	"time"
+)
+
+func TestGCAuthTokens(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for name, dbHandler := range localDBHandlers(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, authToken := range []*AuthToken{
+				{DocID: "expired1", KeyID: "k1", ExpiresAt: now.Add(-time.Hour), CachedResponse: []byte("c"), DEKWrapped: []byte("d")},
+				{DocID: "expired2", KeyID: "k1", ExpiresAt: now.Add(-2 * time.Hour), RequestHash: []byte("h")},
+				{DocID: "expired3", ExpiresAt: now.Add(-3 * time.Hour), DEKKMSKeyID: "kms"},
+				{DocID: "live", KeyID: "k1", ExpiresAt: now.Add(time.Hour), CachedResponse: []byte("c")},
+				{DocID: "retired1", KeyID: "k0", ExpiresAt: now.Add(-time.Hour)},
+				{DocID: "retired2", KeyID: "k0", ExpiresAt: now.Add(time.Hour)},
+			} {
+				assert.Nil(t, dbHandler.Upsert(ctx, authToken))
+			}
+			opts := AuthTokenGCOptions{
+				StripBefore:   now,
+				RetiredKeyIDs: []string{"k0"},
+				BatchSize:     2,
+				MaxBatches:    10,
+			}
+
+			report, err := GCAuthTokens(ctx, dbHandler, opts)
+			assert.Nil(t, err)
+			assert.Equal(t, 4, report.Stripped)
+			assert.Equal(t, 2, report.Deleted)
+			assert.Equal(t, 6, report.Scanned)
+			assert.False(t, report.Truncated)
+
+			for _, docID := range []string{"expired1", "expired2", "expired3"} {
+				authToken := &AuthToken{DocID: docID}
+				assert.Nil(t, dbHandler.Fetch(ctx, authToken))
+				assert.True(t, authToken.Stripped)
+				assert.Nil(t, authToken.RequestHash)
+				assert.Nil(t, authToken.CachedResponse)
+				assert.Nil(t, authToken.DEKWrapped)
+				assert.Empty(t, authToken.DEKKMSKeyID)
+			}
+			live := &AuthToken{DocID: "live"}
+			assert.Nil(t, dbHandler.Fetch(ctx, live))
+			assert.False(t, live.Stripped)
+			assert.Equal(t, []byte("c"), live.CachedResponse)
+			for _, docID := range []string{"retired1", "retired2"} {
+				assert.True(t, IsNotFoundErr(dbHandler.Fetch(ctx, &AuthToken{DocID: docID})))
+			}
+
+			// Stripped markers aren't picked up again.
+			report, err = GCAuthTokens(ctx, dbHandler, opts)
+			assert.Nil(t, err)
+			assert.Equal(t, 0, report.Scanned)
+		})
+	}
+}
+
+func TestGCAuthTokensTruncates(t *testing.T) {
+	ctx := context.Background()
+	dbHandler := NewMemDBHandler()
+	now := time.Now().UTC()
+	for _, docID := range []string{"a", "b", "c"} {
+		assert.Nil(t, dbHandler.Upsert(ctx, &AuthToken{DocID: docID, ExpiresAt: now.Add(-time.Hour)}))
+	}
+	opts := AuthTokenGCOptions{StripBefore: now, BatchSize: 1, MaxBatches: 2}
+
+	report, err := GCAuthTokens(ctx, dbHandler, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Stripped)
+	assert.True(t, report.Truncated)
+
+	report, err = GCAuthTokens(ctx, dbHandler, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Stripped)
+	assert.False(t, report.Truncated)
+}
+
+func TestGCAuthTokensRecoversStuckRedemptions(t *testing.T) {
+	ctx := context.Background()
+	dbHandler := NewMemDBHandler()
+	now := time.Now().UTC()
+	expiresAt := now.Add(24 * time.Hour)
+	for _, authToken := range []*AuthToken{
+		{DocID: "reserved", State: AuthTokenStateReserved, StateAt: now.Add(-time.Hour), RequestHash: []byte("h"), ExpiresAt: expiresAt},
+		{DocID: "in-flight", State: AuthTokenStateInFlight, StateAt: now.Add(-time.Hour), RequestHash: []byte("h"), ExpiresAt: expiresAt},
+		{DocID: "recent", State: AuthTokenStateInFlight, StateAt: now, RequestHash: []byte("h"), ExpiresAt: expiresAt},
+		{DocID: "refunded", State: AuthTokenStateFailedRefundable, StateAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Hour)},
+	} {
+		assert.Nil(t, dbHandler.Upsert(ctx, authToken))
+	}
+
+	report, err := GCAuthTokens(ctx, dbHandler, AuthTokenGCOptions{
+		RecoverBefore: now.Add(-time.Minute),
+		StripBefore:   now,
+		BatchSize:     10,
+		MaxBatches:    10,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Recovered)
+	// Refunded tokens aren't spent, so they're not stripped.
+	assert.Equal(t, 0, report.Stripped)
+
+	fetch := func(docID string) *AuthToken {
+		authToken := &AuthToken{DocID: docID}
+		assert.Nil(t, dbHandler.Fetch(ctx, authToken))
+		return authToken
+	}
+	reserved := fetch("reserved")
+	assert.Equal(t, AuthTokenStateFailedRefundable, reserved.State)
+	assert.Nil(t, reserved.RequestHash)
+	inFlight := fetch("in-flight")
+	assert.Equal(t, AuthTokenStateFailedRefundable, inFlight.State)
+	// Upstream might have served it, only the same request may retry.
+	assert.Equal(t, []byte("h"), inFlight.RequestHash)
+	assert.Equal(t, AuthTokenStateInFlight, fetch("recent").State)
+	assert.False(t, fetch("refunded").Stripped)
+}
+
+func TestGCAuthTokensDeletesExpiredTokens(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for name, dbHandler := range localDBHandlers(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, authToken := range []*AuthToken{
+				{DocID: "expired", TokenExpiresAt: common.ToPtr(now.Add(-time.Hour)), ExpiresAt: now.Add(time.Hour)},
+				{DocID: "valid", TokenExpiresAt: common.ToPtr(now.Add(time.Hour)), ExpiresAt: now.Add(time.Hour)},
+				// Tokens without an expiry are kept.
+				{DocID: "no-expiry", ExpiresAt: now.Add(time.Hour)},
+			} {
+				assert.Nil(t, dbHandler.Upsert(ctx, authToken))
+			}
+
+			report, err := GCAuthTokens(ctx, dbHandler, AuthTokenGCOptions{
+				StripBefore:         now,
+				TokensExpiredBefore: now,
+				BatchSize:           10,
+				MaxBatches:          10,
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, 1, report.Deleted)
+			assert.True(t, IsNotFoundErr(dbHandler.Fetch(ctx, &AuthToken{DocID: "expired"})))
+			assert.Nil(t, dbHandler.Fetch(ctx, &AuthToken{DocID: "valid"}))
+			assert.Nil(t, dbHandler.Fetch(ctx, &AuthToken{DocID: "no-expiry"}))
+		})
+	}
+}
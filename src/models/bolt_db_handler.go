@@ -0,0 +1,174 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"github.com/cockroachdb/errors"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// BoltDBHandler stores documents in a single local bbolt file, one bucket per container.
+// Good enough for self-hosted single instance deployments and offline development.
+type BoltDBHandler struct {
+	db *bolt.DB
+}
+
+func NewBoltDBHandler(path string) (*BoltDBHandler, error) {
+	if path == "" {
+		return nil, errors.New("bolt storage needs a file path")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open bolt db at %s", path)
+	}
+	return &BoltDBHandler{db: db}, nil
+}
+
+func (d *BoltDBHandler) Close() error {
+	return d.db.Close()
+}
+
+func boltKey(m Model) []byte {
+	return []byte(m.GetPartitionKey() + "/" + m.ItemID())
+}
+
+func (d *BoltDBHandler) Upsert(ctx context.Context, m Model) error {
+	return errors.Wrapf(d.writeBatch([]Model{m}, nil), "failed to upsert")
+}
+
+func (d *BoltDBHandler) UpsertBatch(ctx context.Context, ms ...Model) error {
+	return errors.Wrapf(d.writeBatch(ms, nil), "failed to upsert batch")
+}
+
+func (d *BoltDBHandler) Create(ctx context.Context, ms ...Model) error {
+	err := d.writeBatch(ms, func(existing []byte, m Model) error {
+		if existing != nil {
+			return ErrConflict
+		}
+		return nil
+	})
+	return errors.Wrapf(err, "failed to create")
+}
+
+func (d *BoltDBHandler) Replace(ctx context.Context, ms ...Model) error {
+	err := d.writeBatch(ms, func(existing []byte, m Model) error {
+		if existing == nil {
+			return ErrNotFound
+		}
+		if etag := etagOf(m); etag != "" && etag != storedETag(existing) {
+			return ErrConflict
+		}
+		return nil
+	})
+	return errors.Wrapf(err, "failed to replace")
+}
+
+// writeBatch stores all the models if check (when set) passes for every one of them. It's a single bolt transaction,
+// so either everything lands or nothing does.
+func (d *BoltDBHandler) writeBatch(ms []Model, check func(existing []byte, m Model) error) error {
+	if err := checkSameBatch(ms); err != nil {
+		return err
+	}
+	if len(ms) == 0 {
+		return nil
+	}
+	etags := make([]string, len(ms))
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(ms[0].Container()))
+		if err != nil {
+			return err
+		}
+		for i, m := range ms {
+			if check != nil {
+				if err = check(bucket.Get(boltKey(m)), m); err != nil {
+					return errors.Wrapf(err, "%s/%s", m.Container(), m.ItemID())
+				}
+			}
+			var data []byte
+			data, etags[i], err = marshalWithETag(m)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(boltKey(m), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, m := range ms {
+		setETag(m, etags[i])
+	}
+	return nil
+}
+
+func (d *BoltDBHandler) Delete(ctx context.Context, m Model) error {
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(m.Container()))
+		if bucket == nil || bucket.Get(boltKey(m)) == nil {
+			return ErrNotFound
+		}
+		if etag := etagOf(m); etag != "" && etag != storedETag(bucket.Get(boltKey(m))) {
+			return ErrConflict
+		}
+		return bucket.Delete(boltKey(m))
+	})
+	return errors.Wrapf(err, "failed to delete")
+}
+
+func (d *BoltDBHandler) Fetch(ctx context.Context, m Model) error {
+	var data []byte
+	err := d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(m.Container()))
+		if bucket == nil {
+			return ErrNotFound
+		}
+		val := bucket.Get(boltKey(m))
+		if val == nil {
+			return ErrNotFound
+		}
+		// Bolt values are only valid inside the transaction.
+		data = append([]byte{}, val...)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch")
+	}
+	return Deserialize(data, m)
+}
+
+func (d *BoltDBHandler) QueryEq(ctx context.Context, m Model, field string, value any) ([][]byte, error) {
+	return d.Query(ctx, m, 0, QueryFilter{Field: field, Op: QueryOpEq, Value: value})
+}
+
+func (d *BoltDBHandler) Query(ctx context.Context, m Model, limit int, filters ...QueryFilter) ([][]byte, error) {
+	var res [][]byte
+	prefix := []byte(m.GetPartitionKey() + "/")
+	err := d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(m.Container()))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if limit > 0 && len(res) == limit {
+				break
+			}
+			ok, err := matchesFilters(v, filters)
+			if err != nil {
+				return err
+			}
+			if ok {
+				res = append(res, append([]byte{}, v...))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query %s", m.Container())
+	}
+	return res, nil
+}
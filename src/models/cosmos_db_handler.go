@@ -0,0 +1,250 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/common"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CosmosDBHandler stores the models in Azure Cosmos DB, one container per model type.
+type CosmosDBHandler struct {
+	client       *azcosmos.Client
+	databaseName string
+}
+
+func NewCosmosDBHandler(cosmosCreds *common.CosmosDBCredsConfig) (*CosmosDBHandler, error) {
+	if cosmosCreds == nil {
+		return nil, errors.New("cosmos creds not configured")
+	}
+	connString := cosmosCreds.ConnectionString
+	client, err := azcosmos.NewClientFromConnectionString(connString, nil)
+	if err != nil {
+		return nil, err
+	}
+	databaseName := cosmosCreds.DatabaseName
+	return &CosmosDBHandler{client: client, databaseName: databaseName}, nil
+}
+
+func (d *CosmosDBHandler) Upsert(ctx context.Context, m Model) error {
+	m.GetPartitionKey() // Fill it
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	resp, err := d.ContainerRef(m).UpsertItem(
+		ctx,
+		azcosmos.NewPartitionKeyString(m.GetPartitionKey()),
+		data,
+		nil,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to upsert")
+	}
+	setETag(m, string(resp.ETag))
+	return nil
+}
+
+func (d *CosmosDBHandler) UpsertBatch(ctx context.Context, ms ...Model) error {
+	if err := checkSameBatch(ms); err != nil {
+		return err
+	}
+	if len(ms) == 0 {
+		return nil
+	}
+	if len(ms) == 1 {
+		return d.Upsert(ctx, ms[0])
+	}
+
+	partitionKey := azcosmos.NewPartitionKeyString(ms[0].GetPartitionKey())
+	containerRef := d.ContainerRef(ms[0])
+	batch := containerRef.NewTransactionalBatch(partitionKey)
+	for _, m := range ms {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		batch.UpsertItem(data, nil)
+	}
+	resp, err := containerRef.ExecuteTransactionalBatch(ctx, batch, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to upsert batch")
+	}
+	if !resp.Success {
+		for i, result := range resp.OperationResults {
+			if result.StatusCode != http.StatusFailedDependency {
+				return errors.Newf("failed to upsert batch, item %s failed with status %d", ms[i].ItemID(), result.StatusCode)
+			}
+		}
+		return errors.New("failed to upsert batch")
+	}
+	for i, result := range resp.OperationResults {
+		setETag(ms[i], string(result.ETag))
+	}
+	return nil
+}
+
+func (d *CosmosDBHandler) Create(ctx context.Context, ms ...Model) error {
+	return d.executeBatch(ctx, "create", ms, func(batch *azcosmos.TransactionalBatch, m Model, data []byte) {
+		batch.CreateItem(data, nil)
+	})
+}
+
+func (d *CosmosDBHandler) Replace(ctx context.Context, ms ...Model) error {
+	return d.executeBatch(ctx, "replace", ms, func(batch *azcosmos.TransactionalBatch, m Model, data []byte) {
+		var options *azcosmos.TransactionalBatchItemOptions
+		if etag := etagOf(m); etag != "" {
+			ifMatch := azcore.ETag(etag)
+			options = &azcosmos.TransactionalBatchItemOptions{IfMatchETag: &ifMatch}
+		}
+		batch.ReplaceItem(m.ItemID(), data, options)
+	})
+}
+
+// executeBatch runs one op per model as a transactional batch, and hands the new ETags to Versioned models.
+// A conflicting or missing item fails the batch with that item's status.
+func (d *CosmosDBHandler) executeBatch(ctx context.Context, opName string, ms []Model,
+	addOp func(batch *azcosmos.TransactionalBatch, m Model, data []byte)) error {
+	if err := checkSameBatch(ms); err != nil {
+		return err
+	}
+	if len(ms) == 0 {
+		return nil
+	}
+
+	partitionKey := azcosmos.NewPartitionKeyString(ms[0].GetPartitionKey())
+	containerRef := d.ContainerRef(ms[0])
+	batch := containerRef.NewTransactionalBatch(partitionKey)
+	for _, m := range ms {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		addOp(&batch, m, data)
+	}
+	resp, err := containerRef.ExecuteTransactionalBatch(ctx, batch, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to %s batch", opName)
+	}
+	if !resp.Success {
+		for i, result := range resp.OperationResults {
+			if result.StatusCode == http.StatusFailedDependency {
+				continue
+			}
+			var cause error
+			switch result.StatusCode {
+			case http.StatusConflict, http.StatusPreconditionFailed:
+				cause = ErrConflict
+			case http.StatusNotFound:
+				cause = ErrNotFound
+			default:
+				cause = errors.Newf("status %d", result.StatusCode)
+			}
+			return errors.Wrapf(cause, "failed to %s batch, item %s failed", opName, ms[i].ItemID())
+		}
+		return errors.Newf("failed to %s batch", opName)
+	}
+	for i, result := range resp.OperationResults {
+		setETag(ms[i], string(result.ETag))
+	}
+	return nil
+}
+
+func (d *CosmosDBHandler) Delete(ctx context.Context, m Model) error {
+	m.GetPartitionKey() // Fill it
+	var options *azcosmos.ItemOptions
+	if etag := etagOf(m); etag != "" {
+		ifMatch := azcore.ETag(etag)
+		options = &azcosmos.ItemOptions{IfMatchEtag: &ifMatch}
+	}
+	_, err := d.ContainerRef(m).DeleteItem(
+		ctx,
+		azcosmos.NewPartitionKeyString(m.GetPartitionKey()),
+		m.ItemID(),
+		options,
+	)
+	return errors.Wrapf(err, "failed to delete")
+}
+
+func (d *CosmosDBHandler) Fetch(ctx context.Context, m Model) error {
+	resp, err := d.ContainerRef(m).ReadItem(
+		ctx,
+		azcosmos.NewPartitionKeyString(m.GetPartitionKey()),
+		m.ItemID(),
+		nil,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch")
+	}
+	if resp.RawResponse.StatusCode != 200 {
+		return errors.Newf("unexpected resp: %v, %v", resp.RawResponse.Status, resp.RawResponse.Status)
+	}
+	err = Deserialize(resp.Value, m)
+	if err != nil {
+		return err
+	}
+	setETag(m, string(resp.ETag))
+	return nil
+}
+
+func (d *CosmosDBHandler) QueryEq(ctx context.Context, m Model, field string, value any) ([][]byte, error) {
+	return d.Query(ctx, m, 0, QueryFilter{Field: field, Op: QueryOpEq, Value: value})
+}
+
+func (d *CosmosDBHandler) Query(ctx context.Context, m Model, limit int, filters ...QueryFilter) ([][]byte, error) {
+	partitionKey := azcosmos.NewPartitionKeyString(m.GetPartitionKey())
+	var conditions []string
+	var params []azcosmos.QueryParameter
+	for i, filter := range filters {
+		name := fmt.Sprintf("@value%d", i)
+		field := "t." + filter.Field
+		switch filter.Op {
+		case QueryOpEq, QueryOpLt:
+			conditions = append(conditions, fmt.Sprintf("%s %s %s", field, filter.Op, name))
+		case QueryOpNe:
+			conditions = append(conditions, fmt.Sprintf("(NOT IS_DEFINED(%s) OR %s != %s)", field, field, name))
+		default:
+			return nil, errors.Newf("unknown query op %s", filter.Op)
+		}
+		value := filter.Value
+		if t, ok := value.(time.Time); ok {
+			// Same layout the documents are serialized with.
+			value = t.Format(time.RFC3339Nano)
+		}
+		params = append(params, azcosmos.QueryParameter{Name: name, Value: value})
+	}
+	top := ""
+	if limit > 0 {
+		top = fmt.Sprintf("TOP %d ", limit)
+	}
+	query := fmt.Sprintf("SELECT %s* FROM %s t", top, m.Container())
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	queryOptions := azcosmos.QueryOptions{
+		QueryParameters: params,
+	}
+
+	var res [][]byte
+	pager := d.ContainerRef(m).NewQueryItemsPager(query, partitionKey, &queryOptions)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query %s", m.Container())
+		}
+		res = append(res, page.Items...)
+	}
+	return res, nil
+}
+
+func (d *CosmosDBHandler) ContainerRef(m Model) *azcosmos.ContainerClient {
+	containerClient, err := d.client.NewContainer(d.databaseName, m.Container())
+	common.Assert(err == nil, "Failed to get container defaultClient: %v", err)
+	return containerClient
+}
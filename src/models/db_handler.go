@@ -4,32 +4,92 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
-	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
 	"github.com/cockroachdb/errors"
 	"llmmask/src/common"
 	"net/http"
 )
 
-type DBHandler struct {
-	client       *azcosmos.Client
-	databaseName string
+const (
+	StorageBackendCosmos = "cosmos"
+	StorageBackendMemory = "memory"
+	StorageBackendBolt   = "bolt"
+)
+
+// ErrNotFound is returned by the non Cosmos backends when a document does not exist.
+var ErrNotFound = errors.New("document not found")
+
+// ErrConflict is returned by the non Cosmos backends when Create finds an existing document, or Replace a changed one.
+var ErrConflict = errors.New("document already exists or changed")
+
+// DBHandler is the document store all the models are persisted in.
+// Documents are addressed by (Container, PartitionKey, ItemID) and stored as their JSON serialization,
+// so every backend sees the exact same document layout.
+type DBHandler interface {
+	Fetch(ctx context.Context, m Model) error
+	Upsert(ctx context.Context, m Model) error
+	// Delete removes the document. Versioned models are only deleted if it still has their ETag, a conflict otherwise.
+	Delete(ctx context.Context, m Model) error
+	// UpsertBatch upserts all or none of the models, which must share a container and partition key.
+	UpsertBatch(ctx context.Context, ms ...Model) error
+	// QueryEq returns the raw documents in m's container and partition whose top level field equals value.
+	QueryEq(ctx context.Context, m Model, field string, value any) ([][]byte, error)
+	// Query returns at most limit (0 for all) raw documents in m's container and partition matching every filter.
+	Query(ctx context.Context, m Model, limit int, filters ...QueryFilter) ([][]byte, error)
+	// Create creates all or none of the models, which must share a container and partition key. It fails with a
+	// conflict (see IsConflictErr) if any of them already exists, so exactly one of concurrent creators wins.
+	Create(ctx context.Context, ms ...Model) error
+	// Replace replaces all or none of the models, which must share a container and partition key. Versioned models
+	// are only replaced if their document still has the ETag they were read with, a conflict otherwise.
+	Replace(ctx context.Context, ms ...Model) error
+}
+
+// Versioned models carry the ETag of their document, for compare-and-swap writes with Replace. Every write sets it to
+// the ETag of the new document.
+type Versioned interface {
+	Model
+	GetETag() string
+	SetETag(etag string)
+}
+
+const (
+	QueryOpEq = "="
+	// QueryOpNe also matches documents without the field.
+	QueryOpNe = "!="
+	// QueryOpLt compares numbers, and strings lexically. Times compare correctly as long as they're UTC.
+	QueryOpLt = "<"
+)
+
+// QueryFilter compares a top level field of the documents with Value.
+type QueryFilter struct {
+	Field string
+	Op    string
+	Value any
 }
 
-var defaultDBHandler *DBHandler
+var defaultDBHandler DBHandler
 
-func NewDBHandler(cosmosCreds *common.CosmosDBCredsConfig) (*DBHandler, error) {
-	connString := cosmosCreds.ConnectionString
-	client := common.Must(azcosmos.NewClientFromConnectionString(connString, nil))
-	databaseName := cosmosCreds.DatabaseName
-	return &DBHandler{client: client, databaseName: databaseName}, nil
+func NewDBHandler(creds *common.CredsConfig) (DBHandler, error) {
+	storageConf := creds.Storage
+	if storageConf == nil {
+		storageConf = &common.StorageConfig{Backend: StorageBackendCosmos}
+	}
+	switch storageConf.Backend {
+	case StorageBackendCosmos, "":
+		return NewCosmosDBHandler(creds.Cosmos)
+	case StorageBackendMemory:
+		return NewMemDBHandler(), nil
+	case StorageBackendBolt:
+		return NewBoltDBHandler(storageConf.Path)
+	default:
+		return nil, errors.Newf("unknown storage backend: %s", storageConf.Backend)
+	}
 }
 
 func Init(ctx context.Context) {
-	cosmosCreds := common.PlatformCredsConfig().Cosmos
-	defaultDBHandler = common.Must(NewDBHandler(cosmosCreds))
+	defaultDBHandler = common.Must(NewDBHandler(common.PlatformCredsConfig()))
 }
 
-func DefaultDBHandler() *DBHandler {
+func DefaultDBHandler() DBHandler {
 	return defaultDBHandler
 }
 
@@ -37,58 +97,137 @@ func Deserialize(data []byte, m Model) error {
 	return json.Unmarshal(data, m)
 }
 
-func (d *DBHandler) Upsert(ctx context.Context, m Model) error {
+func IsNotFoundErr(err error) bool {
+	if errors.Is(err, ErrNotFound) {
+		return true
+	}
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// IsConflictErr is true when Create or Replace lost to a concurrent write.
+func IsConflictErr(err error) bool {
+	if errors.Is(err, ErrConflict) {
+		return true
+	}
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.StatusCode == http.StatusConflict || responseErr.StatusCode == http.StatusPreconditionFailed
+	}
+	return false
+}
+
+// etagOf is the ETag a Versioned model was read with, empty for the rest.
+func etagOf(m Model) string {
+	if versioned, ok := m.(Versioned); ok {
+		return versioned.GetETag()
+	}
+	return ""
+}
+
+func setETag(m Model, etag string) {
+	if versioned, ok := m.(Versioned); ok {
+		versioned.SetETag(etag)
+	}
+}
+
+// marshalWithETag serializes the model for the local backends, with a fresh "_etag" like Cosmos keeps on every
+// document.
+func marshalWithETag(m Model) ([]byte, string, error) {
 	m.GetPartitionKey() // Fill it
 	data, err := json.Marshal(m)
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	doc := map[string]json.RawMessage{}
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, "", err
+	}
+	etag := common.RandomString(16)
+	doc["_etag"], err = json.Marshal(etag)
+	if err != nil {
+		return nil, "", err
 	}
-	_, err = d.ContainerRef(m).UpsertItem(
-		ctx,
-		azcosmos.NewPartitionKeyString(m.GetPartitionKey()),
-		data,
-		nil,
-	)
-	return errors.Wrapf(err, "failed to upsert")
+	data, err = json.Marshal(doc)
+	return data, etag, err
 }
 
-func (d *DBHandler) Delete(ctx context.Context, m Model) error {
-	m.GetPartitionKey() // Fill it
-	_, err := d.ContainerRef(m).DeleteItem(
-		ctx,
-		azcosmos.NewPartitionKeyString(m.GetPartitionKey()),
-		m.ItemID(),
-		nil,
-	)
-	return errors.Wrapf(err, "failed to delete")
-}
-
-func (d *DBHandler) Fetch(ctx context.Context, m Model) error {
-	resp, err := d.ContainerRef(m).ReadItem(
-		ctx,
-		azcosmos.NewPartitionKeyString(m.GetPartitionKey()),
-		m.ItemID(),
-		nil,
-	)
-	if err != nil {
-		return errors.Wrapf(err, "failed to fetch")
+// storedETag reads "_etag" out of a document written by marshalWithETag.
+func storedETag(data []byte) string {
+	doc := struct {
+		ETag string `json:"_etag"`
+	}{}
+	_ = json.Unmarshal(data, &doc)
+	return doc.ETag
+}
+
+// checkSameBatch asserts all the models in a batch share a container and partition key.
+func checkSameBatch(ms []Model) error {
+	if len(ms) == 0 {
+		return nil
 	}
-	if resp.RawResponse.StatusCode != 200 {
-		return errors.Newf("unexpected resp: %v, %v", resp.RawResponse.Status, resp.RawResponse.Status)
+	for _, m := range ms {
+		if m.Container() != ms[0].Container() || m.GetPartitionKey() != ms[0].GetPartitionKey() {
+			return errors.Newf("batch spans containers or partitions: %s/%s and %s/%s",
+				ms[0].Container(), ms[0].GetPartitionKey(), m.Container(), m.GetPartitionKey())
+		}
 	}
-	return Deserialize(resp.Value, m)
+	return nil
 }
 
-func (d *DBHandler) ContainerRef(m Model) *azcosmos.ContainerClient {
-	containerClient, err := d.client.NewContainer(d.databaseName, m.Container())
-	common.Assert(err == nil, "Failed to get container defaultClient: %v", err)
-	return containerClient
+// matchesFilters is the Query filter used by the local backends.
+func matchesFilters(data []byte, filters []QueryFilter) (bool, error) {
+	doc := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to unmarshal document")
+	}
+	for _, filter := range filters {
+		ok, err := matchesFilter(doc, filter)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
 }
 
-func IsNotFoundErr(err error) bool {
-	var responseErr *azcore.ResponseError
-	if errors.As(err, &responseErr) {
-		return responseErr.StatusCode == http.StatusNotFound
+func matchesFilter(doc map[string]json.RawMessage, filter QueryFilter) (bool, error) {
+	fieldVal, ok := doc[filter.Field]
+	if !ok {
+		return filter.Op == QueryOpNe, nil
+	}
+	// Round trip the value so it compares the same way it was serialized.
+	valueBytes, err := json.Marshal(filter.Value)
+	if err != nil {
+		return false, err
+	}
+	var lhs, rhs any
+	if err = json.Unmarshal(fieldVal, &lhs); err != nil {
+		return false, err
+	}
+	if err = json.Unmarshal(valueBytes, &rhs); err != nil {
+		return false, err
+	}
+	switch filter.Op {
+	case QueryOpEq:
+		return lhs == rhs, nil
+	case QueryOpNe:
+		return lhs != rhs, nil
+	case QueryOpLt:
+		switch lhs := lhs.(type) {
+		case float64:
+			rhs, ok := rhs.(float64)
+			return ok && lhs < rhs, nil
+		case string:
+			rhs, ok := rhs.(string)
+			return ok && lhs < rhs, nil
+		}
+		return false, nil
+	default:
+		return false, errors.Newf("unknown query op %s", filter.Op)
 	}
-	return false
 }
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func localDBHandlers(t *testing.T) map[string]DBHandler {
+	boltHandler, err := NewBoltDBHandler(filepath.Join(t.TempDir(), "llmmask.db"))
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = boltHandler.Close() })
+	return map[string]DBHandler{
+		StorageBackendMemory: NewMemDBHandler(),
+		StorageBackendBolt:   boltHandler,
+	}
+}
+
+func TestLocalDBHandlersRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	for name, dbHandler := range localDBHandlers(t) {
+		t.Run(name, func(t *testing.T) {
+			authToken := &AuthToken{DocID: DocIDForAuthToken([]byte("token"))}
+			err := dbHandler.Fetch(ctx, authToken)
+			assert.True(t, IsNotFoundErr(err), "got err %+v", err)
+
+			createdAt := time.Now().UTC().Truncate(time.Second)
+			err = dbHandler.Upsert(ctx, &AuthToken{
+				DocID:          authToken.DocID,
+				ModelName:      "gpt-4.1",
+				CreatedAt:      createdAt,
+				CachedResponse: []byte("wrapped"),
+			})
+			assert.Nil(t, err)
+
+			err = dbHandler.Fetch(ctx, authToken)
+			assert.Nil(t, err)
+			assert.Equal(t, "gpt-4.1", authToken.ModelName)
+			assert.Equal(t, DefaultPartitionKey, authToken.PartitionKey)
+			assert.True(t, createdAt.Equal(authToken.CreatedAt))
+			assert.Equal(t, []byte("wrapped"), authToken.CachedResponse)
+
+			// Same id in another container must not collide.
+			dek := &DEK{DocID: authToken.DocID}
+			assert.True(t, IsNotFoundErr(dbHandler.Fetch(ctx, dek)))
+
+			err = dbHandler.Delete(ctx, authToken)
+			assert.Nil(t, err)
+			assert.True(t, IsNotFoundErr(dbHandler.Fetch(ctx, authToken)))
+			assert.True(t, IsNotFoundErr(dbHandler.Delete(ctx, authToken)))
+		})
+	}
+}
+
+func TestLocalDBHandlersListUserSessions(t *testing.T) {
+	ctx := context.Background()
+	for name, dbHandler := range localDBHandlers(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, sess := range []*UserSession{
+				{DocID: "s1", UserDocID: "u1"},
+				{DocID: "s2", UserDocID: "u1"},
+				{DocID: "s3", UserDocID: "u2"},
+			} {
+				assert.Nil(t, dbHandler.Upsert(ctx, sess))
+			}
+			// Documents in other containers with a matching field must not show up.
+			assert.Nil(t, dbHandler.Upsert(ctx, &User{DocID: "u1"}))
+
+			sessions, err := ListUserSessions(ctx, dbHandler, "u1")
+			assert.Nil(t, err)
+			assert.Len(t, sessions, 2)
+			for _, sess := range sessions {
+				assert.Equal(t, "u1", sess.UserDocID)
+			}
+
+			sessions, err = ListUserSessions(ctx, dbHandler, "nobody")
+			assert.Nil(t, err)
+			assert.Empty(t, sessions)
+		})
+	}
+}
+
+func TestLocalDBHandlersConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	for name, dbHandler := range localDBHandlers(t) {
+		t.Run(name, func(t *testing.T) {
+			var wins atomic.Int32
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := dbHandler.Create(ctx, &AuthToken{DocID: "a"}, &AuthToken{DocID: "b"})
+					if err == nil {
+						wins.Add(1)
+					} else {
+						assert.True(t, IsConflictErr(err), "got err %+v", err)
+					}
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, int32(1), wins.Load())
+
+			// Half conflicting creates don't write anything.
+			err := dbHandler.Create(ctx, &AuthToken{DocID: "b"}, &AuthToken{DocID: "c"})
+			assert.True(t, IsConflictErr(err))
+			assert.True(t, IsNotFoundErr(dbHandler.Fetch(ctx, &AuthToken{DocID: "c"})))
+
+			first, second := &AuthToken{DocID: "a"}, &AuthToken{DocID: "a"}
+			assert.Nil(t, dbHandler.Fetch(ctx, first))
+			assert.Nil(t, dbHandler.Fetch(ctx, second))
+			assert.NotEmpty(t, first.ETag)
+			first.ModelName = "first"
+			assert.Nil(t, dbHandler.Replace(ctx, first))
+			second.ModelName = "second"
+			assert.True(t, IsConflictErr(dbHandler.Replace(ctx, second)))
+
+			// The ETag is updated on write, so the winner can keep going.
+			first.ModelName = "first again"
+			assert.Nil(t, dbHandler.Replace(ctx, first))
+			assert.Nil(t, dbHandler.Fetch(ctx, second))
+			assert.Equal(t, "first again", second.ModelName)
+
+			assert.True(t, IsNotFoundErr(dbHandler.Replace(ctx, &AuthToken{DocID: "missing"})))
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 const (
 	DEKContainer = "deks"
 )
@@ -9,6 +11,10 @@ type DEK struct {
 	PartitionKey string `json:"PartitionKey"`
 	DEKWrapped   []byte
 	KMSKeyID     string // Wraps DEK
+	// The DEK before the last rotation, still needed for data that wasn't re-encrypted yet.
+	PreviousDEKWrapped []byte
+	PreviousKMSKeyID   string
+	RotatedAt          time.Time
 }
 
 func (u *DEK) Container() string {
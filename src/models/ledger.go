@@ -0,0 +1,177 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+const (
+	LedgerEntryContainer = "ledger"
+)
+
+const (
+	// LedgerKindOpeningBalance carries over the balance a user had when their ledger was started.
+	LedgerKindOpeningBalance = "opening-balance"
+	LedgerKindPurchase       = "purchase"
+	LedgerKindFreeGrant      = "free-grant"
+	LedgerKindIssuance       = "issuance"
+	// LedgerKindRefund is credits taken back by a refund, chargeback or credit of a purchase.
+	LedgerKindRefund          = "refund"
+	LedgerKindAdminAdjustment = "admin-adjustment"
+)
+
+// LedgerEntry is one change to the credits of a user for one model. Entries are only ever created, the balance in
+// SubscriptionInfo must always equal the sum of them, which the reconciliation job checks.
+type LedgerEntry struct {
+	DocID        string `json:"id"` // DocIDForLedgerEntry
+	PartitionKey string `json:"PartitionKey"`
+	UserDocID    string
+	Kind         string
+	ModelName    string
+	// Credits is the change of ActiveAuthTokens, negative for debits.
+	Credits int
+	// Used is the change of UsedAuthTokens.
+	Used int
+	// Reference is what caused the entry, like the transaction, adjustment or issuance request ID.
+	Reference string
+	Note      string
+	CreatedAt time.Time
+}
+
+func (l *LedgerEntry) Container() string {
+	return LedgerEntryContainer
+}
+
+func (l *LedgerEntry) ItemID() string {
+	return l.DocID
+}
+
+func (l *LedgerEntry) GetPartitionKey() string {
+	l.PartitionKey = DefaultPartitionKey
+	return l.PartitionKey
+}
+
+// NewLedgerEntry makes an entry whose ID is derived from what it records, so recording it again is a no-op.
+func NewLedgerEntry(userDocID, kind, reference, modelName string, credits, used int, now time.Time) *LedgerEntry {
+	return &LedgerEntry{
+		DocID:     DocIDForLedgerEntry(userDocID, kind, reference, modelName),
+		UserDocID: userDocID,
+		Kind:      kind,
+		ModelName: modelName,
+		Credits:   credits,
+		Used:      used,
+		Reference: reference,
+		CreatedAt: now,
+	}
+}
+
+func DocIDForLedgerEntry(userDocID, kind, reference, modelName string) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{userDocID, kind, reference, modelName}, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+// AppendLedgerEntries records the entries, skipping ones that were already recorded.
+func AppendLedgerEntries(ctx context.Context, dbHandler DBHandler, entries ...*LedgerEntry) error {
+	for _, entry := range entries {
+		err := dbHandler.Create(ctx, entry)
+		if err != nil && !IsConflictErr(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// FetchLedgerEntries returns every entry of the user, in no particular order.
+func FetchLedgerEntries(ctx context.Context, dbHandler DBHandler, userDocID string) ([]*LedgerEntry, error) {
+	items, err := dbHandler.Query(ctx, &LedgerEntry{}, 0,
+		QueryFilter{Field: "UserDocID", Op: QueryOpEq, Value: userDocID},
+	)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*LedgerEntry, 0, len(items))
+	for _, item := range items {
+		entry := &LedgerEntry{}
+		err = Deserialize(item, entry)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// LedgerBalance sums the entries up into the active and used credits per model.
+func LedgerBalance(entries []*LedgerEntry) (active AuthTokenInfo, used AuthTokenInfo) {
+	active, used = AuthTokenInfo{}, AuthTokenInfo{}
+	for _, entry := range entries {
+		active[entry.ModelName] += entry.Credits
+		used[entry.ModelName] += entry.Used
+	}
+	return active, used
+}
+
+// LedgerDrift is a model whose balance doesn't match the ledger.
+type LedgerDrift struct {
+	UserDocID    string
+	ModelName    string
+	Active       int
+	LedgerActive int
+	Used         int
+	LedgerUsed   int
+}
+
+// FindLedgerDrift compares the balance of the user with what the entries sum up to.
+func FindLedgerDrift(user *User, entries []*LedgerEntry) []LedgerDrift {
+	active, used := LedgerBalance(entries)
+	modelNames := map[string]bool{}
+	for _, balance := range []AuthTokenInfo{active, used, user.SubscriptionInfo.ActiveAuthTokens, user.SubscriptionInfo.UsedAuthTokens} {
+		for modelName := range balance {
+			modelNames[modelName] = true
+		}
+	}
+	var res []LedgerDrift
+	for modelName := range modelNames {
+		drift := LedgerDrift{
+			UserDocID:    user.DocID,
+			ModelName:    modelName,
+			Active:       user.SubscriptionInfo.ActiveAuthTokens[modelName],
+			LedgerActive: active[modelName],
+			Used:         user.SubscriptionInfo.UsedAuthTokens[modelName],
+			LedgerUsed:   used[modelName],
+		}
+		if drift.Active != drift.LedgerActive || drift.Used != drift.LedgerUsed {
+			res = append(res, drift)
+		}
+	}
+	return res
+}
+
+// OpenLedger starts the ledger of a user that doesn't have one yet, with the balance from before the given entries
+// as the opening balance. The entries to record are returned.
+func OpenLedger(user *User, entries []*LedgerEntry, now time.Time) []*LedgerEntry {
+	subscriptionInfo := &user.SubscriptionInfo
+	if !subscriptionInfo.LedgerOpenedAt.IsZero() {
+		return entries
+	}
+	subscriptionInfo.LedgerOpenedAt = now
+	active, used := LedgerBalance(entries)
+	modelNames := map[string]bool{}
+	for _, balance := range []AuthTokenInfo{subscriptionInfo.ActiveAuthTokens, subscriptionInfo.UsedAuthTokens} {
+		for modelName := range balance {
+			modelNames[modelName] = true
+		}
+	}
+	var res []*LedgerEntry
+	for modelName := range modelNames {
+		openingActive := subscriptionInfo.ActiveAuthTokens[modelName] - active[modelName]
+		openingUsed := subscriptionInfo.UsedAuthTokens[modelName] - used[modelName]
+		if openingActive != 0 || openingUsed != 0 {
+			res = append(res, NewLedgerEntry(user.DocID, LedgerKindOpeningBalance, "", modelName, openingActive, openingUsed, now))
+		}
+	}
+	return append(res, entries...)
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	ctx := context.Background()
+	dbHandler := NewMemDBHandler()
+	now := time.Now().UTC()
+
+	// A user from before the ledger, with a purchase already applied to the balance.
+	user := &User{DocID: "user"}
+	user.SubscriptionInfo.ActiveAuthTokens = AuthTokenInfo{"m": 15}
+	user.SubscriptionInfo.UsedAuthTokens = AuthTokenInfo{"m": 3}
+	purchase := NewLedgerEntry(user.DocID, LedgerKindPurchase, "txn_1", "m", 10, 0, now)
+	entries := OpenLedger(user, []*LedgerEntry{purchase}, now)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, now, user.SubscriptionInfo.LedgerOpenedAt)
+	assert.Nil(t, AppendLedgerEntries(ctx, dbHandler, entries...))
+	// Recording again is a no-op.
+	assert.Nil(t, AppendLedgerEntries(ctx, dbHandler, entries...))
+	assert.Equal(t, []*LedgerEntry{purchase}, OpenLedger(user, []*LedgerEntry{purchase}, now))
+
+	user.SubscriptionInfo.ActiveAuthTokens["m"] -= 2
+	user.SubscriptionInfo.UsedAuthTokens["m"] += 2
+	assert.Nil(t, AppendLedgerEntries(ctx, dbHandler, NewLedgerEntry(user.DocID, LedgerKindIssuance, "req_1", "m", -2, 2, now)))
+	assert.Nil(t, AppendLedgerEntries(ctx, dbHandler, NewLedgerEntry("other", LedgerKindFreeGrant, "signup", "m", 20, 0, now)))
+
+	saved, err := FetchLedgerEntries(ctx, dbHandler, user.DocID)
+	assert.Nil(t, err)
+	assert.Len(t, saved, 3)
+	assert.Empty(t, FindLedgerDrift(user, saved))
+
+	user.SubscriptionInfo.ActiveAuthTokens["m"] += 5
+	assert.Equal(t, []LedgerDrift{{
+		UserDocID:    user.DocID,
+		ModelName:    "m",
+		Active:       18,
+		LedgerActive: 13,
+		Used:         5,
+		LedgerUsed:   5,
+	}}, FindLedgerDrift(user, saved))
+}
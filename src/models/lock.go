@@ -0,0 +1,47 @@
+package models
+
+import (
+	"net/url"
+	"time"
+)
+
+const (
+	LockContainer = "locks"
+)
+
+// Lock is a lease on a key held by one process, see locks.StoreLocker.
+type Lock struct {
+	DocID        string `json:"id"` // See DocIDForLock.
+	PartitionKey string `json:"PartitionKey"`
+	Owner        string
+	ExpiresAt    time.Time
+	// TTL lets Cosmos drop locks of crashed holders, in seconds from the last renewal.
+	TTL  int    `json:"ttl,omitempty"`
+	ETag string `json:"_etag,omitempty"`
+}
+
+func (u *Lock) Container() string {
+	return LockContainer
+}
+
+func (u *Lock) ItemID() string {
+	return u.DocID
+}
+
+func (u *Lock) GetPartitionKey() string {
+	u.PartitionKey = DefaultPartitionKey
+	return u.PartitionKey
+}
+
+func (u *Lock) GetETag() string {
+	return u.ETag
+}
+
+func (u *Lock) SetETag(etag string) {
+	u.ETag = etag
+}
+
+// DocIDForLock escapes the characters Cosmos doesn't allow in ids.
+func DocIDForLock(key string) string {
+	return url.PathEscape(key)
+}
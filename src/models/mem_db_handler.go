@@ -0,0 +1,147 @@
+package models
+
+import (
+	"context"
+	"github.com/cockroachdb/errors"
+	"sync"
+)
+
+// MemDBHandler keeps all documents in process memory. Meant for tests and local development, nothing survives a
+// restart.
+type MemDBHandler struct {
+	sync.RWMutex
+	// container -> partition key -> item id -> document
+	docs map[string]map[string]map[string][]byte
+}
+
+func NewMemDBHandler() *MemDBHandler {
+	return &MemDBHandler{
+		docs: make(map[string]map[string]map[string][]byte),
+	}
+}
+
+func (d *MemDBHandler) partition(m Model, create bool) map[string][]byte {
+	container, ok := d.docs[m.Container()]
+	if !ok {
+		if !create {
+			return nil
+		}
+		container = make(map[string]map[string][]byte)
+		d.docs[m.Container()] = container
+	}
+	partition, ok := container[m.GetPartitionKey()]
+	if !ok && create {
+		partition = make(map[string][]byte)
+		container[m.GetPartitionKey()] = partition
+	}
+	return partition
+}
+
+func (d *MemDBHandler) Upsert(ctx context.Context, m Model) error {
+	return d.UpsertBatch(ctx, m)
+}
+
+func (d *MemDBHandler) UpsertBatch(ctx context.Context, ms ...Model) error {
+	return d.writeBatch(ms, func(partition map[string][]byte, m Model) error {
+		return nil
+	})
+}
+
+func (d *MemDBHandler) Create(ctx context.Context, ms ...Model) error {
+	return d.writeBatch(ms, func(partition map[string][]byte, m Model) error {
+		if _, ok := partition[m.ItemID()]; ok {
+			return errors.Wrapf(ErrConflict, "failed to create %s/%s", m.Container(), m.ItemID())
+		}
+		return nil
+	})
+}
+
+func (d *MemDBHandler) Replace(ctx context.Context, ms ...Model) error {
+	return d.writeBatch(ms, func(partition map[string][]byte, m Model) error {
+		data, ok := partition[m.ItemID()]
+		if !ok {
+			return errors.Wrapf(ErrNotFound, "failed to replace %s/%s", m.Container(), m.ItemID())
+		}
+		if etag := etagOf(m); etag != "" && etag != storedETag(data) {
+			return errors.Wrapf(ErrConflict, "failed to replace %s/%s", m.Container(), m.ItemID())
+		}
+		return nil
+	})
+}
+
+// writeBatch stores all the models if check passes for every one of them, under a single lock.
+func (d *MemDBHandler) writeBatch(ms []Model, check func(partition map[string][]byte, m Model) error) error {
+	if err := checkSameBatch(ms); err != nil {
+		return err
+	}
+	docs := make([][]byte, len(ms))
+	etags := make([]string, len(ms))
+	for i, m := range ms {
+		data, etag, err := marshalWithETag(m)
+		if err != nil {
+			return err
+		}
+		docs[i], etags[i] = data, etag
+	}
+	d.Lock()
+	defer d.Unlock()
+	for _, m := range ms {
+		err := check(d.partition(m, true), m)
+		if err != nil {
+			return err
+		}
+	}
+	for i, m := range ms {
+		d.partition(m, true)[m.ItemID()] = docs[i]
+		setETag(m, etags[i])
+	}
+	return nil
+}
+
+func (d *MemDBHandler) Delete(ctx context.Context, m Model) error {
+	d.Lock()
+	defer d.Unlock()
+	partition := d.partition(m, false)
+	data, ok := partition[m.ItemID()]
+	if !ok {
+		return errors.Wrapf(ErrNotFound, "failed to delete %s/%s", m.Container(), m.ItemID())
+	}
+	if etag := etagOf(m); etag != "" && etag != storedETag(data) {
+		return errors.Wrapf(ErrConflict, "failed to delete %s/%s", m.Container(), m.ItemID())
+	}
+	delete(partition, m.ItemID())
+	return nil
+}
+
+func (d *MemDBHandler) Fetch(ctx context.Context, m Model) error {
+	d.RLock()
+	data, ok := d.partition(m, false)[m.ItemID()]
+	d.RUnlock()
+	if !ok {
+		return errors.Wrapf(ErrNotFound, "failed to fetch %s/%s", m.Container(), m.ItemID())
+	}
+	return Deserialize(data, m)
+}
+
+func (d *MemDBHandler) QueryEq(ctx context.Context, m Model, field string, value any) ([][]byte, error) {
+	return d.Query(ctx, m, 0, QueryFilter{Field: field, Op: QueryOpEq, Value: value})
+}
+
+func (d *MemDBHandler) Query(ctx context.Context, m Model, limit int, filters ...QueryFilter) ([][]byte, error) {
+	d.RLock()
+	defer d.RUnlock()
+	var res [][]byte
+	for _, data := range d.partition(m, false) {
+		if limit > 0 && len(res) == limit {
+			break
+		}
+		ok, err := matchesFilters(data, filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res = append(res, data)
+		}
+	}
+	return res, nil
+}
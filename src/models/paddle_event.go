@@ -0,0 +1,68 @@
+package models
+
+import "time"
+
+const (
+	PaddleEventContainer       = "paddle_events"
+	PaddleTransactionContainer = "paddle_transactions"
+)
+
+const (
+	PaddleEventStateProcessed = "processed"
+	// PaddleEventStateFailed events are retried from the background at NextAttemptAt.
+	PaddleEventStateFailed = "failed"
+	// PaddleEventStateDead events ran out of attempts, and need a look.
+	PaddleEventStateDead = "dead"
+)
+
+// PaddleEvent is a received webhook event, so every event is handled once, and failed ones are retried.
+type PaddleEvent struct {
+	DocID         string `json:"id"` // Paddle event ID.
+	PartitionKey  string `json:"PartitionKey"`
+	EventType     string
+	Body          []byte // The raw notification, dropped once processed.
+	State         string
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	ReceivedAt    time.Time
+	ProcessedAt   time.Time
+}
+
+func (u *PaddleEvent) Container() string {
+	return PaddleEventContainer
+}
+
+func (u *PaddleEvent) ItemID() string {
+	return u.DocID
+}
+
+func (u *PaddleEvent) GetPartitionKey() string {
+	u.PartitionKey = DefaultPartitionKey
+	return u.PartitionKey
+}
+
+// PaddleTransaction is what a completed transaction granted, to find the user and credits when it's adjusted.
+type PaddleTransaction struct {
+	DocID         string `json:"id"` // Paddle transaction ID.
+	PartitionKey  string `json:"PartitionKey"`
+	UserDocID     string
+	TokensGranted AuthTokenInfo
+	// Total paid, in the lowest denomination of the currency. Unknown for transactions completed before they were
+	// recorded, see svc.legacyPaddleTransaction.
+	Total     string
+	CreatedAt time.Time
+}
+
+func (u *PaddleTransaction) Container() string {
+	return PaddleTransactionContainer
+}
+
+func (u *PaddleTransaction) ItemID() string {
+	return u.DocID
+}
+
+func (u *PaddleTransaction) GetPartitionKey() string {
+	u.PartitionKey = DefaultPartitionKey
+	return u.PartitionKey
+}
@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 const (
 	RSAKeyContainer = "rsa_keys"
 )
@@ -7,13 +9,24 @@ const (
 // RSAKeys - The Public/Private key pair used for blind signing.
 // Store the RSA key in DB, because can't call KMS all the time
 type RSAKeys struct {
-	DocID              string `json:"id"` // Same as model name for ease
-	PartitionKey       string `json:"PartitionKey"`
-	ModelName          string
+	DocID        string `json:"id"` // See secrets.RSAKeyDocID.
+	PartitionKey string `json:"PartitionKey"`
+	ModelName    string
+	// Denomination is the credits every token signed under the key is worth, 0 for keys from before denominations.
+	Denomination       int
 	PublicKeyPlaintext []byte
 	PrivateKeyWrapped  []byte
-	DEKWrapped         []byte // Wraps PrivateKey
+	DEKWrapped         []byte // Wraps PrivateKey and VOPRFKeyWrapped
 	KMSKeyID           string // Wraps DEK
+	// VOPRFKeyWrapped is the VOPRF key going with the key pair, empty for keys from before VOPRF keys and for
+	// partially blind issuer keys.
+	VOPRFKeyWrapped []byte
+	// Validity window, zero values mean unbounded. The key with the latest NotBefore signs, the rest only verify.
+	NotBefore time.Time
+	NotAfter  time.Time
+	// Revoked keys are neither used for signing nor verification, for compromised keys.
+	Revoked   bool
+	RevokedAt time.Time
 }
 
 func (u *RSAKeys) Container() string {
@@ -28,3 +41,8 @@ func (u *RSAKeys) GetPartitionKey() string {
 	u.PartitionKey = DefaultPartitionKey
 	return u.PartitionKey
 }
+
+// GetDenomination is Denomination, keys from before denominations sign single credit tokens.
+func (u *RSAKeys) GetDenomination() int {
+	return max(1, u.Denomination)
+}
@@ -1,7 +1,9 @@
 package models
 
 import (
+	"github.com/cockroachdb/errors"
 	"llmmask/src/common"
+	"time"
 )
 
 const (
@@ -26,6 +28,9 @@ type User struct {
 	PaddleCustomerID     string
 	PaddleSubscriptionID string
 
+	// LedgerReconciledAt is when the reconciliation job last checked the balance against the ledger.
+	LedgerReconciledAt time.Time
+
 	// Transient Info, not really persisted
 	TransientToken string
 }
@@ -50,16 +55,157 @@ func (u *User) ToRedacted() common.Redactable {
 	return res
 }
 
+// UserBalanceLockKey is the lock serializing everything that reads and writes the credits of a user.
+func UserBalanceLockKey(userDocID string) string {
+	return "user-balance-" + userDocID
+}
+
 type SubscriptionInfo struct {
 	ActiveAuthTokens AuthTokenInfo
 	UsedAuthTokens   AuthTokenInfo
 	// Payment log for sake of recalculation in case some screw up happens.
 	PaymentLogs []PaymentLog
+	// Recently charged issuance batches, so a retried batch is never charged twice.
+	// Saved along with the debit itself, pruned after IssuedBatchRetention.
+	IssuedBatches []IssuedBatch
+	// Recently charged single token issuances, by the ID of their marker, saved along with the debit. They only need to
+	// outlive marking the TokenIssuance charged, pruned after IssuedTokenRetention.
+	IssuedTokens []IssuedToken
+	// LedgerOpenedAt is when the ledger of the user was started, zero for users from before the ledger.
+	LedgerOpenedAt time.Time
 }
 
 type AuthTokenInfo = map[string]int
 
+const IssuedBatchRetention = time.Hour * 24 * 7
+
+const IssuedTokenRetention = time.Hour * 24
+
+type IssuedToken struct {
+	MarkerID string
+	IssuedAt time.Time
+}
+
+type IssuedBatch struct {
+	RequestID         string
+	ModelName         string
+	NumTokens         int
+	Denomination      int // 0 for batches from before denominations, which were single credit tokens.
+	BlindedTokensHash []byte
+	IssuedAt          time.Time
+}
+
+// Credits the batch was charged.
+func (b *IssuedBatch) Credits() int {
+	return b.NumTokens * max(1, b.Denomination)
+}
+
+// FindIssuedBatch returns the already charged batch with this request ID, if any.
+func (s *SubscriptionInfo) FindIssuedBatch(requestID string) *IssuedBatch {
+	for i := range s.IssuedBatches {
+		if s.IssuedBatches[i].RequestID == requestID {
+			return &s.IssuedBatches[i]
+		}
+	}
+	return nil
+}
+
+// PruneIssuedBatches drops batches older than IssuedBatchRetention.
+func (s *SubscriptionInfo) PruneIssuedBatches(now time.Time) {
+	s.IssuedBatches = common.Filter(s.IssuedBatches, func(b IssuedBatch) bool {
+		return now.Sub(b.IssuedAt) < IssuedBatchRetention
+	})
+}
+
+// FindIssuedToken returns the already charged single token issuance with this marker ID, if any.
+func (s *SubscriptionInfo) FindIssuedToken(markerID string) *IssuedToken {
+	for i := range s.IssuedTokens {
+		if s.IssuedTokens[i].MarkerID == markerID {
+			return &s.IssuedTokens[i]
+		}
+	}
+	return nil
+}
+
+// PruneIssuedTokens drops issuances older than IssuedTokenRetention.
+func (s *SubscriptionInfo) PruneIssuedTokens(now time.Time) {
+	s.IssuedTokens = common.Filter(s.IssuedTokens, func(t IssuedToken) bool {
+		return now.Sub(t.IssuedAt) < IssuedTokenRetention
+	})
+}
+
 type PaymentLog struct {
 	TransactionID string
 	TokensGranted AuthTokenInfo
+	// Set for adjustments of the transaction (refunds, chargebacks, credits), which deduct credits instead.
+	AdjustmentID   string
+	Action         string
+	TokensDeducted AuthTokenInfo
+	// TokensUnrecovered were already turned into tokens when the adjustment came in, so they couldn't be deducted.
+	TokensUnrecovered AuthTokenInfo
+	EventID           string
+	CreatedAt         time.Time
+}
+
+// FindPaymentLog returns the purchase of the transaction if adjustmentID is empty, otherwise that adjustment.
+func (s *SubscriptionInfo) FindPaymentLog(transactionID, adjustmentID string) *PaymentLog {
+	for i := range s.PaymentLogs {
+		if s.PaymentLogs[i].TransactionID == transactionID && s.PaymentLogs[i].AdjustmentID == adjustmentID {
+			return &s.PaymentLogs[i]
+		}
+	}
+	return nil
+}
+
+// GrantPurchase credits what paymentLog.TokensGranted says, once per transaction. It's false if the transaction was
+// already credited.
+func (s *SubscriptionInfo) GrantPurchase(paymentLog PaymentLog) bool {
+	if s.FindPaymentLog(paymentLog.TransactionID, "") != nil {
+		return false
+	}
+	if s.ActiveAuthTokens == nil {
+		s.ActiveAuthTokens = make(AuthTokenInfo)
+	}
+	for modelName, credits := range paymentLog.TokensGranted {
+		s.ActiveAuthTokens[modelName] += credits
+	}
+	// TODO: Keep consolidating to prevent unending growth.
+	s.PaymentLogs = append(s.PaymentLogs, paymentLog)
+	return true
+}
+
+// DeductAdjustment takes back up to toDeduct credits for an adjustment, once per adjustment ID. Credits already
+// turned into tokens can't be taken back, they're recorded as unrecovered. It returns nil if the adjustment was
+// already applied.
+func (s *SubscriptionInfo) DeductAdjustment(paymentLog PaymentLog, toDeduct AuthTokenInfo) *PaymentLog {
+	if s.FindPaymentLog(paymentLog.TransactionID, paymentLog.AdjustmentID) != nil {
+		return nil
+	}
+	if s.ActiveAuthTokens == nil {
+		s.ActiveAuthTokens = make(AuthTokenInfo)
+	}
+	paymentLog.TokensDeducted = AuthTokenInfo{}
+	paymentLog.TokensUnrecovered = AuthTokenInfo{}
+	for modelName, credits := range toDeduct {
+		deducted := min(credits, max(s.ActiveAuthTokens[modelName], 0))
+		s.ActiveAuthTokens[modelName] -= deducted
+		paymentLog.TokensDeducted[modelName] = deducted
+		if deducted < credits {
+			paymentLog.TokensUnrecovered[modelName] = credits - deducted
+		}
+	}
+	s.PaymentLogs = append(s.PaymentLogs, paymentLog)
+	return &s.PaymentLogs[len(s.PaymentLogs)-1]
+}
+
+// AdjustCredits adds credits, negative to take them away, failing if that leaves a negative balance.
+func (s *SubscriptionInfo) AdjustCredits(modelName string, credits int) error {
+	if s.ActiveAuthTokens == nil {
+		s.ActiveAuthTokens = make(AuthTokenInfo)
+	}
+	if s.ActiveAuthTokens[modelName]+credits < 0 {
+		return errors.Newf("only %d credits left for %s", s.ActiveAuthTokens[modelName], modelName)
+	}
+	s.ActiveAuthTokens[modelName] += credits
+	return nil
 }
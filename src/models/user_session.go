@@ -2,9 +2,7 @@ package models
 
 import (
 	"context"
-	"fmt"
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
-	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/cockroachdb/errors"
 )
 
 const (
@@ -32,15 +30,20 @@ func (u *UserSession) GetPartitionKey() string {
 	return u.PartitionKey
 }
 
-func ListUserSessions(ctx context.Context, dbHandler *DBHandler, userDocID string) *runtime.Pager[azcosmos.QueryItemsResponse] {
-	dummySess := &UserSession{}
-	partitionKey := azcosmos.NewPartitionKeyString(dummySess.GetPartitionKey())
-	query := fmt.Sprintf("SELECT * FROM %s t WHERE t.UserDocID = @userID", UserSessionContainer)
-	queryOptions := azcosmos.QueryOptions{
-		QueryParameters: []azcosmos.QueryParameter{
-			{Name: "@userID", Value: userDocID},
-		},
+func ListUserSessions(ctx context.Context, dbHandler DBHandler, userDocID string) ([]*UserSession, error) {
+	items, err := dbHandler.QueryEq(ctx, &UserSession{}, "UserDocID", userDocID)
+	if err != nil {
+		return nil, err
 	}
 
-	return dbHandler.ContainerRef(dummySess).NewQueryItemsPager(query, partitionKey, &queryOptions)
+	var res []*UserSession
+	for _, itemData := range items {
+		userSession := &UserSession{}
+		err = Deserialize(itemData, userSession)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to deserialize user session")
+		}
+		res = append(res, userSession)
+	}
+	return res, nil
 }
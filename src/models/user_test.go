@@ -0,0 +1,28 @@
+package models
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSubscriptionInfoPaymentLogs(t *testing.T) {
+	info := &SubscriptionInfo{}
+	assert.True(t, info.GrantPurchase(PaymentLog{TransactionID: "txn_1", TokensGranted: AuthTokenInfo{"m": 100}}))
+	// Redelivered events don't credit the transaction twice.
+	assert.False(t, info.GrantPurchase(PaymentLog{TransactionID: "txn_1", TokensGranted: AuthTokenInfo{"m": 100}}))
+	assert.Equal(t, 100, info.ActiveAuthTokens["m"])
+
+	// Part of the credits were already issued as tokens.
+	info.ActiveAuthTokens["m"] = 30
+	paymentLog := info.DeductAdjustment(PaymentLog{TransactionID: "txn_1", AdjustmentID: "adj_1"}, AuthTokenInfo{"m": 50})
+	assert.NotNil(t, paymentLog)
+	assert.Equal(t, AuthTokenInfo{"m": 30}, paymentLog.TokensDeducted)
+	assert.Equal(t, AuthTokenInfo{"m": 20}, paymentLog.TokensUnrecovered)
+	assert.Equal(t, 0, info.ActiveAuthTokens["m"])
+
+	info.ActiveAuthTokens["m"] = 10
+	assert.Nil(t, info.DeductAdjustment(PaymentLog{TransactionID: "txn_1", AdjustmentID: "adj_1"}, AuthTokenInfo{"m": 50}))
+	assert.Equal(t, 10, info.ActiveAuthTokens["m"])
+	assert.NotNil(t, info.FindPaymentLog("txn_1", ""))
+	assert.Len(t, info.PaymentLogs, 2)
+}
@@ -0,0 +1,69 @@
+package privacypass
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/cloudflare/circl/blindsign/blindrsa"
+)
+
+// TokenRequestState is what a client keeps between sending a token request and finalizing the response.
+type TokenRequestState struct {
+	publicKey  *rsa.PublicKey
+	token      *Token
+	blindState blindrsa.State
+}
+
+// NewTokenRequest is the client side of issuance, for tests and Go clients: a fresh nonce, blinded for the key.
+func NewTokenRequest(publicKey *rsa.PublicKey, challenge *TokenChallenge) (*TokenRequest, *TokenRequestState, error) {
+	challengeDigest, err := challenge.Digest()
+	if err != nil {
+		return nil, nil, err
+	}
+	tokenKeyID, err := TokenKeyID(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	token := &Token{
+		TokenType:       TokenTypeBlindRSA,
+		Nonce:           nonce,
+		ChallengeDigest: challengeDigest,
+		TokenKeyID:      tokenKeyID,
+	}
+	client, err := blindrsa.NewClient(blindrsa.SHA384PSSDeterministic, publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	blindedMsg, blindState, err := client.Blind(rand.Reader, token.AuthenticatorInput())
+	if err != nil {
+		return nil, nil, err
+	}
+	return &TokenRequest{
+		TokenType:           TokenTypeBlindRSA,
+		TruncatedTokenKeyID: tokenKeyID[Nid-1],
+		BlindedMsg:          blindedMsg,
+	}, &TokenRequestState{
+		publicKey:  publicKey,
+		token:      token,
+		blindState: blindState,
+	}, nil
+}
+
+// Finalize unblinds the issuer's response into a spendable token.
+func (s *TokenRequestState) Finalize(resp *TokenResponse) (*Token, error) {
+	client, err := blindrsa.NewClient(blindrsa.SHA384PSSDeterministic, s.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	authenticator, err := client.Finalize(s.blindState, resp.BlindSig)
+	if err != nil {
+		return nil, err
+	}
+	token := *s.token
+	token.Authenticator = authenticator
+	return &token, nil
+}
@@ -0,0 +1,100 @@
+package privacypass
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"net/http"
+	"strings"
+)
+
+// AuthScheme is the HTTP authentication scheme of RFC 9577.
+const AuthScheme = "PrivateToken"
+
+// WWWAuthenticate is the challenge origins send in a 401, RFC 9577 section 2.1. tokenKey is the encoded issuer key,
+// see MarshalPublicKey.
+func WWWAuthenticate(challenge *TokenChallenge, tokenKey []byte) (string, error) {
+	data, err := challenge.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`%s challenge="%s", token-key="%s"`, AuthScheme,
+		base64.URLEncoding.EncodeToString(data), base64.URLEncoding.EncodeToString(tokenKey)), nil
+}
+
+// AuthorizationTokens parses the tokens out of the PrivateToken credentials of the request, RFC 9577 section 2.2.
+// Requests costing several credits send one credential per token, comma separated. Other schemes are ignored.
+func AuthorizationTokens(r *http.Request) ([]*Token, error) {
+	var res []*Token
+	for _, header := range r.Header.Values("Authorization") {
+		credentials, err := parseCredentials(header)
+		if err != nil {
+			return nil, err
+		}
+		for _, params := range credentials {
+			encoded, ok := params["token"]
+			if !ok {
+				return nil, errors.New("PrivateToken credential without a token")
+			}
+			data, err := decodeBase64URL(encoded)
+			if err != nil {
+				return nil, errors.Wrapf(err, "token isn't base64url")
+			}
+			token, err := UnmarshalToken(data)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, token)
+		}
+	}
+	return res, nil
+}
+
+// AuthorizationHeader is the header value redeeming the tokens.
+func AuthorizationHeader(tokens ...*Token) string {
+	var credentials []string
+	for _, token := range tokens {
+		credentials = append(credentials, fmt.Sprintf(`%s token="%s"`, AuthScheme,
+			base64.URLEncoding.EncodeToString(token.Marshal())))
+	}
+	return strings.Join(credentials, ", ")
+}
+
+// parseCredentials returns the params of every PrivateToken credential in the header.
+func parseCredentials(header string) ([]map[string]string, error) {
+	var res []map[string]string
+	var current map[string]string
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		scheme, rest, hasParams := strings.Cut(part, " ")
+		if !strings.Contains(scheme, "=") {
+			// Start of a new credential.
+			current = nil
+			if strings.EqualFold(scheme, AuthScheme) {
+				current = map[string]string{}
+				res = append(res, current)
+			}
+			if !hasParams {
+				continue
+			}
+			part = strings.TrimSpace(rest)
+		}
+		if current == nil {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, errors.Newf("malformed auth param %q", part)
+		}
+		current[strings.ToLower(strings.TrimSpace(key))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return res, nil
+}
+
+// decodeBase64URL takes base64url with or without padding, RFC 9577 doesn't pin it down.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,110 @@
+package privacypass
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"github.com/cloudflare/circl/blindsign/blindrsa"
+	"github.com/cockroachdb/errors"
+)
+
+var (
+	oidRSASSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidMGF1      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidSHA384    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+)
+
+// pssParameters is RSASSA-PSS-params of RFC 4055, laid out like crypto/x509 does for its PSS signatures.
+type pssParameters struct {
+	Hash         pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF          pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength   int                      `asn1:"explicit,tag:2"`
+	TrailerField int                      `asn1:"optional,explicit,tag:3,default:1"`
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// MarshalPublicKey encodes the issuer key the way RFC 9578 section 6.5 wants it: a SubjectPublicKeyInfo with the
+// RSASSA-PSS OID and SHA-384 parameters, rather than the plain rsaEncryption one. The hash identifiers carry no
+// parameters, not even NULL, or the token key ID won't match the one clients compute.
+func MarshalPublicKey(publicKey *rsa.PublicKey) ([]byte, error) {
+	sha384 := pkix.AlgorithmIdentifier{Algorithm: oidSHA384}
+	mgfParams, err := asn1.Marshal(sha384)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pssParameters{
+		Hash:         sha384,
+		MGF:          pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: mgfParams}},
+		SaltLength:   48,
+		TrailerField: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	publicKeyBytes := x509.MarshalPKCS1PublicKey(publicKey)
+	return asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSASSAPSS, Parameters: asn1.RawValue{FullBytes: params}},
+		PublicKey: asn1.BitString{Bytes: publicKeyBytes, BitLength: 8 * len(publicKeyBytes)},
+	})
+}
+
+// UnmarshalPublicKey reads keys encoded by MarshalPublicKey.
+func UnmarshalPublicKey(data []byte) (*rsa.PublicKey, error) {
+	spki := subjectPublicKeyInfo{}
+	rest, err := asn1.Unmarshal(data, &spki)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data after public key")
+	}
+	if !spki.Algorithm.Algorithm.Equal(oidRSASSAPSS) {
+		return nil, errors.New("public key isn't an RSASSA-PSS key")
+	}
+	publicKey, err := x509.ParsePKCS1PublicKey(spki.PublicKey.RightAlign())
+	if err != nil {
+		return nil, err
+	}
+	if publicKey.Size() != Nk {
+		return nil, errors.Newf("public key is %d bytes, must be %d", publicKey.Size(), Nk)
+	}
+	return publicKey, nil
+}
+
+// TokenKeyID is the SHA-256 of the encoded public key.
+func TokenKeyID(publicKey *rsa.PublicKey) ([]byte, error) {
+	data, err := MarshalPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	return hash[:], nil
+}
+
+// Sign answers a token request. The caller checks it's for the key, see TokenRequest.TruncatedTokenKeyID.
+func Sign(privateKey *rsa.PrivateKey, req *TokenRequest) (*TokenResponse, error) {
+	if privateKey.Size() != Nk {
+		return nil, errors.Newf("signing key is %d bytes, must be %d", privateKey.Size(), Nk)
+	}
+	blindSig, err := blindrsa.NewSigner(privateKey).BlindSign(req.BlindedMsg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to sign token request")
+	}
+	return &TokenResponse{BlindSig: blindSig}, nil
+}
+
+// Verify checks the authenticator of the token against the public key. The caller checks the challenge digest, and
+// that the token key ID is of this key.
+func Verify(publicKey *rsa.PublicKey, token *Token) error {
+	verifier, err := blindrsa.NewVerifier(blindrsa.SHA384PSSDeterministic, publicKey)
+	if err != nil {
+		return err
+	}
+	return verifier.Verify(token.AuthenticatorInput(), token.Authenticator)
+}
@@ -0,0 +1,176 @@
+// Package privacypass implements the Privacy Pass wire formats (RFC 9577, RFC 9578) for the publicly verifiable
+// token type 0x0002, blind RSA with RSABSSA-SHA384-PSS-Deterministic and a 2048 bit key.
+package privacypass
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/cockroachdb/errors"
+	"golang.org/x/crypto/cryptobyte"
+	"strings"
+)
+
+const (
+	// TokenTypeBlindRSA is the publicly verifiable token type, RFC 9578 section 6.
+	TokenTypeBlindRSA uint16 = 0x0002
+	// Nk is the size of a blind RSA signature, and of blinded messages.
+	Nk = 256
+	// Nid is the size of token key IDs.
+	Nid = 32
+
+	nonceSize           = 32
+	challengeDigestSize = 32
+	// authenticatorInputSize is token_type, nonce, challenge_digest and token_key_id.
+	authenticatorInputSize = 2 + nonceSize + challengeDigestSize + Nid
+
+	ContentTypeTokenRequest  = "application/private-token-request"
+	ContentTypeTokenResponse = "application/private-token-response"
+)
+
+var errTruncated = errors.New("malformed or truncated input")
+
+// TokenChallenge is what an origin asks tokens for, RFC 9577 section 2.1.
+type TokenChallenge struct {
+	TokenType  uint16
+	IssuerName string
+	// RedemptionContext is empty or 32 bytes, empty lets tokens be fetched ahead of the challenge.
+	RedemptionContext []byte
+	OriginInfo        []string
+}
+
+func (c *TokenChallenge) Marshal() ([]byte, error) {
+	if len(c.IssuerName) == 0 {
+		return nil, errors.New("issuer name is required")
+	}
+	if len(c.RedemptionContext) != 0 && len(c.RedemptionContext) != 32 {
+		return nil, errors.New("redemption context must be empty or 32 bytes")
+	}
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(c.TokenType)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(c.IssuerName))
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(c.RedemptionContext)
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(strings.Join(c.OriginInfo, ",")))
+	})
+	return b.Bytes()
+}
+
+func UnmarshalTokenChallenge(data []byte) (*TokenChallenge, error) {
+	s := cryptobyte.String(data)
+	res := &TokenChallenge{}
+	var issuerName, redemptionContext, originInfo cryptobyte.String
+	if !s.ReadUint16(&res.TokenType) ||
+		!s.ReadUint16LengthPrefixed(&issuerName) ||
+		!s.ReadUint8LengthPrefixed(&redemptionContext) ||
+		!s.ReadUint16LengthPrefixed(&originInfo) ||
+		!s.Empty() {
+		return nil, errTruncated
+	}
+	res.IssuerName = string(issuerName)
+	if len(redemptionContext) > 0 {
+		res.RedemptionContext = []byte(redemptionContext)
+	}
+	if len(originInfo) > 0 {
+		res.OriginInfo = strings.Split(string(originInfo), ",")
+	}
+	return res, nil
+}
+
+// Digest is the challenge_digest tokens for this challenge carry.
+func (c *TokenChallenge) Digest() ([]byte, error) {
+	data, err := c.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	return digest[:], nil
+}
+
+// TokenRequest is what clients send the issuer, RFC 9578 section 6.1.
+type TokenRequest struct {
+	TokenType uint16
+	// TruncatedTokenKeyID is the last byte of the key ID the client expects to be signed under.
+	TruncatedTokenKeyID uint8
+	BlindedMsg          []byte
+}
+
+func (r *TokenRequest) Marshal() []byte {
+	res := make([]byte, 0, 3+len(r.BlindedMsg))
+	res = binary.BigEndian.AppendUint16(res, r.TokenType)
+	res = append(res, r.TruncatedTokenKeyID)
+	return append(res, r.BlindedMsg...)
+}
+
+func UnmarshalTokenRequest(data []byte) (*TokenRequest, error) {
+	if len(data) != 3+Nk {
+		return nil, errTruncated
+	}
+	res := &TokenRequest{
+		TokenType:           binary.BigEndian.Uint16(data),
+		TruncatedTokenKeyID: data[2],
+		BlindedMsg:          data[3:],
+	}
+	if res.TokenType != TokenTypeBlindRSA {
+		return nil, errors.Newf("unsupported token type 0x%04x", res.TokenType)
+	}
+	return res, nil
+}
+
+// TokenResponse is the blind signature the issuer sends back, RFC 9578 section 6.2.
+type TokenResponse struct {
+	BlindSig []byte
+}
+
+func (r *TokenResponse) Marshal() []byte {
+	return r.BlindSig
+}
+
+func UnmarshalTokenResponse(data []byte) (*TokenResponse, error) {
+	if len(data) != Nk {
+		return nil, errTruncated
+	}
+	return &TokenResponse{BlindSig: data}, nil
+}
+
+// Token is what clients redeem, RFC 9577 section 2.2.
+type Token struct {
+	TokenType       uint16
+	Nonce           []byte
+	ChallengeDigest []byte
+	TokenKeyID      []byte
+	Authenticator   []byte
+}
+
+// AuthenticatorInput is what the authenticator signs: everything but the authenticator itself.
+func (t *Token) AuthenticatorInput() []byte {
+	res := make([]byte, 0, authenticatorInputSize)
+	res = binary.BigEndian.AppendUint16(res, t.TokenType)
+	res = append(res, t.Nonce...)
+	res = append(res, t.ChallengeDigest...)
+	return append(res, t.TokenKeyID...)
+}
+
+func (t *Token) Marshal() []byte {
+	return append(t.AuthenticatorInput(), t.Authenticator...)
+}
+
+func UnmarshalToken(data []byte) (*Token, error) {
+	if len(data) != authenticatorInputSize+Nk {
+		return nil, errTruncated
+	}
+	res := &Token{
+		TokenType:       binary.BigEndian.Uint16(data),
+		Nonce:           data[2 : 2+nonceSize],
+		ChallengeDigest: data[2+nonceSize : 2+nonceSize+challengeDigestSize],
+		TokenKeyID:      data[2+nonceSize+challengeDigestSize : authenticatorInputSize],
+		Authenticator:   data[authenticatorInputSize:],
+	}
+	if res.TokenType != TokenTypeBlindRSA {
+		return nil, errors.Newf("unsupported token type 0x%04x", res.TokenType)
+	}
+	return res, nil
+}
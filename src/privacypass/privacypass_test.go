@@ -0,0 +1,111 @@
+package privacypass
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestIssueAndRedeem(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	challenge := &TokenChallenge{TokenType: TokenTypeBlindRSA, IssuerName: "issuer.example"}
+
+	req, state, err := NewTokenRequest(&privateKey.PublicKey, challenge)
+	assert.NoError(t, err)
+	req, err = UnmarshalTokenRequest(req.Marshal())
+	assert.NoError(t, err)
+	tokenKeyID, err := TokenKeyID(&privateKey.PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, tokenKeyID[Nid-1], req.TruncatedTokenKeyID)
+
+	resp, err := Sign(privateKey, req)
+	assert.NoError(t, err)
+	resp, err = UnmarshalTokenResponse(resp.Marshal())
+	assert.NoError(t, err)
+	token, err := state.Finalize(resp)
+	assert.NoError(t, err)
+
+	r, err := http.NewRequest(http.MethodPost, "/", nil)
+	assert.NoError(t, err)
+	r.Header.Set("Authorization", AuthorizationHeader(token, token))
+	tokens, err := AuthorizationTokens(r)
+	assert.NoError(t, err)
+	assert.Len(t, tokens, 2)
+	assert.Equal(t, token.Marshal(), tokens[0].Marshal())
+	assert.NoError(t, Verify(&privateKey.PublicKey, tokens[0]))
+
+	digest, err := challenge.Digest()
+	assert.NoError(t, err)
+	assert.Equal(t, digest, tokens[0].ChallengeDigest)
+
+	tampered := *tokens[0]
+	tampered.Nonce = make([]byte, nonceSize)
+	assert.Error(t, Verify(&privateKey.PublicKey, &tampered))
+}
+
+func TestPublicKeyRoundTrip(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	data, err := MarshalPublicKey(&privateKey.PublicKey)
+	assert.NoError(t, err)
+	publicKey, err := UnmarshalPublicKey(data)
+	assert.NoError(t, err)
+	assert.True(t, privateKey.PublicKey.Equal(publicKey))
+}
+
+func TestTokenChallengeRoundTrip(t *testing.T) {
+	challenge := &TokenChallenge{
+		TokenType:         TokenTypeBlindRSA,
+		IssuerName:        "issuer.example",
+		RedemptionContext: make([]byte, 32),
+		OriginInfo:        []string{"a.example", "b.example"},
+	}
+	data, err := challenge.Marshal()
+	assert.NoError(t, err)
+	parsed, err := UnmarshalTokenChallenge(data)
+	assert.NoError(t, err)
+	assert.Equal(t, challenge, parsed)
+
+	_, err = UnmarshalTokenChallenge(data[:len(data)-1])
+	assert.Error(t, err)
+}
+
+func TestAuthorizationTokensIgnoresOtherSchemes(t *testing.T) {
+	r, err := http.NewRequest(http.MethodPost, "/", nil)
+	assert.NoError(t, err)
+	r.Header.Set("Authorization", `Bearer abc`)
+	tokens, err := AuthorizationTokens(r)
+	assert.NoError(t, err)
+	assert.Empty(t, tokens)
+}
+
+// rfc9578PublicKey and rfc9578TokenKeyID are pkS and token_key_id of the RFC 9578 Appendix A.2 test vectors.
+const (
+	rfc9578PublicKey = "30820152303d06092a864886f70d01010a3030a00d300b0609608648016503040202a11a301806092a864886f70d010108300b" +
+		"0609608648016503040202a2030201300382010f003082010a0282010100cb1aed6b6a95f5b1ce013a4cfcab25b94b2e64a23034e4250a7" +
+		"eab43c0df3a8c12993af12b111908d4b471bec31d4b6c9ad9cdda90612a2ee903523e6de5a224d6b02f09e5c374d0cfe01d8f529c500a78a" +
+		"2f67908fa682b5a2b430c81eaf1af72d7b5e794fc98a3139276879757ce453b526ef9bf6ceb99979b8423b90f4461a22af37aab0cf5733f75" +
+		"97abe44d31c732db68a181c6cbbe607d8c0e52e0655fd9996dc584eca0be87afbcd78a337d17b1dba9e828bbd81e291317144e7ff89f55619" +
+		"709b096cbb9ea474cead264c2073fe49740c01f00e109106066983d21e5f83f086e2e823c879cd43cef700d2a352a9babd612d03cad02db1" +
+		"34b7e225a5f0203010001"
+	rfc9578TokenKeyID = "ca572f8982a9ca248a3056186322d93ca147266121ddeb5632c07f1f71cd2708"
+)
+
+func TestPublicKeyRFC9578Vector(t *testing.T) {
+	data, err := hex.DecodeString(rfc9578PublicKey)
+	assert.NoError(t, err)
+	publicKey, err := UnmarshalPublicKey(data)
+	assert.NoError(t, err)
+
+	encoded, err := MarshalPublicKey(publicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, rfc9578PublicKey, hex.EncodeToString(encoded))
+
+	tokenKeyID, err := TokenKeyID(publicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, rfc9578TokenKeyID, hex.EncodeToString(tokenKeyID))
+}
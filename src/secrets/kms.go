@@ -15,6 +15,18 @@ import (
 	"time"
 )
 
+// KMS wraps and unwraps DEKs with a platform key it never hands out.
+// Encrypt returns the base64 ciphertext along with the ID of the exact key version used, Decrypt needs both back.
+type KMS interface {
+	Encrypt(ctx context.Context, plaintext []byte) (string, string, error)
+	Decrypt(ctx context.Context, ciphertextB64 string, keyID string) ([]byte, error)
+}
+
+const (
+	KMSBackendAzure = "azure"
+	KMSBackendLocal = "local"
+)
+
 type AzureKMS struct {
 	client       *azkeys.Client
 	key          string
@@ -22,19 +34,37 @@ type AzureKMS struct {
 	decryptCache *cache.Cache
 }
 
-var defaultKMS *AzureKMS
+var defaultKMS KMS
 
-func DefaultKMS() *AzureKMS {
+func DefaultKMS() KMS {
 	return defaultKMS
 }
 
 func Init(ctx context.Context) {
-	defaultKMS = common.Must(NewKMS(common.PlatformCredsConfig().KeyVaultCreds))
+	defaultKMS = common.Must(NewKMS(common.PlatformCredsConfig()))
 	InitRSA(ctx)
 	InitPlatformDEKs(ctx)
 }
 
-func NewKMS(kmsCreds *common.KeyVaultCredsConfig) (*AzureKMS, error) {
+func NewKMS(creds *common.CredsConfig) (KMS, error) {
+	kmsConf := creds.KMS
+	if kmsConf == nil {
+		kmsConf = &common.KMSConfig{Backend: KMSBackendAzure}
+	}
+	switch kmsConf.Backend {
+	case KMSBackendAzure, "":
+		return NewAzureKMS(creds.KeyVaultCreds)
+	case KMSBackendLocal:
+		return NewLocalKMSFromConfig(kmsConf)
+	default:
+		return nil, errors.Newf("unknown kms backend: %s", kmsConf.Backend)
+	}
+}
+
+func NewAzureKMS(kmsCreds *common.KeyVaultCredsConfig) (*AzureKMS, error) {
+	if kmsCreds == nil {
+		return nil, errors.New("key vault creds not configured")
+	}
 	cred, err := azidentity.NewClientSecretCredential(kmsCreds.TenantID, kmsCreds.ClientID, kmsCreds.ClientSecret, nil)
 	if err != nil {
 		return nil, err
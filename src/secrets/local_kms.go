@@ -0,0 +1,144 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/common"
+	"os"
+	"strings"
+)
+
+const (
+	defaultLocalKMSMasterKeysEnv = "LLMMASK_KMS_MASTER_KEYS"
+	localKMSKeyIDPrefix          = "local-kms"
+)
+
+// LocalMasterKeys is the file/env format for the local KMS master keys.
+// Old versions are kept around so DEKs wrapped before a rotation can still be unwrapped.
+type LocalMasterKeys struct {
+	Name    string            `json:"name"`
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"` // version -> base64 of a 32 byte AES key
+}
+
+// LocalKMS wraps DEKs with AES-GCM under a master key loaded from a file or env var.
+// For self-hosted and test deployments, where running an Azure Key Vault is not an option.
+// Key IDs look like local-kms/<name>/<version>, same shape as the Key Vault ones.
+type LocalKMS struct {
+	name    string
+	current string
+	keys    map[string][]byte
+}
+
+func NewLocalKMSFromConfig(conf *common.KMSConfig) (*LocalKMS, error) {
+	var data []byte
+	if conf.MasterKeysFile != "" {
+		var err error
+		data, err = os.ReadFile(conf.MasterKeysFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read local kms master keys file")
+		}
+	} else {
+		envKey := common.ValueOR(conf.MasterKeysEnv, defaultLocalKMSMasterKeysEnv)
+		data = []byte(os.Getenv(envKey))
+		if len(data) == 0 {
+			return nil, errors.Newf("local kms master keys not set in env %s", envKey)
+		}
+	}
+
+	masterKeys := &LocalMasterKeys{}
+	err := json.Unmarshal(data, masterKeys)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse local kms master keys")
+	}
+	return NewLocalKMS(masterKeys)
+}
+
+func NewLocalKMS(masterKeys *LocalMasterKeys) (*LocalKMS, error) {
+	if masterKeys.Name == "" || strings.Contains(masterKeys.Name, "/") {
+		return nil, errors.Newf("invalid local kms key name: %q", masterKeys.Name)
+	}
+	keys := make(map[string][]byte, len(masterKeys.Keys))
+	for version, keyB64 := range masterKeys.Keys {
+		if version == "" || strings.Contains(version, "/") {
+			return nil, errors.Newf("invalid local kms key version: %q", version)
+		}
+		key, err := base64.StdEncoding.DecodeString(keyB64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode local kms key version %s", version)
+		}
+		if len(key) != 32 {
+			return nil, errors.Newf("local kms key version %s must be 32 bytes, got %d", version, len(key))
+		}
+		keys[version] = key
+	}
+	if _, ok := keys[masterKeys.Current]; !ok {
+		return nil, errors.Newf("current local kms key version %q not found", masterKeys.Current)
+	}
+	return &LocalKMS{
+		name:    masterKeys.Name,
+		current: masterKeys.Current,
+		keys:    keys,
+	}, nil
+}
+
+func (k *LocalKMS) keyID(version string) string {
+	return fmt.Sprintf("%s/%s/%s", localKMSKeyIDPrefix, k.name, version)
+}
+
+func (k *LocalKMS) Encrypt(ctx context.Context, plaintext []byte) (string, string, error) {
+	ct, err := EncryptAES(string(plaintext), string(k.keys[k.current]))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to encrypt")
+	}
+	return ct, k.keyID(k.current), nil
+}
+
+func (k *LocalKMS) Decrypt(ctx context.Context, ciphertextB64 string, keyID string) ([]byte, error) {
+	if !strings.HasPrefix(keyID, localKMSKeyIDPrefix+"/") || keyNameFromKeyID(keyID) != k.name {
+		return nil, errors.Newf("key id %s not managed by this local kms", keyID)
+	}
+	key, ok := k.keys[keyVersionFromKeyID(keyID)]
+	if !ok {
+		return nil, errors.Newf("unknown local kms key version in %s", keyID)
+	}
+	pt, err := DecryptAES(ciphertextB64, string(key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt")
+	}
+	return []byte(pt), nil
+}
+
+// NewLocalMasterKeys creates a fresh key set with a single version.
+func NewLocalMasterKeys(name string) (*LocalMasterKeys, error) {
+	res := &LocalMasterKeys{
+		Name: name,
+		Keys: map[string]string{},
+	}
+	_, err := res.Rotate()
+	return res, err
+}
+
+// Rotate adds a new key version and makes it current. Older versions stay for unwrapping.
+func (m *LocalMasterKeys) Rotate() (string, error) {
+	key, err := NewRandomAESKey()
+	if err != nil {
+		return "", err
+	}
+	if m.Keys == nil {
+		m.Keys = map[string]string{}
+	}
+	var version string
+	for n := len(m.Keys) + 1; ; n++ {
+		version = fmt.Sprintf("v%d", n)
+		if _, ok := m.Keys[version]; !ok {
+			break
+		}
+	}
+	m.Keys[version] = base64.StdEncoding.EncodeToString(key)
+	m.Current = version
+	return version, nil
+}
@@ -0,0 +1,54 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/common"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalKMSRotation(t *testing.T) {
+	ctx := context.Background()
+	masterKeys, err := NewLocalMasterKeys("platform")
+	assert.Nil(t, err)
+
+	kmsV1, err := NewLocalKMS(masterKeys)
+	assert.Nil(t, err)
+	dek, err := NewRandomAESKey()
+	assert.Nil(t, err)
+	dekWrappedV1, keyIDV1, err := kmsV1.Encrypt(ctx, dek)
+	assert.Nil(t, err)
+	assert.Equal(t, "local-kms/platform/v1", keyIDV1)
+
+	version, err := masterKeys.Rotate()
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", version)
+
+	// Loaded from a file, like a self-hosted deployment would.
+	keysFile := filepath.Join(t.TempDir(), "master_keys.json")
+	assert.Nil(t, os.WriteFile(keysFile, common.Must(json.Marshal(masterKeys)), 0600))
+	kmsV2, err := NewLocalKMSFromConfig(&common.KMSConfig{Backend: KMSBackendLocal, MasterKeysFile: keysFile})
+	assert.Nil(t, err)
+
+	dekWrappedV2, keyIDV2, err := kmsV2.Encrypt(ctx, dek)
+	assert.Nil(t, err)
+	assert.Equal(t, "local-kms/platform/v2", keyIDV2)
+
+	// DEKs wrapped before the rotation still unwrap.
+	for keyID, wrapped := range map[string]string{keyIDV1: dekWrappedV1, keyIDV2: dekWrappedV2} {
+		unwrapped, err := kmsV2.Decrypt(ctx, wrapped, keyID)
+		assert.Nil(t, err)
+		assert.Equal(t, dek, unwrapped)
+	}
+
+	// Wrong version fails authentication instead of returning garbage.
+	_, err = kmsV2.Decrypt(ctx, dekWrappedV1, keyIDV2)
+	assert.NotNil(t, err)
+	_, err = kmsV2.Decrypt(ctx, dekWrappedV1, "local-kms/platform/v9")
+	assert.NotNil(t, err)
+	_, err = kmsV2.Decrypt(ctx, dekWrappedV1, "local-kms/other/v1")
+	assert.NotNil(t, err)
+}
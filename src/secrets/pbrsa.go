@@ -0,0 +1,113 @@
+package secrets
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/cloudflare/circl/blindsign/blindrsa/partiallyblindrsa"
+	"github.com/cockroachdb/errors"
+	"math/big"
+)
+
+// Partially blind RSA (draft-amjad-cfrg-partially-blind-rsa) signs tokens bound to public metadata, so a single issuer
+// key serves every model, denomination and expiry. The issuer keys are stored like the keys of a model named
+// PartiallyBlindKeyName, and rotated and revoked the same way.
+
+// PartiallyBlindKeyName is the model name the partially blind issuer keys are stored under.
+const PartiallyBlindKeyName = "partially-blind-issuer"
+
+// PartiallyBlindSignAlgorithm is the variant partially blind tokens are signed with.
+const PartiallyBlindSignAlgorithm = "PBRSA-SHA384-PSS-Randomized"
+
+// GeneratePartiallyBlindRSAKeyPair is GenerateRSAKeyPair with safe primes, which partially blind RSA needs. Finding
+// them takes a while, minutes for 2048 bit keys.
+func GeneratePartiallyBlindRSAKeyPair(bits int) (string, string, error) {
+	privateKey, err := generateSafePrimeRSAKey(bits)
+	if err != nil {
+		return "", "", err
+	}
+	privPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+	pubBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pubBytes,
+	})
+	return string(pubPEM), string(privPEM), nil
+}
+
+func generateSafePrimeRSAKey(bits int) (*rsa.PrivateKey, error) {
+	e := big.NewInt(65537)
+	one := big.NewInt(1)
+	for {
+		p, err := generateSafePrime(bits / 2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := generateSafePrime(bits - bits/2)
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+		n := new(big.Int).Mul(p, q)
+		phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		d := new(big.Int).ModInverse(e, phi)
+		if n.BitLen() != bits || d == nil {
+			continue
+		}
+		privateKey := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		err = privateKey.Validate()
+		if err != nil {
+			return nil, err
+		}
+		privateKey.Precompute()
+		return privateKey, nil
+	}
+}
+
+// generateSafePrime finds a prime p = 2q + 1 with q prime.
+func generateSafePrime(bits int) (*big.Int, error) {
+	for {
+		q, err := rand.Prime(rand.Reader, bits-1)
+		if err != nil {
+			return nil, err
+		}
+		p := new(big.Int).Lsh(q, 1)
+		p.Add(p, big.NewInt(1))
+		if p.ProbablyPrime(20) {
+			return p, nil
+		}
+	}
+}
+
+// NewPartiallyBlindSigner checks the key has safe primes, keep the signer around since that isn't cheap.
+func NewPartiallyBlindSigner(privateKey *rsa.PrivateKey) (*partiallyblindrsa.Signer, error) {
+	signer, err := partiallyblindrsa.NewSigner(privateKey, crypto.SHA384)
+	if err != nil {
+		return nil, errors.Wrapf(err, "key can't sign partially blind")
+	}
+	return &signer, nil
+}
+
+// PBRSASignBlinded signs a blinded message under the key derived for metadata.
+func PBRSASignBlinded(signer *partiallyblindrsa.Signer, msg, metadata []byte) ([]byte, error) {
+	return signer.BlindSign(msg, metadata)
+}
+
+// PBRSAVerify checks a finalized partially blind signature of msg for metadata.
+func PBRSAVerify(publicKey *rsa.PublicKey, msg, metadata, signature []byte) error {
+	return partiallyblindrsa.NewVerifier(publicKey, crypto.SHA384).Verify(msg, metadata, signature)
+}
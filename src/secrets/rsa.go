@@ -8,56 +8,88 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"github.com/cloudflare/circl/blindsign/blindrsa"
+	"github.com/cloudflare/circl/blindsign/blindrsa/partiallyblindrsa"
+	"github.com/cloudflare/circl/oprf"
 	"github.com/cockroachdb/errors"
 	"llmmask/src/common"
 	"llmmask/src/confs"
 	"llmmask/src/log"
 	"llmmask/src/models"
+	"math/big"
 	"strings"
+	"time"
 )
 
+// BlindSignAlgorithm is the blind RSA variant all tokens are signed with, RFC 9474 naming.
+const BlindSignAlgorithm = "SHA384PSSRandomized"
+
 type RSAKeys struct {
 	PrivateKey *rsa.PrivateKey
 	PublicKey  *rsa.PublicKey
+	// KeyID identifies the public key, see RSAKeyID.
+	KeyID     string
+	ModelName string
+	// Denomination is the credits every token signed under the key is worth.
+	Denomination int
+	// Validity window, zero values mean unbounded.
+	NotBefore time.Time
+	NotAfter  time.Time
+	// VOPRFKey is stored along with the key pair, nil for keys from before VOPRF keys. See NewVOPRFKey.
+	VOPRFKey       *oprf.PrivateKey
+	VOPRFPublicKey *oprf.PublicKey
+	// PartiallyBlindSigner is set for the partially blind issuer keys, see PartiallyBlindKeyName.
+	PartiallyBlindSigner *partiallyblindrsa.Signer
+}
+
+// IsPartiallyBlind tells issuer keys signing partially blind tokens apart from the keys of a model.
+func (e RSAKeys) IsPartiallyBlind() bool {
+	return e.ModelName == PartiallyBlindKeyName
 }
 
 // ToRedacted returns a version of the RSAKeys struct with the private key
 // redacted. This is a good practice to prevent accidental logging or exposure.
 func (e RSAKeys) ToRedacted() common.Redactable {
-	res := RSAKeys{
-		PublicKey:  e.PublicKey,
-		PrivateKey: nil,
-	}
+	res := e
+	res.PrivateKey = nil
+	res.VOPRFKey = nil
+	res.PartiallyBlindSigner = nil
 	return res
 }
 
-var rsaKeysPerModel map[confs.ModelName]*RSAKeys
+var rsaKeysPerModel map[confs.ModelName][]*RSAKeys
 
-func GetRSAKeysForModel(modelName confs.ModelName) *RSAKeys {
+// GetRSAKeysForModel returns all the keys loaded at startup for the model, the partially blind issuer keys included.
+// See AuthManager for which one is used. Empty for models skipped by InitRSA.
+func GetRSAKeysForModel(modelName confs.ModelName) []*RSAKeys {
 	return rsaKeysPerModel[modelName]
 }
 
+// InitRSA loads the keys of every model. Models without usable keys, say ones added before their keys were
+// provisioned, are logged and left out, see GetRSAKeysForModel.
 func InitRSA(ctx context.Context) {
-	rsaKeysPerModel = make(map[confs.ModelName]*RSAKeys)
+	rsaKeysPerModel = make(map[confs.ModelName][]*RSAKeys)
 	dbHandler := models.DefaultDBHandler()
 	kms := DefaultKMS()
+	partiallyBlindKeys := common.Must(LoadRSAKeysForModel(ctx, dbHandler, kms, PartiallyBlindKeyName))
+	log.Infof(ctx, "Loaded %d partially blind issuer keys", len(partiallyBlindKeys))
 	for _, modelName := range confs.AllModels() {
 		log.Infof(ctx, "Loading rsa for model: %s", modelName)
-		rsaKey := &models.RSAKeys{
-			DocID: modelName,
+		rsaKeysForModel := common.Must(LoadRSAKeysForModel(ctx, dbHandler, kms, modelName))
+		// Models issuing partially blind tokens only need the issuer keys.
+		modelSpec := common.Must(confs.ModelSpecFor(modelName))
+		if modelSpec.TokenScheme == confs.TokenSchemePartiallyBlindRSA && len(partiallyBlindKeys) == 0 {
+			log.Errorf(ctx, "[ALERT]: No usable partially blind issuer keys for model %s, skipping it", modelName)
+			continue
 		}
-		common.Must2(dbHandler.Fetch(ctx, rsaKey))
-
-		dek := common.Must(kms.Decrypt(ctx, string(rsaKey.DEKWrapped), rsaKey.KMSKeyID))
-
-		privateKeyPT := common.Must(DecryptAES(string(rsaKey.PrivateKeyWrapped), string(dek)))
-		publicKeyPT := string(rsaKey.PublicKeyPlaintext)
-
-		rsaKeysForModel := common.Must(RSALoad(privateKeyPT, publicKeyPT))
-		rsaKeysPerModel[modelName] = rsaKeysForModel
-		log.Infof(ctx, "Loaded RSA keys for model: %s", modelName)
+		if modelSpec.TokenScheme != confs.TokenSchemePartiallyBlindRSA && len(rsaKeysForModel) == 0 {
+			log.Errorf(ctx, "[ALERT]: No usable rsa keys for model %s, skipping it", modelName)
+			continue
+		}
+		rsaKeysPerModel[modelName] = append(rsaKeysForModel, partiallyBlindKeys...)
+		log.Infof(ctx, "Loaded %d RSA keys for model: %s", len(rsaKeysForModel), modelName)
 	}
 }
 
@@ -176,7 +208,23 @@ func RSALoad(privateKeyPEM, publicKeyStr string) (*RSAKeys, error) {
 		}
 	}
 
-	block, _ = pem.Decode([]byte(publicKeyStr))
+	publicRSAKey, err := RSALoadPublicKey(publicKeyStr)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKeys := &RSAKeys{
+		PrivateKey:   privateRSAKey,
+		PublicKey:    publicRSAKey,
+		KeyID:        RSAKeyID(publicRSAKey),
+		Denomination: 1,
+	}
+	return rsaKeys, nil
+}
+
+// RSALoadPublicKey parses a PKIX "PUBLIC KEY" PEM block.
+func RSALoadPublicKey(publicKeyStr string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(publicKeyStr)))
 	if block == nil || block.Type != "PUBLIC KEY" {
 		return nil, errors.Newf("Failed to decode PEM block containing public key")
 	}
@@ -189,11 +237,46 @@ func RSALoad(privateKeyPEM, publicKeyStr string) (*RSAKeys, error) {
 	if !ok {
 		return nil, errors.Newf("Failed to parse RSA public key")
 	}
+	return publicRSAKey, nil
+}
+
+// RSAKeyID is the base64url SHA-256 of the DER SubjectPublicKeyInfo, stable for a key across restarts.
+func RSAKeyID(publicKey *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	common.Assert(err == nil, "failed to marshal rsa public key: %v", err)
+	hash := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
 
-	return &RSAKeys{
-		PrivateKey: privateRSAKey,
-		PublicKey:  publicRSAKey,
-	}, nil
+// RSAPublicKeyPEM encodes the public key as a PKIX "PUBLIC KEY" PEM block.
+func RSAPublicKeyPEM(publicKey *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	common.Assert(err == nil, "failed to marshal rsa public key: %v", err)
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}))
+}
+
+// RSAPublicJWK is the RFC 7517 JSON Web Key form of an RSA public key.
+type RSAPublicJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func NewRSAPublicJWK(publicKey *rsa.PublicKey) *RSAPublicJWK {
+	return &RSAPublicJWK{
+		Kty: "RSA",
+		Kid: RSAKeyID(publicKey),
+		Alg: "PS384",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+	}
 }
 
 // GenerateRSAKeyPair creates a new 2048-bit RSA key pair in PEM format
@@ -0,0 +1,260 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"llmmask/src/confs"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"time"
+)
+
+// LoadRSAKeysForModel unwraps every key of the model that is neither revoked nor expired.
+func LoadRSAKeysForModel(ctx context.Context, dbHandler models.DBHandler, kms KMS, modelName confs.ModelName) ([]*RSAKeys, error) {
+	docs, err := ListRSAKeyDocsForModel(ctx, dbHandler, modelName)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	var res []*RSAKeys
+	for _, rsaKey := range docs {
+		if rsaKey.Revoked || (!rsaKey.NotAfter.IsZero() && rsaKey.NotAfter.Before(now)) {
+			continue
+		}
+		dek, err := kms.Decrypt(ctx, string(rsaKey.DEKWrapped), rsaKey.KMSKeyID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to unwrap dek for rsa key %s", rsaKey.DocID)
+		}
+		privateKeyPT, err := DecryptAES(string(rsaKey.PrivateKeyWrapped), string(dek))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to unwrap rsa key %s", rsaKey.DocID)
+		}
+		rsaKeys, err := RSALoad(privateKeyPT, string(rsaKey.PublicKeyPlaintext))
+		if err != nil {
+			return nil, err
+		}
+		if len(rsaKey.VOPRFKeyWrapped) > 0 {
+			voprfKeyPT, err := DecryptAES(string(rsaKey.VOPRFKeyWrapped), string(dek))
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to unwrap voprf key of rsa key %s", rsaKey.DocID)
+			}
+			rsaKeys.VOPRFKey, err = LoadVOPRFKey([]byte(voprfKeyPT))
+			if err != nil {
+				return nil, errors.Wrapf(err, "rsa key %s", rsaKey.DocID)
+			}
+			rsaKeys.VOPRFPublicKey = rsaKeys.VOPRFKey.Public()
+		}
+		rsaKeys.ModelName = modelName
+		rsaKeys.Denomination = rsaKey.GetDenomination()
+		if rsaKeys.IsPartiallyBlind() {
+			rsaKeys.PartiallyBlindSigner, err = NewPartiallyBlindSigner(rsaKeys.PrivateKey)
+			if err != nil {
+				return nil, errors.Wrapf(err, "rsa key %s", rsaKey.DocID)
+			}
+		}
+		rsaKeys.NotBefore = rsaKey.NotBefore
+		rsaKeys.NotAfter = rsaKey.NotAfter
+		res = append(res, rsaKeys)
+	}
+	return res, nil
+}
+
+// ListRSAKeyDocsForModel returns the stored key documents of a model, including revoked and expired ones.
+func ListRSAKeyDocsForModel(ctx context.Context, dbHandler models.DBHandler, modelName confs.ModelName) ([]*models.RSAKeys, error) {
+	items, err := dbHandler.QueryEq(ctx, &models.RSAKeys{}, "ModelName", modelName)
+	if err != nil {
+		return nil, err
+	}
+	var res []*models.RSAKeys
+	for _, item := range items {
+		rsaKey := &models.RSAKeys{}
+		err = models.Deserialize(item, rsaKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to deserialize rsa key")
+		}
+		res = append(res, rsaKey)
+	}
+	return res, nil
+}
+
+// RSAKeyDocID is the model name for the first key of a model, rotated keys get the time they start signing appended.
+// Keys of tokens worth more than a credit have the denomination in between.
+func RSAKeyDocID(modelName confs.ModelName, denomination int, notBefore time.Time) string {
+	docID := modelName
+	if denomination > 1 {
+		docID = fmt.Sprintf("%s-x%d", docID, denomination)
+	}
+	if !notBefore.IsZero() {
+		docID = fmt.Sprintf("%s-%d", docID, notBefore.Unix())
+	}
+	return docID
+}
+
+// NewWrappedRSAKeys generates a fresh key pair for the model and denomination, with the private key wrapped by a new DEK
+// under kms. Keys of models come with a VOPRF key wrapped by the same DEK, in case the model issues VOPRF tokens. The
+// document isn't saved.
+func NewWrappedRSAKeys(ctx context.Context, kms KMS, modelName confs.ModelName, denomination int, docID string,
+	notBefore time.Time) (*models.RSAKeys, error) {
+	generateKeyPair := GenerateRSAKeyPair
+	if modelName == PartiallyBlindKeyName {
+		generateKeyPair = func() (string, string, error) { return GeneratePartiallyBlindRSAKeyPair(2048) }
+	}
+	pubStr, privStr, err := generateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	dek, err := NewRandomAESKey()
+	if err != nil {
+		return nil, err
+	}
+	privateKeyWrapped, err := EncryptAES(privStr, string(dek))
+	if err != nil {
+		return nil, err
+	}
+	var voprfKeyWrapped string
+	if modelName != PartiallyBlindKeyName {
+		voprfKey, err := NewVOPRFKey()
+		if err != nil {
+			return nil, err
+		}
+		voprfKeyPT, err := voprfKey.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		voprfKeyWrapped, err = EncryptAES(string(voprfKeyPT), string(dek))
+		if err != nil {
+			return nil, err
+		}
+	}
+	dekWrapped, kmsKeyID, err := kms.Encrypt(ctx, dek)
+	if err != nil {
+		return nil, err
+	}
+	return &models.RSAKeys{
+		DocID:              docID,
+		ModelName:          modelName,
+		Denomination:       denomination,
+		PublicKeyPlaintext: []byte(pubStr),
+		PrivateKeyWrapped:  []byte(privateKeyWrapped),
+		VOPRFKeyWrapped:    []byte(voprfKeyWrapped),
+		DEKWrapped:         []byte(dekWrapped),
+		KMSKeyID:           kmsKeyID,
+		NotBefore:          notBefore,
+	}, nil
+}
+
+// RotateRSAKey adds a new key for the model and denomination that starts signing at notBefore. Keys of the denomination
+// signing till now keep verifying for overlap after that, so tokens issued just before the rotation can still be spent.
+// Partially blind issuer keys need at least confs.PartiallyBlindKeyMinOverlap, their tokens are spendable that long.
+func RotateRSAKey(ctx context.Context, dbHandler models.DBHandler, kms KMS, modelName confs.ModelName, denomination int,
+	notBefore time.Time, overlap time.Duration) (*models.RSAKeys, error) {
+	if modelName == PartiallyBlindKeyName && overlap < confs.PartiallyBlindKeyMinOverlap(ctx) {
+		return nil, errors.Newf("partially blind issuer keys need an overlap of at least %v, the lifetime of their tokens",
+			confs.PartiallyBlindKeyMinOverlap(ctx))
+	}
+	docs, err := ListRSAKeyDocsForModel(ctx, dbHandler, modelName)
+	if err != nil {
+		return nil, err
+	}
+
+	docID := RSAKeyDocID(modelName, denomination, notBefore)
+	newKey, err := NewWrappedRSAKeys(ctx, kms, modelName, denomination, docID, notBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	retireAt := notBefore.Add(overlap)
+	toSave := []*models.RSAKeys{newKey}
+	for _, doc := range docs {
+		if doc.DocID == docID {
+			return nil, errors.Newf("rsa key %s already exists", docID)
+		}
+		if doc.Revoked || doc.GetDenomination() != denomination || !doc.NotBefore.Before(notBefore) {
+			continue
+		}
+		if doc.NotAfter.IsZero() || doc.NotAfter.After(retireAt) {
+			doc.NotAfter = retireAt
+			toSave = append(toSave, doc)
+		}
+	}
+	// New key first, so a failure half way never leaves the model without a signing key.
+	for _, doc := range toSave {
+		err = dbHandler.Upsert(ctx, doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Infof(ctx, "Rotated rsa key for model %s (x%d), new key %s from %v, old keys retire at %v",
+		modelName, denomination, docID, notBefore, retireAt)
+	return newKey, nil
+}
+
+// RevokeRSAKey marks the key with keyID revoked. Running instances stop signing and verifying with it once they poll
+// for revocations, see confs.RSAKeyRevocationPollInterval. Call AuthManager.Revoke too, for the current instance to
+// stop right away.
+func RevokeRSAKey(ctx context.Context, dbHandler models.DBHandler, modelName confs.ModelName, keyID string) error {
+	docs, err := ListRSAKeyDocsForModel(ctx, dbHandler, modelName)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		publicKey, err := RSALoadPublicKey(string(doc.PublicKeyPlaintext))
+		if err != nil {
+			return err
+		}
+		if RSAKeyID(publicKey) != keyID {
+			continue
+		}
+		doc.Revoked = true
+		doc.RevokedAt = time.Now().UTC()
+		log.Infof(ctx, "Revoking rsa key %s (%s) for model %s", keyID, doc.DocID, modelName)
+		return dbHandler.Upsert(ctx, doc)
+	}
+	return errors.Newf("no rsa key %s for model %s", keyID, modelName)
+}
+
+// RevokedRSAKeyIDs lists the key IDs of the model that got revoked.
+func RevokedRSAKeyIDs(ctx context.Context, dbHandler models.DBHandler, modelName confs.ModelName) ([]string, error) {
+	docs, err := ListRSAKeyDocsForModel(ctx, dbHandler, modelName)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, doc := range docs {
+		if !doc.Revoked {
+			continue
+		}
+		publicKey, err := RSALoadPublicKey(string(doc.PublicKeyPlaintext))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load public key of rsa key %s", doc.DocID)
+		}
+		res = append(res, RSAKeyID(publicKey))
+	}
+	return res, nil
+}
+
+// RetiredRSAKeyIDs lists the key IDs of the model that expired or got revoked before the given time.
+func RetiredRSAKeyIDs(ctx context.Context, dbHandler models.DBHandler, modelName confs.ModelName, before time.Time) ([]string, error) {
+	docs, err := ListRSAKeyDocsForModel(ctx, dbHandler, modelName)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, doc := range docs {
+		retiredAt := doc.NotAfter
+		if doc.Revoked && (retiredAt.IsZero() || doc.RevokedAt.Before(retiredAt)) {
+			retiredAt = doc.RevokedAt
+		}
+		if retiredAt.IsZero() || !retiredAt.Before(before) {
+			continue
+		}
+		publicKey, err := RSALoadPublicKey(string(doc.PublicKeyPlaintext))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load public key of rsa key %s", doc.DocID)
+		}
+		res = append(res, RSAKeyID(publicKey))
+	}
+	return res, nil
+}
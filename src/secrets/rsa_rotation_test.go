@@ -0,0 +1,76 @@
+package secrets
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"testing"
+	"time"
+)
+
+func TestRSAKeyRotationAndRevocation(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	dbHandler := models.NewMemDBHandler()
+	masterKeys, err := NewLocalMasterKeys("platform")
+	assert.Nil(t, err)
+	kms, err := NewLocalKMS(masterKeys)
+	assert.Nil(t, err)
+
+	now := time.Now().UTC()
+	first, err := NewWrappedRSAKeys(ctx, kms, "gpt-4.1", 1, "gpt-4.1", now.Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Nil(t, dbHandler.Upsert(ctx, first))
+
+	// Keys of other denominations rotate on their own.
+	fives, err := NewWrappedRSAKeys(ctx, kms, "gpt-4.1", 5, RSAKeyDocID("gpt-4.1", 5, time.Time{}), now.Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Nil(t, dbHandler.Upsert(ctx, fives))
+
+	_, err = RotateRSAKey(ctx, dbHandler, kms, "gpt-4.1", 1, now, time.Hour)
+	assert.Nil(t, err)
+	rsaKeys, err := LoadRSAKeysForModel(ctx, dbHandler, kms, "gpt-4.1")
+	assert.Nil(t, err)
+	assert.Len(t, rsaKeys, 3)
+	for _, rsaKey := range rsaKeys {
+		if rsaKey.Denomination == 5 {
+			assert.True(t, rsaKey.NotAfter.IsZero())
+		} else if rsaKey.NotBefore.Before(now) {
+			// Old key keeps verifying for the overlap.
+			assert.True(t, now.Add(time.Hour).Equal(rsaKey.NotAfter))
+		} else {
+			assert.True(t, rsaKey.NotAfter.IsZero())
+		}
+	}
+
+	// Past the overlap, only the new key is left.
+	_, err = RotateRSAKey(ctx, dbHandler, kms, "gpt-4.1", 1, now.Add(time.Minute), -2*time.Minute)
+	assert.Nil(t, err)
+	_, err = RotateRSAKey(ctx, dbHandler, kms, "gpt-4.1", 5, now.Add(time.Minute), -2*time.Minute)
+	assert.Nil(t, err)
+	rsaKeys, err = LoadRSAKeysForModel(ctx, dbHandler, kms, "gpt-4.1")
+	assert.Nil(t, err)
+	assert.Len(t, rsaKeys, 2)
+	rsaKeys = common.Filter(rsaKeys, func(rsaKey *RSAKeys) bool { return rsaKey.Denomination == 1 })
+	assert.Len(t, rsaKeys, 1)
+
+	assert.Nil(t, RevokeRSAKey(ctx, dbHandler, "gpt-4.1", rsaKeys[0].KeyID))
+	rsaKeys, err = LoadRSAKeysForModel(ctx, dbHandler, kms, "gpt-4.1")
+	assert.Nil(t, err)
+	assert.Len(t, rsaKeys, 1)
+	assert.Equal(t, 5, rsaKeys[0].Denomination)
+	assert.NotNil(t, RevokeRSAKey(ctx, dbHandler, "gpt-4.1", "unknown"))
+}
+
+func TestPartiallyBlindKeyRotationOverlap(t *testing.T) {
+	ctx := context.Background()
+	// Tokens signed just before the rotation are spendable for their whole lifetime.
+	_, err := RotateRSAKey(ctx, models.NewMemDBHandler(), nil, PartiallyBlindKeyName, 1, time.Now().UTC(),
+		7*24*time.Hour)
+	assert.ErrorContains(t, err, "overlap")
+	assert.Greater(t, confs.PartiallyBlindKeyMinOverlap(ctx),
+		time.Duration(confs.TokenLifetimeEpochs(ctx))*confs.TokenEpochLength(ctx))
+}
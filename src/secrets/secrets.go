@@ -6,10 +6,11 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
-	"errors"
+	"github.com/cockroachdb/errors"
 	"io"
 	"llmmask/src/common"
 	"llmmask/src/models"
+	"time"
 )
 
 const (
@@ -18,6 +19,9 @@ const (
 
 var userCredsDEKStr string
 
+// prevUserCredsDEKStr is the DEK before the last rotation, empty if it was never rotated.
+var prevUserCredsDEKStr string
+
 func InitPlatformDEKs(ctx context.Context) {
 	dbHandler := models.DefaultDBHandler()
 	kms := DefaultKMS()
@@ -27,8 +31,89 @@ func InitPlatformDEKs(ctx context.Context) {
 	}
 	common.Must2(dbHandler.Fetch(ctx, userCredsDEK))
 
-	unwrappedDEKValue := common.Must(kms.Decrypt(ctx, string(userCredsDEK.DEKWrapped), userCredsDEK.KMSKeyID))
-	userCredsDEKStr = string(unwrappedDEKValue)
+	var err error
+	userCredsDEKStr, prevUserCredsDEKStr, err = UnwrapDEK(ctx, kms, userCredsDEK)
+	common.Must2(err)
+}
+
+// UnwrapDEK returns the current and the previous (empty if never rotated) DEK.
+func UnwrapDEK(ctx context.Context, kms KMS, dek *models.DEK) (string, string, error) {
+	current, err := kms.Decrypt(ctx, string(dek.DEKWrapped), dek.KMSKeyID)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to unwrap dek %s", dek.DocID)
+	}
+	if len(dek.PreviousDEKWrapped) == 0 {
+		return string(current), "", nil
+	}
+	previous, err := kms.Decrypt(ctx, string(dek.PreviousDEKWrapped), dek.PreviousKMSKeyID)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to unwrap previous dek %s", dek.DocID)
+	}
+	return string(current), string(previous), nil
+}
+
+// CreateUserCredsDEK generates the user-creds-dek, failing if there's one already.
+func CreateUserCredsDEK(ctx context.Context, dbHandler models.DBHandler, kms KMS) error {
+	dek, err := NewRandomAESKey()
+	if err != nil {
+		return err
+	}
+	dekWrapped, kmsKeyID, err := kms.Encrypt(ctx, dek)
+	if err != nil {
+		return err
+	}
+	err = dbHandler.Create(ctx, &models.DEK{
+		DocID:      userCredsDEKID,
+		DEKWrapped: []byte(dekWrapped),
+		KMSKeyID:   kmsKeyID,
+	})
+	if models.IsConflictErr(err) {
+		return errors.Newf("%s already exists, rotate it instead", userCredsDEKID)
+	}
+	return err
+}
+
+// RotateUserCredsDEK replaces the user-creds-dek with a fresh one, keeping the current one as previous. Data under
+// the one before that can't be read anymore, so everything must be re-encrypted (see ReencryptAES) between rotations.
+// Servers pick the new DEK up on restart.
+func RotateUserCredsDEK(ctx context.Context, dbHandler models.DBHandler, kms KMS) (*models.DEK, error) {
+	userCredsDEK := &models.DEK{
+		DocID: userCredsDEKID,
+	}
+	err := dbHandler.Fetch(ctx, userCredsDEK)
+	if err != nil {
+		return nil, err
+	}
+	dek, err := NewRandomAESKey()
+	if err != nil {
+		return nil, err
+	}
+	dekWrapped, kmsKeyID, err := kms.Encrypt(ctx, dek)
+	if err != nil {
+		return nil, err
+	}
+	userCredsDEK.PreviousDEKWrapped = userCredsDEK.DEKWrapped
+	userCredsDEK.PreviousKMSKeyID = userCredsDEK.KMSKeyID
+	userCredsDEK.DEKWrapped = []byte(dekWrapped)
+	userCredsDEK.KMSKeyID = kmsKeyID
+	userCredsDEK.RotatedAt = time.Now().UTC()
+	err = dbHandler.Upsert(ctx, userCredsDEK)
+	if err != nil {
+		return nil, err
+	}
+	return userCredsDEK, nil
+}
+
+// FetchUserCredsDEK returns the current and previous user-creds-dek.
+func FetchUserCredsDEK(ctx context.Context, dbHandler models.DBHandler, kms KMS) (string, string, error) {
+	userCredsDEK := &models.DEK{
+		DocID: userCredsDEKID,
+	}
+	err := dbHandler.Fetch(ctx, userCredsDEK)
+	if err != nil {
+		return "", "", err
+	}
+	return UnwrapDEK(ctx, kms, userCredsDEK)
 }
 
 func NewRandomAESKey() ([]byte, error) {
@@ -48,7 +133,12 @@ func EncryptUserCreds(userData string) (string, error) {
 }
 
 func DecryptUserData(userDataEncrypted string) (string, error) {
-	return DecryptAES(userDataEncrypted, userCredsDEKStr)
+	res, err := DecryptAES(userDataEncrypted, userCredsDEKStr)
+	if err != nil && prevUserCredsDEKStr != "" {
+		// Not re-encrypted since the last rotation.
+		return DecryptAES(userDataEncrypted, prevUserCredsDEKStr)
+	}
+	return res, err
 }
 
 // EncryptAES encrypts plain text using a key and returns the base64 encoded cipher text.
@@ -102,3 +192,24 @@ func DecryptAES(cipherText, key string) (string, error) {
 
 	return string(plainText), nil
 }
+
+// ReencryptAES makes sure cipherText is under key, decrypting it with whichever of key and oldKeys works. It's
+// false if it already was under key.
+func ReencryptAES(cipherText, key string, oldKeys ...string) (string, bool, error) {
+	_, err := DecryptAES(cipherText, key)
+	if err == nil {
+		return cipherText, false, nil
+	}
+	for _, oldKey := range oldKeys {
+		if oldKey == "" {
+			continue
+		}
+		plainText, err := DecryptAES(cipherText, oldKey)
+		if err != nil {
+			continue
+		}
+		res, err := EncryptAES(plainText, key)
+		return res, err == nil, err
+	}
+	return "", false, errors.New("cipher text is under none of the keys")
+}
@@ -0,0 +1,110 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/circl/zk/dleq"
+	"github.com/cockroachdb/errors"
+)
+
+// VOPRF tokens (RFC 9497, verifiable mode) are a cheaper alternative to blind RSA for models that pick them, see
+// confs.TokenSchemeVOPRF. Only we verify tokens, so the scheme doesn't need to be publicly verifiable: a token is a
+// random input and its OPRF output, and the issuance response carries a batched DLEQ proof that clients check against
+// the published VOPRF public key.
+
+// VOPRFSuite is the suite all VOPRF tokens use.
+var VOPRFSuite = oprf.SuiteRistretto255
+
+// VOPRFAlgorithm names VOPRFSuite in the public key listing.
+const VOPRFAlgorithm = "VOPRF-ristretto255-SHA512"
+
+// VOPRFInputSize is the size of the random token inputs clients pick.
+const VOPRFInputSize = 32
+
+// errNoVOPRFKey is for RSA keys stored before they came with a VOPRF key, models switching to VOPRF tokens need a
+// rotation first.
+var errNoVOPRFKey = errors.New("key has no voprf key, rotate it")
+
+// NewVOPRFKey generates the VOPRF key of a new RSA key pair. It's stored wrapped next to the RSA key, see
+// models.RSAKeys.VOPRFKeyWrapped, so it shares the RSA key's rotation and revocation, and its key ID, without being
+// tied to its key material.
+func NewVOPRFKey() (*oprf.PrivateKey, error) {
+	return oprf.GenerateKey(VOPRFSuite, rand.Reader)
+}
+
+// LoadVOPRFKey parses a VOPRF key marshaled with MarshalBinary.
+func LoadVOPRFKey(data []byte) (*oprf.PrivateKey, error) {
+	privateKey := &oprf.PrivateKey{}
+	err := privateKey.UnmarshalBinary(VOPRFSuite, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid voprf key")
+	}
+	return privateKey, nil
+}
+
+// VOPRFEvaluate evaluates the blinded elements of one issuance, with a single DLEQ proof for all of them.
+func VOPRFEvaluate(privateKey *oprf.PrivateKey, blindedElements [][]byte) ([][]byte, []byte, error) {
+	if privateKey == nil {
+		return nil, nil, errNoVOPRFKey
+	}
+	req := &oprf.EvaluationRequest{}
+	for _, blindedElement := range blindedElements {
+		element := VOPRFSuite.Group().NewElement()
+		err := element.UnmarshalBinary(blindedElement)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid blinded element")
+		}
+		req.Elements = append(req.Elements, element)
+	}
+	evaluation, err := oprf.NewVerifiableServer(VOPRFSuite, privateKey).Evaluate(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	var evaluatedElements [][]byte
+	for _, element := range evaluation.Elements {
+		evaluatedElement, err := element.MarshalBinaryCompress()
+		if err != nil {
+			return nil, nil, err
+		}
+		evaluatedElements = append(evaluatedElements, evaluatedElement)
+	}
+	proof, err := evaluation.Proof.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	return evaluatedElements, proof, nil
+}
+
+// VOPRFVerify checks that output is the OPRF output of input under the key.
+func VOPRFVerify(privateKey *oprf.PrivateKey, input, output []byte) error {
+	if privateKey == nil {
+		return errNoVOPRFKey
+	}
+	if len(input) != VOPRFInputSize {
+		return errors.Newf("voprf token input must be %d bytes", VOPRFInputSize)
+	}
+	if !oprf.NewVerifiableServer(VOPRFSuite, privateKey).VerifyFinalize(input, output) {
+		return errors.New("invalid voprf token")
+	}
+	return nil
+}
+
+// VOPRFFinalize is the client side of VOPRFEvaluate: it checks the proof and unblinds the outputs. For tests and Go
+// clients, blinding is oprf.VerifiableClient.Blind.
+func VOPRFFinalize(publicKey *oprf.PublicKey, finalizeData *oprf.FinalizeData, evaluatedElements [][]byte,
+	proof []byte) ([][]byte, error) {
+	evaluation := &oprf.Evaluation{Proof: &dleq.Proof{}}
+	for _, evaluatedElement := range evaluatedElements {
+		element := VOPRFSuite.Group().NewElement()
+		err := element.UnmarshalBinary(evaluatedElement)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid evaluated element")
+		}
+		evaluation.Elements = append(evaluation.Elements, element)
+	}
+	err := evaluation.Proof.UnmarshalBinary(VOPRFSuite.Group(), proof)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid proof")
+	}
+	return oprf.NewVerifiableClient(VOPRFSuite, publicKey).Finalize(finalizeData, evaluation)
+}
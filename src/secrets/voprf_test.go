@@ -0,0 +1,75 @@
+package secrets
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/cloudflare/circl/oprf"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/common"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"testing"
+	"time"
+)
+
+func TestVOPRFIssueAndVerify(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	dbHandler := models.NewMemDBHandler()
+	kms, err := NewLocalKMS(common.Must(NewLocalMasterKeys("platform")))
+	assert.Nil(t, err)
+	doc, err := NewWrappedRSAKeys(ctx, kms, "gpt-4.1", 1, "gpt-4.1", time.Time{})
+	assert.Nil(t, err)
+	assert.Nil(t, dbHandler.Upsert(ctx, doc))
+	// Stored with the key pair, so every instance loading the key agrees on it.
+	loaded, err := LoadRSAKeysForModel(ctx, dbHandler, kms, "gpt-4.1")
+	assert.Nil(t, err)
+	reloaded, err := LoadRSAKeysForModel(ctx, dbHandler, kms, "gpt-4.1")
+	assert.Nil(t, err)
+	rsaKeys := loaded[0]
+	assert.Equal(t, mustMarshal(t, rsaKeys.VOPRFPublicKey), mustMarshal(t, reloaded[0].VOPRFPublicKey))
+
+	inputs := make([][]byte, 3)
+	for i := range inputs {
+		inputs[i] = make([]byte, VOPRFInputSize)
+		_, err = rand.Read(inputs[i])
+		assert.Nil(t, err)
+	}
+	finalizeData, evalReq, err := oprf.NewVerifiableClient(VOPRFSuite, rsaKeys.VOPRFPublicKey).Blind(inputs)
+	assert.Nil(t, err)
+	var blindedElements [][]byte
+	for _, element := range evalReq.Elements {
+		blindedElements = append(blindedElements, mustMarshal(t, element))
+	}
+
+	evaluatedElements, proof, err := VOPRFEvaluate(rsaKeys.VOPRFKey, blindedElements)
+	assert.Nil(t, err)
+	outputs, err := VOPRFFinalize(rsaKeys.VOPRFPublicKey, finalizeData, evaluatedElements, proof)
+	assert.Nil(t, err)
+	for i, output := range outputs {
+		assert.Nil(t, VOPRFVerify(reloaded[0].VOPRFKey, inputs[i], output))
+	}
+	assert.NotNil(t, VOPRFVerify(rsaKeys.VOPRFKey, inputs[0], outputs[1]))
+
+	// The proof doesn't hold for another key.
+	otherKey, err := NewVOPRFKey()
+	assert.Nil(t, err)
+	_, err = VOPRFFinalize(otherKey.Public(), finalizeData, evaluatedElements, proof)
+	assert.NotNil(t, err)
+
+	// Keys stored before VOPRF keys have none.
+	doc.VOPRFKeyWrapped = nil
+	assert.Nil(t, dbHandler.Upsert(ctx, doc))
+	loaded, err = LoadRSAKeysForModel(ctx, dbHandler, kms, "gpt-4.1")
+	assert.Nil(t, err)
+	assert.Nil(t, loaded[0].VOPRFKey)
+	_, _, err = VOPRFEvaluate(loaded[0].VOPRFKey, blindedElements)
+	assert.NotNil(t, err)
+	assert.NotNil(t, VOPRFVerify(loaded[0].VOPRFKey, inputs[0], outputs[0]))
+}
+
+func mustMarshal(t *testing.T, m interface{ MarshalBinary() ([]byte, error) }) []byte {
+	data, err := m.MarshalBinary()
+	assert.Nil(t, err)
+	return data
+}
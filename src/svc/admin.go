@@ -0,0 +1,83 @@
+package svc
+
+import (
+	"github.com/cockroachdb/errors"
+	"github.com/go-chi/render"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	llm_proxy "llmmask/src/llm-proxy"
+	"llmmask/src/models"
+	"llmmask/src/secrets"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// AdminMiddleware lets through signed in users listed in admin_emails, must come after AuthMiddleware.
+func (s *Service) AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := s.getUserFromContext(r.Context())
+		adminEmails := common.PlatformCredsConfig().AdminEmails
+		isAdmin := user.Email != "" && slices.ContainsFunc(adminEmails, func(email string) bool {
+			return strings.EqualFold(email, user.Email)
+		})
+		if !isAdmin {
+			render.Render(w, r, ErrForbidden(errors.New("admins only")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type GetAPIKeysResp struct {
+	Keys []llm_proxy.APIKeyHealth
+}
+
+// GetAPIKeysHandler shows the health, consumption and budgets of every provider api key, as seen by this instance.
+func (s *Service) GetAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	render.Respond(w, r, Ok200(&GetAPIKeysResp{
+		Keys: s.apiKeyManager.Health(),
+	}))
+}
+
+type GetGCReportResp struct {
+	Report *models.AuthTokenGCReport
+}
+
+// GetGCReportHandler shows what the latest auth token GC run of this instance processed.
+func (s *Service) GetGCReportHandler(w http.ResponseWriter, r *http.Request) {
+	render.Respond(w, r, Ok200(&GetGCReportResp{
+		Report: s.lastGCReport.Load(),
+	}))
+}
+
+type RevokeRSAKeyReq struct {
+	// ModelName is the model the key belongs to, secrets.PartiallyBlindKeyName for partially blind issuer keys.
+	ModelName confs.ModelName
+	KeyID     string
+}
+
+func (r *RevokeRSAKeyReq) Bind(req *http.Request) error {
+	if r.ModelName == "" || r.KeyID == "" {
+		return errors.New("ModelName and KeyID are required")
+	}
+	return nil
+}
+
+// RevokeRSAKeyHandler revokes a signing key, for compromised keys. This instance stops using it right away, the others
+// when they next poll for revocations.
+func (s *Service) RevokeRSAKeyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &RevokeRSAKeyReq{}
+	if err := render.Bind(r, req); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	err := secrets.RevokeRSAKey(ctx, s.dbHandler, req.ModelName, req.KeyID)
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	s.revokeRSAKeys(req.KeyID)
+	render.Render(w, r, Ok200("ok"))
+}
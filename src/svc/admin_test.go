@@ -0,0 +1,33 @@
+package svc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/confs"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"llmmask/src/secrets"
+	"testing"
+)
+
+func TestApplyRSAKeyRevocations(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	s := newTestService(t, confs.ModelChatGPT41, confs.ModelChatGPT4o)
+	for _, modelName := range []confs.ModelName{confs.ModelChatGPT41, confs.ModelChatGPT4o} {
+		publicKey := s.authManagers[modelName].PublicKeys()[0].PublicKey
+		assert.NoError(t, s.dbHandler.Upsert(ctx, &models.RSAKeys{
+			DocID:              string(modelName) + "-key",
+			ModelName:          modelName,
+			PublicKeyPlaintext: []byte(secrets.RSAPublicKeyPEM(publicKey)),
+		}))
+	}
+	revokedKeyID := s.authManagers[confs.ModelChatGPT41].KeyID()
+	assert.NoError(t, secrets.RevokeRSAKey(ctx, s.dbHandler, confs.ModelChatGPT41, revokedKeyID))
+
+	// Revoking elsewhere only marks the key, instances stop using it when they poll.
+	assert.Equal(t, revokedKeyID, s.authManagers[confs.ModelChatGPT41].KeyID())
+	s.applyRSAKeyRevocations(ctx)
+	assert.Empty(t, s.authManagers[confs.ModelChatGPT41].KeyID())
+	assert.NotEmpty(t, s.authManagers[confs.ModelChatGPT4o].KeyID())
+}
@@ -1,15 +1,23 @@
 package svc
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"github.com/cockroachdb/errors"
 	"github.com/go-chi/render"
+	"llmmask/src/auth"
 	"llmmask/src/common"
 	"llmmask/src/confs"
 	"llmmask/src/log"
 	"llmmask/src/models"
 	"net/http"
+	"runtime"
+	"slices"
 	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
 func (s *Service) GetSignedBlindedTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -30,87 +38,457 @@ func (s *Service) GetSignedBlindedTokenHandler(w http.ResponseWriter, r *http.Re
 }
 
 func (s *Service) getSignedBlindedToken(ctx context.Context, user *models.User, req *GetSignedBlindedTokenReq) (*GetSignedBlindedTokenResp, error) {
-	cacheID := "getSignedBlindedToken" + req.RequestID
-	if res, found := s.inMemCache.Get(cacheID); found {
-		resp, ok := res.(*GetSignedBlindedTokenResp)
-		common.Assert(ok, "cache misuse")
-		return resp, nil
+	signedBlindedToken, keyID, err := s.issueToken(ctx, user, req.ModelName, req.Denomination, req.ExpiryEpoch,
+		req.BlindedToken, func(authManager *auth.AuthManager) ([]byte, string, error) {
+			return signBlindedToken(ctx, authManager, req.Denomination, req.ExpiryEpoch, req.BlindedToken)
+		})
+	if err != nil {
+		return nil, err
 	}
+	return &GetSignedBlindedTokenResp{
+		ModelName:          req.ModelName,
+		Denomination:       req.Denomination,
+		ExpiryEpoch:        req.ExpiryEpoch,
+		KeyID:              keyID,
+		SignedBlindedToken: signedBlindedToken,
+	}, nil
+}
 
-	authManager, ok := s.authManagers[req.ModelName]
+// issueToken charges the user denomination credits of the model for signing blindedToken with sign. Nothing is
+// charged if signing fails. Each blinded token is issued once, it's the reference of the issuance in the ledger. The
+// signature is kept on its marker, written before the debit, so the same user repeating the issuance gets it back,
+// charged only if the debit didn't go through the first time.
+func (s *Service) issueToken(ctx context.Context, user *models.User, modelName confs.ModelName, denomination int,
+	expiryEpoch int64, blindedToken []byte, sign func(authManager *auth.AuthManager) ([]byte, string, error)) ([]byte,
+	string, error) {
+	authManager, ok := s.authManagers[modelName]
 	if !ok {
-		return nil, errors.New("no auth manager found")
+		return nil, "", errors.New("no auth manager found")
 	}
-	sem := &common.SemaphoreConf{
-		Handle:  "getSignedBlindedToken" + user.DocID,
-		Request: 1,
-		Limit:   1,
-	}
-	err := common.AcquireSemaphore(ctx, sem)
+	lease, err := s.locker.Acquire(ctx, models.UserBalanceLockKey(user.DocID), confs.LockLeaseTTL(ctx))
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	defer common.ReleaseSemaphore(sem)
+	defer lease.Release(ctx)
 
 	err = s.dbHandler.Fetch(ctx, user)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	authToken := &models.AuthToken{DocID: models.DocIDForAuthToken(blindedToken)}
+	err = s.dbHandler.Fetch(ctx, authToken)
+	if err != nil && !models.IsNotFoundErr(err) {
+		return nil, "", err
+	}
+	found := err == nil
+	if found && !isIssuanceOf(authToken, user, modelName, denomination, expiryEpoch) {
+		return nil, "", errors.New("blinded token already issued, blind a fresh one")
+	}
+	if found && authToken.Issuance.Charged {
+		log.Infof(ctx, "Blinded token %s already issued, returning its signature", authToken.DocID)
+		return authToken.Issuance.SignedBlindedToken, authToken.KeyID, nil
 	}
 
-	if user.SubscriptionInfo.ActiveAuthTokens == nil {
-		user.SubscriptionInfo.ActiveAuthTokens = make(models.AuthTokenInfo)
+	subscriptionInfo := &user.SubscriptionInfo
+	ledgerEntry := models.NewLedgerEntry(user.DocID, models.LedgerKindIssuance, authToken.DocID, modelName,
+		-denomination, denomination, time.Now().UTC())
+	alreadyCharged := found && subscriptionInfo.FindIssuedToken(authToken.DocID) != nil
+	if !alreadyCharged && subscriptionInfo.ActiveAuthTokens[modelName] < denomination {
+		return nil, "", errors.New("no quota left")
 	}
-	if user.SubscriptionInfo.UsedAuthTokens == nil {
-		user.SubscriptionInfo.UsedAuthTokens = make(models.AuthTokenInfo)
+
+	if !found {
+		signedBlindedToken, keyID, err := sign(authManager)
+		if err != nil {
+			return nil, "", err
+		}
+		now := time.Now().UTC()
+		authToken.ModelName = modelName
+		// Marks the blinded token issued until its key retires, GC then drops it with the key's spent markers.
+		authToken.KeyID = keyID
+		authToken.CreatedAt = now
+		authToken.ExpiresAt = now.Add(-time.Hour * 24 * 7) // Already expired.
+		authToken.Issuance = &models.TokenIssuance{
+			UserDocID:          user.DocID,
+			Denomination:       denomination,
+			ExpiryEpoch:        expiryEpoch,
+			SignedBlindedToken: signedBlindedToken,
+		}
+		err = s.dbHandler.Create(ctx, authToken)
+		if err != nil {
+			return nil, "", err
+		}
 	}
-	currActive := user.SubscriptionInfo.ActiveAuthTokens[req.ModelName]
-	currUsed := user.SubscriptionInfo.UsedAuthTokens[req.ModelName]
-	if currActive <= 0 {
-		return nil, errors.New("no quota left")
+
+	if alreadyCharged {
+		log.Infof(ctx, "Blinded token %s already charged, returning its signature", authToken.DocID)
+		s.appendLedger(ctx, ledgerEntry)
+	} else {
+		if subscriptionInfo.ActiveAuthTokens == nil {
+			subscriptionInfo.ActiveAuthTokens = make(models.AuthTokenInfo)
+		}
+		if subscriptionInfo.UsedAuthTokens == nil {
+			subscriptionInfo.UsedAuthTokens = make(models.AuthTokenInfo)
+		}
+		now := time.Now().UTC()
+		subscriptionInfo.ActiveAuthTokens[modelName] -= denomination
+		subscriptionInfo.UsedAuthTokens[modelName] += denomination
+		subscriptionInfo.PruneIssuedTokens(now)
+		// Tells a repeat whether the debit went through, in case marking the issuance charged below doesn't.
+		subscriptionInfo.IssuedTokens = append(subscriptionInfo.IssuedTokens, models.IssuedToken{
+			MarkerID: authToken.DocID,
+			IssuedAt: now,
+		})
+		err = s.saveBalance(ctx, user, ledgerEntry)
+		if err != nil {
+			return nil, "", err
+		}
 	}
-	currActive--
-	currUsed++
-	signedBlindedToken, err := authManager.SignBlindedToken(req.BlindedToken)
+
+	authToken.Issuance.Charged = true
+	err = s.dbHandler.Replace(ctx, authToken)
 	if err != nil {
-		return nil, err
+		// The user has the signature, a repeat finds the debit in IssuedTokens for a while still.
+		log.Errorf(ctx, "[ALERT]: Failed to mark blinded token %s charged: %+v", authToken.DocID, err)
+	}
+	return authToken.Issuance.SignedBlindedToken, authToken.KeyID, nil
+}
+
+// isIssuanceOf tells if the marker is of the user issuing a token of the model, denomination and expiryEpoch. Markers
+// from before signatures were kept on them aren't of anyone.
+func isIssuanceOf(authToken *models.AuthToken, user *models.User, modelName confs.ModelName, denomination int,
+	expiryEpoch int64) bool {
+	issuance := authToken.Issuance
+	return issuance != nil && issuance.UserDocID == user.DocID && authToken.ModelName == modelName &&
+		issuance.Denomination == denomination && issuance.ExpiryEpoch == expiryEpoch
+}
+
+// signBlindedToken signs under the scheme of the model, partially blind tokens for the denomination and expiryEpoch.
+func signBlindedToken(ctx context.Context, authManager *auth.AuthManager, denomination int, expiryEpoch int64,
+	blindedToken []byte) ([]byte, string, error) {
+	if authManager.Scheme() == confs.TokenSchemePartiallyBlindRSA {
+		return authManager.SignPartiallyBlindToken(ctx, denomination, expiryEpoch, blindedToken)
+	}
+	return authManager.SignBlindedToken(denomination, blindedToken)
+}
+
+type GetSignedBlindedTokenReq struct {
+	// RequestID isn't needed anymore, repeats are told by BlindedToken.
+	RequestID    string
+	BlindedToken []byte
+	ModelName    confs.ModelName
+	// Denomination is how many credits the token is worth, one of confs.TokenDenominations. Defaults to 1.
+	Denomination int
+	// ExpiryEpoch is only for models issuing partially blind tokens, see GetPublicKeysResp.ExpiryEpoch.
+	ExpiryEpoch int64
+}
+
+func (r *GetSignedBlindedTokenReq) Bind(req *http.Request) error {
+	var err error
+	r.Denomination, err = validateDenomination(req.Context(), r.Denomination)
+	return err
+}
+
+type GetSignedBlindedTokenResp struct {
+	ModelName          confs.ModelName
+	Denomination       int
+	ExpiryEpoch        int64 `json:",omitempty"`
+	KeyID              string
+	SignedBlindedToken []byte
+}
+
+// validateDenomination defaults the denomination of issuance requests from before denominations to 1.
+func validateDenomination(ctx context.Context, denomination int) (int, error) {
+	denomination = common.ValueOR(denomination, 1)
+	if !slices.Contains(confs.TokenDenominations(ctx), denomination) {
+		return 0, errors.Newf("tokens come in denominations of %v credits", confs.TokenDenominations(ctx))
+	}
+	return denomination, nil
+}
+
+func (s *Service) GetSignedBlindedTokensBatchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := s.getUserFromContext(ctx)
+	req := &GetSignedBlindedTokensBatchReq{}
+	if err := render.Bind(r, req); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
 	}
-	user.SubscriptionInfo.ActiveAuthTokens[req.ModelName] = currActive
-	user.SubscriptionInfo.UsedAuthTokens[req.ModelName] = currUsed
-	err = s.dbHandler.Upsert(ctx, user)
+
+	resp, err := s.getSignedBlindedTokensBatch(ctx, user, req)
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	render.Respond(w, r, Ok200(resp))
+}
+
+// getSignedBlindedTokensBatch signs N blinded tokens for one model, debiting the balance once.
+// It's idempotent on RequestID: a retried batch with the same blinded tokens is signed again without charging.
+// Blind RSA signatures are deterministic, so the retry gets back the exact same signed tokens.
+func (s *Service) getSignedBlindedTokensBatch(ctx context.Context, user *models.User, req *GetSignedBlindedTokensBatchReq) (*GetSignedBlindedTokensBatchResp, error) {
+	numTokens := len(req.BlindedTokens)
+	signedBlindedTokens := make([][]byte, numTokens)
+	keyIDs := make([]string, numTokens)
+	err := s.issueBatch(ctx, user, req.RequestID, req.ModelName, req.Denomination, req.ExpiryEpoch, req.BlindedTokens,
+		func(authManager *auth.AuthManager) (string, error) {
+			g, _ := errgroup.WithContext(ctx)
+			g.SetLimit(runtime.NumCPU())
+			for i, blindedToken := range req.BlindedTokens {
+				g.Go(func() error {
+					signedBlindedToken, keyID, err := signBlindedToken(ctx, authManager, req.Denomination, req.ExpiryEpoch,
+						blindedToken)
+					if err != nil {
+						return err
+					}
+					signedBlindedTokens[i] = signedBlindedToken
+					keyIDs[i] = keyID
+					return nil
+				})
+			}
+			err := g.Wait()
+			if err != nil {
+				return "", err
+			}
+			// The response has a single key ID, nothing is charged yet so the client can simply retry.
+			for _, keyID := range keyIDs {
+				if keyID != keyIDs[0] {
+					return "", errors.New("signing key rotated during the batch, please retry")
+				}
+			}
+			return keyIDs[0], nil
+		})
 	if err != nil {
 		return nil, err
 	}
-	resp := &GetSignedBlindedTokenResp{
-		ModelName:          req.ModelName,
-		SignedBlindedToken: signedBlindedToken,
+	return &GetSignedBlindedTokensBatchResp{
+		ModelName:           req.ModelName,
+		Denomination:        req.Denomination,
+		ExpiryEpoch:         req.ExpiryEpoch,
+		KeyID:               keyIDs[0],
+		SignedBlindedTokens: signedBlindedTokens,
+	}, nil
+}
+
+// issueBatch charges the user denomination credits of the model per blinded token, once per requestID, around sign,
+// which returns the key ID it signed with. A retried batch is signed again without charging, nothing is charged if
+// signing fails or a blinded token was already issued.
+func (s *Service) issueBatch(ctx context.Context, user *models.User, requestID string, modelName confs.ModelName,
+	denomination int, expiryEpoch int64, blindedTokens [][]byte,
+	sign func(authManager *auth.AuthManager) (string, error)) error {
+	authManager, ok := s.authManagers[modelName]
+	if !ok {
+		return errors.New("no auth manager found")
 	}
+	numTokens := len(blindedTokens)
+	credits := numTokens * denomination
+	batchHash := blindedTokensHash(denomination, expiryEpoch, blindedTokens)
 
-	authToken := &models.AuthToken{
-		DocID:     models.DocIDForAuthToken(req.BlindedToken),
-		ModelName: req.ModelName,
-		CreatedAt: time.Now().UTC(),
-		ExpiresAt: time.Now().UTC().Add(-time.Hour * 24 * 7), // Already expired.
+	lease, err := s.locker.Acquire(ctx, models.UserBalanceLockKey(user.DocID), confs.LockLeaseTTL(ctx))
+	if err != nil {
+		return err
 	}
-	err = s.dbHandler.Upsert(ctx, authToken)
+	defer lease.Release(ctx)
+
+	err = s.dbHandler.Fetch(ctx, user)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = s.inMemCache.Add(cacheID, resp, time.Minute*5)
+
+	subscriptionInfo := &user.SubscriptionInfo
+	alreadyCharged := false
+	if issuedBatch := subscriptionInfo.FindIssuedBatch(requestID); issuedBatch != nil {
+		if issuedBatch.ModelName != modelName || max(1, issuedBatch.Denomination) != denomination ||
+			!bytes.Equal(issuedBatch.BlindedTokensHash, batchHash) {
+			return errors.New("request id already used for a different batch")
+		}
+		alreadyCharged = true
+		log.Infof(ctx, "Batch %s already charged, re-signing without charging", requestID)
+		s.appendLedger(ctx, issuanceLedgerEntry(user, issuedBatch))
+	}
+
+	if !alreadyCharged {
+		if subscriptionInfo.ActiveAuthTokens == nil {
+			subscriptionInfo.ActiveAuthTokens = make(models.AuthTokenInfo)
+		}
+		if subscriptionInfo.UsedAuthTokens == nil {
+			subscriptionInfo.UsedAuthTokens = make(models.AuthTokenInfo)
+		}
+		if subscriptionInfo.ActiveAuthTokens[modelName] < credits {
+			return errors.Newf("not enough quota left for %d tokens worth %d credits", numTokens, credits)
+		}
+	}
+
+	keyID, err := sign(authManager)
+	if err != nil {
+		return err
+	}
+	if alreadyCharged {
+		return nil
+	}
+
+	// Like issueToken, a blinded token is only ever signed for one issuance. Creating the markers fails if any of them
+	// exists, and comes before the debit so a conflict charges nothing.
+	now := time.Now().UTC()
+	var authTokens []models.Model
+	for _, blindedToken := range blindedTokens {
+		authTokens = append(authTokens, &models.AuthToken{
+			DocID:     models.DocIDForAuthToken(blindedToken),
+			ModelName: modelName,
+			KeyID:     keyID, // See issueToken.
+			CreatedAt: now,
+			ExpiresAt: now.Add(-time.Hour * 24 * 7), // Already expired.
+		})
+	}
+	err = s.dbHandler.Create(ctx, authTokens...)
+	if models.IsConflictErr(err) {
+		return errors.New("blinded token already issued, blind a fresh one")
+	}
+	if err != nil {
+		return err
+	}
+
+	subscriptionInfo.ActiveAuthTokens[modelName] -= credits
+	subscriptionInfo.UsedAuthTokens[modelName] += credits
+	subscriptionInfo.PruneIssuedBatches(now)
+	issuedBatch := models.IssuedBatch{
+		RequestID:         requestID,
+		ModelName:         modelName,
+		NumTokens:         numTokens,
+		Denomination:      denomination,
+		BlindedTokensHash: batchHash,
+		IssuedAt:          now,
+	}
+	subscriptionInfo.IssuedBatches = append(subscriptionInfo.IssuedBatches, issuedBatch)
+	// Debit and the idempotency record land in the same document write.
+	return s.saveBalance(ctx, user, issuanceLedgerEntry(user, &issuedBatch))
+}
+
+func issuanceLedgerEntry(user *models.User, issuedBatch *models.IssuedBatch) *models.LedgerEntry {
+	return models.NewLedgerEntry(user.DocID, models.LedgerKindIssuance, issuedBatch.RequestID, issuedBatch.ModelName,
+		-issuedBatch.Credits(), issuedBatch.Credits(), issuedBatch.IssuedAt)
+}
+
+// blindedTokensHash identifies a batch by its content, length prefixed so different splits can't collide. The
+// denomination and expiryEpoch are part of what's signed, so they're part of the batch too.
+func blindedTokensHash(denomination int, expiryEpoch int64, blindedTokens [][]byte) []byte {
+	h := sha256.New()
+	_ = binary.Write(h, binary.BigEndian, int64(denomination))
+	_ = binary.Write(h, binary.BigEndian, expiryEpoch)
+	for _, blindedToken := range blindedTokens {
+		_ = binary.Write(h, binary.BigEndian, uint32(len(blindedToken)))
+		h.Write(blindedToken)
+	}
+	return h.Sum(nil)
+}
+
+type GetSignedBlindedTokensBatchReq struct {
+	RequestID     string
+	BlindedTokens [][]byte
+	ModelName     confs.ModelName
+	Denomination  int   // See GetSignedBlindedTokenReq.
+	ExpiryEpoch   int64 // See GetSignedBlindedTokenReq.
+}
+
+func (r *GetSignedBlindedTokensBatchReq) Bind(req *http.Request) error {
+	var err error
+	r.Denomination, err = validateDenomination(req.Context(), r.Denomination)
+	if err != nil {
+		return err
+	}
+	return validateIssuanceBatch(req.Context(), r.RequestID, r.BlindedTokens)
+}
+
+func validateIssuanceBatch(ctx context.Context, requestID string, blindedTokens [][]byte) error {
+	if requestID == "" {
+		return errors.New("RequestID is required")
+	}
+	if len(blindedTokens) == 0 {
+		return errors.New("no blinded tokens")
+	}
+	maxTokens := confs.MaxTokensPerIssuanceBatch(ctx)
+	if len(blindedTokens) > maxTokens {
+		return errors.Newf("at most %d tokens per batch", maxTokens)
+	}
+	seen := map[string]bool{}
+	for _, blindedToken := range blindedTokens {
+		if len(blindedToken) == 0 {
+			return errors.New("empty blinded token")
+		}
+		if seen[string(blindedToken)] {
+			return errors.New("same blinded token sent more than once")
+		}
+		seen[string(blindedToken)] = true
+	}
+	return nil
+}
+
+type GetSignedBlindedTokensBatchResp struct {
+	ModelName           confs.ModelName
+	Denomination        int
+	ExpiryEpoch         int64 `json:",omitempty"`
+	KeyID               string
+	SignedBlindedTokens [][]byte
+}
+
+func (s *Service) GetVOPRFTokensHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := s.getUserFromContext(ctx)
+	req := &GetVOPRFTokensReq{}
+	if err := render.Bind(r, req); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	resp, err := s.getVOPRFTokens(ctx, user, req)
 	if err != nil {
-		log.Errorf(ctx, "[ALERT]: Cache fill error %+v", err)
+		render.Render(w, r, ErrInternal(err))
+		return
 	}
+	render.Respond(w, r, Ok200(resp))
+}
 
+// getVOPRFTokens evaluates a batch of blinded VOPRF elements for a model issuing VOPRF tokens, charged like
+// getSignedBlindedTokensBatch. A retry gets the same evaluated elements, with a fresh proof.
+func (s *Service) getVOPRFTokens(ctx context.Context, user *models.User, req *GetVOPRFTokensReq) (*GetVOPRFTokensResp, error) {
+	resp := &GetVOPRFTokensResp{
+		ModelName:    req.ModelName,
+		Denomination: req.Denomination,
+	}
+	err := s.issueBatch(ctx, user, req.RequestID, req.ModelName, req.Denomination, 0, req.BlindedElements,
+		func(authManager *auth.AuthManager) (string, error) {
+			var err error
+			resp.EvaluatedElements, resp.Proof, resp.KeyID, err = authManager.EvaluateVOPRF(req.Denomination, req.BlindedElements)
+			return resp.KeyID, err
+		})
+	if err != nil {
+		return nil, err
+	}
 	return resp, nil
 }
 
-type GetSignedBlindedTokenReq struct {
-	noValidationReq
-	RequestID    string
-	BlindedToken []byte
-	ModelName    confs.ModelName
+type GetVOPRFTokensReq struct {
+	RequestID       string
+	BlindedElements [][]byte
+	ModelName       confs.ModelName
+	Denomination    int // See GetSignedBlindedTokenReq.
 }
 
-type GetSignedBlindedTokenResp struct {
-	ModelName          confs.ModelName
-	SignedBlindedToken []byte
+func (r *GetVOPRFTokensReq) Bind(req *http.Request) error {
+	var err error
+	r.Denomination, err = validateDenomination(req.Context(), r.Denomination)
+	if err != nil {
+		return err
+	}
+	return validateIssuanceBatch(req.Context(), r.RequestID, r.BlindedElements)
+}
+
+// GetVOPRFTokensResp has one DLEQ proof for the whole batch, clients check it against the key's VOPRF public key
+// before using any of the tokens.
+type GetVOPRFTokensResp struct {
+	ModelName         confs.ModelName
+	Denomination      int
+	KeyID             string
+	EvaluatedElements [][]byte
+	Proof             []byte
 }
@@ -0,0 +1,150 @@
+package svc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/confs"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"testing"
+)
+
+func TestGetSignedBlindedTokenOncePerBlindedToken(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	s := newTestService(t, confs.ModelChatGPT41)
+	user := &models.User{DocID: "user"}
+	user.SubscriptionInfo.ActiveAuthTokens = models.AuthTokenInfo{confs.ModelChatGPT41: 10}
+	assert.NoError(t, s.dbHandler.Upsert(ctx, user))
+
+	blindedToken := make([]byte, 256)
+	blindedToken[255] = 2
+	req := &GetSignedBlindedTokenReq{ModelName: confs.ModelChatGPT41, Denomination: 1, BlindedToken: blindedToken}
+	resp, err := s.getSignedBlindedToken(ctx, user, req)
+	assert.NoError(t, err)
+	// The issuance marker goes with the key, see gcAuthTokens.
+	marker := &models.AuthToken{DocID: models.DocIDForAuthToken(blindedToken)}
+	assert.NoError(t, s.dbHandler.Fetch(ctx, marker))
+	assert.Equal(t, resp.KeyID, marker.KeyID)
+	assert.NotEmpty(t, marker.KeyID)
+	// Repeats, whatever their request ID, get the same signature back without being charged again.
+	for _, requestID := range []string{"", "retry"} {
+		req.RequestID = requestID
+		repeatResp, err := s.getSignedBlindedToken(ctx, user, req)
+		assert.NoError(t, err)
+		assert.Equal(t, resp, repeatResp)
+	}
+	// Other users, and other denominations, can't have it.
+	other := &models.User{DocID: "other"}
+	other.SubscriptionInfo.ActiveAuthTokens = models.AuthTokenInfo{confs.ModelChatGPT41: 10}
+	assert.NoError(t, s.dbHandler.Upsert(ctx, other))
+	_, err = s.getSignedBlindedToken(ctx, other, req)
+	assert.ErrorContains(t, err, "already issued")
+	_, err = s.getSignedBlindedToken(ctx, user, &GetSignedBlindedTokenReq{ModelName: confs.ModelChatGPT41,
+		Denomination: 5, BlindedToken: blindedToken})
+	assert.ErrorContains(t, err, "already issued")
+
+	// A fresh blinded token is charged for, whatever its request ID.
+	blindedToken = make([]byte, 256)
+	blindedToken[255] = 3
+	req.BlindedToken = blindedToken
+	_, err = s.getSignedBlindedToken(ctx, user, req)
+	assert.NoError(t, err)
+	assert.NoError(t, s.dbHandler.Fetch(ctx, user))
+	assert.Equal(t, 8, user.SubscriptionInfo.ActiveAuthTokens[confs.ModelChatGPT41])
+}
+
+func TestGetSignedBlindedTokenAfterFailedDebit(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	s := newTestService(t, confs.ModelChatGPT41)
+	user := &models.User{DocID: "user"}
+	user.SubscriptionInfo.ActiveAuthTokens = models.AuthTokenInfo{confs.ModelChatGPT41: 10}
+	assert.NoError(t, s.dbHandler.Upsert(ctx, user))
+
+	issue := func(lastByte byte) (*GetSignedBlindedTokenResp, *models.AuthToken) {
+		blindedToken := make([]byte, 256)
+		blindedToken[255] = lastByte
+		resp, err := s.getSignedBlindedToken(ctx, user, &GetSignedBlindedTokenReq{ModelName: confs.ModelChatGPT41,
+			Denomination: 1, BlindedToken: blindedToken})
+		assert.NoError(t, err)
+		marker := &models.AuthToken{DocID: models.DocIDForAuthToken(blindedToken)}
+		assert.NoError(t, s.dbHandler.Fetch(ctx, marker))
+		assert.True(t, marker.Issuance.Charged)
+		assert.Equal(t, resp.SignedBlindedToken, marker.Issuance.SignedBlindedToken)
+		return resp, marker
+	}
+	balance := func() int {
+		assert.NoError(t, s.dbHandler.Fetch(ctx, user))
+		return user.SubscriptionInfo.ActiveAuthTokens[confs.ModelChatGPT41]
+	}
+
+	// The debit didn't go through, the repeat is charged.
+	resp, marker := issue(2)
+	assert.Equal(t, 9, balance())
+	marker.Issuance.Charged = false
+	assert.NoError(t, s.dbHandler.Upsert(ctx, marker))
+	user.SubscriptionInfo.ActiveAuthTokens[confs.ModelChatGPT41] = 10
+	user.SubscriptionInfo.IssuedTokens = nil
+	assert.NoError(t, s.dbHandler.Upsert(ctx, user))
+	repeatResp, _ := issue(2)
+	assert.Equal(t, resp, repeatResp)
+	assert.Equal(t, 9, balance())
+
+	// The debit went through, but marking the issuance charged didn't.
+	resp, marker = issue(3)
+	assert.Equal(t, 8, balance())
+	marker.Issuance.Charged = false
+	assert.NoError(t, s.dbHandler.Upsert(ctx, marker))
+	repeatResp, _ = issue(3)
+	assert.Equal(t, resp, repeatResp)
+	assert.Equal(t, 8, balance())
+}
+
+func TestGetSignedBlindedTokensBatchOncePerBlindedToken(t *testing.T) {
+	log.Init()
+	ctx := context.Background()
+	s := newTestService(t, confs.ModelChatGPT41)
+	user := &models.User{DocID: "user"}
+	user.SubscriptionInfo.ActiveAuthTokens = models.AuthTokenInfo{confs.ModelChatGPT41: 10}
+	assert.NoError(t, s.dbHandler.Upsert(ctx, user))
+	blindedToken := func(lastByte byte) []byte {
+		blindedToken := make([]byte, 256)
+		blindedToken[255] = lastByte
+		return blindedToken
+	}
+	balance := func() int {
+		assert.NoError(t, s.dbHandler.Fetch(ctx, user))
+		return user.SubscriptionInfo.ActiveAuthTokens[confs.ModelChatGPT41]
+	}
+
+	req := &GetSignedBlindedTokensBatchReq{RequestID: "batch", ModelName: confs.ModelChatGPT41, Denomination: 1,
+		BlindedTokens: [][]byte{blindedToken(2), blindedToken(3)}}
+	resp, err := s.getSignedBlindedTokensBatch(ctx, user, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, balance())
+	retryResp, err := s.getSignedBlindedTokensBatch(ctx, user, req)
+	assert.NoError(t, err)
+	assert.Equal(t, resp, retryResp)
+	assert.Equal(t, 8, balance())
+	// The expiry epoch is signed too, a retry can't change it for free.
+	_, err = s.getSignedBlindedTokensBatch(ctx, user, &GetSignedBlindedTokensBatchReq{RequestID: "batch",
+		ModelName: confs.ModelChatGPT41, Denomination: 1, ExpiryEpoch: 5, BlindedTokens: req.BlindedTokens})
+	assert.ErrorContains(t, err, "different batch")
+
+	// Blinded tokens of the batch can't be issued again on their own, nor the other way around.
+	_, err = s.getSignedBlindedToken(ctx, user, &GetSignedBlindedTokenReq{ModelName: confs.ModelChatGPT41,
+		Denomination: 1, BlindedToken: blindedToken(3)})
+	assert.ErrorContains(t, err, "already issued")
+	_, err = s.getSignedBlindedToken(ctx, user, &GetSignedBlindedTokenReq{ModelName: confs.ModelChatGPT41,
+		Denomination: 1, BlindedToken: blindedToken(4)})
+	assert.NoError(t, err)
+	assert.Equal(t, 7, balance())
+	for _, lastByte := range []byte{3, 4} {
+		_, err = s.getSignedBlindedTokensBatch(ctx, user, &GetSignedBlindedTokensBatchReq{RequestID: "other",
+			ModelName: confs.ModelChatGPT41, Denomination: 1, BlindedTokens: [][]byte{blindedToken(5),
+				blindedToken(lastByte)}})
+		assert.ErrorContains(t, err, "already issued")
+	}
+	assert.Equal(t, 7, balance())
+}
@@ -71,3 +71,13 @@ func ErrNotFound() render.Renderer {
 		StatusText:     "Resource not found.",
 	}
 }
+
+func ErrForbidden(err error) render.Renderer {
+	log.Errorf(context.Background(), "Err Forbidden: %v", err)
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: http.StatusForbidden,
+		StatusText:     "Forbidden",
+		ErrorText:      err.Error(),
+	}
+}
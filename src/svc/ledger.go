@@ -0,0 +1,174 @@
+package svc
+
+import (
+	"context"
+	"github.com/go-chi/render"
+	"llmmask/src/confs"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// saveBalance saves the user after a change to their credits, and records the change in the ledger. Must be called
+// with the balance lock of the user held.
+func (s *Service) saveBalance(ctx context.Context, user *models.User, entries ...*models.LedgerEntry) error {
+	entries = models.OpenLedger(user, entries, time.Now().UTC())
+	err := s.dbHandler.Upsert(ctx, user)
+	if err != nil {
+		return err
+	}
+	s.appendLedger(ctx, entries...)
+	return nil
+}
+
+// appendLedger records entries of a balance change that's already saved. Failing to is only alerted, the
+// reconciliation job reports the user as drifted until it's sorted out. Recording them again is a no-op, so paths
+// that find their change already applied call it as well, to fill in entries a previous attempt didn't get to.
+func (s *Service) appendLedger(ctx context.Context, entries ...*models.LedgerEntry) {
+	err := models.AppendLedgerEntries(context.WithoutCancel(ctx), s.dbHandler, entries...)
+	if err != nil {
+		log.Errorf(ctx, "[ALERT]: Failed to record %d ledger entries: %+v", len(entries), err)
+	}
+}
+
+// ledgerEntries makes an entry per model of a change.
+func ledgerEntries(userDocID, kind, reference string, credits models.AuthTokenInfo, now time.Time) []*models.LedgerEntry {
+	var res []*models.LedgerEntry
+	for modelName, amount := range credits {
+		if amount != 0 {
+			res = append(res, models.NewLedgerEntry(userDocID, kind, reference, modelName, amount, 0, now))
+		}
+	}
+	return res
+}
+
+type LedgerReconciliationReport struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	Checked   int
+	// Opened is users whose ledger was started by this run.
+	Opened    int
+	Drifted   []models.LedgerDrift
+	Failed    int
+	Truncated bool
+}
+
+// reconcileLedgers checks the balance of users not checked in the last confs.LedgerReconcileInterval against their
+// ledger. Drift is alerted and kept in the report, nothing is corrected automatically.
+func (s *Service) reconcileLedgers(ctx context.Context) {
+	report := &LedgerReconciliationReport{StartedAt: time.Now().UTC()}
+	batchSize := confs.LedgerReconcileBatchSize(ctx)
+	items, err := s.dbHandler.Query(ctx, &models.User{}, batchSize,
+		models.QueryFilter{
+			Field: "LedgerReconciledAt",
+			Op:    models.QueryOpLt,
+			Value: report.StartedAt.Add(-confs.LedgerReconcileInterval(ctx)),
+		},
+	)
+	if err != nil {
+		log.Errorf(ctx, "[ALERT]: Failed to query users to reconcile: %+v", err)
+		return
+	}
+	report.Truncated = len(items) >= batchSize
+	for _, item := range items {
+		user := &models.User{}
+		err = models.Deserialize(item, user)
+		if err == nil {
+			err = s.reconcileLedger(ctx, user.DocID, report)
+		}
+		if err != nil {
+			report.Failed++
+			log.Errorf(ctx, "[ALERT]: Failed to reconcile the ledger of user %s: %+v", user.DocID, err)
+		}
+	}
+	report.Duration = time.Since(report.StartedAt)
+	log.Infof(ctx, "Ledger reconciliation checked %d users, opened %d, %d drifted, %d failed, truncated: %v",
+		report.Checked, report.Opened, len(report.Drifted), report.Failed, report.Truncated)
+	s.lastReconciliationReport.Store(report)
+}
+
+func (s *Service) reconcileLedger(ctx context.Context, userDocID string, report *LedgerReconciliationReport) error {
+	lease, err := s.locker.Acquire(ctx, models.UserBalanceLockKey(userDocID), confs.LockLeaseTTL(ctx))
+	if err != nil {
+		return err
+	}
+	defer lease.Release(ctx)
+
+	user, err := s.getUserFromDocID(ctx, userDocID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	user.LedgerReconciledAt = now
+	if user.SubscriptionInfo.LedgerOpenedAt.IsZero() {
+		report.Opened++
+		return s.saveBalance(ctx, user)
+	}
+
+	entries, err := models.FetchLedgerEntries(ctx, s.dbHandler, userDocID)
+	if err != nil {
+		return err
+	}
+	report.Checked++
+	for _, drift := range models.FindLedgerDrift(user, entries) {
+		log.Errorf(ctx, "[ALERT]: Balance of user %s for %s drifted from the ledger: active %d vs %d, used %d vs %d",
+			userDocID, drift.ModelName, drift.Active, drift.LedgerActive, drift.Used, drift.LedgerUsed)
+		report.Drifted = append(report.Drifted, drift)
+	}
+	return s.dbHandler.Upsert(ctx, user)
+}
+
+type GetReconciliationReportResp struct {
+	Report *LedgerReconciliationReport
+}
+
+// GetReconciliationReportHandler shows what the latest ledger reconciliation run of this instance found.
+func (s *Service) GetReconciliationReportHandler(w http.ResponseWriter, r *http.Request) {
+	render.Respond(w, r, Ok200(&GetReconciliationReportResp{
+		Report: s.lastReconciliationReport.Load(),
+	}))
+}
+
+type LedgerEntryResp struct {
+	Kind      string
+	ModelName string
+	Credits   int
+	Used      int
+	Reference string
+	CreatedAt time.Time
+}
+
+type GetLedgerResp struct {
+	// Entries are the latest first, at most confs.LedgerMaxEntriesShown of them.
+	Entries []LedgerEntryResp
+}
+
+// GetLedgerHandler shows the signed in user the history of their credits: purchases, grants, issuances and refunds.
+func (s *Service) GetLedgerHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := s.getUserFromContext(ctx)
+	entries, err := models.FetchLedgerEntries(ctx, s.dbHandler, user.DocID)
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	slices.SortFunc(entries, func(a, b *models.LedgerEntry) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	entries = entries[:min(len(entries), confs.LedgerMaxEntriesShown(ctx))]
+
+	resp := &GetLedgerResp{Entries: []LedgerEntryResp{}}
+	for _, entry := range entries {
+		resp.Entries = append(resp.Entries, LedgerEntryResp{
+			Kind:      entry.Kind,
+			ModelName: entry.ModelName,
+			Credits:   entry.Credits,
+			Used:      entry.Used,
+			Reference: entry.Reference,
+			CreatedAt: entry.CreatedAt,
+		})
+	}
+	render.Respond(w, r, Ok200(resp))
+}
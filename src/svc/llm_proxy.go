@@ -1,12 +1,27 @@
 package svc
 
 import (
+	"github.com/cockroachdb/errors"
 	"github.com/go-chi/render"
+	llm_proxy "llmmask/src/llm-proxy"
+	"llmmask/src/log"
 	"net/http"
 )
 
 func (s *Service) LLMProxyHandler(w http.ResponseWriter, r *http.Request) {
-	resp, err := s.llmProxy.ServeRequest(r)
+	resp, err := s.llmProxy.ServeRequest(w, r)
+	if resp.Streamed() {
+		// Already relayed to the client, can only log from here.
+		if err != nil {
+			log.Errorf(r.Context(), "llm proxy stream failed after relaying: %v", err)
+		}
+		return
+	}
+	var noTokensErr *llm_proxy.NoTokensError
+	if errors.As(err, &noTokensErr) {
+		s.challengePrivacyPass(w, r, noTokensErr)
+		return
+	}
 	if err != nil {
 		render.Render(w, r, ErrInternal(err))
 		return
@@ -43,22 +43,6 @@ func (s *Service) AuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func (s *Service) SemaphoreMiddleware(semaphoreConf *common.SemaphoreConf) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := r.Context()
-			err := common.AcquireSemaphore(ctx, semaphoreConf)
-			if err != nil {
-				render.Render(w, r, ErrInternal(err))
-				return
-			}
-			defer common.ReleaseSemaphore(semaphoreConf)
-
-			next.ServeHTTP(w, r)
-		})
-	}
-}
-
 func (s *Service) getUserFromSession(ctx context.Context, sessionID string) (*models.User, error) {
 	userSession := &models.UserSession{
 		DocID: sessionID,
@@ -1,6 +1,7 @@
 package svc
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/PaddleHQ/paddle-go-sdk"
 	"github.com/PaddleHQ/paddle-go-sdk/pkg/paddlenotification"
@@ -8,9 +9,12 @@ import (
 	"github.com/go-chi/render"
 	"io"
 	"llmmask/src/common"
+	"llmmask/src/confs"
 	"llmmask/src/log"
 	"llmmask/src/models"
+	"math/big"
 	"net/http"
+	"time"
 )
 
 const (
@@ -29,6 +33,8 @@ var subscriptionChangedEvents = []paddlenotification.EventTypeName{
 	paddlenotification.EventTypeNameSubscriptionUpdated,
 }
 
+// PaddleWebHookHandler handles every event once, by event ID. Failed events are kept and retried by
+// retryPaddleEvents, besides Paddle's own redeliveries.
 func (s *Service) PaddleWebHookHandler(w http.ResponseWriter, r *http.Request) {
 	paddleSecretKey := common.PlatformCredsConfig().PaddleCreds.SecretKey
 	verifier := paddle.NewWebhookVerifier(paddleSecretKey)
@@ -39,6 +45,7 @@ func (s *Service) PaddleWebHookHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if !ok {
 		render.Render(w, r, ErrUnauthorized(errors.New("Signature mismatch")))
+		return
 	}
 
 	ctx := r.Context()
@@ -50,60 +57,362 @@ func (s *Service) PaddleWebHookHandler(w http.ResponseWriter, r *http.Request) {
 
 	notification := &paddlenotification.GenericNotificationEvent{}
 	err = json.Unmarshal(body, notification)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if notification.EventID == "" {
+		render.Render(w, r, ErrInvalidRequest(errors.New("event id missing")))
+		return
+	}
+
+	lease, err := s.locker.Acquire(ctx, paddleEventLockKey(notification.EventID), confs.LockLeaseTTL(ctx))
 	if err != nil {
 		render.Render(w, r, ErrInternal(err))
 		return
 	}
+	defer lease.Release(ctx)
+
+	event := &models.PaddleEvent{DocID: notification.EventID}
+	err = s.dbHandler.Fetch(ctx, event)
+	if err != nil && !models.IsNotFoundErr(err) {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	if err == nil && event.State != models.PaddleEventStateFailed {
+		log.Infof(ctx, "Skipping already handled paddle event %s (%s)", event.DocID, event.State)
+		render.Render(w, r, Ok200("ok"))
+		return
+	}
+	if err != nil {
+		event = &models.PaddleEvent{
+			DocID:      notification.EventID,
+			EventType:  string(notification.EventType),
+			Body:       body,
+			ReceivedAt: time.Now().UTC(),
+		}
+	}
+
+	err = s.handlePaddleEvent(ctx, event)
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	render.Render(w, r, Ok200("ok"))
+}
+
+func paddleEventLockKey(eventID string) string {
+	return "paddle-event-" + eventID
+}
+
+// handlePaddleEvent processes the event and saves how it went. Failures are queued for a retry with backoff, until
+// they run out of attempts.
+func (s *Service) handlePaddleEvent(ctx context.Context, event *models.PaddleEvent) error {
+	event.Attempts++
+	processErr := s.processPaddleEvent(ctx, event)
+	now := time.Now().UTC()
+	if processErr == nil {
+		event.State = models.PaddleEventStateProcessed
+		event.ProcessedAt = now
+		event.LastError = ""
+		event.Body = nil
+	} else {
+		event.LastError = processErr.Error()
+		event.State = models.PaddleEventStateFailed
+		backoff := confs.PaddleEventRetryBackoff(ctx) << min(event.Attempts-1, 16)
+		event.NextAttemptAt = now.Add(min(backoff, confs.PaddleEventMaxRetryBackoff(ctx)))
+		if event.Attempts >= confs.PaddleEventMaxAttempts(ctx) {
+			event.State = models.PaddleEventStateDead
+			log.Errorf(ctx, "[ALERT]: Paddle event %s gave up after %d attempts: %+v", event.DocID, event.Attempts, processErr)
+		} else {
+			log.Errorf(ctx, "Paddle event %s failed (attempt %d), retrying at %v: %+v", event.DocID, event.Attempts, event.NextAttemptAt, processErr)
+		}
+	}
 
-	if notification.EventType == paddlenotification.EventTypeNameTransactionCompleted {
-		transactionCompleted := &paddlenotification.TransactionCompleted{}
-		err = json.Unmarshal(body, transactionCompleted)
+	err := s.dbHandler.Upsert(ctx, event)
+	if err != nil {
+		return errors.CombineErrors(processErr, err)
+	}
+	return processErr
+}
+
+func (s *Service) processPaddleEvent(ctx context.Context, event *models.PaddleEvent) error {
+	switch paddlenotification.EventTypeName(event.EventType) {
+	case paddlenotification.EventTypeNameTransactionCompleted:
+		return s.creditPaddleTransaction(ctx, event)
+	case paddlenotification.EventTypeNameAdjustmentCreated, paddlenotification.EventTypeNameAdjustmentUpdated:
+		return s.applyPaddleAdjustment(ctx, event)
+	default:
+		log.Infof(ctx, "Skipping paddle event %s of type %s", event.DocID, event.EventType)
+		return nil
+	}
+}
+
+// creditPaddleTransaction grants the credits of every item, once per transaction.
+func (s *Service) creditPaddleTransaction(ctx context.Context, event *models.PaddleEvent) error {
+	transactionCompleted := &paddlenotification.TransactionCompleted{}
+	err := json.Unmarshal(event.Body, transactionCompleted)
+	if err != nil {
+		return err
+	}
+	transaction := transactionCompleted.Data
+	userID, _ := transaction.CustomData[customDataUserIDKey].(string)
+	if userID == "" {
+		return errors.Newf("transaction %s has no user id", transaction.ID)
+	}
+
+	// Everything is worked out before writing anything, so an unknown item can't leave a half credited purchase.
+	tokensGranted := models.AuthTokenInfo{}
+	for _, item := range transaction.Items {
+		tokenPackage := s.getPackageForPriceID(item.PriceID)
+		if tokenPackage == nil {
+			return errors.Newf("unknown price id %s in transaction %s", item.PriceID, transaction.ID)
+		}
+		tokensGranted[tokenPackage.ModelID] += item.Quantity * tokenPackage.Tokens
+	}
+
+	lease, err := s.locker.Acquire(ctx, models.UserBalanceLockKey(userID), confs.LockLeaseTTL(ctx))
+	if err != nil {
+		return err
+	}
+	defer lease.Release(ctx)
+
+	user, err := s.getUserFromDocID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	entries := ledgerEntries(userID, models.LedgerKindPurchase, transaction.ID, tokensGranted, now)
+	granted := user.SubscriptionInfo.GrantPurchase(models.PaymentLog{
+		TransactionID: transaction.ID,
+		TokensGranted: tokensGranted,
+		EventID:       event.DocID,
+		CreatedAt:     now,
+	})
+	if granted {
+		err = s.saveBalance(ctx, user, entries...)
 		if err != nil {
-			render.Render(w, r, ErrInternal(err))
-			return
+			return err
 		}
+		log.Infof(ctx, "User %s purchased %v in transaction %s", userID, tokensGranted, transaction.ID)
+	} else {
+		log.Infof(ctx, "Transaction %s already credited to user %s", transaction.ID, userID)
+		s.appendLedger(ctx, entries...)
+	}
 
-		log.Infof(ctx, "Handling transactionCompleted event: %s", string(body))
-		transaction := transactionCompleted.Data
-		userID := transaction.CustomData[customDataUserIDKey].(string)
-		transactionID := transaction.ID
-		log.Infof(ctx, "Purchasing user: %s", userID)
-		for _, item := range transactionCompleted.Data.Items {
-			priceID := item.PriceID
-			quantity := item.Quantity
-
-			tokenPackage := s.getPackageForPriceID(priceID)
-
-			modelID := tokenPackage.ModelID
-			totalCreditsPurchased := quantity * (tokenPackage.Tokens)
-			log.Infof(ctx, "User %s purchased %d credits for model %s", userID, totalCreditsPurchased, modelID)
-			user, err := s.getUserFromDocID(ctx, userID)
-			if err != nil {
-				render.Render(w, r, ErrInternal(err))
-				return
-			}
-			if user.SubscriptionInfo.ActiveAuthTokens == nil {
-				user.SubscriptionInfo.ActiveAuthTokens = make(map[string]int)
+	// Saved after the user, a retry after a failure here finds the user credited and only saves this.
+	return s.dbHandler.Upsert(ctx, &models.PaddleTransaction{
+		DocID:         transaction.ID,
+		UserDocID:     userID,
+		TokensGranted: tokensGranted,
+		Total:         transaction.Details.Totals.Total,
+		CreatedAt:     now,
+	})
+}
+
+// applyPaddleAdjustment takes back the credits of approved refunds, chargebacks and credits, once per adjustment.
+// Only credits not yet turned into tokens can be taken back, tokens are unlinkable by design.
+func (s *Service) applyPaddleAdjustment(ctx context.Context, event *models.PaddleEvent) error {
+	adjustmentEvent := &paddlenotification.AdjustmentUpdated{}
+	err := json.Unmarshal(event.Body, adjustmentEvent)
+	if err != nil {
+		return err
+	}
+	adjustment := adjustmentEvent.Data
+	switch adjustment.Action {
+	case paddlenotification.AdjustmentActionRefund, paddlenotification.AdjustmentActionChargeback,
+		paddlenotification.AdjustmentActionCredit:
+	case paddlenotification.AdjustmentActionChargebackReverse, paddlenotification.AdjustmentActionCreditReverse:
+		log.Errorf(ctx, "[ALERT]: Adjustment %s (%s) of transaction %s needs its credits restored by hand",
+			adjustment.ID, adjustment.Action, adjustment.TransactionID)
+		return nil
+	default:
+		log.Infof(ctx, "Skipping adjustment %s with action %s", adjustment.ID, adjustment.Action)
+		return nil
+	}
+	if adjustment.Status != paddlenotification.AdjustmentStatusApproved {
+		// Pending refunds come back as adjustment.updated once approved.
+		log.Infof(ctx, "Skipping adjustment %s with status %s", adjustment.ID, adjustment.Status)
+		return nil
+	}
+
+	transaction := &models.PaddleTransaction{DocID: adjustment.TransactionID}
+	err = s.dbHandler.Fetch(ctx, transaction)
+	if models.IsNotFoundErr(err) {
+		transaction, err = s.legacyPaddleTransaction(ctx, adjustment.TransactionID)
+	}
+	if err != nil {
+		// Possibly the completed event of the transaction didn't go through yet, the retry picks it up.
+		return errors.Wrapf(err, "failed to fetch transaction %s of adjustment %s", adjustment.TransactionID, adjustment.ID)
+	}
+	if transaction.Total == "" && !isFullAdjustment(&adjustment) {
+		log.Errorf(ctx, "[ALERT]: Partial adjustment %s (%s) of transaction %s, completed before transactions were "+
+			"recorded, needs its share of %v taken back by hand", adjustment.ID, adjustment.Action,
+			adjustment.TransactionID, transaction.TokensGranted)
+		return nil
+	}
+	toDeduct := adjustedCredits(transaction, &adjustment)
+
+	lease, err := s.locker.Acquire(ctx, models.UserBalanceLockKey(transaction.UserDocID), confs.LockLeaseTTL(ctx))
+	if err != nil {
+		return err
+	}
+	defer lease.Release(ctx)
+
+	user, err := s.getUserFromDocID(ctx, transaction.UserDocID)
+	if err != nil {
+		return err
+	}
+	paymentLog := user.SubscriptionInfo.DeductAdjustment(models.PaymentLog{
+		TransactionID: adjustment.TransactionID,
+		AdjustmentID:  adjustment.ID,
+		Action:        string(adjustment.Action),
+		EventID:       event.DocID,
+		CreatedAt:     time.Now().UTC(),
+	}, toDeduct)
+	if paymentLog == nil {
+		log.Infof(ctx, "Adjustment %s already applied to user %s", adjustment.ID, transaction.UserDocID)
+		s.appendLedger(ctx, refundLedgerEntries(transaction.UserDocID, user.SubscriptionInfo.FindPaymentLog(
+			adjustment.TransactionID, adjustment.ID))...)
+		return nil
+	}
+	err = s.saveBalance(ctx, user, refundLedgerEntries(transaction.UserDocID, paymentLog)...)
+	if err != nil {
+		return err
+	}
+	log.Infof(ctx, "Adjustment %s (%s) deducted %v from user %s", adjustment.ID, adjustment.Action,
+		paymentLog.TokensDeducted, transaction.UserDocID)
+	if len(paymentLog.TokensUnrecovered) > 0 {
+		log.Errorf(ctx, "[ALERT]: Adjustment %s of transaction %s couldn't recover %v, already issued as tokens",
+			adjustment.ID, adjustment.TransactionID, paymentLog.TokensUnrecovered)
+	}
+	return nil
+}
+
+// legacyPaddleTransaction rebuilds the record of a transaction completed before transactions were recorded, from the
+// payment logs of the user who made it, and saves it for later adjustments. Every user is scanned, since the
+// adjustment doesn't say who made the purchase. Not found if no user has the transaction either.
+func (s *Service) legacyPaddleTransaction(ctx context.Context, transactionID string) (*models.PaddleTransaction, error) {
+	items, err := s.dbHandler.Query(ctx, &models.User{}, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		user := &models.User{}
+		err = models.Deserialize(item, user)
+		if err != nil {
+			return nil, err
+		}
+		// Purchases used to log every item of the transaction separately.
+		tokensGranted := models.AuthTokenInfo{}
+		for _, paymentLog := range user.SubscriptionInfo.PaymentLogs {
+			if paymentLog.TransactionID != transactionID || paymentLog.AdjustmentID != "" {
+				continue
 			}
-			user.SubscriptionInfo.ActiveAuthTokens[modelID] += totalCreditsPurchased
-
-			// TODO: Keep consolidating to prevent unending growth.
-			user.SubscriptionInfo.PaymentLogs = append(user.SubscriptionInfo.PaymentLogs, models.PaymentLog{
-				TransactionID: transactionID,
-				TokensGranted: map[string]int{
-					modelID: totalCreditsPurchased,
-				},
-			})
-
-			err = s.dbHandler.Upsert(ctx, user)
-			if err != nil {
-				render.Render(w, r, ErrInternal(err))
-				return
+			for modelName, credits := range paymentLog.TokensGranted {
+				tokensGranted[modelName] += credits
 			}
 		}
-	} else {
-		log.Infof(ctx, "Skipping notification: %+v", notification)
+		if len(tokensGranted) == 0 {
+			continue
+		}
+		transaction := &models.PaddleTransaction{
+			DocID:         transactionID,
+			UserDocID:     user.DocID,
+			TokensGranted: tokensGranted,
+			CreatedAt:     time.Now().UTC(),
+		}
+		log.Infof(ctx, "Rebuilt the record of transaction %s of user %s from its payment logs", transactionID, user.DocID)
+		return transaction, s.dbHandler.Upsert(ctx, transaction)
 	}
+	return nil, errors.Wrapf(models.ErrNotFound, "no user purchased in transaction %s", transactionID)
+}
 
-	render.Render(w, r, Ok200("ok"))
+func refundLedgerEntries(userDocID string, paymentLog *models.PaymentLog) []*models.LedgerEntry {
+	deducted := models.AuthTokenInfo{}
+	for modelName, credits := range paymentLog.TokensDeducted {
+		deducted[modelName] = -credits
+	}
+	entries := ledgerEntries(userDocID, models.LedgerKindRefund, paymentLog.AdjustmentID, deducted, paymentLog.CreatedAt)
+	for _, entry := range entries {
+		entry.Note = paymentLog.Action
+	}
+	return entries
+}
+
+// adjustedCredits is the share of the transaction's credits the adjustment is worth, rounded up. Full adjustments,
+// or ones whose amounts don't parse, take back everything.
+func adjustedCredits(transaction *models.PaddleTransaction, adjustment *paddlenotification.AdjustmentNotification) models.AuthTokenInfo {
+	full := isFullAdjustment(adjustment)
+	adjustedTotal, ok1 := new(big.Int).SetString(adjustment.Totals.Total, 10)
+	transactionTotal, ok2 := new(big.Int).SetString(transaction.Total, 10)
+	if !ok1 || !ok2 || transactionTotal.Sign() <= 0 || adjustedTotal.Cmp(transactionTotal) >= 0 {
+		full = true
+	}
+
+	res := models.AuthTokenInfo{}
+	for modelName, credits := range transaction.TokensGranted {
+		if full {
+			res[modelName] = credits
+			continue
+		}
+		// ceil(credits * adjusted / total)
+		share := new(big.Int).Mul(big.NewInt(int64(credits)), adjustedTotal)
+		share.Add(share, new(big.Int).Sub(transactionTotal, big.NewInt(1)))
+		share.Quo(share, transactionTotal)
+		res[modelName] = int(share.Int64())
+	}
+	return res
+}
+
+// isFullAdjustment tells if every item of the adjustment is adjusted in full.
+func isFullAdjustment(adjustment *paddlenotification.AdjustmentNotification) bool {
+	full := len(adjustment.Items) > 0
+	for _, item := range adjustment.Items {
+		full = full && item.Type == paddlenotification.AdjustmentTypeFull
+	}
+	return full
+}
+
+// retryPaddleEvents goes over the failed webhook events that are due for another attempt.
+func (s *Service) retryPaddleEvents(ctx context.Context) {
+	items, err := s.dbHandler.Query(ctx, &models.PaddleEvent{}, confs.PaddleEventRetryBatchSize(ctx),
+		models.QueryFilter{Field: "State", Op: models.QueryOpEq, Value: models.PaddleEventStateFailed},
+		models.QueryFilter{Field: "NextAttemptAt", Op: models.QueryOpLt, Value: time.Now().UTC()},
+	)
+	if err != nil {
+		log.Errorf(ctx, "[ALERT]: Failed to query failed paddle events: %+v", err)
+		return
+	}
+	for _, item := range items {
+		event := &models.PaddleEvent{}
+		err = models.Deserialize(item, event)
+		if err != nil {
+			log.Errorf(ctx, "[ALERT]: Failed to deserialize paddle event: %+v", err)
+			continue
+		}
+		s.retryPaddleEvent(ctx, event.DocID)
+	}
+}
+
+func (s *Service) retryPaddleEvent(ctx context.Context, eventID string) {
+	lease, err := s.locker.Acquire(ctx, paddleEventLockKey(eventID), confs.LockLeaseTTL(ctx))
+	if err != nil {
+		log.Errorf(ctx, "Failed to lock paddle event %s for a retry: %+v", eventID, err)
+		return
+	}
+	defer lease.Release(ctx)
+
+	// Fetched again under the lock, a redelivery might have handled it meanwhile.
+	event := &models.PaddleEvent{DocID: eventID}
+	err = s.dbHandler.Fetch(ctx, event)
+	if err != nil {
+		log.Errorf(ctx, "Failed to fetch paddle event %s for a retry: %+v", eventID, err)
+		return
+	}
+	if event.State != models.PaddleEventStateFailed {
+		return
+	}
+	// Failures are logged and requeued by handlePaddleEvent.
+	_ = s.handlePaddleEvent(ctx, event)
 }
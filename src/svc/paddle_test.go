@@ -0,0 +1,181 @@
+package svc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPaddleSecretKey = "paddle-secret"
+
+// newPaddleTestService serves webhooks signed with testPaddleSecretKey, for purchases of 100 gpt-4.1 credits.
+func newPaddleTestService(t *testing.T) (*Service, http.Handler) {
+	log.Init()
+	creds, err := json.Marshal(&common.CredsConfig{
+		PaddleCreds: &common.PaddleCreds{SecretKey: testPaddleSecretKey},
+		ModelPackages: []common.ModelTokenPackage{
+			{ModelID: confs.ModelChatGPT41, Tokens: 100, PaddlePriceID: "pri_100"},
+		},
+	})
+	assert.NoError(t, err)
+	t.Setenv(common.DepEnvKey, "PROD")
+	t.Setenv("PROD_CREDENTIALS_CONFIG", string(creds))
+	s := newTestService(t)
+	return s, s.Router(context.Background())
+}
+
+// sendPaddleEvent posts the event signed the way Paddle does, and returns the status it got.
+func sendPaddleEvent(t *testing.T, router http.Handler, secretKey, eventID, eventType string, data any) int {
+	body, err := json.Marshal(map[string]any{"event_id": eventID, "event_type": eventType, "data": data})
+	assert.NoError(t, err)
+	ts := fmt.Sprint(time.Now().Unix())
+	mac := hmac.New(sha256.New, []byte(secretKey))
+	mac.Write([]byte(ts + ":"))
+	mac.Write(body)
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/paddle/webhook", strings.NewReader(string(body)))
+	r.Header.Set("Paddle-Signature", "ts="+ts+";h1="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w.Code
+}
+
+func transactionCompletedData(transactionID, userID string, quantity int, total string) map[string]any {
+	return map[string]any{
+		"id":          transactionID,
+		"custom_data": map[string]any{customDataUserIDKey: userID},
+		"items":       []map[string]any{{"price_id": "pri_100", "quantity": quantity}},
+		"details":     map[string]any{"totals": map[string]any{"total": total}},
+	}
+}
+
+func adjustmentData(adjustmentID, transactionID, action, itemType, total string) map[string]any {
+	return map[string]any{
+		"id":             adjustmentID,
+		"transaction_id": transactionID,
+		"action":         action,
+		"status":         "approved",
+		"items":          []map[string]any{{"type": itemType}},
+		"totals":         map[string]any{"total": total},
+	}
+}
+
+func fetchTestUser(t *testing.T, s *Service, docID string) *models.User {
+	user, err := s.getUserFromDocID(context.Background(), docID)
+	assert.NoError(t, err)
+	return user
+}
+
+func TestPaddleWebHookTransactionCompleted(t *testing.T) {
+	s, router := newPaddleTestService(t)
+	ctx := context.Background()
+	assert.NoError(t, s.dbHandler.Upsert(ctx, &models.User{DocID: "user"}))
+
+	data := transactionCompletedData("txn_1", "user", 2, "2000")
+	assert.Equal(t, http.StatusUnauthorized, sendPaddleEvent(t, router, "wrong", "evt_1", "transaction.completed", data))
+	assert.Equal(t, http.StatusOK, sendPaddleEvent(t, router, testPaddleSecretKey, "evt_1", "transaction.completed", data))
+	// Redeliveries, and the same transaction under another event, are only credited once.
+	assert.Equal(t, http.StatusOK, sendPaddleEvent(t, router, testPaddleSecretKey, "evt_1", "transaction.completed", data))
+	assert.Equal(t, http.StatusOK, sendPaddleEvent(t, router, testPaddleSecretKey, "evt_2", "transaction.completed", data))
+	assert.Equal(t, 200, fetchTestUser(t, s, "user").SubscriptionInfo.ActiveAuthTokens[confs.ModelChatGPT41])
+
+	transaction := &models.PaddleTransaction{DocID: "txn_1"}
+	assert.NoError(t, s.dbHandler.Fetch(ctx, transaction))
+	assert.Equal(t, "user", transaction.UserDocID)
+	assert.Equal(t, "2000", transaction.Total)
+	event := &models.PaddleEvent{DocID: "evt_1"}
+	assert.NoError(t, s.dbHandler.Fetch(ctx, event))
+	assert.Equal(t, models.PaddleEventStateProcessed, event.State)
+	assert.Equal(t, 1, event.Attempts)
+
+	// An unknown price fails the event, without crediting anything, and it's queued for a retry.
+	data["items"] = []map[string]any{{"price_id": "pri_unknown", "quantity": 1}}
+	data["id"] = "txn_2"
+	assert.Equal(t, http.StatusInternalServerError,
+		sendPaddleEvent(t, router, testPaddleSecretKey, "evt_3", "transaction.completed", data))
+	event = &models.PaddleEvent{DocID: "evt_3"}
+	assert.NoError(t, s.dbHandler.Fetch(ctx, event))
+	assert.Equal(t, models.PaddleEventStateFailed, event.State)
+	assert.Equal(t, 200, fetchTestUser(t, s, "user").SubscriptionInfo.ActiveAuthTokens[confs.ModelChatGPT41])
+}
+
+func TestPaddleWebHookAdjustments(t *testing.T) {
+	s, router := newPaddleTestService(t)
+	ctx := context.Background()
+	assert.NoError(t, s.dbHandler.Upsert(ctx, &models.User{DocID: "user"}))
+
+	// The refund comes in before the purchase went through, the retry applies it.
+	assert.Equal(t, http.StatusInternalServerError, sendPaddleEvent(t, router, testPaddleSecretKey, "evt_adj_1",
+		"adjustment.updated", adjustmentData("adj_1", "txn_1", "refund", "partial", "500")))
+	assert.Equal(t, http.StatusOK, sendPaddleEvent(t, router, testPaddleSecretKey, "evt_1", "transaction.completed",
+		transactionCompletedData("txn_1", "user", 1, "2000")))
+	event := &models.PaddleEvent{DocID: "evt_adj_1"}
+	assert.NoError(t, s.dbHandler.Fetch(ctx, event))
+	event.NextAttemptAt = time.Now().UTC().Add(-time.Second)
+	assert.NoError(t, s.dbHandler.Upsert(ctx, event))
+	s.retryPaddleEvents(ctx)
+	assert.NoError(t, s.dbHandler.Fetch(ctx, event))
+	assert.Equal(t, models.PaddleEventStateProcessed, event.State)
+	// A quarter of the total is refunded, so is a quarter of the credits.
+	assert.Equal(t, 75, fetchTestUser(t, s, "user").SubscriptionInfo.ActiveAuthTokens[confs.ModelChatGPT41])
+
+	// Applied once per adjustment, even under another event.
+	assert.Equal(t, http.StatusOK, sendPaddleEvent(t, router, testPaddleSecretKey, "evt_adj_2",
+		"adjustment.updated", adjustmentData("adj_1", "txn_1", "refund", "partial", "500")))
+	assert.Equal(t, 75, fetchTestUser(t, s, "user").SubscriptionInfo.ActiveAuthTokens[confs.ModelChatGPT41])
+
+	// Credits turned into tokens can't be taken back, the chargeback takes what's left.
+	user := fetchTestUser(t, s, "user")
+	user.SubscriptionInfo.ActiveAuthTokens[confs.ModelChatGPT41] = 40
+	assert.NoError(t, s.dbHandler.Upsert(ctx, user))
+	assert.Equal(t, http.StatusOK, sendPaddleEvent(t, router, testPaddleSecretKey, "evt_adj_3",
+		"adjustment.updated", adjustmentData("adj_2", "txn_1", "chargeback", "full", "2000")))
+	user = fetchTestUser(t, s, "user")
+	assert.Equal(t, 0, user.SubscriptionInfo.ActiveAuthTokens[confs.ModelChatGPT41])
+	paymentLog := user.SubscriptionInfo.FindPaymentLog("txn_1", "adj_2")
+	assert.Equal(t, 60, paymentLog.TokensUnrecovered[confs.ModelChatGPT41])
+}
+
+func TestPaddleWebHookAdjustmentsOfLegacyPurchases(t *testing.T) {
+	s, router := newPaddleTestService(t)
+	ctx := context.Background()
+	// Purchases from before transactions were recorded only have the payment logs of the user, one per item.
+	user := &models.User{DocID: "user"}
+	user.SubscriptionInfo.ActiveAuthTokens = models.AuthTokenInfo{confs.ModelChatGPT41: 300}
+	user.SubscriptionInfo.PaymentLogs = []models.PaymentLog{
+		{TransactionID: "txn_old", TokensGranted: models.AuthTokenInfo{confs.ModelChatGPT41: 100}},
+		{TransactionID: "txn_old", TokensGranted: models.AuthTokenInfo{confs.ModelChatGPT41: 100}},
+		{TransactionID: "txn_other", TokensGranted: models.AuthTokenInfo{confs.ModelChatGPT41: 100}},
+	}
+	assert.NoError(t, s.dbHandler.Upsert(ctx, user))
+	assert.NoError(t, s.dbHandler.Upsert(ctx, &models.User{DocID: "someone else"}))
+
+	// The total paid isn't known, partial adjustments are left for a human.
+	assert.Equal(t, http.StatusOK, sendPaddleEvent(t, router, testPaddleSecretKey, "evt_adj_1",
+		"adjustment.updated", adjustmentData("adj_1", "txn_old", "refund", "partial", "500")))
+	assert.Equal(t, 300, fetchTestUser(t, s, "user").SubscriptionInfo.ActiveAuthTokens[confs.ModelChatGPT41])
+	transaction := &models.PaddleTransaction{DocID: "txn_old"}
+	assert.NoError(t, s.dbHandler.Fetch(ctx, transaction))
+	assert.Equal(t, "user", transaction.UserDocID)
+	assert.Equal(t, models.AuthTokenInfo{confs.ModelChatGPT41: 200}, transaction.TokensGranted)
+
+	assert.Equal(t, http.StatusOK, sendPaddleEvent(t, router, testPaddleSecretKey, "evt_adj_2",
+		"adjustment.updated", adjustmentData("adj_2", "txn_old", "refund", "full", "2000")))
+	assert.Equal(t, 100, fetchTestUser(t, s, "user").SubscriptionInfo.ActiveAuthTokens[confs.ModelChatGPT41])
+
+	// Transactions nobody made wait for their purchase to come in.
+	assert.Equal(t, http.StatusInternalServerError, sendPaddleEvent(t, router, testPaddleSecretKey, "evt_adj_3",
+		"adjustment.updated", adjustmentData("adj_3", "txn_unknown", "refund", "full", "2000")))
+}
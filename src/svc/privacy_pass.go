@@ -0,0 +1,227 @@
+package svc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/cockroachdb/errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"io"
+	"llmmask/src/auth"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	llm_proxy "llmmask/src/llm-proxy"
+	"llmmask/src/log"
+	"llmmask/src/privacypass"
+	"llmmask/src/secrets"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Privacy Pass (RFC 9578) issuance, with an issuer per model since every model has its own keys. Models share the
+// api server as their issuer unless they configure their own issuer name, the directory of a shared issuer lists the
+// keys of all its models. Redemption is in llm_proxy, through the PrivateToken Authorization header.
+
+const contentTypeIssuerDirectory = "application/private-token-issuer-directory"
+
+type PrivacyPassIssuerDirectory struct {
+	IssuerRequestURI string                `json:"issuer-request-uri"`
+	TokenKeys        []PrivacyPassTokenKey `json:"token-keys"`
+}
+
+type PrivacyPassTokenKey struct {
+	TokenType uint16 `json:"token-type"`
+	// TokenKey is base64url of privacypass.MarshalPublicKey.
+	TokenKey  string `json:"token-key"`
+	NotBefore int64  `json:"not-before,omitempty"`
+}
+
+// PrivacyPassWellKnownIssuerDirectoryHandler serves the directory of the issuer named by the request's host, RFC 9578
+// section 4, which is where clients look it up from a challenge. An issuer of a single model sends its token
+// requests to that model, a shared issuer to the endpoint telling the models apart by key.
+func (s *Service) PrivacyPassWellKnownIssuerDirectoryHandler(w http.ResponseWriter, r *http.Request) {
+	var modelNames []confs.ModelName
+	for _, modelName := range confs.AllModels() {
+		if _, ok := s.authManagers[modelName]; ok && llm_proxy.PrivacyPassIssuerName(modelName) == r.Host {
+			modelNames = append(modelNames, modelName)
+		}
+	}
+	switch len(modelNames) {
+	case 0:
+		render.Render(w, r, ErrNotFound())
+	case 1:
+		s.renderPrivacyPassIssuerDirectory(w, r, privacyPassIssuerRequestURI(modelNames[0]), modelNames...)
+	default:
+		s.renderPrivacyPassIssuerDirectory(w, r, privacyPassIssuerRequestURI(""), modelNames...)
+	}
+}
+
+// PrivacyPassIssuerDirectoryHandler lists the keys of the model alone, for clients that know the model up front.
+func (s *Service) PrivacyPassIssuerDirectoryHandler(w http.ResponseWriter, r *http.Request) {
+	modelName := chi.URLParam(r, "modelName")
+	if _, ok := s.authManagers[modelName]; !ok {
+		render.Render(w, r, ErrNotFound())
+		return
+	}
+	s.renderPrivacyPassIssuerDirectory(w, r, privacyPassIssuerRequestURI(modelName), modelName)
+}
+
+// renderPrivacyPassIssuerDirectory lists the single credit blind RSA keys of the models. The current key of each
+// model comes before its older ones, clients blind for the one the challenge names.
+func (s *Service) renderPrivacyPassIssuerDirectory(w http.ResponseWriter, r *http.Request, issuerRequestURI string,
+	modelNames ...confs.ModelName) {
+	directory := &PrivacyPassIssuerDirectory{
+		IssuerRequestURI: issuerRequestURI,
+		TokenKeys:        []PrivacyPassTokenKey{},
+	}
+	now := time.Now().UTC()
+	for _, modelName := range modelNames {
+		authManager := s.authManagers[modelName]
+		currentKeyID := authManager.KeyID()
+		var tokenKeys []PrivacyPassTokenKey
+		for _, rsaKeys := range authManager.PublicKeys() {
+			// Privacy Pass tokens are single credit, and plain blind RSA.
+			if rsaKeys.NotBefore.After(now) || rsaKeys.Denomination != 1 || rsaKeys.IsPartiallyBlind() {
+				continue
+			}
+			tokenKey, err := privacypass.MarshalPublicKey(rsaKeys.PublicKey)
+			if err != nil {
+				render.Render(w, r, ErrInternal(err))
+				return
+			}
+			key := PrivacyPassTokenKey{
+				TokenType: privacypass.TokenTypeBlindRSA,
+				TokenKey:  base64.URLEncoding.EncodeToString(tokenKey),
+			}
+			if !rsaKeys.NotBefore.IsZero() {
+				key.NotBefore = rsaKeys.NotBefore.Unix()
+			}
+			if rsaKeys.KeyID == currentKeyID {
+				tokenKeys = append([]PrivacyPassTokenKey{key}, tokenKeys...)
+			} else {
+				tokenKeys = append(tokenKeys, key)
+			}
+		}
+		directory.TokenKeys = append(directory.TokenKeys, tokenKeys...)
+	}
+	w.Header().Set("Content-Type", contentTypeIssuerDirectory)
+	w.Header().Set("Cache-Control", "max-age=300")
+	_ = json.NewEncoder(w).Encode(directory)
+}
+
+// privacyPassIssuerRequestURI is the token request endpoint of the model, or of a shared issuer without one.
+func privacyPassIssuerRequestURI(modelName confs.ModelName) string {
+	if modelName == "" {
+		return common.APIServerBaseURL() + "/api/v1/privacypass/token-request"
+	}
+	return common.APIServerBaseURL() + "/api/v1/privacypass/" + url.PathEscape(modelName) + "/token-request"
+}
+
+// privacyPassModelForRequest is the model of a token request sent to a shared issuer, the one whose current key the
+// request was blinded for. Truncated key IDs are a single byte, requests matching several models are rejected.
+func (s *Service) privacyPassModelForRequest(tokenReq *privacypass.TokenRequest) (confs.ModelName, error) {
+	var res []confs.ModelName
+	for _, modelName := range confs.AllModels() {
+		authManager, ok := s.authManagers[modelName]
+		if !ok {
+			continue
+		}
+		rsaKeys := currentPrivacyPassKey(authManager)
+		if rsaKeys == nil {
+			continue
+		}
+		tokenKeyID, err := privacypass.TokenKeyID(rsaKeys.PublicKey)
+		if err == nil && tokenKeyID[privacypass.Nid-1] == tokenReq.TruncatedTokenKeyID {
+			res = append(res, modelName)
+		}
+	}
+	switch len(res) {
+	case 0:
+		return "", errors.New("token request is for a key that isn't signing, refetch the issuer directory")
+	case 1:
+		return res[0], nil
+	default:
+		log.Errorf(context.Background(), "[ALERT]: Privacy Pass keys of models %v share a truncated key ID", res)
+		return "", errors.Newf("token request matches the keys of several models, use the issuer of the model")
+	}
+}
+
+// currentPrivacyPassKey is the key Privacy Pass clients blind for, nil if the model doesn't issue them.
+func currentPrivacyPassKey(authManager *auth.AuthManager) *secrets.RSAKeys {
+	if authManager.Scheme() != confs.TokenSchemeBlindRSA {
+		return nil
+	}
+	currentKeyID := authManager.KeyID()
+	for _, rsaKeys := range authManager.PublicKeys() {
+		if rsaKeys.KeyID == currentKeyID && !rsaKeys.IsPartiallyBlind() {
+			return &rsaKeys
+		}
+	}
+	return nil
+}
+
+// PrivacyPassTokenRequestHandler issues one single credit token of the model for a TokenRequest, charging like
+// GetSignedBlindedTokenHandler does. Requires a signed in user, which is the attestation here. Requests to a shared
+// issuer come without a model, see privacyPassModelForRequest.
+func (s *Service) PrivacyPassTokenRequestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := s.getUserFromContext(ctx)
+	modelName := chi.URLParam(r, "modelName")
+	if r.Header.Get("Content-Type") != privacypass.ContentTypeTokenRequest {
+		render.Render(w, r, ErrInvalidRequest(errors.Newf("content type must be %s", privacypass.ContentTypeTokenRequest)))
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 3+privacypass.Nk+1))
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	tokenReq, err := privacypass.UnmarshalTokenRequest(body)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if modelName == "" {
+		modelName, err = s.privacyPassModelForRequest(tokenReq)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	}
+
+	blindSig, _, err := s.issueToken(ctx, user, modelName, 1, 0, tokenReq.BlindedMsg,
+		func(authManager *auth.AuthManager) ([]byte, string, error) {
+			tokenResp, keyID, err := authManager.SignPrivacyPassRequest(tokenReq)
+			if err != nil {
+				return nil, "", err
+			}
+			return tokenResp.Marshal(), keyID, nil
+		})
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	w.Header().Set("Content-Type", privacypass.ContentTypeTokenResponse)
+	_, _ = w.Write(blindSig)
+}
+
+// challengePrivacyPass answers a request without tokens with a PrivateToken challenge for the model, RFC 9577
+// section 2.1.
+func (s *Service) challengePrivacyPass(w http.ResponseWriter, r *http.Request, noTokensErr *llm_proxy.NoTokensError) {
+	authManager, ok := s.authManagers[noTokensErr.ModelName]
+	if ok {
+		if rsaKeys := currentPrivacyPassKey(authManager); rsaKeys != nil {
+			tokenKey, err := privacypass.MarshalPublicKey(rsaKeys.PublicKey)
+			if err == nil {
+				challenge, err := privacypass.WWWAuthenticate(llm_proxy.PrivacyPassChallenge(noTokensErr.ModelName),
+					tokenKey)
+				if err == nil {
+					w.Header().Set("WWW-Authenticate", challenge)
+				}
+			}
+		}
+	}
+	render.Render(w, r, ErrUnauthorized(noTokensErr))
+}
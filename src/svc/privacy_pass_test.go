@@ -0,0 +1,144 @@
+package svc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"llmmask/src/auth"
+	"llmmask/src/confs"
+	"llmmask/src/locks"
+	"llmmask/src/log"
+	"llmmask/src/models"
+	"llmmask/src/privacypass"
+	"llmmask/src/secrets"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func newTestService(t *testing.T, modelNames ...confs.ModelName) *Service {
+	authManagers := map[confs.ModelName]*auth.AuthManager{}
+	truncatedKeyIDs := map[byte]bool{}
+	for _, modelName := range modelNames {
+		spec, err := confs.ModelSpecFor(modelName)
+		assert.NoError(t, err)
+		// Distinct truncated key IDs, so requests to the shared issuer resolve to a single model.
+		var privateKey *rsa.PrivateKey
+		for privateKey == nil {
+			privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+			assert.NoError(t, err)
+			tokenKeyID, err := privacypass.TokenKeyID(&privateKey.PublicKey)
+			assert.NoError(t, err)
+			if truncatedKeyIDs[tokenKeyID[privacypass.Nid-1]] {
+				privateKey = nil
+				continue
+			}
+			truncatedKeyIDs[tokenKeyID[privacypass.Nid-1]] = true
+		}
+		authManagers[modelName] = auth.NewAuthManager(spec, &secrets.RSAKeys{
+			PrivateKey:   privateKey,
+			PublicKey:    &privateKey.PublicKey,
+			KeyID:        secrets.RSAKeyID(&privateKey.PublicKey),
+			ModelName:    modelName,
+			Denomination: 1,
+		})
+	}
+	return NewService(0, authManagers, nil, models.NewMemDBHandler(), nil, nil, locks.NewMemLocker())
+}
+
+var challengeParamsRegexp = regexp.MustCompile(`challenge="([^"]+)", token-key="([^"]+)"`)
+
+// fetchChallenge sends a request without tokens for the model, and returns the challenge and token key it's answered
+// with.
+func fetchChallenge(t *testing.T, router http.Handler, modelName confs.ModelName) (*privacypass.TokenChallenge, string) {
+	body := `{"model": "` + modelName + `", "messages": [{"role": "user", "content": "hi"}]}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/llm-proxy", strings.NewReader(body)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	params := challengeParamsRegexp.FindStringSubmatch(w.Header().Get("WWW-Authenticate"))
+	assert.Len(t, params, 3)
+	data, err := base64.URLEncoding.DecodeString(params[1])
+	assert.NoError(t, err)
+	challenge, err := privacypass.UnmarshalTokenChallenge(data)
+	assert.NoError(t, err)
+	return challenge, params[2]
+}
+
+// fetchIssuerDirectory looks the issuer of the challenge up the way clients do.
+func fetchIssuerDirectory(t *testing.T, router http.Handler, challenge *privacypass.TokenChallenge) *PrivacyPassIssuerDirectory {
+	r := httptest.NewRequest(http.MethodGet, "https://"+challenge.IssuerName+"/.well-known/private-token-issuer-directory", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, contentTypeIssuerDirectory, w.Header().Get("Content-Type"))
+	directory := &PrivacyPassIssuerDirectory{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(directory))
+	return directory
+}
+
+func directoryHasKey(directory *PrivacyPassIssuerDirectory, tokenKey string) bool {
+	for _, key := range directory.TokenKeys {
+		if key.TokenKey == tokenKey {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPrivacyPassChallengeToSharedIssuerDirectory(t *testing.T) {
+	log.Init()
+	s := newTestService(t, confs.ModelChatGPT41, confs.ModelChatGPT4o)
+	router := s.Router(context.Background())
+
+	for _, modelName := range []confs.ModelName{confs.ModelChatGPT41, confs.ModelChatGPT4o} {
+		challenge, tokenKey := fetchChallenge(t, router, modelName)
+		directory := fetchIssuerDirectory(t, router, challenge)
+		assert.True(t, directoryHasKey(directory, tokenKey))
+		assert.Len(t, directory.TokenKeys, 2)
+		assert.True(t, strings.HasSuffix(directory.IssuerRequestURI, "/api/v1/privacypass/token-request"))
+
+		// A request blinded for the challenge's key is issued by the model of the challenge.
+		data, err := base64.URLEncoding.DecodeString(tokenKey)
+		assert.NoError(t, err)
+		publicKey, err := privacypass.UnmarshalPublicKey(data)
+		assert.NoError(t, err)
+		tokenReq, _, err := privacypass.NewTokenRequest(publicKey, challenge)
+		assert.NoError(t, err)
+		requestModel, err := s.privacyPassModelForRequest(tokenReq)
+		assert.NoError(t, err)
+		assert.Equal(t, modelName, requestModel)
+	}
+}
+
+func TestPrivacyPassChallengeToModelIssuerDirectory(t *testing.T) {
+	log.Init()
+	spec, err := confs.ModelSpecFor(confs.ModelChatGPT4o)
+	assert.NoError(t, err)
+	spec.PrivacyPassIssuer = "gpt-4o.issuer.example"
+	defer func() { spec.PrivacyPassIssuer = "" }()
+	s := newTestService(t, confs.ModelChatGPT41, confs.ModelChatGPT4o)
+	router := s.Router(context.Background())
+
+	challenge, tokenKey := fetchChallenge(t, router, confs.ModelChatGPT4o)
+	assert.Equal(t, "gpt-4o.issuer.example", challenge.IssuerName)
+	directory := fetchIssuerDirectory(t, router, challenge)
+	assert.True(t, directoryHasKey(directory, tokenKey))
+	assert.Len(t, directory.TokenKeys, 1)
+	assert.True(t, strings.HasSuffix(directory.IssuerRequestURI, "/api/v1/privacypass/gpt-4o/token-request"))
+
+	// The shared issuer no longer lists the model.
+	challenge, tokenKey = fetchChallenge(t, router, confs.ModelChatGPT41)
+	directory = fetchIssuerDirectory(t, router, challenge)
+	assert.True(t, directoryHasKey(directory, tokenKey))
+	assert.Len(t, directory.TokenKeys, 1)
+
+	r := httptest.NewRequest(http.MethodGet, "https://unknown.example/.well-known/private-token-issuer-directory", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,105 @@
+package svc
+
+import (
+	"github.com/go-chi/render"
+	"llmmask/src/auth"
+	"llmmask/src/confs"
+	"llmmask/src/secrets"
+	"net/http"
+	"time"
+)
+
+type PublicKeyInfo struct {
+	ModelName confs.ModelName
+	KeyID     string
+	// Denomination is the credits every token signed under the key is worth, zero for the partially blind issuer keys
+	// whose tokens carry it in their metadata.
+	Denomination int
+	Algorithm    string
+	NotBefore    *time.Time `json:",omitempty"`
+	NotAfter     *time.Time `json:",omitempty"`
+	PEM          string
+	JWK          *secrets.RSAPublicJWK
+	// TokenScheme the model issues new tokens under, the VOPRF key is only listed for confs.TokenSchemeVOPRF.
+	// Empty for the partially blind issuer keys, which are listed once under secrets.PartiallyBlindKeyName.
+	TokenScheme    string
+	VOPRFAlgorithm string `json:",omitempty"`
+	VOPRFPublicKey []byte `json:",omitempty"`
+}
+
+type GetPublicKeysResp struct {
+	Keys []*PublicKeyInfo
+	// ExpiryEpoch partially blind tokens issued now are signed for, see auth.TokenMetadata.
+	ExpiryEpoch int64
+	// EpochSeconds is the length of an epoch.
+	EpochSeconds int64
+}
+
+// GetPublicKeysHandler lists every active blind-signing public key, so clients don't need them baked in.
+// Unauthenticated on purpose, clients verify their signed tokens against these before spending them.
+func (s *Service) GetPublicKeysHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	now := time.Now().UTC()
+	resp := &GetPublicKeysResp{
+		ExpiryEpoch:  auth.IssuanceExpiryEpoch(ctx, now),
+		EpochSeconds: int64(confs.TokenEpochLength(ctx) / time.Second),
+	}
+	// Every model has the issuer keys, list them once.
+	seenPartiallyBlind := map[string]bool{}
+	for _, modelName := range confs.AllModels() {
+		authManager, ok := s.authManagers[modelName]
+		if !ok {
+			continue
+		}
+		for _, rsaKeys := range authManager.PublicKeys() {
+			if !rsaKeys.NotAfter.IsZero() && rsaKeys.NotAfter.Before(now) {
+				continue
+			}
+			if rsaKeys.IsPartiallyBlind() {
+				if seenPartiallyBlind[rsaKeys.KeyID] {
+					continue
+				}
+				seenPartiallyBlind[rsaKeys.KeyID] = true
+				resp.Keys = append(resp.Keys, &PublicKeyInfo{
+					ModelName: secrets.PartiallyBlindKeyName,
+					KeyID:     rsaKeys.KeyID,
+					Algorithm: secrets.PartiallyBlindSignAlgorithm,
+					NotBefore: timeOrNil(rsaKeys.NotBefore),
+					NotAfter:  timeOrNil(rsaKeys.NotAfter),
+					PEM:       secrets.RSAPublicKeyPEM(rsaKeys.PublicKey),
+					JWK:       secrets.NewRSAPublicJWK(rsaKeys.PublicKey),
+				})
+				continue
+			}
+			keyInfo := &PublicKeyInfo{
+				ModelName:    modelName,
+				KeyID:        rsaKeys.KeyID,
+				Denomination: rsaKeys.Denomination,
+				Algorithm:    secrets.BlindSignAlgorithm,
+				NotBefore:    timeOrNil(rsaKeys.NotBefore),
+				NotAfter:     timeOrNil(rsaKeys.NotAfter),
+				PEM:          secrets.RSAPublicKeyPEM(rsaKeys.PublicKey),
+				JWK:          secrets.NewRSAPublicJWK(rsaKeys.PublicKey),
+				TokenScheme:  authManager.Scheme(),
+			}
+			if authManager.Scheme() == confs.TokenSchemeVOPRF && rsaKeys.VOPRFPublicKey != nil {
+				voprfPublicKey, err := rsaKeys.VOPRFPublicKey.MarshalBinary()
+				if err != nil {
+					render.Render(w, r, ErrInternal(err))
+					return
+				}
+				keyInfo.VOPRFAlgorithm = secrets.VOPRFAlgorithm
+				keyInfo.VOPRFPublicKey = voprfPublicKey
+			}
+			resp.Keys = append(resp.Keys, keyInfo)
+		}
+	}
+	render.Respond(w, r, Ok200(resp))
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
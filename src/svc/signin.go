@@ -103,6 +103,12 @@ func (s *Service) signInUser(ctx context.Context, oauthConf *oauth2.Config, toke
 		return errors.Wrap(err, "failed to encrypt user creds")
 	}
 
+	lease, err := s.locker.Acquire(ctx, models.UserBalanceLockKey(userInfo.ID), confs.LockLeaseTTL(ctx))
+	if err != nil {
+		return err
+	}
+	defer lease.Release(ctx)
+
 	user := &models.User{
 		DocID: userInfo.ID,
 	}
@@ -118,6 +124,7 @@ func (s *Service) signInUser(ctx context.Context, oauthConf *oauth2.Config, toke
 	user.ProfileImage = userInfo.Picture
 
 	// For first time user, give free credits.
+	var freeGrants []*models.LedgerEntry
 	if models.IsNotFoundErr(err) {
 		user.SubscriptionInfo = models.SubscriptionInfo{
 			ActiveAuthTokens: map[string]int{
@@ -125,6 +132,7 @@ func (s *Service) signInUser(ctx context.Context, oauthConf *oauth2.Config, toke
 				confs.ModelGemini25Pro:   2,
 			},
 		}
+		freeGrants = ledgerEntries(user.DocID, models.LedgerKindFreeGrant, "signup", user.SubscriptionInfo.ActiveAuthTokens, time.Now().UTC())
 	}
 
 	// TODO: Remove, Free credits for beta testing.
@@ -140,7 +148,7 @@ func (s *Service) signInUser(ctx context.Context, oauthConf *oauth2.Config, toke
 	//	}
 	//}
 
-	err = s.dbHandler.Upsert(ctx, user)
+	err = s.saveBalance(ctx, user, freeGrants...)
 	if err != nil {
 		return errors.Wrap(err, "failed to upsert user")
 	}
@@ -177,22 +185,9 @@ func (s *Service) signInUser(ctx context.Context, oauthConf *oauth2.Config, toke
 }
 
 func (s *Service) deleteAllExistingUserSessions(ctx context.Context, user *models.User) error {
-	prevSessionsIt := models.ListUserSessions(ctx, s.dbHandler, user.DocID)
-	var prevSessions []*models.UserSession
-	for prevSessionsIt.More() {
-		sessionsPage, err := prevSessionsIt.NextPage(ctx)
-		if err != nil {
-			return errors.Wrapf(err, "failed to iterate over prev user sessions")
-		}
-
-		for _, itemData := range sessionsPage.Items {
-			userSession := &models.UserSession{}
-			err = models.Deserialize(itemData, userSession)
-			if err != nil {
-				return errors.Wrapf(err, "failed to deserialize user session")
-			}
-			prevSessions = append(prevSessions, userSession)
-		}
+	prevSessions, err := models.ListUserSessions(ctx, s.dbHandler, user.DocID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list prev user sessions")
 	}
 
 	// TODO Do we want this behavior?
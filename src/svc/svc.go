@@ -6,6 +6,7 @@ import (
 	"llmmask/src/auth"
 	"llmmask/src/confs"
 	llm_proxy "llmmask/src/llm-proxy"
+	"llmmask/src/locks"
 	"llmmask/src/log"
 	"llmmask/src/models"
 	"llmmask/src/secrets"
@@ -13,6 +14,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/errors"
@@ -35,33 +37,54 @@ var (
 )
 
 type Service struct {
-	port         int
-	inMemCache   cache.Cache
-	authManagers map[confs.ModelName]*auth.AuthManager
-	llmProxy     *llm_proxy.LLMProxy
-	dbHandler    *models.DBHandler
+	port          int
+	inMemCache    cache.Cache
+	authManagers  map[confs.ModelName]*auth.AuthManager
+	llmProxy      *llm_proxy.LLMProxy
+	apiKeyManager *llm_proxy.APIKeyManager
+	dbHandler     models.DBHandler
+	kms           secrets.KMS
+	locker        locks.Locker
+	// lastGCReport is of the latest auth token GC run, nil before the first one finishes.
+	lastGCReport atomic.Pointer[models.AuthTokenGCReport]
+	// lastReconciliationReport is of the latest ledger reconciliation run, nil before the first one finishes.
+	lastReconciliationReport atomic.Pointer[LedgerReconciliationReport]
 }
 
 func NewService(
 	port int,
 	authManagers map[confs.ModelName]*auth.AuthManager,
 	apiKeyManager *llm_proxy.APIKeyManager,
-	dbHandler *models.DBHandler,
+	dbHandler models.DBHandler,
 	contentModerator *llm_proxy.ContentModerator,
-	kms *secrets.AzureKMS,
+	kms secrets.KMS,
+	locker locks.Locker,
 ) *Service {
 	return &Service{
-		port:         port,
-		inMemCache:   *cache.New(10*time.Minute, 20*time.Minute),
-		authManagers: authManagers,
-		llmProxy:     llm_proxy.NewLLMProxy(authManagers, apiKeyManager, dbHandler, contentModerator, kms),
-		dbHandler:    dbHandler,
+		port:          port,
+		inMemCache:    *cache.New(10*time.Minute, 20*time.Minute),
+		authManagers:  authManagers,
+		llmProxy:      llm_proxy.NewLLMProxy(authManagers, apiKeyManager, dbHandler, contentModerator, kms, locker),
+		apiKeyManager: apiKeyManager,
+		dbHandler:     dbHandler,
+		kms:           kms,
+		locker:        locker,
 	}
 }
 
 func (s *Service) Run() {
-	r := chi.NewRouter()
 	ctx := context.Background()
+	r := s.Router(ctx)
+	s.StartBackgroundJobs()
+	err := http.ListenAndServe(":"+strconv.Itoa(s.port), r)
+	if err != nil {
+		log.Errorf(ctx, "Failed to start server: %v", err)
+	}
+}
+
+// Router has every route of the service, with its middlewares.
+func (s *Service) Router(ctx context.Context) chi.Router {
+	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
@@ -84,6 +107,7 @@ func (s *Service) Run() {
 
 	r.Get("/health", s.health)
 	r.Get("/", s.health)
+	r.Get("/.well-known/private-token-issuer-directory", s.PrivacyPassWellKnownIssuerDirectoryHandler)
 
 	r.Route("/api/v1", func(r chi.Router) {
 		// These apis will not be needed for relay servers. Really only needed for the api-server users interact
@@ -100,10 +124,25 @@ func (s *Service) Run() {
 		r.Route("/", func(r chi.Router) {
 			r.Use(s.AuthMiddleware)
 			r.Get("/me", s.GetCurrentUser)
+			r.Get("/me/ledger", s.GetLedgerHandler)
 			r.Post("/auth-token/{modelName}", s.GetSignedBlindedTokenHandler)
+			r.Post("/auth-token/{modelName}/batch", s.GetSignedBlindedTokensBatchHandler)
+			r.Post("/auth-token/{modelName}/voprf", s.GetVOPRFTokensHandler)
+			r.Post("/privacypass/token-request", s.PrivacyPassTokenRequestHandler)
+			r.Post("/privacypass/{modelName}/token-request", s.PrivacyPassTokenRequestHandler)
+			r.Route("/admin", func(r chi.Router) {
+				r.Use(s.AdminMiddleware)
+				r.Get("/api-keys", s.GetAPIKeysHandler)
+				r.Get("/gc-report", s.GetGCReportHandler)
+				r.Get("/reconciliation-report", s.GetReconciliationReportHandler)
+				r.Post("/rsa-keys/revoke", s.RevokeRSAKeyHandler)
+			})
 		})
 		r.Post("/llm-proxy", s.LLMProxyHandler)
 		r.Get("/model-pricing", s.GetModelPricingHandler)
+		r.Get("/public-keys", s.GetPublicKeysHandler)
+		r.Get("/token-epochs", s.GetTokenEpochsHandler)
+		r.Get("/privacypass/{modelName}/issuer-directory", s.PrivacyPassIssuerDirectoryHandler)
 		r.Post("/paddle/webhook", s.PaddleWebHookHandler)
 		r.Get("/purchase", s.PurchaseHandler)
 	})
@@ -115,21 +154,38 @@ func (s *Service) Run() {
 
 	// Fallback to serve index.html for all non-API and non-static file routes
 	r.Handle("/*", ServeFileFallback(staticDir, staticFileServer))
-
-	s.StartBackgroundJobs()
-	err := http.ListenAndServe(":"+strconv.Itoa(s.port), r)
-	if err != nil {
-		log.Errorf(ctx, "Failed to start server: %v", err)
-	}
+	return r
 }
 
 func (s *Service) StartBackgroundJobs() {
+	// Budgets need fresher usage than the other jobs.
+	go func() {
+		for {
+			ctx := context.Background()
+			err := s.apiKeyManager.FlushUsage(ctx, s.dbHandler)
+			if err != nil {
+				log.Errorf(ctx, "[ALERT]: Failed to flush api key usage: %+v", err)
+			}
+			time.Sleep(confs.APIKeyUsageFlushInterval(ctx))
+		}
+	}()
+	// Revocations are for compromised keys, they can't wait for the next key reload.
+	go func() {
+		for {
+			ctx := context.Background()
+			s.applyRSAKeyRevocations(ctx)
+			time.Sleep(confs.RSAKeyRevocationPollInterval(ctx))
+		}
+	}()
 	go func() {
 		for {
 			ctx := context.Background()
 			startTime := time.Now()
 			log.Infof(ctx, "Starting background jobs... (ts = %v)", startTime)
-			// Do Work.
+			s.reloadRSAKeys(ctx)
+			s.gcAuthTokens(ctx)
+			s.retryPaddleEvents(ctx)
+			s.reconcileLedgers(ctx)
 
 			endTime := time.Now()
 			timeSpent := endTime.Sub(startTime)
@@ -188,3 +244,81 @@ func isStaticFile(path string) bool {
 	}
 	return false
 }
+
+// reloadRSAKeys picks up rotations and revocations done elsewhere, and drops keys past their NotAfter.
+func (s *Service) reloadRSAKeys(ctx context.Context) {
+	partiallyBlindKeys, err := secrets.LoadRSAKeysForModel(ctx, s.dbHandler, s.kms, secrets.PartiallyBlindKeyName)
+	if err != nil {
+		log.Errorf(ctx, "[ALERT]: Failed to reload partially blind issuer keys, keeping the loaded ones: %+v", err)
+		return
+	}
+	for modelName, authManager := range s.authManagers {
+		rsaKeys, err := secrets.LoadRSAKeysForModel(ctx, s.dbHandler, s.kms, modelName)
+		if err != nil {
+			log.Errorf(ctx, "[ALERT]: Failed to reload rsa keys for model %s: %+v", modelName, err)
+			continue
+		}
+		if len(rsaKeys) == 0 && authManager.Scheme() != confs.TokenSchemePartiallyBlindRSA {
+			log.Errorf(ctx, "[ALERT]: No usable rsa keys for model %s, keeping the loaded ones", modelName)
+			continue
+		}
+		if len(partiallyBlindKeys) == 0 && authManager.Scheme() == confs.TokenSchemePartiallyBlindRSA {
+			log.Errorf(ctx, "[ALERT]: No usable partially blind issuer keys for model %s, keeping the loaded ones", modelName)
+			continue
+		}
+		authManager.SetKeys(append(rsaKeys, partiallyBlindKeys...)...)
+	}
+}
+
+// applyRSAKeyRevocations stops this instance from using keys revoked elsewhere.
+func (s *Service) applyRSAKeyRevocations(ctx context.Context) {
+	for _, modelName := range append(confs.AllModels(), secrets.PartiallyBlindKeyName) {
+		keyIDs, err := secrets.RevokedRSAKeyIDs(ctx, s.dbHandler, modelName)
+		if err != nil {
+			log.Errorf(ctx, "[ALERT]: Failed to list revoked rsa keys for model %s: %+v", modelName, err)
+			continue
+		}
+		s.revokeRSAKeys(keyIDs...)
+	}
+}
+
+// revokeRSAKeys stops every model of this instance from using the keys. Key IDs are unique across models, and
+// partially blind issuer keys are shared by all models issuing under the scheme.
+func (s *Service) revokeRSAKeys(keyIDs ...string) {
+	for _, authManager := range s.authManagers {
+		for _, keyID := range keyIDs {
+			authManager.Revoke(keyID)
+		}
+	}
+}
+
+// gcAuthTokens refunds crashed redemptions, strips expired auth tokens down to spent markers, and drops the markers
+// of retired keys.
+func (s *Service) gcAuthTokens(ctx context.Context) {
+	now := time.Now().UTC()
+	var retiredKeyIDs []string
+	for _, modelName := range append(confs.AllModels(), secrets.PartiallyBlindKeyName) {
+		keyIDs, err := secrets.RetiredRSAKeyIDs(ctx, s.dbHandler, modelName, now.Add(-confs.SpentMarkerRetention(ctx)))
+		if err != nil {
+			log.Errorf(ctx, "[ALERT]: Failed to list retired rsa keys for model %s: %+v", modelName, err)
+			continue
+		}
+		retiredKeyIDs = append(retiredKeyIDs, keyIDs...)
+	}
+
+	report, err := models.GCAuthTokens(ctx, s.dbHandler, models.AuthTokenGCOptions{
+		RecoverBefore: now.Add(-confs.AuthTokenRecoveryAfter(ctx)),
+		StripBefore:   now.Add(-confs.CachedResponseRetention(ctx)),
+		RetiredKeyIDs: retiredKeyIDs,
+		BatchSize:     confs.AuthTokenGCBatchSize(ctx),
+		MaxBatches:    confs.AuthTokenGCMaxBatches(ctx),
+		// Expired tokens fail verification, their spent markers can go.
+		TokensExpiredBefore: now.Add(-confs.CachedResponseRetention(ctx)),
+	})
+	if err != nil {
+		log.Errorf(ctx, "[ALERT]: Auth token gc failed: %+v", err)
+	}
+	log.Infof(ctx, "Auth token gc: scanned %d, recovered %d, stripped %d, deleted %d, truncated %v in %v",
+		report.Scanned, report.Recovered, report.Stripped, report.Deleted, report.Truncated, report.Duration)
+	s.lastGCReport.Store(report)
+}
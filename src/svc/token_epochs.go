@@ -0,0 +1,43 @@
+package svc
+
+import (
+	"github.com/go-chi/render"
+	"llmmask/src/auth"
+	"llmmask/src/common"
+	"llmmask/src/confs"
+	"net/http"
+	"time"
+)
+
+// GetTokenEpochsResp is the epoch schedule partially blind tokens are issued and redeemed on, see auth.TokenMetadata.
+type GetTokenEpochsResp struct {
+	EpochSeconds      int64
+	CurrentEpoch      int64
+	CurrentEpochStart time.Time
+	CurrentEpochEnd   time.Time
+	// ExpiryEpoch tokens issued now are signed for.
+	ExpiryEpoch int64
+	// RedeemableFrom is when tokens issued now can be spent on models in DelayedRedemptionModels.
+	RedeemableFrom          time.Time
+	DelayedRedemptionModels []confs.ModelName
+}
+
+// GetTokenEpochsHandler tells clients when to fetch tokens and when they can spend them. Unauthenticated, like the
+// public keys.
+func (s *Service) GetTokenEpochsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	now := time.Now().UTC()
+	epoch := auth.Epoch(ctx, now)
+	resp := &GetTokenEpochsResp{
+		EpochSeconds:      int64(confs.TokenEpochLength(ctx) / time.Second),
+		CurrentEpoch:      epoch,
+		CurrentEpochStart: auth.EpochEnd(ctx, epoch-1),
+		CurrentEpochEnd:   auth.EpochEnd(ctx, epoch),
+		ExpiryEpoch:       auth.IssuanceExpiryEpoch(ctx, now),
+		RedeemableFrom:    auth.EpochEnd(ctx, epoch),
+		DelayedRedemptionModels: common.Filter(confs.AllModels(), func(modelName confs.ModelName) bool {
+			return common.Must(confs.ModelSpecFor(modelName)).DelayedRedemption
+		}),
+	}
+	render.Respond(w, r, Ok200(resp))
+}